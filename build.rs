@@ -4,6 +4,19 @@ const COMMANDS: &[&str] = &[
     "switch_model",
     "list_available_models",
     "add_configuration",
+    "special_tokens",
+    "score",
+    "classify",
+    "rerank",
+    "get_usage_report",
+    "reset_usage",
+    "list_prompts",
+    "remove_prompt",
+    "run_prompt",
+    "save_prompt",
+    "export_feedback",
+    "submit_feedback",
+    "cancel",
 ];
 
 fn main() {
@@ -15,6 +15,12 @@ export type SamplingConfig =
   | "TopKThenTopP"
   | "GumbelSoftmax";
 
+/** Decides when generated tokens are flushed as a chunk, at the latest after `chunk_size` tokens */
+export type FlushPolicy =
+  | { type: "tokens" }
+  | { type: "timed"; interval_ms: number }
+  | { type: "adaptive"; target_ms?: number };
+
 export type Query =
   | {
     type: "Prompt";
@@ -27,11 +33,84 @@ export type Query =
     top_k?: number;
     top_p?: number;
     think?: boolean;
+    /** Continue the trailing assistant message instead of starting a new turn */
+    continue_final_message?: boolean;
+    stream?: boolean;
+    model?: string;
+    penalty?: number;
+    seed?: GenerationSeed;
+    sampling_config?: SamplingConfig;
+    add_special_tokens?: boolean;
+    skip_special_tokens?: boolean;
+    flush?: FlushPolicy;
+  }
+  | {
+    type: "Completion";
+    /** Raw prompt text. Mutually exclusive with `token_ids` */
+    prompt?: string;
+    /** Pre-tokenized prompt. Mutually exclusive with `prompt` */
+    token_ids?: number[];
+    chunk_size?: number;
+    timestamp?: number;
+    max_tokens?: number;
+    temperature?: number;
+    top_k?: number;
+    top_p?: number;
+    stream?: boolean;
+    model?: string;
+    penalty?: number;
+    seed?: GenerationSeed;
+    sampling_config?: SamplingConfig;
+    add_special_tokens?: boolean;
+    skip_special_tokens?: boolean;
+    flush?: FlushPolicy;
+  }
+  | {
+    type: "Infill";
+    prefix: string;
+    suffix: string;
+    chunk_size?: number;
+    timestamp?: number;
+    max_tokens?: number;
+    temperature?: number;
+    top_k?: number;
+    top_p?: number;
     stream?: boolean;
     model?: string;
     penalty?: number;
     seed?: GenerationSeed;
     sampling_config?: SamplingConfig;
+    add_special_tokens?: boolean;
+    skip_special_tokens?: boolean;
+    flush?: FlushPolicy;
+  }
+  | {
+    type: "Score";
+    context: string;
+    continuation: string;
+    model?: string;
+    timestamp?: number;
+  }
+  | {
+    type: "Classify";
+    messages: QueryMessage[];
+    labels: string[];
+    model?: string;
+    timestamp?: number;
+  }
+  | {
+    type: "Rerank";
+    query: string;
+    documents: string[];
+    top_n?: number;
+    model?: string;
+    timestamp?: number;
+  }
+  | {
+    type: "Embed";
+    texts: string[];
+    model?: string;
+    timestamp?: number;
   }
   | {
     type: "Response";
@@ -46,9 +125,43 @@ export type Query =
     kind: "string" | "bytes";
     timestamp?: number;
   }
+  | {
+    type: "Scored";
+    score: Score;
+    timestamp?: number;
+  }
+  | {
+    type: "Classified";
+    classification: Classification;
+    timestamp?: number;
+  }
+  | {
+    type: "Reranked";
+    results: RerankResult[];
+    timestamp?: number;
+  }
+  | {
+    type: "Embedded";
+    embeddings: number[][];
+    timestamp?: number;
+  }
+  | {
+    type: "ContextShift";
+    discarded: number;
+    kept: number;
+    timestamp?: number;
+  }
+  | {
+    type: "PrefillProgress";
+    processed: number;
+    total: number;
+    timestamp?: number;
+  }
   | {
     type: "End";
     usage: TokenUsage;
+    finish_reason?: FinishReason;
+    cache_hit?: CacheHit;
   }
   | {
     type: "Exit";
@@ -63,6 +176,112 @@ export interface QueryMessage {
   content: string;
 }
 
+export interface SpecialToken {
+  id?: number;
+  content: string;
+  special: boolean;
+}
+
+export interface SpecialTokens {
+  bos_token?: SpecialToken;
+  eos_token?: SpecialToken;
+  pad_token?: SpecialToken;
+  added_tokens: SpecialToken[];
+}
+
+export interface TokenLogprob {
+  id: number;
+  text: string;
+  logprob: number;
+}
+
+export interface Score {
+  tokens: TokenLogprob[];
+  log_likelihood: number;
+  perplexity: number;
+  is_greedy: boolean;
+}
+
+export interface LabelProbability {
+  label: string;
+  probability: number;
+  log_likelihood: number;
+}
+
+export interface Classification {
+  label: string;
+  labels: LabelProbability[];
+}
+
+export interface RerankResult {
+  index: number;
+  score: number;
+}
+
+export type FinishReason = "stop" | "length" | "repetition" | "cancelled";
+
+/// The cache a response has been replayed from
+export type CacheHit =
+  | { type: "exact" }
+  | { type: "semantic"; similarity: number };
+
+export interface UsageTotals {
+  requests: number;
+  prompt_tokens: number;
+  completion_tokens: number;
+  generation_ms: number;
+}
+
+export interface UsageEntry extends UsageTotals {
+  model: string;
+  window: string;
+  /// Day in `YYYY-MM-DD` format (UTC)
+  day: string;
+}
+
+export interface UsageReport {
+  total: UsageTotals;
+  models: Record<string, UsageTotals>;
+  windows: Record<string, UsageTotals>;
+  days: Record<string, UsageTotals>;
+  entries: UsageEntry[];
+}
+
+export type VariableType = "string" | "number" | "integer" | "boolean" | "array" | "object";
+
+export interface PromptVariable {
+  name: string;
+  type?: VariableType;
+  description?: string;
+  /// Value used if the variable is not provided. Variables without a default are required.
+  default?: unknown;
+}
+
+export interface PromptOverrides {
+  model?: string;
+  max_tokens?: number;
+  temperature?: number;
+  top_k?: number;
+  top_p?: number;
+  penalty?: number;
+  seed?: GenerationSeed;
+  sampling_config?: SamplingConfig;
+  chunk_size?: number;
+}
+
+export interface PromptTemplate {
+  name: string;
+  description?: string;
+  /// Jinja template of the system message
+  system?: string;
+  /// Jinja template of the user message
+  template: string;
+  variables?: PromptVariable[];
+  settings?: PromptOverrides;
+}
+
+export type DatasetFormat = "openai" | "sharegpt" | "dpo";
+
 export interface TokenUsage {
   prompt_tokens: number;
   completion_tokens: number;
@@ -73,7 +292,9 @@ export interface TokenUsage {
 export interface CallBacks {
   onData: (id: number, data: Uint8Array, timestamp?: number) => void,
   onError: (msg: string) => void,
-  onEnd: (usage?: TokenUsage) => void
+  onEnd: (usage?: TokenUsage, finishReason?: FinishReason, cacheHit?: CacheHit) => void,
+  onContextShift?: (discarded: number, kept: number, timestamp?: number) => void,
+  onPrefillProgress?: (processed: number, total: number, timestamp?: number) => void
 }
 
 /**
@@ -89,10 +310,12 @@ export class LLMStreamListener {
   /**
    * Initializes the event listeners to process messages received from the backend.
    *
-   * Sets up three event listeners:
+   * Sets up five event listeners:
    * - `query-stream-chunk`: Receives data chunks from the LLM response
    * - `query-stream-error`: Receives error messages during streaming
    * - `query-stream-end`: Signals the end of the stream
+   * - `query-stream-context-shift`: Signals that older tokens have been discarded from the context window
+   * - `query-stream-prefill-progress`: Reports the prompt tokens prefilled so far with chunked prefill
    *
    * @param callb - Callback functions to handle data, errors, and stream completion
    * @returns A promise that resolves when all listeners are set up
@@ -136,10 +359,28 @@ export class LLMStreamListener {
     const unlistenEnd = await listen('query-stream-end', (event) => {
       const message = event.payload as Query | null;
       const usage = message?.type === 'End' ? message.usage : undefined;
-      callb.onEnd(usage);
+      const finishReason = message?.type === 'End' ? message.finish_reason : undefined;
+      const cacheHit = message?.type === 'End' ? message.cache_hit : undefined;
+      callb.onEnd(usage, finishReason, cacheHit);
+    });
+
+    const unlistenContextShift = await listen('query-stream-context-shift', (event) => {
+      const message = event.payload as Extract<Query, { type: "ContextShift" }>;
+      callb.onContextShift?.(message.discarded, message.kept, message.timestamp);
+    });
+
+    const unlistenPrefillProgress = await listen('query-stream-prefill-progress', (event) => {
+      const message = event.payload as Extract<Query, { type: "PrefillProgress" }>;
+      callb.onPrefillProgress?.(message.processed, message.total, message.timestamp);
     });
 
-    this.unListeners = [unlistenData, unlistenError, unlistenEnd];
+    this.unListeners = [
+      unlistenData,
+      unlistenError,
+      unlistenEnd,
+      unlistenContextShift,
+      unlistenPrefillProgress
+    ];
   }
 
   /**
@@ -170,7 +411,7 @@ export class LLMStreamListener {
    * received through the callbacks registered in `setup()`.
    *
    * @param message - The query to send to the backend (typically a Prompt query)
-   * @returns A promise that resolves when the query has been sent
+   * @returns A promise that resolves with the request id, which can be rated with {@link submitFeedback}
    * @throws Error if the listener has not been initialized via `setup()`
    *
    * @example
@@ -189,12 +430,30 @@ export class LLMStreamListener {
    * });
    * ```
    */
-  async stream(message: Query): Promise<void> {
+  async stream(message: Query): Promise<string> {
     if (!this.isActive) {
       throw new Error('Stream listener not initialized.');
     }
 
-    await invoke("plugin:llm|stream", { message })
+    return await invoke("plugin:llm|stream", { message })
+  }
+
+  /**
+   * Cancels the query currently run by the active model.
+   *
+   * The stream ends with the finish reason `"cancelled"` once the current prefill block or token
+   * has been computed.
+   *
+   * @returns A promise that resolves when the cancellation has been requested
+   *
+   * @example
+   * ```typescript
+   * const request = listener.stream(query);
+   * await listener.cancel();
+   * ```
+   */
+  async cancel(): Promise<void> {
+    return await invoke("plugin:llm|cancel");
   }
 
   /**
@@ -229,6 +488,204 @@ export class LLMStreamListener {
     return await invoke("plugin:llm|list_available_models");
   }
 
+  /**
+   * Returns the special tokens of a model's tokenizer.
+   *
+   * @param id - The model identifier/name. Defaults to the active model
+   * @returns A promise that resolves to the BOS, EOS and PAD tokens and all added tokens
+   *
+   * @example
+   * ```typescript
+   * const { eos_token, added_tokens } = await listener.specialTokens();
+   * console.log("EOS:", eos_token?.content, eos_token?.id);
+   * ```
+   */
+  async specialTokens(id?: string): Promise<SpecialTokens> {
+    return await invoke("plugin:llm|special_tokens", { id });
+  }
+
+  /**
+   * Scores a continuation following a context with the active model, without generating text.
+   *
+   * @param context - The text the continuation is conditioned on
+   * @param continuation - The text to score
+   * @returns A promise that resolves to the per-token log-probabilities, log-likelihood and perplexity
+   *
+   * @example
+   * ```typescript
+   * const { log_likelihood, perplexity } = await listener.score("The capital of France is", " Paris");
+   * ```
+   */
+  async score(context: string, continuation: string): Promise<Score> {
+    return await invoke("plugin:llm|score", { context, continuation });
+  }
+
+  /**
+   * Classifies a conversation into one of the given labels with the active model.
+   *
+   * Every label is scored as the beginning of the assistant's answer, nothing is sampled.
+   *
+   * @param messages - The conversation to classify
+   * @param labels - The candidate labels
+   * @returns A promise that resolves to the most likely label and the probability of every label
+   *
+   * @example
+   * ```typescript
+   * const { label } = await listener.classify(
+   *   [{ role: "user", content: "Is this review positive or negative? 'Great phone!'" }],
+   *   ["positive", "negative"]
+   * );
+   * ```
+   */
+  async classify(messages: QueryMessage[], labels: string[]): Promise<Classification> {
+    return await invoke("plugin:llm|classify", { messages, labels });
+  }
+
+  /**
+   * Reranks documents by their relevance to a query with the active reranker model.
+   *
+   * Requires a model configured with `kind: "reranker"`.
+   *
+   * @param query - The search query
+   * @param documents - The candidate documents
+   * @param topN - Number of most relevant documents to return. Defaults to all documents
+   * @returns A promise that resolves to the document indices and relevance scores, most relevant first
+   *
+   * @example
+   * ```typescript
+   * const results = await listener.rerank("How many people live in Berlin?", passages, 3);
+   * const best = passages[results[0].index];
+   * ```
+   */
+  async rerank(query: string, documents: string[], topN?: number): Promise<RerankResult[]> {
+    return await invoke("plugin:llm|rerank", { query, documents, topN });
+  }
+
+  /**
+   * Returns the token usage of streamed generations, aggregated by model, window label and day.
+   *
+   * Usage is persisted in the app data directory and survives restarts.
+   *
+   * @returns A promise that resolves to the usage totals and the entries per model, window and day
+   *
+   * @example
+   * ```typescript
+   * const { total, models } = await listener.getUsageReport();
+   * console.log(`${total.completion_tokens} tokens generated in ${total.requests} requests`);
+   * ```
+   */
+  async getUsageReport(): Promise<UsageReport> {
+    return await invoke("plugin:llm|get_usage_report");
+  }
+
+  /**
+   * Removes all recorded usage.
+   *
+   * @returns A promise that resolves when the usage has been reset
+   */
+  async resetUsage(): Promise<void> {
+    return await invoke("plugin:llm|reset_usage");
+  }
+
+  /**
+   * Returns the prompt templates of the plugin config and those saved by the application.
+   *
+   * @returns A promise that resolves to the templates ordered by name
+   */
+  async listPrompts(): Promise<PromptTemplate[]> {
+    return await invoke("plugin:llm|list_prompts");
+  }
+
+  /**
+   * Saves a prompt template in the app data directory, replacing a saved template of the same name.
+   *
+   * @param template - The prompt template to save
+   * @returns A promise that resolves when the template has been saved
+   * @throws Error if the template cannot be parsed
+   *
+   * @example
+   * ```typescript
+   * await listener.savePrompt({
+   *   name: "summarize",
+   *   system: "You summarize texts in {{ sentences }} sentences.",
+   *   template: "{{ text }}",
+   *   variables: [
+   *     { name: "text" },
+   *     { name: "sentences", type: "integer", default: 3 }
+   *   ]
+   * });
+   * ```
+   */
+  async savePrompt(template: PromptTemplate): Promise<void> {
+    return await invoke("plugin:llm|save_prompt", { template });
+  }
+
+  /**
+   * Removes a saved prompt template. Templates of the plugin config cannot be removed.
+   *
+   * @param name - The name of the template
+   * @returns A promise that resolves when the template has been removed
+   */
+  async removePrompt(name: string): Promise<void> {
+    return await invoke("plugin:llm|remove_prompt", { name });
+  }
+
+  /**
+   * Renders a prompt template and streams the response like {@link stream}.
+   *
+   * @param name - The name of the template
+   * @param vars - Values of the template variables
+   * @param overrides - Generation settings overriding those of the template
+   * @returns A promise that resolves with the request id when the stream has ended
+   * @throws Error if the template is unknown or a variable is missing or of the wrong type
+   *
+   * @example
+   * ```typescript
+   * await listener.runPrompt("summarize", { text: article }, { max_tokens: 200 });
+   * ```
+   */
+  async runPrompt(
+    name: string,
+    vars?: Record<string, unknown>,
+    overrides?: PromptOverrides
+  ): Promise<string> {
+    if (!this.isActive) {
+      throw new Error('Stream listener not initialized.');
+    }
+
+    return await invoke("plugin:llm|run_prompt", { name, vars, overrides });
+  }
+
+  /**
+   * Rates the response of a recent {@link stream} or {@link runPrompt} request. Rated responses are
+   * stored in the app data directory and can be exported with {@link exportFeedback}.
+   *
+   * @param requestId - The id returned by `stream()` or `runPrompt()`
+   * @param rating - Positive for good responses, negative for bad ones
+   * @param correction - The response the model should have given
+   * @returns A promise that resolves when the feedback has been stored
+   * @throws Error if the request id is unknown or no longer kept
+   *
+   * @example
+   * ```typescript
+   * const requestId = await listener.stream(query);
+   * await listener.submitFeedback(requestId, -1, "Paris is the capital of France.");
+   * ```
+   */
+  async submitFeedback(requestId: string, rating: number, correction?: string): Promise<void> {
+    return await invoke("plugin:llm|submit_feedback", { requestId, rating, correction });
+  }
+
+  /**
+   * Exports the rated responses as JSONL dataset for fine-tuning.
+   *
+   * @param format - `openai` and `sharegpt` export conversations, `dpo` exports preference pairs
+   * @returns A promise that resolves with one JSON object per line
+   */
+  async exportFeedback(format: DatasetFormat): Promise<string> {
+    return await invoke("plugin:llm|export_feedback", { format });
+  }
+
   /**
    * Adds a new LLMRuntimeConfig to the runtime service at runtime.
    *
@@ -0,0 +1,499 @@
+//! Benchmarks
+//!
+//! Measures greedy completions of [`LocalRuntime::inference`] for a [`LLMRuntimeConfig`] across
+//! prompt lengths and dtypes. Each case is measured as
+//!
+//! - time to first token: from running the query to receiving the first chunk
+//! - prefill throughput: prompt tokens per second of the time to first token
+//! - decode throughput: generated tokens per second after the first chunk
+//! - peak memory: peak resident memory of the process during the case
+//!
+//! A [`BenchmarkReport`] is written as JSON and compared against an earlier report to detect
+//! regressions.
+
+use std::fmt;
+use std::path::Path;
+use std::sync::Arc;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use candle_core::Device;
+use serde::{Deserialize, Serialize};
+
+use crate::runtime::local::LocalRuntime;
+use crate::runtime::{LLMRuntime, LLMRuntimeModel};
+use crate::{
+    CompletionInput, Error, GenerationSeed, LLMRuntimeConfig, ModelDType, Query, SamplingConfig,
+};
+
+/// Text the benchmark prompts are made of. Its tokens are repeated to the prompt length.
+const PROMPT_TEXT: &str = "The quick brown fox jumps over the lazy dog. Pack my box with five \
+                           dozen liquor jugs. How vexingly quick daft zebras jump! ";
+
+/// Cases of a benchmark run.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BenchmarkConfig {
+    /// Prompt lengths in tokens
+    pub prompt_lengths: Vec<usize>,
+
+    /// Data types the model is loaded with. The model is reloaded for every dtype.
+    pub dtypes: Vec<ModelDType>,
+
+    /// Number of generated tokens. EOS tokens do not end the generation.
+    pub decode_tokens: usize,
+
+    /// Measured runs per case. The median of each metric is reported.
+    pub repetitions: usize,
+}
+
+impl Default for BenchmarkConfig {
+    fn default() -> Self {
+        Self {
+            prompt_lengths: vec![128, 512, 2048],
+            dtypes: vec![ModelDType::default()],
+            decode_tokens: 64,
+            repetitions: 3,
+        }
+    }
+}
+
+/// Measurements of a single case.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BenchmarkResult {
+    pub dtype: ModelDType,
+
+    pub prompt_length: usize,
+
+    pub time_to_first_token_ms: f64,
+
+    pub prefill_tokens_per_second: f64,
+
+    pub decode_tokens_per_second: f64,
+
+    /// Peak resident memory of the process. Only available on Linux, memory of GPU devices is
+    /// not included.
+    pub peak_memory_bytes: Option<u64>,
+}
+
+impl BenchmarkResult {
+    /// Returns `true`, if both results measure the same case.
+    fn same_case(&self, other: &Self) -> bool {
+        self.dtype == other.dtype && self.prompt_length == other.prompt_length
+    }
+}
+
+/// A metric that got worse compared to a baseline report.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Regression {
+    pub dtype: ModelDType,
+
+    pub prompt_length: usize,
+
+    /// Name of the metric, as in [`BenchmarkResult`]
+    pub metric: String,
+
+    pub baseline: f64,
+
+    pub current: f64,
+
+    /// Relative change to the baseline, e.g. `-0.2` for a 20% lower throughput
+    pub change: f64,
+}
+
+/// Results of a benchmark run.
+///
+/// Runs are comparable, if they measure the same model on the same device.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BenchmarkReport {
+    pub model: String,
+
+    pub device: String,
+
+    /// Version of this crate
+    pub version: String,
+
+    pub os: String,
+
+    pub arch: String,
+
+    /// Start of the run in seconds since the Unix epoch
+    pub timestamp: u64,
+
+    pub config: BenchmarkConfig,
+
+    pub results: Vec<BenchmarkResult>,
+}
+
+impl BenchmarkReport {
+    /// Loads a report written by [`Self::write`].
+    pub fn from_path<P>(path: P) -> Result<Self, Error>
+    where
+        P: AsRef<Path>,
+    {
+        let file = std::fs::File::open(path)?;
+        Ok(serde_json::from_reader(file)?)
+    }
+
+    /// Writes the report as pretty printed JSON to `path`.
+    pub fn write<P>(&self, path: P) -> Result<(), Error>
+    where
+        P: AsRef<Path>,
+    {
+        std::fs::write(path, serde_json::to_string_pretty(self)?)?;
+        Ok(())
+    }
+
+    /// Compares the results against those of a `baseline` report.
+    ///
+    /// Returns every metric that is worse than the baseline by more than `tolerance`, e.g. `0.1`
+    /// for 10%. Cases missing in either report are skipped.
+    pub fn compare(&self, baseline: &BenchmarkReport, tolerance: f64) -> Vec<Regression> {
+        let mut regressions = vec![];
+
+        for current in &self.results {
+            let Some(previous) = baseline.results.iter().find(|r| r.same_case(current)) else {
+                continue;
+            };
+
+            // Throughput is better when higher, latency and memory when lower
+            let metrics = [
+                (
+                    "prefill_tokens_per_second",
+                    previous.prefill_tokens_per_second,
+                    current.prefill_tokens_per_second,
+                    true,
+                ),
+                (
+                    "decode_tokens_per_second",
+                    previous.decode_tokens_per_second,
+                    current.decode_tokens_per_second,
+                    true,
+                ),
+                (
+                    "time_to_first_token_ms",
+                    previous.time_to_first_token_ms,
+                    current.time_to_first_token_ms,
+                    false,
+                ),
+            ]
+            .into_iter()
+            .chain(
+                previous
+                    .peak_memory_bytes
+                    .zip(current.peak_memory_bytes)
+                    .map(|(previous, current)| {
+                        ("peak_memory_bytes", previous as f64, current as f64, false)
+                    }),
+            );
+
+            for (metric, previous_value, current_value, higher_is_better) in metrics {
+                if previous_value <= 0.0 {
+                    continue;
+                }
+
+                let change = (current_value - previous_value) / previous_value;
+                let regressed = if higher_is_better {
+                    change < -tolerance
+                } else {
+                    change > tolerance
+                };
+
+                if regressed {
+                    regressions.push(Regression {
+                        dtype: current.dtype,
+                        prompt_length: current.prompt_length,
+                        metric: metric.to_string(),
+                        baseline: previous_value,
+                        current: current_value,
+                        change,
+                    });
+                }
+            }
+        }
+
+        regressions
+    }
+}
+
+impl fmt::Display for BenchmarkReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(
+            f,
+            "{} on {} ({} {})",
+            self.model, self.device, self.os, self.arch
+        )?;
+        writeln!(
+            f,
+            "| DType | Prompt | TTFT (ms) | Prefill (tok/s) | Decode (tok/s) | Peak memory (MiB) |"
+        )?;
+        writeln!(
+            f,
+            "| ----- | ------ | --------- | --------------- | -------------- | ----------------- |"
+        )?;
+
+        for result in &self.results {
+            let memory = result
+                .peak_memory_bytes
+                .map(|bytes| format!("{:.0}", bytes as f64 / (1024.0 * 1024.0)))
+                .unwrap_or_else(|| "-".to_string());
+
+            writeln!(
+                f,
+                "| {} | {} | {:.1} | {:.1} | {:.1} | {memory} |",
+                result.dtype,
+                result.prompt_length,
+                result.time_to_first_token_ms,
+                result.prefill_tokens_per_second,
+                result.decode_tokens_per_second,
+            )?;
+        }
+
+        Ok(())
+    }
+}
+
+/// Timings of a single run of a case.
+struct Run {
+    time_to_first_token: Duration,
+    decode: Duration,
+
+    /// Tokens generated after the first chunk
+    decode_tokens: usize,
+}
+
+/// Runs benchmarks for a [`LLMRuntimeConfig`].
+pub struct Benchmark {
+    config: LLMRuntimeConfig,
+    settings: BenchmarkConfig,
+    device: Option<Device>,
+}
+
+impl Benchmark {
+    pub fn new(config: LLMRuntimeConfig, settings: BenchmarkConfig) -> Self {
+        Self {
+            config,
+            settings,
+            device: None,
+        }
+    }
+
+    /// Runs the benchmark on `device` instead of the default device.
+    pub fn device(mut self, device: Device) -> Self {
+        self.device = Some(device);
+        self
+    }
+
+    /// Runs all cases and returns the report.
+    ///
+    /// Cases exceeding the context length of the model are skipped.
+    pub fn run(&self) -> Result<BenchmarkReport, Error> {
+        let settings = &self.settings;
+
+        if settings.decode_tokens == 0 || settings.repetitions == 0 {
+            return Err(Error::ExecutionError(
+                "Benchmarks require at least one decode token and repetition".to_string(),
+            ));
+        }
+
+        let device = self
+            .device
+            .clone()
+            .unwrap_or_else(LLMRuntime::load_default_device);
+
+        let timestamp = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or_default();
+
+        let mut results = vec![];
+
+        for dtype in &settings.dtypes {
+            tracing::info!("Loading {} with dtype {dtype}", self.config.name);
+
+            let mut runtime = LocalRuntime::new(device.clone());
+            runtime.init(&LLMRuntimeConfig {
+                dtype: Some(*dtype),
+                prompt_cache: None,
+                repetition_guard: None,
+                ..self.config.clone()
+            })?;
+
+            // The benchmark generates `decode_tokens`, regardless of the output
+            runtime.eos_token_ids.clear();
+
+            let prompt = Self::prompt_tokens(&runtime)?;
+
+            // Compiles kernels and allocates buffers, which would distort the first case
+            Self::run_case(&mut runtime, &prompt[..prompt.len().min(16)], 2)?;
+
+            for prompt_length in &settings.prompt_lengths {
+                if runtime
+                    .context_length
+                    .is_some_and(|l| prompt_length + settings.decode_tokens > l)
+                {
+                    tracing::warn!(
+                        "Skipping prompt length {prompt_length}, it exceeds the context length"
+                    );
+                    continue;
+                }
+
+                let tokens: Vec<u32> = prompt
+                    .iter()
+                    .cycle()
+                    .take(*prompt_length)
+                    .copied()
+                    .collect();
+
+                tracing::info!("Benchmarking prompt length {prompt_length}");
+
+                reset_peak_memory();
+
+                let runs = (0..settings.repetitions)
+                    .map(|_| Self::run_case(&mut runtime, &tokens, settings.decode_tokens))
+                    .collect::<Result<Vec<_>, Error>>()?;
+
+                let ttft = median(runs.iter().map(|r| r.time_to_first_token.as_secs_f64()));
+                let decode =
+                    median(runs.iter().map(|r| {
+                        r.decode_tokens as f64 / r.decode.as_secs_f64().max(f64::EPSILON)
+                    }));
+
+                results.push(BenchmarkResult {
+                    dtype: *dtype,
+                    prompt_length: *prompt_length,
+                    time_to_first_token_ms: ttft * 1000.0,
+                    prefill_tokens_per_second: *prompt_length as f64 / ttft.max(f64::EPSILON),
+                    decode_tokens_per_second: decode,
+                    peak_memory_bytes: peak_memory(),
+                });
+            }
+        }
+
+        Ok(BenchmarkReport {
+            model: self.config.name.clone(),
+            device: format!("{:?}", device.location()),
+            version: env!("CARGO_PKG_VERSION").to_string(),
+            os: std::env::consts::OS.to_string(),
+            arch: std::env::consts::ARCH.to_string(),
+            timestamp,
+            config: settings.clone(),
+            results,
+        })
+    }
+
+    /// Encodes the benchmark prompt text.
+    fn prompt_tokens(runtime: &LocalRuntime) -> Result<Vec<u32>, Error> {
+        let tokenizer = runtime.tokenizer.as_ref().ok_or(Error::ExecutionError(
+            "Tokenizer is not initialized".to_string(),
+        ))?;
+
+        let tokens = tokenizer
+            .encode(PROMPT_TEXT.repeat(4), false)
+            .map_err(|e| Error::MessageEncodingError(e.to_string()))?
+            .get_ids()
+            .to_vec();
+
+        Ok(tokens)
+    }
+
+    /// Runs a greedy completion of `tokens` generating `decode_tokens` tokens.
+    ///
+    /// The chunks are timestamped on arrival by a separate thread, while the runtime generates.
+    fn run_case(
+        runtime: &mut LocalRuntime,
+        tokens: &[u32],
+        decode_tokens: usize,
+    ) -> Result<Run, Error> {
+        let query = Query::Completion {
+            input: CompletionInput::TokenIds(tokens.to_vec()),
+            chunk_size: Some(1),
+            timestamp: None,
+            max_tokens: Some(decode_tokens),
+            temperature: None,
+            top_k: None,
+            top_p: None,
+            stream: true,
+            model: None,
+            penalty: Some(1.0),
+            seed: Some(GenerationSeed::Fixed(0)),
+            sampling_config: Some(SamplingConfig::ArgMax),
+            add_special_tokens: Some(false),
+            skip_special_tokens: None,
+            flush: None,
+        };
+
+        let (response_tx, response_rx) = std::sync::mpsc::channel();
+
+        let (generated, chunks) = std::thread::scope(|scope| {
+            let receiver = scope.spawn(move || {
+                response_rx
+                    .iter()
+                    .filter(|message| matches!(message, Query::Chunk { .. }))
+                    .map(|_| Instant::now())
+                    .collect::<Vec<_>>()
+            });
+
+            let start = Instant::now();
+            let generated = runtime.inference(query, Arc::new(response_tx));
+
+            let chunks = receiver
+                .join()
+                .map_err(|_| Error::ExecutionError("Benchmark receiver panicked".to_string()));
+
+            (generated.map(|g| (start, g)), chunks)
+        });
+
+        let (start, generated) = generated?;
+        let chunks = chunks?;
+
+        let (Some((usage, _)), Some(first), Some(last)) =
+            (generated, chunks.first(), chunks.last())
+        else {
+            return Err(Error::ExecutionError(
+                "Benchmark generation did not stream any chunk".to_string(),
+            ));
+        };
+
+        Ok(Run {
+            time_to_first_token: *first - start,
+            decode: *last - *first,
+            decode_tokens: usage.completion_tokens.saturating_sub(1),
+        })
+    }
+}
+
+fn median(values: impl Iterator<Item = f64>) -> f64 {
+    let mut values: Vec<f64> = values.collect();
+    values.sort_by(f64::total_cmp);
+
+    values.get(values.len() / 2).copied().unwrap_or_default()
+}
+
+/// Resets the peak resident memory of the process.
+fn reset_peak_memory() {
+    #[cfg(target_os = "linux")]
+    if let Err(e) = std::fs::write("/proc/self/clear_refs", "5") {
+        tracing::debug!("Cannot reset peak memory: {e}");
+    }
+}
+
+/// Returns the peak resident memory of the process since the last reset.
+fn peak_memory() -> Option<u64> {
+    if !cfg!(target_os = "linux") {
+        return None;
+    }
+
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+
+    status
+        .lines()
+        .find_map(|line| line.strip_prefix("VmHWM:"))
+        .and_then(|value| {
+            value
+                .trim()
+                .trim_end_matches("kB")
+                .trim()
+                .parse::<u64>()
+                .ok()
+        })
+        .map(|kib| kib * 1024)
+}
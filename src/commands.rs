@@ -1,6 +1,10 @@
+use crate::feedback::{new_request_id, DatasetFormat, GenerationRecord};
+use crate::prompts::{PromptOverrides, PromptTemplate};
+use crate::usage::UsageReport;
 use crate::Result;
-use crate::{models::*, Error, PluginState};
-use tauri::{command, AppHandle, Runtime};
+use crate::{models::*, Classification, Error, PluginState, RerankResult, Score, SpecialTokens};
+use serde_json::{Map, Value};
+use tauri::{command, AppHandle, Runtime, Window};
 use tauri::{Emitter, State};
 
 #[command]
@@ -42,26 +46,211 @@ pub(crate) async fn list_available_models(state: State<'_, PluginState>) -> Resu
     Ok(models)
 }
 
+#[command]
+pub(crate) async fn special_tokens(
+    state: State<'_, PluginState>,
+    id: Option<String>,
+) -> Result<SpecialTokens> {
+    let service = state.runtime.lock().unwrap();
+
+    tracing::debug!("Reading special tokens of model: {:?}", id);
+
+    service.special_tokens(id.as_deref())
+}
+
+#[command]
+pub(crate) async fn score(
+    state: State<'_, PluginState>,
+    context: String,
+    continuation: String,
+) -> Result<Score> {
+    let mut service = state.runtime.lock().unwrap();
+
+    tracing::debug!("Scoring continuation of {} bytes", continuation.len());
+
+    service.score(&context, &continuation)
+}
+
+#[command]
+pub(crate) async fn classify(
+    state: State<'_, PluginState>,
+    messages: Vec<QueryMessage>,
+    labels: Vec<String>,
+) -> Result<Classification> {
+    let mut service = state.runtime.lock().unwrap();
+
+    tracing::debug!("Classifying into labels: {:?}", labels);
+
+    service.classify(messages, labels)
+}
+
+#[command]
+pub(crate) async fn rerank(
+    state: State<'_, PluginState>,
+    query: String,
+    documents: Vec<String>,
+    top_n: Option<usize>,
+) -> Result<Vec<RerankResult>> {
+    let mut service = state.runtime.lock().unwrap();
+
+    tracing::debug!("Reranking {} documents", documents.len());
+
+    service.rerank(&query, documents, top_n)
+}
+
+#[command]
+pub(crate) async fn get_usage_report(state: State<'_, PluginState>) -> Result<UsageReport> {
+    let usage = state.usage.lock().unwrap();
+
+    Ok(usage.report())
+}
+
+#[command]
+pub(crate) async fn reset_usage(state: State<'_, PluginState>) -> Result<()> {
+    let mut usage = state.usage.lock().unwrap();
+
+    tracing::debug!("Resetting usage accounting");
+
+    usage.reset()
+}
+
+#[command]
+pub(crate) async fn list_prompts(state: State<'_, PluginState>) -> Result<Vec<PromptTemplate>> {
+    let prompts = state.prompts.lock().unwrap();
+
+    Ok(prompts.list())
+}
+
+#[command]
+pub(crate) async fn save_prompt(
+    state: State<'_, PluginState>,
+    template: PromptTemplate,
+) -> Result<()> {
+    let mut prompts = state.prompts.lock().unwrap();
+
+    tracing::debug!("Saving prompt: {}", template.name);
+
+    prompts.save(template)
+}
+
+#[command]
+pub(crate) async fn remove_prompt(state: State<'_, PluginState>, name: String) -> Result<()> {
+    let mut prompts = state.prompts.lock().unwrap();
+
+    tracing::debug!("Removing prompt: {}", name);
+
+    prompts.remove(&name)
+}
+
+#[command]
+pub(crate) async fn run_prompt<R>(
+    state: State<'_, PluginState>,
+    name: String,
+    vars: Option<Map<String, Value>>,
+    overrides: Option<PromptOverrides>,
+    app: AppHandle<R>,
+    window: Window<R>,
+) -> Result<String>
+where
+    R: Runtime,
+{
+    let message = state.prompts.lock().unwrap().query(
+        &name,
+        &vars.unwrap_or_default(),
+        overrides.unwrap_or_default(),
+    )?;
+
+    tracing::debug!("Running prompt: {}", name);
+
+    stream_query(&state, message, &app, &window)
+}
+
 #[command]
 pub(crate) async fn stream<R>(
     state: State<'_, PluginState>,
     message: Query,
     app: AppHandle<R>,
-) -> Result<()>
+    window: Window<R>,
+) -> Result<String>
+where
+    R: Runtime,
+{
+    stream_query(&state, message, &app, &window)
+}
+
+#[command]
+pub(crate) async fn cancel(state: State<'_, PluginState>) -> Result<()> {
+    tracing::debug!("Cancelling the running query");
+
+    // The service is locked while streaming, the token is shared with its runtimes instead
+    state.cancellation.cancel();
+
+    Ok(())
+}
+
+#[command]
+pub(crate) async fn submit_feedback(
+    state: State<'_, PluginState>,
+    request_id: String,
+    rating: i32,
+    correction: Option<String>,
+) -> Result<()> {
+    let mut feedback = state.feedback.lock().unwrap();
+
+    tracing::debug!("Submitting feedback for request: {}", request_id);
+
+    feedback.submit(&request_id, rating, correction)
+}
+
+#[command]
+pub(crate) async fn export_feedback(
+    state: State<'_, PluginState>,
+    format: DatasetFormat,
+) -> Result<String> {
+    let feedback = state.feedback.lock().unwrap();
+    let mut output = vec![];
+
+    let lines = feedback.export(&mut output, format)?;
+    tracing::debug!("Exported {lines} lines of feedback as {format:?}");
+
+    String::from_utf8(output).map_err(|e| Error::ExecutionError(e.to_string()))
+}
+
+/// Sends `message` to the active runtime and emits the received chunks as events until the end
+/// of the stream. Returns the id of the request, which can be rated with `submit_feedback`.
+fn stream_query<R>(
+    state: &PluginState,
+    message: Query,
+    app: &AppHandle<R>,
+    window: &Window<R>,
+) -> Result<String>
 where
     R: Runtime,
 {
     let mut service = state.runtime.lock().unwrap();
-    let runtime = service.runtime().ok_or(Error::MissingActiveRuntime)?;
+    let runtime = service.active_runtime()?;
+    let model = runtime.config().name.clone();
+    let request_id = new_request_id();
 
     tracing::debug!("Send query to runtime: {:?}", message);
-    runtime.send_stream(message)?;
+    runtime.send_stream_from(message, window.label())?;
+
+    let mut output = vec![];
+    let mut tool_calls = vec![];
 
     loop {
         match runtime.recv_stream() {
             Ok(query) => match &query {
-                Query::Chunk { .. } => {
+                Query::Chunk { data, kind, .. } => {
                     tracing::debug!("Got data chunk");
+                    match kind {
+                        QueryChunkType::ToolCall => match serde_json::from_slice(data) {
+                            Ok(calls) => tool_calls = calls,
+                            Err(e) => tracing::warn!("Error parsing tool calls: {e}"),
+                        },
+                        _ => output.extend_from_slice(data),
+                    }
+
                     let event = query.try_render_as_event_name()?;
                     app.emit(&event, query)
                         .map_err(|e| crate::Error::StreamError(e.to_string()))?;
@@ -71,8 +260,42 @@ where
                     app.emit(&event, msg)
                         .map_err(|e| crate::Error::StreamError(e.to_string()))?;
                 }
-                Query::End { .. } => {
+                Query::ContextShift { discarded, .. } => {
+                    tracing::debug!("Context shifted, discarded {discarded} tokens");
+                    let event = query.try_render_as_event_name()?;
+                    app.emit(&event, query)
+                        .map_err(|e| crate::Error::StreamError(e.to_string()))?;
+                }
+                Query::PrefillProgress {
+                    processed, total, ..
+                } => {
+                    tracing::debug!("Prefilled {processed} of {total} prompt tokens");
+                    let event = query.try_render_as_event_name()?;
+                    app.emit(&event, query)
+                        .map_err(|e| crate::Error::StreamError(e.to_string()))?;
+                }
+                Query::End {
+                    usage,
+                    finish_reason,
+                    ..
+                } => {
                     tracing::debug!("Reached end of stream");
+
+                    // keep the generation, so that it can be rated
+                    if let Some(request) = runtime.last_request() {
+                        let mut generation = GenerationRecord::new(
+                            request_id.clone(),
+                            model.clone(),
+                            request,
+                            String::from_utf8_lossy(&output).into_owned(),
+                        );
+                        generation.tool_calls = std::mem::take(&mut tool_calls);
+                        generation.usage = usage.clone();
+                        generation.finish_reason = *finish_reason;
+
+                        state.feedback.lock().unwrap().record(generation);
+                    }
+
                     let event = query.try_render_as_event_name()?;
                     app.emit(&event, query)
                         .map_err(|e| crate::Error::StreamError(e.to_string()))?;
@@ -94,5 +317,5 @@ where
         }
     }
 
-    Ok(())
+    Ok(request_id)
 }
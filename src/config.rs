@@ -0,0 +1,319 @@
+//! Configuration loading
+//!
+//! Many [`LLMRuntimeConfig`]s differ in a single path or parameter only. [`ConfigLoader`] resolves
+//! the following keys of raw JSON configs before they are deserialized:
+//!
+//! - `extends`: name of another config, which is deep merged with this config
+//! - `profiles`: named overrides, e.g. `dev`, `ci` and `prod`, of which the selected one is deep
+//!   merged with the config
+//! - `${NAME}` in paths, i.e. values of keys ending in `_dir`, `_file` or `_path`: replaced by the
+//!   variable `NAME`, `${APP_DATA}` by the app data directory and any other name by the
+//!   environment variable. `$${` yields a literal `${`. Other values, e.g. Jinja templates, are
+//!   left untouched.
+
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+use serde_json::{Map, Value};
+
+use crate::{Error, LLMRuntimeConfig};
+
+/// Key naming the config a config extends
+const EXTENDS: &str = "extends";
+
+/// Key of the named overrides of a config
+const PROFILES: &str = "profiles";
+
+/// Variable resolved to the app data directory
+const APP_DATA: &str = "APP_DATA";
+
+/// Suffixes of the keys whose values are interpolated
+const PATH_SUFFIXES: [&str; 3] = ["_dir", "_file", "_path"];
+
+/// Resolves inheritance, profiles and variables of raw JSON configs.
+///
+/// # Example
+///
+/// ```
+/// use serde_json::json;
+/// use std::collections::HashMap;
+/// use tauri_plugin_llm::config::ConfigLoader;
+///
+/// let configs = HashMap::from([
+///     (
+///         "Qwen3-4B".to_string(),
+///         json!({
+///             "name": "Qwen3-4B",
+///             "model_dir": "${APP_DATA}/models/Qwen3-4B",
+///             "profiles": { "ci": { "dtype": "f32" } }
+///         }),
+///     ),
+///     (
+///         "Qwen3-4B-F16".to_string(),
+///         json!({ "name": "Qwen3-4B-F16", "extends": "Qwen3-4B", "dtype": "f16" }),
+///     ),
+/// ]);
+///
+/// let loader = ConfigLoader::new().profile("ci").app_data_dir("/data");
+/// let config = loader.resolve("Qwen3-4B-F16", &configs).unwrap();
+///
+/// assert_eq!(config.model_dir.unwrap().to_str(), Some("/data/models/Qwen3-4B"));
+/// assert_eq!(config.dtype.unwrap().to_string(), "f16");
+/// ```
+#[derive(Debug, Clone, Default)]
+pub struct ConfigLoader {
+    profile: Option<String>,
+    app_data_dir: Option<PathBuf>,
+    variables: HashMap<String, String>,
+}
+
+impl ConfigLoader {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Selects the profile applied to configs defining it.
+    pub fn profile<S>(mut self, profile: S) -> Self
+    where
+        S: Into<String>,
+    {
+        self.profile = Some(profile.into());
+        self
+    }
+
+    /// Sets the directory `${APP_DATA}` is resolved to.
+    pub fn app_data_dir<P>(mut self, dir: P) -> Self
+    where
+        P: AsRef<Path>,
+    {
+        self.app_data_dir = Some(dir.as_ref().to_path_buf());
+        self
+    }
+
+    /// Sets a variable, which takes precedence over an environment variable of the same name.
+    pub fn variable<S, V>(mut self, name: S, value: V) -> Self
+    where
+        S: Into<String>,
+        V: Into<String>,
+    {
+        self.variables.insert(name.into(), value.into());
+        self
+    }
+
+    /// Returns the selected profile
+    pub fn selected_profile(&self) -> Option<&str> {
+        self.profile.as_deref()
+    }
+
+    /// Reads a raw JSON config from `path`.
+    pub fn read<P>(path: P) -> Result<Value, Error>
+    where
+        P: AsRef<Path>,
+    {
+        Ok(serde_json::from_str(&std::fs::read_to_string(path)?)?)
+    }
+
+    /// Returns the `name` of a raw config.
+    pub fn name_of(config: &Value) -> Option<&str> {
+        config.get("name").and_then(Value::as_str)
+    }
+
+    /// Resolves the config `name` of `configs`, which are indexed by name.
+    ///
+    /// The configs it extends are resolved first, each config applies its selected profile and
+    /// replaces its variables before it is merged with the config it extends.
+    pub fn resolve(
+        &self,
+        name: &str,
+        configs: &HashMap<String, Value>,
+    ) -> Result<LLMRuntimeConfig, Error> {
+        self.resolve_with(name, configs, &HashMap::new())
+    }
+
+    /// Resolves the config `name` like [`Self::resolve`]. Configs missing in `configs` are looked
+    /// up in `resolved`, which are extended as they are.
+    pub fn resolve_with(
+        &self,
+        name: &str,
+        configs: &HashMap<String, Value>,
+        resolved: &HashMap<String, LLMRuntimeConfig>,
+    ) -> Result<LLMRuntimeConfig, Error> {
+        let config = self.resolve_extends(name, configs, resolved, &mut vec![])?;
+
+        Ok(serde_json::from_value(config)?)
+    }
+
+    /// Applies the selected profile to `config` and the objects it contains, e.g. to the
+    /// `llmconfig` of a plugin config, and replaces its variables. `extends` is not resolved.
+    pub fn resolve_value(&self, config: Value) -> Result<Value, Error> {
+        self.interpolate(self.apply_profiles(config))
+    }
+
+    fn resolve_extends(
+        &self,
+        name: &str,
+        configs: &HashMap<String, Value>,
+        resolved: &HashMap<String, LLMRuntimeConfig>,
+        stack: &mut Vec<String>,
+    ) -> Result<Value, Error> {
+        if stack.iter().any(|n| n == name) {
+            stack.push(name.to_string());
+            return Err(Error::MissingConfigLLM(format!(
+                "Configs extend each other: {}",
+                stack.join(" -> ")
+            )));
+        }
+
+        let Some(config) = configs.get(name).cloned() else {
+            return match resolved.get(name) {
+                Some(config) => Ok(serde_json::to_value(config)?),
+                None => Err(Error::MissingConfigLLM(format!("Unknown config '{name}'"))),
+            };
+        };
+        let mut config = self.interpolate(self.apply_profile(config))?;
+
+        let Some(parent) = config
+            .as_object_mut()
+            .and_then(|config| config.remove(EXTENDS))
+        else {
+            return Ok(config);
+        };
+
+        let parent = parent.as_str().ok_or_else(|| {
+            Error::MissingConfigLLM(format!("'{EXTENDS}' of config '{name}' must be a name"))
+        })?;
+
+        stack.push(name.to_string());
+        let mut extended = self.resolve_extends(parent, configs, resolved, stack)?;
+        stack.pop();
+
+        merge(&mut extended, config);
+
+        Ok(extended)
+    }
+
+    /// Removes the profiles of `config` and merges the selected one.
+    fn apply_profile(&self, mut config: Value) -> Value {
+        let profile = config
+            .as_object_mut()
+            .and_then(|config| config.remove(PROFILES))
+            .and_then(|mut profiles| {
+                self.profile
+                    .as_ref()
+                    .and_then(|selected| profiles.as_object_mut()?.remove(selected))
+            });
+
+        if let Some(profile) = profile {
+            merge(&mut config, profile);
+        }
+
+        config
+    }
+
+    /// Applies the selected profile to `config` and, afterwards, to the objects it contains.
+    fn apply_profiles(&self, config: Value) -> Value {
+        match self.apply_profile(config) {
+            Value::Object(values) => Value::Object(
+                values
+                    .into_iter()
+                    .map(|(k, v)| (k, self.apply_profiles(v)))
+                    .collect(),
+            ),
+            value => value,
+        }
+    }
+
+    /// Replaces the variables in the paths of `value`.
+    fn interpolate(&self, value: Value) -> Result<Value, Error> {
+        self.interpolate_value(value, false)
+    }
+
+    /// Replaces the variables in the string values of `value`, if it is a `path`, and in the
+    /// paths of the objects it contains.
+    fn interpolate_value(&self, value: Value, path: bool) -> Result<Value, Error> {
+        Ok(match value {
+            Value::String(s) if path => Value::String(self.interpolate_str(&s)?),
+            Value::Array(values) => Value::Array(
+                values
+                    .into_iter()
+                    .map(|v| self.interpolate_value(v, path))
+                    .collect::<Result<_, _>>()?,
+            ),
+            Value::Object(values) => Value::Object(
+                values
+                    .into_iter()
+                    .map(|(k, v)| {
+                        let path = PATH_SUFFIXES.iter().any(|suffix| k.ends_with(suffix));
+                        Ok((k, self.interpolate_value(v, path)?))
+                    })
+                    .collect::<Result<Map<_, _>, Error>>()?,
+            ),
+            value => value,
+        })
+    }
+
+    fn interpolate_str(&self, input: &str) -> Result<String, Error> {
+        let mut output = String::with_capacity(input.len());
+        let mut rest = input;
+
+        while let Some(start) = rest.find("${") {
+            // `$${` escapes a literal `${`
+            if rest[..start].ends_with('$') {
+                output.push_str(&rest[..start - 1]);
+                output.push_str("${");
+                rest = &rest[start + 2..];
+                continue;
+            }
+
+            output.push_str(&rest[..start]);
+
+            let end = rest[start..].find('}').ok_or_else(|| {
+                Error::MissingConfigLLM(format!("Unterminated variable in '{input}'"))
+            })?;
+
+            output.push_str(&self.variable_value(&rest[start + 2..start + end])?);
+            rest = &rest[start + end + 1..];
+        }
+
+        output.push_str(rest);
+
+        Ok(output)
+    }
+
+    fn variable_value(&self, name: &str) -> Result<String, Error> {
+        if let Some(value) = self.variables.get(name) {
+            return Ok(value.clone());
+        }
+
+        if name == APP_DATA {
+            return self
+                .app_data_dir
+                .as_ref()
+                .map(|dir| dir.to_string_lossy().into_owned())
+                .ok_or_else(|| {
+                    Error::MissingConfigLLM("No app data directory to resolve ${APP_DATA}".into())
+                });
+        }
+
+        std::env::var(name)
+            .map_err(|_| Error::MissingConfigLLM(format!("Undefined variable ${{{name}}}")))
+    }
+}
+
+/// Deep merges `overlay` into `base`. Objects are merged key by key, any other value of
+/// `overlay` replaces the value of `base`.
+pub fn merge(base: &mut Value, overlay: Value) {
+    match (base, overlay) {
+        (Value::Object(base), Value::Object(overlay)) => {
+            for (key, value) in overlay {
+                match base.get_mut(&key) {
+                    Some(existing) => merge(existing, value),
+                    None => {
+                        base.insert(key, value);
+                    }
+                }
+            }
+        }
+        (base, overlay) => *base = overlay,
+    }
+}
@@ -1,7 +1,8 @@
+use schemars::JsonSchema;
 use serde::de::DeserializeOwned;
-use tauri::{plugin::PluginApi, AppHandle, Runtime};
+use tauri::{plugin::PluginApi, AppHandle, Manager, Runtime};
 
-use crate::LLMPluginConfig;
+use crate::{LLMPluginConfig, PluginState, Query};
 
 pub fn init<R: Runtime, C: DeserializeOwned>(
     app: &AppHandle<R>,
@@ -9,15 +10,28 @@ pub fn init<R: Runtime, C: DeserializeOwned>(
     config: LLMPluginConfig,
 ) -> crate::Result<TauriPluginLlm<R>> {
     Ok(TauriPluginLlm {
-        _handle: app.clone(),
+        handle: app.clone(),
         _config: config,
     })
 }
 
 /// Access to the tauri-plugin-llm APIs.
 pub struct TauriPluginLlm<R: Runtime> {
-    _handle: AppHandle<R>,
+    handle: AppHandle<R>,
     _config: LLMPluginConfig,
 }
 
-impl<R: Runtime> TauriPluginLlm<R> {}
+impl<R: Runtime> TauriPluginLlm<R> {
+    /// Sends a [`Query::Prompt`] to the active model and deserializes the output into `T`.
+    ///
+    /// Blocks until the generation ended. Invalid output is retried with a corrective message,
+    /// see [`LLMRuntime::complete_structured`](crate::runtime::LLMRuntime::complete_structured).
+    pub fn complete_structured<T>(&self, query: Query) -> crate::Result<T>
+    where
+        T: DeserializeOwned + JsonSchema,
+    {
+        self.handle
+            .state::<PluginState>()
+            .complete_structured(query)
+    }
+}
@@ -56,6 +56,46 @@ pub enum Error {
 
     #[error("Model not supported: ({0})")]
     UnsupportedModelType(String),
+
+    /// The model output could not be deserialized into the requested type.
+    #[error("Invalid structured output after {attempts} attempts: ({message})")]
+    StructuredOutput {
+        /// Reason the last output was rejected
+        message: String,
+
+        /// Raw output of the last attempt
+        raw: String,
+
+        attempts: usize,
+    },
+}
+
+impl Error {
+    /// Returns the name of the variant, e.g. to label metrics.
+    pub fn kind(&self) -> &'static str {
+        match self {
+            Error::Io(_) => "io",
+            #[cfg(mobile)]
+            Error::PluginInvoke(_) => "plugin_invoke",
+            Error::MissingConfig => "missing_config",
+            Error::ExecutionError(_) => "execution",
+            Error::MissingConfigLLM(_) => "missing_config_llm",
+            Error::MissingDevice => "missing_device",
+            Error::UnexpectedMessage => "unexpected_message",
+            Error::LoadingFile(_, _) => "loading_file",
+            Error::MessageEncodingError(_) => "message_encoding",
+            Error::ChannelReceiveError(_) => "channel_receive",
+            Error::JsonSerdeError(_) => "json_serde",
+            Error::Ffi(_) => "ffi",
+            Error::TemplateError(_) => "template",
+            Error::StreamError(_) => "stream",
+            Error::UndefinedClientEvent(_) => "undefined_client_event",
+            Error::TimeoutError(_) => "timeout",
+            Error::MissingActiveRuntime => "missing_active_runtime",
+            Error::UnsupportedModelType(_) => "unsupported_model_type",
+            Error::StructuredOutput { .. } => "structured_output",
+        }
+    }
 }
 
 impl Serialize for Error {
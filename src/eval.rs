@@ -0,0 +1,528 @@
+//! Offline evaluation
+//!
+//! Measures models on a dataset of prompts with expectations before switching models. A dataset
+//! is a JSONL file with one [`EvalCase`] per line. The [`Evaluator`] runs every case against one
+//! or more models of a [`LLMService`] and collects accuracy, latency, throughput and failures into
+//! an [`EvalReport`].
+//!
+//! Generation is greedy, so that runs are reproducible. The Mock runtime can be used to test
+//! datasets and expectations without loading model weights.
+
+use std::fmt;
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+
+use crate::runtime::LLMRuntime;
+use crate::{
+    Error, LLMService, Query, QueryChunkType, QueryMessage, SamplingConfig, TokenUsage, ToolCall,
+};
+
+/// Default number of generated tokens per case.
+pub const DEFAULT_EVAL_MAX_TOKENS: usize = 256;
+
+/// A single prompt and the expectation its output is checked against.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct EvalCase {
+    /// Identifies the case in the report
+    pub id: String,
+
+    pub messages: Vec<QueryMessage>,
+
+    #[serde(default)]
+    pub tools: Vec<String>,
+
+    /// Defaults to [`DEFAULT_EVAL_MAX_TOKENS`]
+    pub max_tokens: Option<usize>,
+
+    pub expect: Expectation,
+}
+
+/// Expectation on the output of an [`EvalCase`].
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Expectation {
+    /// The output equals the text, ignoring leading and trailing whitespace
+    ExactMatch(String),
+
+    /// The output matches the regular expression
+    Regex(String),
+
+    /// The output is JSON valid against the JSON schema
+    JsonSchema(serde_json::Value),
+
+    /// The model calls the tool `name`. If given, the call contains all `arguments`.
+    ToolCall {
+        name: String,
+        arguments: Option<serde_json::Value>,
+    },
+
+    /// A judge model decides whether the output satisfies the `rubric`.
+    ///
+    /// Requires [`Evaluator::judge`].
+    Judge { rubric: String },
+}
+
+/// Cases of an evaluation dataset.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct EvalDataset {
+    pub cases: Vec<EvalCase>,
+}
+
+impl EvalDataset {
+    /// Loads a dataset from a JSONL file, one [`EvalCase`] per line.
+    pub fn from_path<P>(path: P) -> Result<Self, Error>
+    where
+        P: AsRef<Path>,
+    {
+        Self::from_jsonl(std::fs::read_to_string(path)?)
+    }
+
+    /// Parses a dataset from JSONL, one [`EvalCase`] per line. Empty lines are skipped.
+    pub fn from_jsonl<S>(content: S) -> Result<Self, Error>
+    where
+        S: AsRef<str>,
+    {
+        let cases = content
+            .as_ref()
+            .lines()
+            .enumerate()
+            .filter(|(_, line)| !line.trim().is_empty())
+            .map(|(number, line)| {
+                serde_json::from_str(line).map_err(|e| {
+                    Error::ExecutionError(format!("Invalid eval case on line {}: {e}", number + 1))
+                })
+            })
+            .collect::<Result<Vec<EvalCase>, Error>>()?;
+
+        Ok(Self { cases })
+    }
+}
+
+/// Outcome of a single case.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CaseResult {
+    pub id: String,
+
+    pub passed: bool,
+
+    /// Generated text
+    pub output: String,
+
+    /// Reason the case failed
+    pub failure: Option<String>,
+
+    /// Set, if the generation failed. Errored cases do not count towards latency and throughput.
+    #[serde(default)]
+    pub errored: bool,
+
+    /// Time from sending the prompt to the end of the generation
+    pub latency_ms: f64,
+
+    pub completion_tokens: usize,
+}
+
+/// Results of all cases run against a single model.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ModelReport {
+    pub model: String,
+
+    pub total: usize,
+
+    pub passed: usize,
+
+    /// Share of passed cases in `[0, 1]`
+    pub accuracy: f64,
+
+    /// Mean latency of the cases without generation errors
+    pub mean_latency_ms: f64,
+
+    /// Generated tokens per second of generation time, across all cases without generation errors
+    pub tokens_per_second: f64,
+
+    pub results: Vec<CaseResult>,
+}
+
+impl ModelReport {
+    fn new(model: String, results: Vec<CaseResult>) -> Self {
+        let total = results.len();
+        let passed = results.iter().filter(|r| r.passed).count();
+        let generated = results.iter().filter(|r| !r.errored);
+        let generated_count = generated.clone().count();
+        let latency_ms: f64 = generated.clone().map(|r| r.latency_ms).sum();
+        let tokens: usize = generated.map(|r| r.completion_tokens).sum();
+
+        Self {
+            model,
+            total,
+            passed,
+            accuracy: passed as f64 / total.max(1) as f64,
+            mean_latency_ms: latency_ms / generated_count.max(1) as f64,
+            tokens_per_second: if latency_ms > 0.0 {
+                tokens as f64 / (latency_ms / 1000.0)
+            } else {
+                0.0
+            },
+            results,
+        }
+    }
+
+    /// Returns the failed cases
+    pub fn failures(&self) -> impl Iterator<Item = &CaseResult> {
+        self.results.iter().filter(|r| !r.passed)
+    }
+}
+
+/// Report of an evaluation run, one [`ModelReport`] per model.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct EvalReport {
+    pub models: Vec<ModelReport>,
+}
+
+impl EvalReport {
+    /// Writes the report as pretty printed JSON to `path`.
+    pub fn write<P>(&self, path: P) -> Result<(), Error>
+    where
+        P: AsRef<Path>,
+    {
+        std::fs::write(path, serde_json::to_string_pretty(self)?)?;
+        Ok(())
+    }
+}
+
+impl fmt::Display for EvalReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(
+            f,
+            "| Model | Passed | Accuracy | Mean latency (ms) | Tokens/s |"
+        )?;
+        writeln!(
+            f,
+            "| ----- | ------ | -------- | ----------------- | -------- |"
+        )?;
+
+        for report in &self.models {
+            writeln!(
+                f,
+                "| {} | {}/{} | {:.1}% | {:.1} | {:.1} |",
+                report.model,
+                report.passed,
+                report.total,
+                report.accuracy * 100.0,
+                report.mean_latency_ms,
+                report.tokens_per_second
+            )?;
+        }
+
+        for report in &self.models {
+            for failure in report.failures() {
+                writeln!(
+                    f,
+                    "\n{} / {}: {}",
+                    report.model,
+                    failure.id,
+                    failure.failure.as_deref().unwrap_or_default()
+                )?;
+            }
+        }
+
+        Ok(())
+    }
+}
+
+/// Output of a single generation.
+struct Generation {
+    text: String,
+    tool_calls: Vec<ToolCall>,
+    usage: Option<TokenUsage>,
+    latency: Duration,
+}
+
+/// Runs evaluation datasets against the models of a [`LLMService`].
+#[derive(Debug, Clone, Default)]
+pub struct Evaluator {
+    judge: Option<String>,
+}
+
+impl Evaluator {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Sets the model grading [`Expectation::Judge`] cases. The model must be configured in the
+    /// evaluated [`LLMService`].
+    pub fn judge<S>(mut self, model: S) -> Self
+    where
+        S: Into<String>,
+    {
+        self.judge = Some(model.into());
+        self
+    }
+
+    /// Runs every case of `dataset` against each of `models` and returns the report.
+    ///
+    /// Each model is activated in `service` in turn. Judged cases are graded after all cases of
+    /// a model have been generated, so that the judge model is activated once per model.
+    pub fn run(
+        &self,
+        service: &mut LLMService,
+        dataset: &EvalDataset,
+        models: &[String],
+    ) -> Result<EvalReport, Error> {
+        let mut report = EvalReport::default();
+
+        for model in models {
+            tracing::info!("Evaluating model {model} on {} cases", dataset.cases.len());
+
+            let mut results = Vec::with_capacity(dataset.cases.len());
+            let mut judged = vec![];
+
+            service.activate(model.clone())?;
+
+            for case in &dataset.cases {
+                let runtime = service.active_runtime()?;
+
+                let result = match Self::generate(runtime, case) {
+                    Ok(generation) => {
+                        let failure = match &case.expect {
+                            Expectation::Judge { .. } => {
+                                judged.push(results.len());
+                                None
+                            }
+                            expectation => check(expectation, &generation).err(),
+                        };
+
+                        CaseResult {
+                            id: case.id.clone(),
+                            passed: failure.is_none(),
+                            output: generation.text,
+                            failure,
+                            errored: false,
+                            latency_ms: generation.latency.as_secs_f64() * 1000.0,
+                            completion_tokens: generation
+                                .usage
+                                .map(|u| u.completion_tokens)
+                                .unwrap_or_default(),
+                        }
+                    }
+                    Err(error) => {
+                        tracing::warn!("Case {} failed on model {model}: {error}", case.id);
+
+                        // The runtime stops after an error, it is restarted for the next case
+                        service.activate(model.clone())?;
+
+                        CaseResult {
+                            id: case.id.clone(),
+                            passed: false,
+                            output: String::new(),
+                            failure: Some(error.to_string()),
+                            errored: true,
+                            latency_ms: 0.0,
+                            completion_tokens: 0,
+                        }
+                    }
+                };
+
+                results.push(result);
+            }
+
+            if !judged.is_empty() {
+                self.grade(service, dataset, &judged, &mut results)?;
+            }
+
+            report.models.push(ModelReport::new(model.clone(), results));
+        }
+
+        Ok(report)
+    }
+
+    /// Sends `case` as a greedy [`Query::Prompt`] and collects the output.
+    fn generate(runtime: &LLMRuntime, case: &EvalCase) -> Result<Generation, Error> {
+        let start = Instant::now();
+
+        runtime.send_stream(Query::Prompt {
+            messages: case.messages.clone(),
+            tools: case.tools.clone(),
+            chunk_size: None,
+            timestamp: None,
+            max_tokens: Some(case.max_tokens.unwrap_or(DEFAULT_EVAL_MAX_TOKENS)),
+            temperature: None,
+            top_k: None,
+            top_p: None,
+            think: false,
+            continue_final_message: false,
+            stream: true,
+            model: None,
+            penalty: None,
+            seed: None,
+            sampling_config: Some(SamplingConfig::ArgMax),
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
+        })?;
+
+        let mut text = vec![];
+        let mut tool_calls = vec![];
+
+        loop {
+            match runtime.recv_stream()? {
+                Query::Chunk {
+                    data,
+                    kind: QueryChunkType::ToolCall,
+                    ..
+                } => tool_calls.extend(serde_json::from_slice::<Vec<ToolCall>>(&data)?),
+                Query::Chunk { data, .. } => text.extend(data),
+                Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+                Query::End { usage, .. } => {
+                    return Ok(Generation {
+                        text: String::from_utf8_lossy(&text).into_owned(),
+                        tool_calls,
+                        usage,
+                        latency: start.elapsed(),
+                    })
+                }
+                _ => {}
+            }
+        }
+    }
+
+    /// Grades the `judged` results with the judge model.
+    fn grade(
+        &self,
+        service: &mut LLMService,
+        dataset: &EvalDataset,
+        judged: &[usize],
+        results: &mut [CaseResult],
+    ) -> Result<(), Error> {
+        let Some(judge) = self.judge.as_ref() else {
+            for index in judged {
+                results[*index].passed = false;
+                results[*index].failure = Some("No judge model configured".to_string());
+            }
+
+            return Ok(());
+        };
+
+        service.activate(judge.clone())?;
+
+        for index in judged {
+            let case = &dataset.cases[*index];
+            let Expectation::Judge { rubric } = &case.expect else {
+                continue;
+            };
+
+            let classification = service.classify(
+                judge_messages(case, rubric, &results[*index].output),
+                vec!["PASS".to_string(), "FAIL".to_string()],
+            );
+
+            let result = &mut results[*index];
+
+            match classification {
+                Ok(classification) if classification.label == "PASS" => {}
+                Ok(_) => {
+                    result.passed = false;
+                    result.failure = Some(format!("Judge rejected the output: {rubric}"));
+                }
+                Err(error) => {
+                    service.activate(judge.clone())?;
+
+                    result.passed = false;
+                    result.failure = Some(format!("Judge failed: {error}"));
+                }
+            }
+        }
+
+        Ok(())
+    }
+}
+
+/// Checks `generation` against a non-judged `expectation`.
+///
+/// Returns the reason the expectation is not met.
+fn check(expectation: &Expectation, generation: &Generation) -> Result<(), String> {
+    let output = generation.text.trim();
+
+    match expectation {
+        Expectation::ExactMatch(expected) => {
+            if output == expected.trim() {
+                Ok(())
+            } else {
+                Err(format!("Expected '{}', got '{output}'", expected.trim()))
+            }
+        }
+        Expectation::Regex(pattern) => {
+            let regex = Regex::new(pattern).map_err(|e| format!("Invalid regex: {e}"))?;
+
+            if regex.is_match(output) {
+                Ok(())
+            } else {
+                Err(format!("Output does not match /{pattern}/"))
+            }
+        }
+        Expectation::JsonSchema(schema) => {
+            let validator =
+                jsonschema::validator_for(schema).map_err(|e| format!("Invalid schema: {e}"))?;
+            let value: serde_json::Value =
+                serde_json::from_str(output).map_err(|e| format!("Output is not JSON: {e}"))?;
+
+            match validator.iter_errors(&value).next() {
+                None => Ok(()),
+                Some(error) => Err(format!("Output does not match the schema: {error}")),
+            }
+        }
+        Expectation::ToolCall { name, arguments } => {
+            let call = generation
+                .tool_calls
+                .iter()
+                .find(|call| call.name() == name)
+                .ok_or(format!("Expected a call of tool '{name}'"))?;
+
+            match arguments {
+                Some(expected) if !contains(call.arguments(), expected) => Err(format!(
+                    "Tool '{name}' called with {}, expected {expected}",
+                    call.arguments()
+                )),
+                _ => Ok(()),
+            }
+        }
+        Expectation::Judge { .. } => Err("Judged cases are graded by the judge model".to_string()),
+    }
+}
+
+/// Returns `true`, if `actual` contains all fields of `expected`.
+fn contains(actual: &serde_json::Value, expected: &serde_json::Value) -> bool {
+    match (actual, expected) {
+        (serde_json::Value::Object(actual), serde_json::Value::Object(expected)) => expected
+            .iter()
+            .all(|(key, value)| actual.get(key).is_some_and(|a| contains(a, value))),
+        (actual, expected) => actual == expected,
+    }
+}
+
+/// Builds the conversation asking the judge model to grade `output` against `rubric`.
+fn judge_messages(case: &EvalCase, rubric: &str, output: &str) -> Vec<QueryMessage> {
+    let conversation = case
+        .messages
+        .iter()
+        .map(|m| format!("{}: {}", m.role, m.content))
+        .collect::<Vec<_>>()
+        .join("\n");
+
+    vec![
+        QueryMessage {
+            role: "system".to_string(),
+            content: "You grade responses of an AI assistant. Answer PASS, if the response \
+                      satisfies the rubric, and FAIL otherwise."
+                .to_string(),
+        },
+        QueryMessage {
+            role: "user".to_string(),
+            content: format!(
+                "Rubric: {rubric}\n\nConversation:\n{conversation}\n\nResponse:\n{output}"
+            ),
+        },
+    ]
+}
@@ -0,0 +1,527 @@
+//! Feedback
+//!
+//! Ratings and corrections of generations, exported as fine-tuning datasets. The plugin keeps
+//! the most recent generations in memory, including the exact rendered prompt, the sampling
+//! parameters, the output and tool calls. Once a generation is rated with
+//! [`FeedbackStore::submit`], it is persisted as `feedback.json` in the app data directory.
+//!
+//! Rated generations are exported as JSON Lines in a [`DatasetFormat`]:
+//!
+//! - chat conversations for supervised fine-tuning ([`DatasetFormat::OpenAi`],
+//!   [`DatasetFormat::ShareGpt`]), containing positively rated outputs and corrections
+//! - preference pairs ([`DatasetFormat::Dpo`]), pairing corrections and positively rated outputs
+//!   with negatively rated outputs of the same conversation
+
+use std::collections::VecDeque;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+
+use crate::runtime::RenderedRequest;
+use crate::util;
+use crate::{
+    CompletionInput, Error, FinishReason, GenerationSeed, Query, QueryMessage, SamplingConfig,
+    TokenUsage, ToolCall,
+};
+
+/// Number of generations kept in memory until they are rated.
+pub const DEFAULT_PENDING_GENERATIONS: usize = 100;
+
+/// Sampling parameters of a generation.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SamplingParameters {
+    pub max_tokens: Option<usize>,
+
+    pub temperature: Option<f32>,
+
+    pub top_k: Option<f32>,
+
+    pub top_p: Option<f32>,
+
+    pub penalty: Option<f32>,
+
+    pub seed: Option<GenerationSeed>,
+
+    pub sampling_config: Option<SamplingConfig>,
+}
+
+impl SamplingParameters {
+    /// Returns the sampling parameters of a generating query.
+    pub fn from_query(query: &Query) -> Self {
+        match query {
+            Query::Prompt {
+                max_tokens,
+                temperature,
+                top_k,
+                top_p,
+                penalty,
+                seed,
+                sampling_config,
+                ..
+            }
+            | Query::Completion {
+                max_tokens,
+                temperature,
+                top_k,
+                top_p,
+                penalty,
+                seed,
+                sampling_config,
+                ..
+            }
+            | Query::Infill {
+                max_tokens,
+                temperature,
+                top_k,
+                top_p,
+                penalty,
+                seed,
+                sampling_config,
+                ..
+            } => Self {
+                max_tokens: *max_tokens,
+                temperature: *temperature,
+                top_k: *top_k,
+                top_p: *top_p,
+                penalty: *penalty,
+                seed: seed.clone(),
+                sampling_config: sampling_config.clone(),
+            },
+            _ => Self::default(),
+        }
+    }
+}
+
+/// A generation, which can be rated.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct GenerationRecord {
+    pub request_id: String,
+
+    pub model: String,
+
+    /// Seconds since the Unix epoch
+    pub timestamp: u64,
+
+    /// Messages of a [`Query::Prompt`] after the default system prompt has been applied. Empty
+    /// for other queries.
+    #[serde(default)]
+    pub messages: Vec<QueryMessage>,
+
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tools: Vec<String>,
+
+    /// The exact prompt text the model has been given
+    pub prompt: Option<String>,
+
+    pub sampling: SamplingParameters,
+
+    pub output: String,
+
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tool_calls: Vec<ToolCall>,
+
+    pub usage: Option<TokenUsage>,
+
+    pub finish_reason: Option<FinishReason>,
+}
+
+impl GenerationRecord {
+    /// Creates a record of the `output` of `request`, see
+    /// [`LLMRuntime::last_request`](crate::runtime::LLMRuntime::last_request).
+    pub fn new(
+        request_id: String,
+        model: String,
+        request: RenderedRequest,
+        output: String,
+    ) -> Self {
+        let (messages, tools, prompt) = match request.query {
+            Query::Prompt {
+                ref messages,
+                ref tools,
+                ..
+            } => (messages.clone(), tools.clone(), request.prompt),
+            Query::Completion {
+                input: CompletionInput::Prompt(ref text),
+                ..
+            } => (vec![], vec![], request.prompt.or(Some(text.clone()))),
+            _ => (vec![], vec![], request.prompt),
+        };
+
+        Self {
+            request_id,
+            model,
+            timestamp: util::now(),
+            messages,
+            tools,
+            prompt,
+            sampling: SamplingParameters::from_query(&request.query),
+            output,
+            tool_calls: vec![],
+            usage: None,
+            finish_reason: None,
+        }
+    }
+}
+
+/// Rating and correction of a generation.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Feedback {
+    /// Positive ratings mark good outputs, negative ratings bad outputs, e.g. `1` and `-1` for
+    /// thumbs up and down.
+    pub rating: i32,
+
+    /// The output the user expected instead
+    pub correction: Option<String>,
+
+    /// Seconds since the Unix epoch
+    pub timestamp: u64,
+}
+
+/// A rated generation.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FeedbackEntry {
+    pub generation: GenerationRecord,
+
+    pub feedback: Feedback,
+}
+
+impl FeedbackEntry {
+    /// Returns the output preferred over the generated output, i.e. a differing correction.
+    fn preferred(&self) -> Option<&str> {
+        self.feedback
+            .correction
+            .as_deref()
+            .filter(|correction| *correction != self.generation.output)
+    }
+}
+
+/// Format of an exported dataset.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DatasetFormat {
+    /// `{"messages": [{"role": ..., "content": ...}]}`
+    #[serde(rename = "openai")]
+    OpenAi,
+
+    /// `{"conversations": [{"from": ..., "value": ...}]}`
+    #[serde(rename = "sharegpt")]
+    ShareGpt,
+
+    /// `{"prompt": [...], "chosen": [...], "rejected": [...]}`
+    Dpo,
+}
+
+/// Recent generations and the feedback on them.
+///
+/// A store without a path is kept in memory only.
+#[derive(Debug)]
+pub struct FeedbackStore {
+    path: Option<PathBuf>,
+    capacity: usize,
+    pending: VecDeque<GenerationRecord>,
+    entries: Vec<FeedbackEntry>,
+}
+
+impl Default for FeedbackStore {
+    fn default() -> Self {
+        Self {
+            path: None,
+            capacity: DEFAULT_PENDING_GENERATIONS,
+            pending: VecDeque::new(),
+            entries: vec![],
+        }
+    }
+}
+
+impl FeedbackStore {
+    /// Opens the store persisted at `path`. A missing file is created with the first feedback.
+    pub fn open<P>(path: P) -> Result<Self, Error>
+    where
+        P: AsRef<Path>,
+    {
+        let path = path.as_ref().to_path_buf();
+
+        let entries = util::read_json(&path)?;
+
+        Ok(Self {
+            path: Some(path),
+            entries,
+            ..Default::default()
+        })
+    }
+
+    /// Sets the number of generations kept in memory until they are rated.
+    pub fn with_capacity(mut self, capacity: usize) -> Self {
+        self.capacity = capacity;
+        self
+    }
+
+    /// Keeps `generation` until it is rated. The oldest generation is discarded once the
+    /// capacity is reached.
+    pub fn record(&mut self, generation: GenerationRecord) {
+        while self.pending.len() >= self.capacity.max(1) {
+            self.pending.pop_front();
+        }
+
+        self.pending.push_back(generation);
+    }
+
+    /// Rates the generation `request_id`. Rating a generation again replaces its feedback.
+    pub fn submit(
+        &mut self,
+        request_id: &str,
+        rating: i32,
+        correction: Option<String>,
+    ) -> Result<(), Error> {
+        let feedback = Feedback {
+            rating,
+            correction,
+            timestamp: util::now(),
+        };
+
+        if let Some(entry) = self
+            .entries
+            .iter_mut()
+            .find(|e| e.generation.request_id == request_id)
+        {
+            entry.feedback = feedback;
+        } else {
+            let generation = self
+                .pending
+                .iter()
+                .position(|g| g.request_id == request_id)
+                .and_then(|index| self.pending.remove(index))
+                .ok_or_else(|| {
+                    Error::ExecutionError(format!("Unknown or expired request '{request_id}'"))
+                })?;
+
+            self.entries.push(FeedbackEntry {
+                generation,
+                feedback,
+            });
+        }
+
+        self.persist()
+    }
+
+    /// Returns all rated generations.
+    pub fn entries(&self) -> &[FeedbackEntry] {
+        &self.entries
+    }
+
+    /// Writes the rated generations as JSON Lines in `format`. Returns the number of lines.
+    ///
+    /// Only generations of [`Query::Prompt`]s are exported.
+    pub fn export<W>(&self, writer: &mut W, format: DatasetFormat) -> Result<usize, Error>
+    where
+        W: Write,
+    {
+        let lines = match format {
+            DatasetFormat::OpenAi | DatasetFormat::ShareGpt => self.conversations(format),
+            DatasetFormat::Dpo => self.preference_pairs(),
+        };
+
+        for line in &lines {
+            serde_json::to_writer(&mut *writer, line)?;
+            writer.write_all(b"\n")?;
+        }
+
+        Ok(lines.len())
+    }
+
+    /// Returns conversations ending with a positively rated output or a correction.
+    fn conversations(&self, format: DatasetFormat) -> Vec<Value> {
+        self.entries
+            .iter()
+            .filter(|e| !e.generation.messages.is_empty())
+            .filter_map(|entry| {
+                let generation = &entry.generation;
+
+                let answer = match (&entry.feedback.correction, entry.feedback.rating > 0) {
+                    (Some(correction), _) => Answer::Text(correction),
+                    (None, true) if !generation.tool_calls.is_empty() => {
+                        Answer::ToolCalls(&generation.output, &generation.tool_calls)
+                    }
+                    (None, true) => Answer::Text(&generation.output),
+                    (None, false) => return None,
+                };
+
+                Some(match format {
+                    DatasetFormat::ShareGpt => sharegpt(generation, answer),
+                    _ => openai(generation, answer),
+                })
+            })
+            .collect()
+    }
+
+    /// Returns pairs of preferred and rejected outputs of the same conversation.
+    ///
+    /// Corrections and positively rated outputs are preferred over negatively rated and
+    /// corrected outputs.
+    fn preference_pairs(&self) -> Vec<Value> {
+        // (messages, chosen, rejected) grouped by conversation in order of appearance
+        let mut groups: Vec<(&[QueryMessage], Vec<&str>, Vec<&str>)> = vec![];
+
+        for entry in &self.entries {
+            let messages = entry.generation.messages.as_slice();
+            if messages.is_empty() {
+                continue;
+            }
+
+            let index = match groups
+                .iter()
+                .position(|(m, _, _)| same_messages(m, messages))
+            {
+                Some(index) => index,
+                None => {
+                    groups.push((messages, vec![], vec![]));
+                    groups.len() - 1
+                }
+            };
+
+            let (_, chosen, rejected) = &mut groups[index];
+            let output = entry.generation.output.as_str();
+
+            if let Some(preferred) = entry.preferred() {
+                chosen.push(preferred);
+                rejected.push(output);
+            } else if entry.feedback.rating > 0 {
+                chosen.push(output);
+            } else if entry.feedback.rating < 0 {
+                rejected.push(output);
+            }
+        }
+
+        let mut pairs = vec![];
+
+        for (messages, chosen, rejected) in groups {
+            let mut seen = vec![];
+
+            for c in &chosen {
+                for r in &rejected {
+                    if c == r || seen.contains(&(c, r)) {
+                        continue;
+                    }
+                    seen.push((c, r));
+
+                    pairs.push(json!({
+                        "prompt": messages,
+                        "chosen": [{ "role": "assistant", "content": c }],
+                        "rejected": [{ "role": "assistant", "content": r }],
+                    }));
+                }
+            }
+        }
+
+        pairs
+    }
+
+    /// Writes the entries to the file of the store, if any.
+    fn persist(&self) -> Result<(), Error> {
+        match self.path.as_ref() {
+            Some(path) => util::write_json(path, &self.entries),
+            None => Ok(()),
+        }
+    }
+}
+
+/// The final assistant turn of an exported conversation.
+enum Answer<'a> {
+    Text(&'a str),
+    ToolCalls(&'a str, &'a [ToolCall]),
+}
+
+fn same_messages(a: &[QueryMessage], b: &[QueryMessage]) -> bool {
+    a.len() == b.len()
+        && a.iter()
+            .zip(b)
+            .all(|(a, b)| a.role == b.role && a.content == b.content)
+}
+
+fn openai(generation: &GenerationRecord, answer: Answer) -> Value {
+    let mut messages: Vec<Value> = generation
+        .messages
+        .iter()
+        .map(|m| json!({ "role": m.role, "content": m.content }))
+        .collect();
+
+    messages.push(match answer {
+        Answer::Text(content) => json!({ "role": "assistant", "content": content }),
+        Answer::ToolCalls(content, calls) => json!({
+            "role": "assistant",
+            "content": content,
+            "tool_calls": calls
+                .iter()
+                .map(|call| json!({
+                    "id": call.id(),
+                    "type": "function",
+                    "function": {
+                        "name": call.name(),
+                        "arguments": call.arguments().to_string(),
+                    },
+                }))
+                .collect::<Vec<_>>(),
+        }),
+    });
+
+    let mut line = json!({ "messages": messages });
+    if !generation.tools.is_empty() {
+        line["tools"] = generation
+            .tools
+            .iter()
+            .map(|tool| serde_json::from_str(tool).unwrap_or_else(|_| Value::from(tool.as_str())))
+            .collect();
+    }
+
+    line
+}
+
+fn sharegpt(generation: &GenerationRecord, answer: Answer) -> Value {
+    let mut conversations: Vec<Value> = generation
+        .messages
+        .iter()
+        .map(|m| {
+            let from = match m.role.as_str() {
+                "user" => "human",
+                "assistant" => "gpt",
+                "tool" => "observation",
+                role => role,
+            };
+
+            json!({ "from": from, "value": m.content })
+        })
+        .collect();
+
+    match answer {
+        Answer::Text(value) => conversations.push(json!({ "from": "gpt", "value": value })),
+        Answer::ToolCalls(_, calls) => conversations.extend(calls.iter().map(|call| {
+            json!({
+                "from": "function_call",
+                "value": json!({ "name": call.name(), "arguments": call.arguments() }).to_string(),
+            })
+        })),
+    }
+
+    let mut line = json!({ "conversations": conversations });
+    if !generation.tools.is_empty() {
+        line["tools"] = Value::from(format!("[{}]", generation.tools.join(",")));
+    }
+
+    line
+}
+
+/// Returns a new request id, unique within the process.
+pub fn new_request_id() -> String {
+    static COUNTER: AtomicU64 = AtomicU64::new(0);
+
+    let millis = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis())
+        .unwrap_or_default();
+
+    format!("{millis:x}-{:x}", COUNTER.fetch_add(1, Ordering::Relaxed))
+}
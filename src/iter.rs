@@ -1,3 +1,13 @@
+use serde::{Deserialize, Serialize};
+use std::time::{Duration, Instant};
+
+/// Default flush interval of [`FlushPolicy::Adaptive`] in milliseconds.
+pub const DEFAULT_FLUSH_TARGET_MS: u64 = 50;
+
+/// Weight of the latest interval between two items in the moving average of
+/// [`FlushPolicy::Adaptive`].
+const RATE_SMOOTHING: f64 = 0.3;
+
 /// Extension trait that adds chunking capability to any iterator.
 ///
 /// This trait provides the [`chunks`](IntoIterChunks::chunks) method which groups
@@ -49,6 +59,30 @@ pub trait IntoIterChunks: Iterator + Sized {
     fn chunks(self, size: usize) -> Chunks<Self> {
         Chunks::new(self, size)
     }
+
+    /// Groups iterator items into chunks of at most `size` elements, flushed according to
+    /// `policy`.
+    ///
+    /// Unlike [`chunks`](IntoIterChunks::chunks), a chunk may be yielded before it is full,
+    /// e.g. once the items of a slow producer have accumulated for a while. A `size` of 0 is
+    /// treated as 1.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// use tauri_plugin_llm::iter::*;
+    ///
+    /// // Items arriving faster than the interval are flushed every `size` items
+    /// let chunks: Vec<Vec<i32>> = (1..=5)
+    ///     .chunks_with(2, FlushPolicy::Timed { interval_ms: 60_000 })
+    ///     .map(|chunk| chunk.into_iter().collect())
+    ///     .collect();
+    ///
+    /// assert_eq!(chunks, vec![vec![1, 2], vec![3, 4], vec![5]]);
+    /// ```
+    fn chunks_with(self, size: usize, policy: FlushPolicy) -> FlushChunks<Self> {
+        FlushChunks::new(self, size, policy)
+    }
 }
 
 impl<I: Iterator> IntoIterChunks for I {}
@@ -80,6 +114,133 @@ impl<I: Iterator> Iterator for Chunks<I> {
     }
 }
 
+/// Policy deciding when accumulated items, e.g. generated tokens, are flushed as a chunk.
+///
+/// All policies flush at the latest once `chunk_size` items have accumulated.
+#[derive(Deserialize, Serialize, Debug, Clone, Copy, PartialEq, Eq, Default)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum FlushPolicy {
+    /// Flushes every `chunk_size` items
+    #[default]
+    Tokens,
+
+    /// Also flushes at the next item once `interval_ms` milliseconds have passed since the last
+    /// flush. Items are not flushed by a timer, they wait for the next item or the end of the
+    /// iterator.
+    Timed { interval_ms: u64 },
+
+    /// Tunes the number of items per chunk to the observed item rate, so that a chunk is
+    /// flushed about every `target_ms` milliseconds. Defaults to 50 milliseconds.
+    ///
+    /// The first item is flushed on its own.
+    Adaptive {
+        #[serde(default = "default_target_ms")]
+        target_ms: u64,
+    },
+}
+
+fn default_target_ms() -> u64 {
+    DEFAULT_FLUSH_TARGET_MS
+}
+
+/// An iterator adapter that groups items into chunks flushed according to a [`FlushPolicy`].
+///
+/// Created by the [`IntoIterChunks::chunks_with`] method. See its documentation for more.
+pub struct FlushChunks<I: Iterator> {
+    iter: I,
+    state: FlushState,
+}
+
+impl<I: Iterator> FlushChunks<I> {
+    fn new(iter: I, size: usize, policy: FlushPolicy) -> Self {
+        Self {
+            iter,
+            state: FlushState {
+                size: size.max(1),
+                policy,
+                last_flush: Instant::now(),
+                last_item: None,
+                item_interval: None,
+            },
+        }
+    }
+}
+
+/// Timing of the items of a [`FlushChunks`] iterator.
+struct FlushState {
+    size: usize,
+    policy: FlushPolicy,
+    last_flush: Instant,
+    last_item: Option<Instant>,
+
+    /// Moving average of the seconds between two items
+    item_interval: Option<f64>,
+}
+
+impl FlushState {
+    /// Updates the moving average of the interval between items with an item received `now`.
+    fn observe(&mut self, now: Instant) {
+        if let Some(last) = self.last_item.replace(now) {
+            let interval = (now - last).as_secs_f64();
+
+            self.item_interval = Some(match self.item_interval {
+                Some(average) => average + RATE_SMOOTHING * (interval - average),
+                None => interval,
+            });
+        }
+    }
+
+    /// Returns `true`, if a chunk of `len` items is flushed at `now`.
+    fn is_due(&self, len: usize, now: Instant) -> bool {
+        if len >= self.size {
+            return true;
+        }
+
+        match self.policy {
+            FlushPolicy::Tokens => false,
+            FlushPolicy::Timed { interval_ms } => {
+                now - self.last_flush >= Duration::from_millis(interval_ms)
+            }
+            FlushPolicy::Adaptive { target_ms } => {
+                let Some(interval) = self.item_interval else {
+                    return true;
+                };
+
+                let target = Duration::from_millis(target_ms).as_secs_f64();
+                let size = (target / interval.max(f64::EPSILON)).round() as usize;
+
+                len >= size.clamp(1, self.size)
+            }
+        }
+    }
+}
+
+impl<I: Iterator> Iterator for FlushChunks<I> {
+    type Item = Chunk<I::Item>;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        let mut items = vec![];
+
+        for item in &mut self.iter {
+            let now = Instant::now();
+            self.state.observe(now);
+            items.push(item);
+
+            if self.state.is_due(items.len(), now) {
+                break;
+            }
+        }
+
+        self.state.last_flush = Instant::now();
+
+        if items.is_empty() {
+            None
+        } else {
+            Some(Chunk { items })
+        }
+    }
+}
+
 /// A container holding a single chunk of items from a [`Chunks`] iterator.
 ///
 /// Use [`cloned`](Chunk::cloned) to iterate over the contained items.
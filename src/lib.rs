@@ -6,30 +6,62 @@ mod llm;
 #[cfg(mobile)]
 mod mobile;
 mod models;
+mod normalize;
+mod system_prompt;
 
+pub mod bench;
+pub mod config;
+pub mod eval;
+pub mod feedback;
 pub mod iter;
+pub mod metrics;
+pub mod prompts;
 mod templates;
+pub mod usage;
+mod util;
 
+pub use normalize::*;
+pub use system_prompt::*;
 pub use templates::*;
 
+use std::collections::HashMap;
 use std::sync::Arc;
 use std::sync::Mutex;
 
+use config::ConfigLoader;
 #[cfg(desktop)]
 use desktop::TauriPluginLlm;
 pub use error::{Error, Result};
+use feedback::FeedbackStore;
+pub use llm::cancellation::CancellationToken;
+pub use llm::classify::{Classification, LabelProbability};
+pub use llm::context_shift::ContextShift;
+pub use llm::fim::FimTokens;
 pub use llm::loaders;
+pub use llm::prefill::ChunkedPrefill;
+pub use llm::prompt_cache::{CachedPrefix, PromptCacheConfig};
+pub use llm::repetition::{RepetitionAction, RepetitionGuard};
+pub use llm::rerank::RerankResult;
+pub use llm::response_cache::ResponseCacheConfig;
 pub use llm::runtime;
+pub use llm::semantic_cache::{cosine_similarity, SemanticCacheConfig};
+pub use llm::special_tokens::{SpecialToken, SpecialTokenPolicy, SpecialTokens};
+pub use llm::structured::{json_schema, DEFAULT_STRUCTURED_RETRIES};
+pub use llm::token_healing::TokenHealing;
 pub use llm::LLMService;
 #[cfg(mobile)]
 use mobile::TauriPluginLlm;
 pub use models::*;
+pub use prometheus;
+use prompts::{PromptLibrary, PromptTemplate};
+pub use schemars;
 use serde::Deserialize;
 use serde::Serialize;
 use tauri::{
     plugin::{Builder as PluginBuilder, TauriPlugin},
     Manager, Runtime,
 };
+use usage::UsageStore;
 
 /// Extensions to [`tauri::App`], [`tauri::AppHandle`] and [`tauri::Window`] to access the tauri-plugin-llm APIs.
 pub trait TauriPluginLlmExt<R: Runtime> {
@@ -48,15 +80,62 @@ pub struct LLMPluginConfig {
     pub mcpurify_config: Option<mcpurify::Config>,
 
     pub llmconfig: LLMRuntimeConfig,
+
+    /// Serves Prometheus metrics on `http://127.0.0.1:<metrics_port>/metrics`, if set.
+    #[serde(default)]
+    pub metrics_port: Option<u16>,
+
+    /// Prompt templates available to `run_prompt`, in addition to those saved by the application.
+    #[serde(default)]
+    pub prompts: Vec<PromptTemplate>,
+
+    /// Named overrides of this config, e.g. `dev`, `ci` and `prod`, selected with
+    /// [`Builder::profile`].
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub profiles: HashMap<String, serde_json::Value>,
 }
 
 #[derive(Default)]
 pub struct Builder {
     plugin_config: Option<LLMPluginConfig>,
+    profile: Option<String>,
 }
 
 pub struct PluginState {
     runtime: Arc<Mutex<LLMService>>,
+    usage: Arc<Mutex<UsageStore>>,
+    prompts: Arc<Mutex<PromptLibrary>>,
+    feedback: Arc<Mutex<FeedbackStore>>,
+    cancellation: CancellationToken,
+}
+
+impl PluginState {
+    /// Sends a [`Query::Prompt`] to the active model and deserializes the output into `T`.
+    ///
+    /// Blocks until the generation ended. Invalid output is retried with a corrective message,
+    /// see [`LLMRuntime::complete_structured`](crate::runtime::LLMRuntime::complete_structured).
+    /// The service is only locked while an attempt is generated.
+    pub(crate) fn complete_structured<T>(&self, query: Query) -> crate::Result<T>
+    where
+        T: serde::de::DeserializeOwned + schemars::JsonSchema,
+    {
+        let lock = || {
+            self.runtime
+                .lock()
+                .map_err(|e| Error::ExecutionError(e.to_string()))
+        };
+
+        llm::structured::complete(query, DEFAULT_STRUCTURED_RETRIES, |query| {
+            lock()?.complete(query)
+        })
+        .inspect_err(|error| {
+            if llm::structured::is_rejection(error) {
+                if let Ok(service) = lock() {
+                    service.record_error(error);
+                }
+            }
+        })
+    }
 }
 
 impl Builder {
@@ -71,13 +150,38 @@ impl Builder {
         self
     }
 
+    /// Selects a profile of the config, which overrides its settings.
+    ///
+    /// `${ENV_VAR}` and `${APP_DATA}` in paths of the config are resolved regardless of the
+    /// profile, see [`ConfigLoader`].
+    pub fn profile<S>(mut self, profile: S) -> Self
+    where
+        S: Into<String>,
+    {
+        self.profile = Some(profile.into());
+        self
+    }
+
     pub fn build<R: Runtime>(self) -> TauriPlugin<R, LLMPluginConfig> {
         PluginBuilder::<R, LLMPluginConfig>::new("llm")
             .invoke_handler(tauri::generate_handler![
                 commands::stream,
+                commands::cancel,
                 commands::switch_model,
                 commands::list_available_models,
-                commands::add_configuration
+                commands::add_configuration,
+                commands::special_tokens,
+                commands::score,
+                commands::classify,
+                commands::rerank,
+                commands::get_usage_report,
+                commands::reset_usage,
+                commands::list_prompts,
+                commands::save_prompt,
+                commands::remove_prompt,
+                commands::run_prompt,
+                commands::submit_feedback,
+                commands::export_feedback
             ])
             .setup(|app, api| {
                 let config = self
@@ -85,19 +189,94 @@ impl Builder {
                     .or(Some((*api.config()).clone()))
                     .ok_or(Error::MissingConfig)?;
 
+                let mut loader = ConfigLoader::new();
+                if let Some(profile) = self.profile {
+                    if !config.profiles.contains_key(&profile)
+                        && !config.llmconfig.profiles.contains_key(&profile)
+                    {
+                        tracing::warn!("Profile {profile} is not defined in the plugin config");
+                    }
+
+                    loader = loader.profile(profile);
+                }
+                if let Ok(dir) = app.path().app_data_dir() {
+                    loader = loader.app_data_dir(dir);
+                }
+
+                let config: LLMPluginConfig =
+                    serde_json::from_value(loader.resolve_value(serde_json::to_value(config)?)?)?;
+
                 // manage llm runtime ?
                 app.manage({
                     let config = config.clone();
 
                     let mut service =
                         LLMService::from_runtime_configs(std::slice::from_ref(&config.llmconfig));
+                    service.set_config_loader(loader);
+
+                    // variables of the default system prompts
+                    let package_info = app.package_info();
+                    service.set_prompt_variable("app_name", package_info.name.clone());
+                    service.set_prompt_variable("app_version", package_info.version.to_string());
+
+                    // persist prompt and response caches in the app cache directory
+                    if let Ok(dir) = app.path().app_cache_dir() {
+                        service.set_cache_dir(dir.join("prompt-cache"));
+                        service.set_response_cache_dir(dir.join("response-cache"));
+                    }
+
+                    if let Some(port) = config.metrics_port {
+                        service.metrics().serve(port)?;
+                    }
+
+                    // persist usage accounting in the app data directory. An unreadable store is
+                    // left untouched and usage is only accounted in memory.
+                    let usage = app
+                        .path()
+                        .app_data_dir()
+                        .map_err(|e| Error::ExecutionError(e.to_string()))
+                        .and_then(|dir| UsageStore::open(dir.join("usage.json")))
+                        .unwrap_or_else(|e| {
+                            tracing::warn!("Usage is not persisted: {e}");
+                            UsageStore::default()
+                        });
+                    let usage = Arc::new(Mutex::new(usage));
+                    service.set_usage_store(usage.clone());
 
                     // initialize and activate runtime by config
                     // TODO: We may have more than one model config available
                     service.activate(config.llmconfig.name.clone())?;
 
+                    // persist saved prompt templates in the app data directory
+                    let prompts = app
+                        .path()
+                        .app_data_dir()
+                        .map_err(|e| Error::ExecutionError(e.to_string()))
+                        .and_then(|dir| {
+                            PromptLibrary::open(dir.join("prompts.json"), config.prompts.clone())
+                        })
+                        .unwrap_or_else(|e| {
+                            tracing::warn!("Prompts are not persisted: {e}");
+                            PromptLibrary::new(config.prompts.clone())
+                        });
+
+                    // persist rated generations in the app data directory
+                    let feedback = app
+                        .path()
+                        .app_data_dir()
+                        .map_err(|e| Error::ExecutionError(e.to_string()))
+                        .and_then(|dir| FeedbackStore::open(dir.join("feedback.json")))
+                        .unwrap_or_else(|e| {
+                            tracing::warn!("Feedback is not persisted: {e}");
+                            FeedbackStore::default()
+                        });
+
                     PluginState {
+                        cancellation: service.cancellation(),
                         runtime: Arc::new(Mutex::new(service)),
+                        usage,
+                        prompts: Arc::new(Mutex::new(prompts)),
+                        feedback: Arc::new(Mutex::new(feedback)),
                     }
                 });
 
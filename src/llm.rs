@@ -4,18 +4,56 @@
 //! their available formats. For now the LLM loader supports `*.safetensors`  files
 //! and text generation models.
 
-use crate::{runtime::LLMRuntime, Error, LLMRuntimeConfig};
-use std::{collections::HashMap, path::Path};
+use crate::{
+    config::ConfigLoader,
+    metrics::{Metrics, NO_MODEL},
+    runtime::LLMRuntime,
+    usage::UsageStore,
+    CancellationToken, Classification, Error, LLMRuntimeConfig, ModelKind, Query, QueryMessage,
+    RerankResult, Score, SpecialTokens,
+};
+use schemars::JsonSchema;
+use semantic_cache::SemanticCache;
+use serde::de::DeserializeOwned;
+use serde_json::{Map, Value};
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+};
 
 pub mod backend;
+pub mod cancellation;
+pub mod classify;
+pub mod context_shift;
+pub mod fim;
 pub mod loaders;
+pub mod prefill;
+pub mod prompt_cache;
+pub mod repetition;
+pub mod rerank;
+pub mod response_cache;
 pub mod runtime;
+pub mod semantic_cache;
+pub mod special_tokens;
+pub mod structured;
+pub mod token_healing;
 pub mod tool_call;
 
 /// LLMServices manages runtime instances
 pub struct LLMService {
     configs: Option<HashMap<String, LLMRuntimeConfig>>,
     active: Option<LLMRuntime>,
+    cache_dir: Option<PathBuf>,
+    response_cache_dir: Option<PathBuf>,
+    metrics: Arc<Metrics>,
+    usage: Option<Arc<Mutex<UsageStore>>>,
+    cancellation: CancellationToken,
+    prompt_variables: Map<String, Value>,
+    loader: ConfigLoader,
+
+    /// Configs as read, before they are resolved by the `loader`
+    raw_configs: HashMap<String, Value>,
 }
 
 impl LLMService {
@@ -36,11 +74,23 @@ impl LLMService {
     /// - configuration file cannot be found
     /// - configuration is malformed / contains invalid values
     pub fn from_dir<P>(dir: P) -> Result<Self, Error>
+    where
+        P: AsRef<Path>,
+    {
+        Self::from_dir_with_loader(dir, ConfigLoader::default())
+    }
+
+    /// Creates a new [`LLMService`] from the configurations in `dir` like [`Self::from_dir`],
+    /// resolving profiles and variables with `loader`.
+    ///
+    /// Configurations may extend any other configuration in `dir`. Configurations which cannot
+    /// be resolved are skipped.
+    pub fn from_dir_with_loader<P>(dir: P, loader: ConfigLoader) -> Result<Self, Error>
     where
         P: AsRef<Path>,
     {
         let filepaths = std::fs::read_dir(dir)?;
-        let mut configs = HashMap::new();
+        let mut raw_configs = HashMap::new();
 
         for entry in filepaths {
             if let Err(error) = entry {
@@ -73,10 +123,15 @@ impl LLMService {
             };
 
             if filename.ends_with(".json") {
-                match LLMRuntimeConfig::from_path(entry.path()) {
-                    Ok(llm_config) => {
-                        configs.insert(llm_config.name.clone(), llm_config);
-                    }
+                match ConfigLoader::read(entry.path()) {
+                    Ok(raw) => match ConfigLoader::name_of(&raw) {
+                        Some(name) => {
+                            raw_configs.insert(name.to_string(), raw);
+                        }
+                        None => {
+                            tracing::error!("Configuration file {filename} has no name");
+                        }
+                    },
                     Err(error) => {
                         tracing::error!(
                             "Reading LLMRuntimeConfig from file returned an error: {error}"
@@ -87,6 +142,20 @@ impl LLMService {
             }
         }
 
+        // configs are resolved once all files are read, as they may extend each other
+        let mut configs = HashMap::new();
+
+        for name in raw_configs.keys() {
+            match loader.resolve(name, &raw_configs) {
+                Ok(llm_config) => {
+                    configs.insert(name.clone(), llm_config);
+                }
+                Err(error) => {
+                    tracing::error!("Resolving LLMRuntimeConfig {name} returned an error: {error}");
+                }
+            }
+        }
+
         if configs.is_empty() {
             return Err(Error::MissingConfigLLM(
                 "No valid configuration files found".to_string(),
@@ -96,6 +165,14 @@ impl LLMService {
         Ok(Self {
             configs: Some(configs),
             active: None,
+            cache_dir: None,
+            response_cache_dir: None,
+            cancellation: CancellationToken::default(),
+            metrics: Arc::new(Metrics::default()),
+            usage: None,
+            prompt_variables: Map::new(),
+            loader,
+            raw_configs,
         })
     }
 
@@ -104,31 +181,46 @@ impl LLMService {
     where
         P: AsRef<Path>,
     {
-        let config = LLMRuntimeConfig::from_path(path)?;
-
-        Ok(Self {
-            configs: Some([config].into_iter().map(|c| (c.name.clone(), c)).collect()),
-            active: None,
-        })
+        Self::from_path_multiple(&[path])
     }
 
     /// Loads multiple [`LLMRuntimeConfig`] from paths.
+    ///
+    /// Configurations may extend each other, see [`ConfigLoader`].
     pub fn from_path_multiple<P>(paths: &[P]) -> Result<Self, Error>
     where
         P: AsRef<Path>,
     {
-        let mut configs = HashMap::default();
+        let loader = ConfigLoader::default();
+        let mut raw_configs = HashMap::default();
 
         for p in paths {
-            let config = LLMRuntimeConfig::from_path(p)?;
-            let name = config.name.clone();
-
-            configs.insert(name, config);
+            let raw = ConfigLoader::read(p)?;
+            let name = ConfigLoader::name_of(&raw)
+                .ok_or_else(|| {
+                    Error::MissingConfigLLM(format!("Configuration {:?} has no name", p.as_ref()))
+                })?
+                .to_string();
+
+            raw_configs.insert(name, raw);
         }
 
+        let configs = raw_configs
+            .keys()
+            .map(|name| Ok((name.clone(), loader.resolve(name, &raw_configs)?)))
+            .collect::<Result<HashMap<_, _>, Error>>()?;
+
         Ok(Self {
             configs: Some(configs),
             active: None,
+            cache_dir: None,
+            response_cache_dir: None,
+            cancellation: CancellationToken::default(),
+            metrics: Arc::new(Metrics::default()),
+            usage: None,
+            prompt_variables: Map::new(),
+            loader,
+            raw_configs,
         })
     }
 
@@ -152,6 +244,14 @@ impl LLMService {
         Self {
             configs: Some(mappings),
             active: None,
+            cache_dir: None,
+            response_cache_dir: None,
+            cancellation: CancellationToken::default(),
+            metrics: Arc::new(Metrics::default()),
+            usage: None,
+            prompt_variables: Map::new(),
+            loader: ConfigLoader::default(),
+            raw_configs: HashMap::new(),
         }
     }
 }
@@ -162,6 +262,86 @@ impl LLMService {
         self.active.as_mut()
     }
 
+    /// Returns the currently active [`LLMRuntime`].
+    ///
+    /// # Errors
+    ///
+    /// Returns [`Error::MissingActiveRuntime`], if no runtime is active. The error is counted in
+    /// the [`Metrics`] of the service.
+    pub fn active_runtime(&mut self) -> Result<&mut LLMRuntime, Error> {
+        if self.active.is_none() {
+            self.record_error(&Error::MissingActiveRuntime);
+        }
+
+        self.active.as_mut().ok_or(Error::MissingActiveRuntime)
+    }
+
+    /// Counts an `error` raised by the service instead of a runtime worker, labeled with the
+    /// active model.
+    pub(crate) fn record_error(&self, error: &Error) {
+        let model = self
+            .active
+            .as_ref()
+            .map(|runtime| runtime.config().name.as_str())
+            .unwrap_or(NO_MODEL);
+
+        self.metrics.record_error(model, error);
+    }
+
+    /// Sets the directory prompt caches are persisted in, if a [`LLMRuntimeConfig`] does not
+    /// configure one itself.
+    pub fn set_cache_dir<P>(&mut self, dir: P)
+    where
+        P: AsRef<Path>,
+    {
+        self.cache_dir = Some(dir.as_ref().to_path_buf());
+    }
+
+    /// Sets the directory cached responses are persisted in, if a [`LLMRuntimeConfig`] does not
+    /// configure one itself.
+    pub fn set_response_cache_dir<P>(&mut self, dir: P)
+    where
+        P: AsRef<Path>,
+    {
+        self.response_cache_dir = Some(dir.as_ref().to_path_buf());
+    }
+
+    /// Returns the token cancelling the query currently run by the active runtime.
+    ///
+    /// The token is shared by all runtimes activated by this service, so that queries can be
+    /// cancelled while the service is busy streaming.
+    pub fn cancellation(&self) -> CancellationToken {
+        self.cancellation.clone()
+    }
+
+    /// Sets a variable available to the default system prompts of all runtimes, e.g. `app_name`.
+    ///
+    /// Takes effect with the next activation of a runtime.
+    pub fn set_prompt_variable<S, V>(&mut self, name: S, value: V)
+    where
+        S: Into<String>,
+        V: Into<Value>,
+    {
+        self.prompt_variables.insert(name.into(), value.into());
+    }
+
+    /// Sets the [`ConfigLoader`] resolving configs added with [`Self::add_config`].
+    pub fn set_config_loader(&mut self, loader: ConfigLoader) {
+        self.loader = loader;
+    }
+
+    /// Accounts the token usage of all generations of the runtimes of this service in `usage`.
+    ///
+    /// Takes effect with the next activation of a runtime.
+    pub fn set_usage_store(&mut self, usage: Arc<Mutex<UsageStore>>) {
+        self.usage = Some(usage);
+    }
+
+    /// Returns the [`Metrics`] shared by all runtimes of this service
+    pub fn metrics(&self) -> Arc<Metrics> {
+        self.metrics.clone()
+    }
+
     /// Returns a list of available model names
     pub fn list_models(&self) -> Vec<String> {
         self.configs
@@ -170,6 +350,80 @@ impl LLMService {
             .unwrap_or_default()
     }
 
+    /// Returns the special tokens of the model `id`, or of the active runtime if `id` is `None`.
+    pub fn special_tokens(&self, id: Option<&str>) -> Result<SpecialTokens, Error> {
+        let config = match id {
+            Some(id) => self
+                .configs
+                .as_ref()
+                .and_then(|configs| configs.get(id))
+                .ok_or_else(|| {
+                    Error::MissingConfigLLM(format!("No configuration found for model: {}", id))
+                })?,
+            None => self
+                .active
+                .as_ref()
+                .map(|runtime| runtime.config())
+                .ok_or_else(|| {
+                    self.record_error(&Error::MissingActiveRuntime);
+                    Error::MissingActiveRuntime
+                })?,
+        };
+
+        SpecialTokens::from_config(config)
+    }
+
+    /// Sends `query` to the active runtime and returns the complete output.
+    pub fn complete(&mut self, query: Query) -> Result<String, Error> {
+        self.active_runtime()?.complete(query)
+    }
+
+    /// Computes the log-likelihood of `continuation` following `context` with the active runtime.
+    pub fn score(&mut self, context: &str, continuation: &str) -> Result<Score, Error> {
+        self.active_runtime()?.score(context, continuation)
+    }
+
+    /// Classifies `messages` into one of `labels` with the active runtime.
+    ///
+    /// The prompt is templated once and every label is scored as the beginning of the answer.
+    pub fn classify(
+        &mut self,
+        messages: Vec<QueryMessage>,
+        labels: Vec<String>,
+    ) -> Result<Classification, Error> {
+        self.active_runtime()?.classify(messages, labels)
+    }
+
+    /// Reranks `documents` by their relevance to `query` with the active reranker runtime.
+    ///
+    /// Returns the indices and relevance scores of the `top_n` most relevant documents, or of all
+    /// documents if `None`.
+    pub fn rerank(
+        &mut self,
+        query: &str,
+        documents: Vec<String>,
+        top_n: Option<usize>,
+    ) -> Result<Vec<RerankResult>, Error> {
+        self.active_runtime()?.rerank(query, documents, top_n)
+    }
+
+    /// Embeds each of `texts` into a normalized vector with the active embedding runtime.
+    pub fn embed(&mut self, texts: Vec<String>) -> Result<Vec<Vec<f32>>, Error> {
+        self.active_runtime()?.embed(texts)
+    }
+
+    /// Sends a [`Query::Prompt`] to the active runtime and deserializes the output into `T`.
+    ///
+    /// Invalid output is retried [`DEFAULT_STRUCTURED_RETRIES`](structured::DEFAULT_STRUCTURED_RETRIES)
+    /// times. See [`LLMRuntime::complete_structured`].
+    pub fn complete_structured<T>(&mut self, query: Query) -> Result<T, Error>
+    where
+        T: DeserializeOwned + JsonSchema,
+    {
+        self.active_runtime()?
+            .complete_structured(query, structured::DEFAULT_STRUCTURED_RETRIES)
+    }
+
     /// Shuts down the currently active runtime if one exists
     fn shutdown_active(&mut self) {
         if let Some(runtime) = self.active.take() {
@@ -179,8 +433,24 @@ impl LLMService {
     }
 
     /// Add a [`LLMRuntimeConfig`] to the service at runtime.
+    ///
+    /// The config may extend any config of the service, see [`ConfigLoader`]. Configs the service
+    /// has been created from are extended as they were read, any other config as it is.
     pub fn add_config(&mut self, config: String) -> Result<(), Error> {
-        let c = LLMRuntimeConfig::from_raw(config)?;
+        let raw: Value = serde_json::from_str(&config)?;
+        let name = ConfigLoader::name_of(&raw)
+            .ok_or_else(|| Error::MissingConfigLLM("Configuration has no name".to_string()))?
+            .to_string();
+
+        let mut raw_configs = self.raw_configs.clone();
+        raw_configs.insert(name.clone(), raw);
+
+        let c = self.loader.resolve_with(
+            &name,
+            &raw_configs,
+            self.configs.as_ref().unwrap_or(&HashMap::new()),
+        )?;
+        self.raw_configs = raw_configs;
 
         match self.configs {
             Some(ref mut inner) => {
@@ -197,6 +467,25 @@ impl LLMService {
         Ok(())
     }
 
+    /// Starts the runtime of the embedding model configured by `id` for a semantic cache.
+    fn embedder(&self, id: &str) -> Result<LLMRuntime, Error> {
+        let config = self
+            .configs
+            .as_ref()
+            .and_then(|configs| configs.get(id))
+            .filter(|config| config.kind == Some(ModelKind::Embedding))
+            .ok_or_else(|| {
+                Error::MissingConfigLLM(format!("No embedding model configured for: {}", id))
+            })?
+            .clone();
+
+        let mut runtime = LLMRuntime::from_config(config)?;
+        runtime.set_metrics(self.metrics.clone());
+        runtime.run_stream()?;
+
+        Ok(runtime)
+    }
+
     /// Activates the target [`LLMRuntime`]
     ///
     /// Calling this function does a few things interally:
@@ -220,10 +509,40 @@ impl LLMService {
             })?
             .clone();
 
+        let mut config = config;
+        if let Some(prompt_cache) = config.prompt_cache.as_mut() {
+            if prompt_cache.cache_dir.is_none() {
+                prompt_cache.cache_dir = self.cache_dir.clone();
+            }
+        }
+        if let Some(response_cache) = config.response_cache.as_mut() {
+            if response_cache.cache_dir.is_none() {
+                response_cache.cache_dir = self.response_cache_dir.clone();
+            }
+        }
+
+        let semantic_cache = match config.semantic_cache.as_ref() {
+            Some(semantic_cache) => Some(SemanticCache::new(
+                &config.name,
+                semantic_cache,
+                self.embedder(&semantic_cache.model)?,
+            )),
+            None => None,
+        };
+
         tracing::debug!("Activating runtime for model: {}", id);
 
         // Create new runtime from config
         let mut runtime = LLMRuntime::from_config(config)?;
+        runtime.set_metrics(self.metrics.clone());
+        if let Some(usage) = self.usage.as_ref() {
+            runtime.set_usage_store(usage.clone());
+        }
+        runtime.set_prompt_variables(self.prompt_variables.clone());
+        runtime.set_cancellation(self.cancellation.clone());
+        if let Some(semantic_cache) = semantic_cache {
+            runtime.set_semantic_cache(semantic_cache);
+        }
 
         // Start the worker thread and load model weights
         runtime.run_stream()?;
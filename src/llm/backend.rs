@@ -3,17 +3,22 @@
 //! Each supported model family implements [`ModelBackend`] to encapsulate
 //! model-specific forward pass, KV cache management, and weight loading.
 
+pub mod cross_encoder;
+pub mod decoder;
 pub mod gemma;
 pub mod llama;
 pub mod qwen3;
+pub mod sentence_encoder;
 
+use std::any::Any;
 use std::path::PathBuf;
 
-use candle_core::{Device, Tensor};
+use candle_core::{DType, Device, Tensor};
 use candle_nn::VarBuilder;
 
 use crate::error::Error;
 use crate::loaders::IndexFile;
+use crate::ModelDType;
 
 use super::tool_call::ToolCallParser;
 
@@ -30,11 +35,103 @@ pub trait ModelBackend: Send + Sync {
     /// Returns logits for the last token, squeezed to [vocab_size].
     fn forward(&mut self, input: &Tensor, index: usize) -> Result<Tensor, Error>;
 
+    /// Run a forward pass returning the logits of every input position.
+    ///
+    /// `input` is the token tensor [1, seq_len]. Returns logits shaped [seq_len, vocab_size].
+    ///
+    /// candle's model implementations only project the last hidden state onto the vocabulary,
+    /// so the default implementation feeds `input` through the KV cache one token at a time.
+    /// Backends with access to the hidden states override this with a single forward pass.
+    fn forward_all(&mut self, input: &Tensor, index: usize) -> Result<Tensor, Error> {
+        let seq_len = input
+            .dim(1)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        let logits = (0..seq_len)
+            .map(|i| {
+                let token = input
+                    .narrow(1, i, 1)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+                self.forward(&token, index + i)
+            })
+            .collect::<Result<Vec<_>, Error>>()?;
+
+        Tensor::cat(&logits, 0).map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+
     /// Clear the KV cache for a fresh generation.
     fn clear_kv_cache(&mut self);
 
     /// Returns the tool call parser for this model, if tool calling is supported.
     fn tool_call_parser(&self) -> Option<&dyn ToolCallParser>;
+
+    /// Returns the data type the model weights and KV cache are loaded with.
+    fn dtype(&self) -> DType {
+        MODEL_DTYPE
+    }
+
+    /// Captures the current KV cache, e.g. after a forward pass over a shared prompt prefix.
+    ///
+    /// Returns `None`, if the backend cannot capture its KV cache.
+    fn snapshot_kv_cache(&self) -> Option<KvCacheSnapshot> {
+        None
+    }
+
+    /// Replaces the KV cache with a snapshot taken by [`Self::snapshot_kv_cache`].
+    fn restore_kv_cache(&mut self, _snapshot: &KvCacheSnapshot) -> Result<(), Error> {
+        Err(Error::ExecutionError(
+            "Backend does not support restoring the KV cache".to_string(),
+        ))
+    }
+}
+
+/// Data type used to load model weights, if none is configured.
+pub const MODEL_DTYPE: DType = DType::BF16;
+
+impl From<ModelDType> for DType {
+    fn from(dtype: ModelDType) -> Self {
+        match dtype {
+            ModelDType::F32 => DType::F32,
+            ModelDType::F16 => DType::F16,
+            ModelDType::BF16 => DType::BF16,
+        }
+    }
+}
+
+/// A copy of a backend's KV cache.
+pub enum KvCacheSnapshot {
+    /// `(key, value)` tensors per layer. These can be persisted to disk.
+    Tensors(Vec<(Tensor, Tensor)>),
+
+    /// Backend specific cache state, only valid for the running process.
+    Opaque(Box<dyn Any + Send + Sync>),
+}
+
+impl KvCacheSnapshot {
+    /// Returns `true`, if the snapshot can be persisted to disk.
+    pub fn is_persistable(&self) -> bool {
+        matches!(self, Self::Tensors(_))
+    }
+
+    /// Returns the snapshot of the first `len` tokens.
+    ///
+    /// Returns `None` for opaque snapshots and snapshots holding fewer tokens.
+    pub fn truncate(&self, len: usize) -> Option<Self> {
+        let Self::Tensors(kvs) = self else {
+            return None;
+        };
+
+        kvs.iter()
+            .map(|(k, v)| {
+                if k.dim(2).ok()? < len {
+                    return None;
+                }
+
+                Some((k.narrow(2, 0, len).ok()?, v.narrow(2, 0, len).ok()?))
+            })
+            .collect::<Option<Vec<_>>>()
+            .map(Self::Tensors)
+    }
 }
 
 /// Extracts the last token's logits from model output.
@@ -65,6 +162,7 @@ pub fn create_backend_by_model_index_file(
     model_index_file: &PathBuf,
     model_dir: &PathBuf,
     model_config_file: &PathBuf,
+    dtype: DType,
 ) -> Result<Box<dyn ModelBackend>, Error> {
     let mut index_file = IndexFile::from_path(model_index_file)?;
     let paths = index_file.files(model_dir);
@@ -72,7 +170,7 @@ pub fn create_backend_by_model_index_file(
     if model_name.contains("Qwen") {
         tracing::info!("Loading Qwen3 safetensors model");
         let vb = unsafe {
-            VarBuilder::from_mmaped_safetensors(&paths, candle_core::DType::BF16, device)
+            VarBuilder::from_mmaped_safetensors(&paths, dtype, device)
                 .map_err(|e| Error::ExecutionError(e.to_string()))?
         };
         return Ok(Box::new(qwen3::Qwen3Backend::from_safetensors(
@@ -82,18 +180,17 @@ pub fn create_backend_by_model_index_file(
     } else if model_name.contains("Llama") {
         tracing::info!("Loading Llama safetensors model");
         let vb = unsafe {
-            VarBuilder::from_mmaped_safetensors(&paths, candle_core::DType::BF16, device)
+            VarBuilder::from_mmaped_safetensors(&paths, dtype, device)
                 .map_err(|e| Error::ExecutionError(e.to_string()))?
         };
         return Ok(Box::new(llama::LlamaBackend::from_safetensors(
             vb,
             model_config_file,
-            device,
         )?));
     } else if model_name.contains("gemma") {
         tracing::info!("Loading Gemma safetensors model");
         let vb = unsafe {
-            VarBuilder::from_mmaped_safetensors(&paths, candle_core::DType::BF16, device)
+            VarBuilder::from_mmaped_safetensors(&paths, dtype, device)
                 .map_err(|e| Error::ExecutionError(e.to_string()))?
         };
         return Ok(Box::new(gemma::Gemma3Backend::from_safetensors(
@@ -115,6 +212,7 @@ pub fn create_backend_by_model_file(
     device: &Device,
     model_file: &PathBuf,
     model_config_file: &PathBuf,
+    dtype: DType,
 ) -> Result<Box<dyn ModelBackend>, Error> {
     // let mut index_file = IndexFile::from_path(model_index_file)?;
     // let paths = index_file.files(model_dir);
@@ -125,7 +223,7 @@ pub fn create_backend_by_model_file(
 
         // load from single safetensor file
         let vb = unsafe {
-            VarBuilder::from_mmaped_safetensors(&[model_file], candle_core::DType::BF16, device)
+            VarBuilder::from_mmaped_safetensors(&[model_file], dtype, device)
                 .map_err(|e| Error::ExecutionError(e.to_string()))?
         };
         return Ok(Box::new(gemma::Gemma3Backend::from_safetensors(
@@ -137,3 +235,106 @@ pub fn create_backend_by_model_file(
 
     Err(Error::UnsupportedModelType(model_name.to_string()))
 }
+
+#[cfg(test)]
+pub(crate) mod testing {
+    //! Small backends with random weights for unit tests.
+
+    use super::{llama::LlamaBackend, qwen3::Qwen3Backend, ModelBackend};
+    use candle_core::{DType, Device, Tensor};
+    use candle_nn::{VarBuilder, VarMap};
+    use candle_transformers::models::{llama, qwen3};
+    use serde_json::json;
+
+    pub(crate) fn qwen3_config() -> qwen3::Config {
+        serde_json::from_value(json!({
+            "vocab_size": 64,
+            "hidden_size": 32,
+            "intermediate_size": 64,
+            "num_hidden_layers": 2,
+            "num_attention_heads": 4,
+            "num_key_value_heads": 2,
+            "head_dim": 8,
+            "attention_bias": false,
+            "max_position_embeddings": 128,
+            "sliding_window": null,
+            "max_window_layers": 2,
+            "tie_word_embeddings": true,
+            "rope_theta": 10000.0,
+            "rms_norm_eps": 1e-6,
+            "use_sliding_window": false,
+            "hidden_act": "silu"
+        }))
+        .unwrap()
+    }
+
+    /// Returns a Llama 3.1 config, rope scaling applies beyond 32 positions.
+    pub(crate) fn llama_config() -> llama::Config {
+        let config: llama::LlamaConfig = serde_json::from_value(json!({
+            "vocab_size": 64,
+            "hidden_size": 32,
+            "intermediate_size": 64,
+            "num_hidden_layers": 2,
+            "num_attention_heads": 4,
+            "num_key_value_heads": 2,
+            "max_position_embeddings": 128,
+            "tie_word_embeddings": false,
+            "rope_theta": 10000.0,
+            "rms_norm_eps": 1e-6,
+            "bos_token_id": 1,
+            "eos_token_id": 2,
+            "rope_scaling": {
+                "factor": 8.0,
+                "low_freq_factor": 1.0,
+                "high_freq_factor": 4.0,
+                "original_max_position_embeddings": 32,
+                "rope_type": "llama3"
+            }
+        }))
+        .unwrap();
+
+        config.into_config(false)
+    }
+
+    /// Returns random weights, layers loaded from the same `varmap` share them.
+    pub(crate) fn weights(varmap: &VarMap) -> VarBuilder<'static> {
+        VarBuilder::from_varmap(varmap, DType::F32, &Device::Cpu)
+    }
+
+    pub(crate) fn qwen3() -> Qwen3Backend {
+        Qwen3Backend::new(&qwen3_config(), weights(&VarMap::new())).unwrap()
+    }
+
+    pub(crate) fn llama() -> LlamaBackend {
+        LlamaBackend::new(&llama_config(), weights(&VarMap::new())).unwrap()
+    }
+
+    /// Feeds `tokens` at position `index` and returns the logits of the last token.
+    pub(crate) fn forward(
+        backend: &mut dyn ModelBackend,
+        tokens: &[u32],
+        index: usize,
+    ) -> Vec<f32> {
+        let input = Tensor::new(tokens, &Device::Cpu)
+            .and_then(|t| t.unsqueeze(0))
+            .unwrap();
+
+        backend
+            .forward(&input, index)
+            .unwrap()
+            .squeeze(0)
+            .and_then(|logits| logits.to_vec1())
+            .unwrap()
+    }
+
+    pub(crate) fn assert_close(left: &[f32], right: &[f32]) {
+        assert_eq!(left.len(), right.len());
+
+        let diff = left
+            .iter()
+            .zip(right)
+            .map(|(l, r)| (l - r).abs())
+            .fold(0f32, f32::max);
+        assert!(diff < 1e-4, "logits differ by {diff}");
+    }
+}
@@ -0,0 +1,139 @@
+use std::fs::File;
+use std::path::PathBuf;
+
+use candle_core::{DType, Device, Tensor, D};
+use candle_nn::{Linear, Module, VarBuilder};
+use candle_transformers::models::bert::{self, BertModel};
+use candle_transformers::models::xlm_roberta::{self, XLMRobertaForSequenceClassification};
+
+use crate::error::Error;
+
+/// Data type used to load cross-encoder weights.
+///
+/// Encoder models are small, loading them in full precision keeps relevance scores comparable
+/// across devices.
+pub const CROSS_ENCODER_DTYPE: DType = DType::F32;
+
+/// Cross-encoder with a sequence classification head, scoring the relevance of a
+/// `(query, document)` pair.
+///
+/// The architecture is selected by the `model_type` of `config.json`.
+pub enum CrossEncoder {
+    /// `BertForSequenceClassification`, e.g. `cross-encoder/ms-marco-MiniLM-L-6-v2`
+    Bert {
+        model: BertModel,
+        pooler: Linear,
+        classifier: Linear,
+    },
+
+    /// `XLMRobertaForSequenceClassification`, e.g. `BAAI/bge-reranker-base`
+    XlmRoberta(XLMRobertaForSequenceClassification),
+}
+
+impl CrossEncoder {
+    /// Load cross-encoder weights from one or more safetensors files.
+    pub fn from_safetensors(
+        paths: &[PathBuf],
+        model_config_file: &PathBuf,
+        device: &Device,
+    ) -> Result<Self, Error> {
+        let mut config_file = File::open(model_config_file)?;
+        let config: serde_json::Value = serde_json::from_reader(&mut config_file)?;
+
+        // Cross-encoders usually declare a single label, the relevance logit
+        let num_labels = config
+            .get("id2label")
+            .and_then(|labels| labels.as_object())
+            .map(|labels| labels.len())
+            .unwrap_or(1);
+
+        let vb = unsafe {
+            VarBuilder::from_mmaped_safetensors(paths, CROSS_ENCODER_DTYPE, device)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?
+        };
+
+        match config.get("model_type").and_then(|t| t.as_str()) {
+            Some("bert") => {
+                tracing::info!("Loading BERT cross-encoder");
+
+                let hidden_size = config.get("hidden_size").and_then(|n| n.as_u64()).ok_or(
+                    Error::MissingConfigLLM(
+                        "Model config does not declare `hidden_size`".to_string(),
+                    ),
+                )? as usize;
+
+                let bert_config: bert::Config = serde_json::from_value(config)?;
+
+                let model = BertModel::load(vb.pp("bert"), &bert_config)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+                let pooler =
+                    candle_nn::linear(hidden_size, hidden_size, vb.pp("bert.pooler.dense"))
+                        .map_err(|e| Error::ExecutionError(e.to_string()))?;
+                let classifier = candle_nn::linear(hidden_size, num_labels, vb.pp("classifier"))
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+                Ok(Self::Bert {
+                    model,
+                    pooler,
+                    classifier,
+                })
+            }
+            Some("xlm-roberta") => {
+                tracing::info!("Loading XLM-RoBERTa cross-encoder");
+
+                let roberta_config: xlm_roberta::Config = serde_json::from_value(config)?;
+
+                XLMRobertaForSequenceClassification::new(num_labels, &roberta_config, vb)
+                    .map(Self::XlmRoberta)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))
+            }
+            other => Err(Error::UnsupportedModelType(format!(
+                "Cross-encoder model type {other:?}"
+            ))),
+        }
+    }
+
+    /// Returns the relevance of each encoded pair in `[0, 1]`.
+    ///
+    /// `input_ids`, `token_type_ids` and `attention_mask` are shaped [batch, seq_len].
+    pub fn relevance(
+        &self,
+        input_ids: &Tensor,
+        token_type_ids: &Tensor,
+        attention_mask: &Tensor,
+    ) -> Result<Vec<f32>, Error> {
+        let logits = match self {
+            Self::Bert {
+                model,
+                pooler,
+                classifier,
+            } => model
+                .forward(input_ids, token_type_ids, Some(attention_mask))
+                .and_then(|hidden| hidden.narrow(1, 0, 1))
+                .and_then(|cls| cls.squeeze(1))
+                .and_then(|cls| pooler.forward(&cls))
+                .and_then(|pooled| pooled.tanh())
+                .and_then(|pooled| classifier.forward(&pooled)),
+            Self::XlmRoberta(model) => model.forward(input_ids, attention_mask, token_type_ids),
+        }
+        .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        // A single logit is mapped with a sigmoid, otherwise the last label is the relevant one
+        let num_labels = logits
+            .dim(D::Minus1)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        let relevance = if num_labels == 1 {
+            candle_nn::ops::sigmoid(&logits).and_then(|p| p.squeeze(D::Minus1))
+        } else {
+            candle_nn::ops::softmax_last_dim(&logits)
+                .and_then(|p| p.narrow(D::Minus1, num_labels - 1, 1))
+                .and_then(|p| p.squeeze(D::Minus1))
+        };
+
+        relevance
+            .and_then(|p| p.to_dtype(DType::F32))
+            .and_then(|p| p.to_vec1::<f32>())
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+}
@@ -0,0 +1,525 @@
+//! Decoder-only transformer shared by the Llama and Qwen3 backends.
+//!
+//! candle's model implementations keep their KV cache private. This decoder holds the
+//! `(key, value)` tensors of each layer itself, so that the KV cache can be captured, persisted
+//! and restored, and masks multi-token inputs at any position of the KV cache.
+
+use candle_core::{DType, Device, Module, Result, Tensor};
+use candle_nn::{
+    embedding, linear_b, linear_no_bias, rms_norm, Activation, Embedding, Linear, RmsNorm,
+    VarBuilder,
+};
+use candle_transformers::utils::repeat_kv;
+
+/// Hyperparameters of a [`Decoder`].
+#[derive(Debug, Clone)]
+pub struct DecoderConfig {
+    pub vocab_size: usize,
+    pub hidden_size: usize,
+    pub intermediate_size: usize,
+    pub num_hidden_layers: usize,
+    pub num_attention_heads: usize,
+    pub num_key_value_heads: usize,
+    pub head_dim: usize,
+    pub max_position_embeddings: usize,
+    pub rms_norm_eps: f64,
+    pub hidden_act: Activation,
+    pub tie_word_embeddings: bool,
+
+    /// Adds a bias to the query, key, value and output projections
+    pub attention_bias: bool,
+
+    /// Normalizes queries and keys of each head before the rotary embedding, as Qwen3 does
+    pub qk_norm: bool,
+
+    /// Computes the attention in f32 regardless of the weight dtype, as candle's Llama does
+    pub attention_f32: bool,
+
+    /// Computes the attention with flash-attn, requires the `flash-attn` feature
+    pub use_flash_attn: bool,
+
+    /// Inverse frequencies of the rotary embedding, `head_dim / 2` values
+    pub inv_freq: Vec<f32>,
+}
+
+impl DecoderConfig {
+    /// Returns the inverse frequencies of an unscaled rotary embedding.
+    pub fn default_inv_freq(head_dim: usize, theta: f32) -> Vec<f32> {
+        (0..head_dim)
+            .step_by(2)
+            .map(|i| 1f32 / theta.powf(i as f32 / head_dim as f32))
+            .collect()
+    }
+}
+
+/// Precomputed cosine and sine tables of the rotary embedding.
+struct RotaryEmbedding {
+    cos: Tensor,
+    sin: Tensor,
+}
+
+impl RotaryEmbedding {
+    fn new(inv_freq: &[f32], max_position: usize, dtype: DType, device: &Device) -> Result<Self> {
+        let inv_freq = Tensor::new(inv_freq, device)?.reshape((1, inv_freq.len()))?;
+        let positions = Tensor::arange(0u32, max_position as u32, device)?
+            .to_dtype(DType::F32)?
+            .reshape((max_position, 1))?;
+        let freqs = positions.matmul(&inv_freq)?;
+
+        Ok(Self {
+            cos: freqs.cos()?.to_dtype(dtype)?,
+            sin: freqs.sin()?.to_dtype(dtype)?,
+        })
+    }
+
+    /// Rotates `x` [batch, heads, seq_len, head_dim] starting at position `offset`.
+    fn apply(&self, x: &Tensor, offset: usize) -> Result<Tensor> {
+        let (_, _, seq_len, _) = x.dims4()?;
+        let cos = self.cos.narrow(0, offset, seq_len)?;
+        let sin = self.sin.narrow(0, offset, seq_len)?;
+
+        candle_nn::rotary_emb::rope(&x.contiguous()?, &cos, &sin)
+    }
+}
+
+struct Attention {
+    q_proj: Linear,
+    k_proj: Linear,
+    v_proj: Linear,
+    o_proj: Linear,
+    q_norm: Option<RmsNorm>,
+    k_norm: Option<RmsNorm>,
+    num_heads: usize,
+    num_kv_heads: usize,
+    head_dim: usize,
+    attention_f32: bool,
+    use_flash_attn: bool,
+}
+
+impl Attention {
+    fn new(config: &DecoderConfig, vb: VarBuilder) -> Result<Self> {
+        let DecoderConfig {
+            hidden_size,
+            num_attention_heads: num_heads,
+            num_key_value_heads: num_kv_heads,
+            head_dim,
+            attention_bias: bias,
+            ..
+        } = *config;
+
+        let (q_norm, k_norm) = if config.qk_norm {
+            (
+                Some(rms_norm(head_dim, config.rms_norm_eps, vb.pp("q_norm"))?),
+                Some(rms_norm(head_dim, config.rms_norm_eps, vb.pp("k_norm"))?),
+            )
+        } else {
+            (None, None)
+        };
+
+        Ok(Self {
+            q_proj: linear_b(hidden_size, num_heads * head_dim, bias, vb.pp("q_proj"))?,
+            k_proj: linear_b(hidden_size, num_kv_heads * head_dim, bias, vb.pp("k_proj"))?,
+            v_proj: linear_b(hidden_size, num_kv_heads * head_dim, bias, vb.pp("v_proj"))?,
+            o_proj: linear_b(num_heads * head_dim, hidden_size, bias, vb.pp("o_proj"))?,
+            q_norm,
+            k_norm,
+            num_heads,
+            num_kv_heads,
+            head_dim,
+            attention_f32: config.attention_f32,
+            use_flash_attn: config.use_flash_attn,
+        })
+    }
+
+    /// Splits the projection `x` [batch, seq_len, heads * head_dim] into heads
+    /// [batch, heads, seq_len, head_dim], normalizing each head with `norm`.
+    fn heads(&self, x: Tensor, heads: usize, norm: Option<&RmsNorm>) -> Result<Tensor> {
+        let (batch, seq_len, _) = x.dims3()?;
+        let x = x
+            .reshape((batch, seq_len, heads, self.head_dim))?
+            .transpose(1, 2)?
+            .contiguous()?;
+
+        match norm {
+            Some(norm) => {
+                norm.forward(&x.flatten(0, 2)?)?
+                    .reshape((batch, heads, seq_len, self.head_dim))
+            }
+            None => Ok(x),
+        }
+    }
+
+    fn forward(
+        &self,
+        xs: &Tensor,
+        rotary: &RotaryEmbedding,
+        mask: Option<&Tensor>,
+        offset: usize,
+        kv_cache: &mut Option<(Tensor, Tensor)>,
+    ) -> Result<Tensor> {
+        let (batch, seq_len, _) = xs.dims3()?;
+
+        let q = self.heads(
+            xs.apply(&self.q_proj)?,
+            self.num_heads,
+            self.q_norm.as_ref(),
+        )?;
+        let k = self.heads(
+            xs.apply(&self.k_proj)?,
+            self.num_kv_heads,
+            self.k_norm.as_ref(),
+        )?;
+        let v = self.heads(xs.apply(&self.v_proj)?, self.num_kv_heads, None)?;
+
+        let q = rotary.apply(&q, offset)?;
+        let k = rotary.apply(&k, offset)?;
+
+        let (k, v) = match kv_cache.as_ref() {
+            Some((cached_k, cached_v)) => (
+                Tensor::cat(&[cached_k, &k], 2)?.contiguous()?,
+                Tensor::cat(&[cached_v, &v], 2)?.contiguous()?,
+            ),
+            None => (k, v),
+        };
+        *kv_cache = Some((k.clone(), v.clone()));
+
+        let n_rep = self.num_heads / self.num_kv_heads;
+        let k = repeat_kv(k, n_rep)?.contiguous()?;
+        let v = repeat_kv(v, n_rep)?.contiguous()?;
+
+        let output = if self.use_flash_attn {
+            flash_attention(&q, &k, &v, self.head_dim, seq_len > 1)?
+        } else {
+            self.attention(&q, &k, &v, mask)?
+        };
+
+        output
+            .transpose(1, 2)?
+            .reshape((batch, seq_len, self.num_heads * self.head_dim))?
+            .apply(&self.o_proj)
+    }
+
+    /// Computes the scaled dot-product attention of `q`, `k` and `v`
+    /// [batch, heads, seq_len, head_dim].
+    fn attention(
+        &self,
+        q: &Tensor,
+        k: &Tensor,
+        v: &Tensor,
+        mask: Option<&Tensor>,
+    ) -> Result<Tensor> {
+        let dtype = q.dtype();
+        let (q, k, v) = if self.attention_f32 {
+            (
+                q.to_dtype(DType::F32)?,
+                k.to_dtype(DType::F32)?,
+                v.to_dtype(DType::F32)?,
+            )
+        } else {
+            (q.clone(), k.clone(), v.clone())
+        };
+
+        let scores = (q.matmul(&k.t()?)? * (1.0 / (self.head_dim as f64).sqrt()))?;
+        let scores = match mask {
+            Some(mask) => scores.broadcast_add(&mask.to_dtype(scores.dtype())?)?,
+            None => scores,
+        };
+        let weights = candle_nn::ops::softmax_last_dim(&scores)?;
+
+        weights.matmul(&v)?.to_dtype(dtype)
+    }
+}
+
+/// Computes the attention of `q`, `k` and `v` [batch, heads, seq_len, head_dim] with flash-attn.
+///
+/// The causal mask is aligned to the end of the keys, so that queries following cached tokens
+/// attend to all of them.
+#[cfg(feature = "flash-attn")]
+fn flash_attention(
+    q: &Tensor,
+    k: &Tensor,
+    v: &Tensor,
+    head_dim: usize,
+    causal: bool,
+) -> Result<Tensor> {
+    let scale = 1f32 / (head_dim as f32).sqrt();
+
+    candle_flash_attn::flash_attn(
+        &q.transpose(1, 2)?,
+        &k.transpose(1, 2)?,
+        &v.transpose(1, 2)?,
+        scale,
+        causal,
+    )?
+    .transpose(1, 2)
+}
+
+#[cfg(not(feature = "flash-attn"))]
+fn flash_attention(_: &Tensor, _: &Tensor, _: &Tensor, _: usize, _: bool) -> Result<Tensor> {
+    unimplemented!("compile with the flash-attn feature to use flash attention")
+}
+
+struct Mlp {
+    gate_proj: Linear,
+    up_proj: Linear,
+    down_proj: Linear,
+    act: Activation,
+}
+
+impl Mlp {
+    fn new(config: &DecoderConfig, vb: VarBuilder) -> Result<Self> {
+        let (hidden, intermediate) = (config.hidden_size, config.intermediate_size);
+
+        Ok(Self {
+            gate_proj: linear_no_bias(hidden, intermediate, vb.pp("gate_proj"))?,
+            up_proj: linear_no_bias(hidden, intermediate, vb.pp("up_proj"))?,
+            down_proj: linear_no_bias(intermediate, hidden, vb.pp("down_proj"))?,
+            act: config.hidden_act,
+        })
+    }
+}
+
+impl Module for Mlp {
+    fn forward(&self, xs: &Tensor) -> Result<Tensor> {
+        let gate = xs.apply(&self.gate_proj)?.apply(&self.act)?;
+        let up = xs.apply(&self.up_proj)?;
+
+        (gate * up)?.apply(&self.down_proj)
+    }
+}
+
+struct DecoderLayer {
+    self_attn: Attention,
+    mlp: Mlp,
+    input_layernorm: RmsNorm,
+    post_attention_layernorm: RmsNorm,
+}
+
+impl DecoderLayer {
+    fn new(config: &DecoderConfig, vb: VarBuilder) -> Result<Self> {
+        let (hidden, eps) = (config.hidden_size, config.rms_norm_eps);
+
+        Ok(Self {
+            self_attn: Attention::new(config, vb.pp("self_attn"))?,
+            mlp: Mlp::new(config, vb.pp("mlp"))?,
+            input_layernorm: rms_norm(hidden, eps, vb.pp("input_layernorm"))?,
+            post_attention_layernorm: rms_norm(hidden, eps, vb.pp("post_attention_layernorm"))?,
+        })
+    }
+
+    fn forward(
+        &self,
+        xs: &Tensor,
+        rotary: &RotaryEmbedding,
+        mask: Option<&Tensor>,
+        offset: usize,
+        kv_cache: &mut Option<(Tensor, Tensor)>,
+    ) -> Result<Tensor> {
+        let hidden = xs.apply(&self.input_layernorm)?;
+        let hidden = (self
+            .self_attn
+            .forward(&hidden, rotary, mask, offset, kv_cache)?
+            + xs)?;
+
+        let output = hidden
+            .apply(&self.post_attention_layernorm)?
+            .apply(&self.mlp)?;
+
+        output + hidden
+    }
+}
+
+/// A decoder-only transformer with a language model head and a KV cache of plain tensors.
+pub struct Decoder {
+    embed_tokens: Embedding,
+    layers: Vec<DecoderLayer>,
+    norm: RmsNorm,
+    lm_head: Linear,
+    rotary: RotaryEmbedding,
+    device: Device,
+
+    /// `(key, value)` tensors [batch, kv_heads, seq_len, head_dim] of each layer
+    kv_cache: Vec<Option<(Tensor, Tensor)>>,
+}
+
+impl Decoder {
+    /// Loads the weights of a Llama style checkpoint from `vb`.
+    pub fn new(config: &DecoderConfig, vb: VarBuilder) -> Result<Self> {
+        let vb_model = vb.pp("model");
+
+        let embed_tokens = embedding(
+            config.vocab_size,
+            config.hidden_size,
+            vb_model.pp("embed_tokens"),
+        )?;
+
+        let layers = (0..config.num_hidden_layers)
+            .map(|i| DecoderLayer::new(config, vb_model.pp(format!("layers.{i}"))))
+            .collect::<Result<Vec<_>>>()?;
+
+        let norm = rms_norm(config.hidden_size, config.rms_norm_eps, vb_model.pp("norm"))?;
+
+        let lm_head = if config.tie_word_embeddings {
+            Linear::new(embed_tokens.embeddings().clone(), None)
+        } else {
+            linear_no_bias(config.hidden_size, config.vocab_size, vb.pp("lm_head"))?
+        };
+
+        let rotary = RotaryEmbedding::new(
+            &config.inv_freq,
+            config.max_position_embeddings,
+            vb.dtype(),
+            vb.device(),
+        )?;
+
+        Ok(Self {
+            embed_tokens,
+            kv_cache: vec![None; layers.len()],
+            layers,
+            norm,
+            lm_head,
+            rotary,
+            device: vb.device().clone(),
+        })
+    }
+
+    /// Feeds `input` [batch, seq_len] through the decoder, starting at position `offset` of the
+    /// KV cache. Returns the normalized hidden states [batch, seq_len, hidden_size].
+    pub fn forward(&mut self, input: &Tensor, offset: usize) -> Result<Tensor> {
+        let (_, seq_len) = input.dims2()?;
+
+        let mask = if seq_len > 1 {
+            Some(causal_mask(seq_len, offset, &self.device)?)
+        } else {
+            None
+        };
+
+        let mut xs = input.apply(&self.embed_tokens)?;
+        for (layer, kv_cache) in self.layers.iter().zip(self.kv_cache.iter_mut()) {
+            xs = layer.forward(&xs, &self.rotary, mask.as_ref(), offset, kv_cache)?;
+        }
+
+        xs.apply(&self.norm)
+    }
+
+    /// Projects `hidden` states onto the vocabulary.
+    pub fn logits(&self, hidden: &Tensor) -> Result<Tensor> {
+        hidden.apply(&self.lm_head)
+    }
+
+    pub fn clear_kv_cache(&mut self) {
+        self.kv_cache.iter_mut().for_each(|kv| *kv = None);
+    }
+
+    /// Returns the `(key, value)` tensors of each layer, or `None` if the KV cache is empty.
+    pub fn kv_cache(&self) -> Option<Vec<(Tensor, Tensor)>> {
+        self.kv_cache.iter().cloned().collect()
+    }
+
+    /// Replaces the KV cache with the `(key, value)` tensors of each layer.
+    pub fn set_kv_cache(&mut self, kvs: &[(Tensor, Tensor)]) -> Result<()> {
+        if kvs.len() != self.layers.len() {
+            return Err(candle_core::Error::Msg(format!(
+                "KV cache of {} layers does not fit a model of {} layers",
+                kvs.len(),
+                self.layers.len()
+            )));
+        }
+
+        // Tensors loaded from disk reside on the CPU
+        self.kv_cache = kvs
+            .iter()
+            .map(|(k, v)| {
+                Ok(Some((
+                    k.to_device(&self.device)?,
+                    v.to_device(&self.device)?,
+                )))
+            })
+            .collect::<Result<_>>()?;
+
+        Ok(())
+    }
+}
+
+/// Returns the additive causal mask [seq_len, offset + seq_len] of `seq_len` tokens following
+/// `offset` cached tokens.
+fn causal_mask(seq_len: usize, offset: usize, device: &Device) -> Result<Tensor> {
+    let mask: Vec<f32> = (0..seq_len)
+        .flat_map(|i| {
+            (0..offset + seq_len).map(move |j| {
+                if j > offset + i {
+                    f32::NEG_INFINITY
+                } else {
+                    0.
+                }
+            })
+        })
+        .collect();
+
+    Tensor::from_vec(mask, (seq_len, offset + seq_len), device)
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::llm::backend::llama::LlamaBackend;
+    use crate::llm::backend::qwen3::Qwen3Backend;
+    use crate::llm::backend::testing::{self, assert_close, forward};
+    use candle_core::{DType, Device, Tensor};
+    use candle_nn::VarMap;
+    use candle_transformers::models::{llama, qwen3};
+
+    /// Prefilled at once, followed by tokens fed one by one
+    const PROMPT: [u32; 7] = [1, 5, 9, 13, 17, 21, 25];
+    const NEXT: [u32; 3] = [29, 33, 37];
+
+    /// Returns the prompt and the next tokens with their positions.
+    fn steps() -> impl Iterator<Item = (&'static [u32], usize)> {
+        std::iter::once((&PROMPT[..], 0)).chain(
+            NEXT.chunks(1)
+                .enumerate()
+                .map(|(i, token)| (token, PROMPT.len() + i)),
+        )
+    }
+
+    fn input(tokens: &[u32]) -> Tensor {
+        Tensor::new(tokens, &Device::Cpu)
+            .and_then(|t| t.unsqueeze(0))
+            .unwrap()
+    }
+
+    fn to_vec(logits: Tensor) -> Vec<f32> {
+        logits.flatten_all().and_then(|l| l.to_vec1()).unwrap()
+    }
+
+    #[test]
+    fn test_qwen3_logits_match_candle() {
+        let config = testing::qwen3_config();
+        let varmap = VarMap::new();
+        let mut backend = Qwen3Backend::new(&config, testing::weights(&varmap)).unwrap();
+        let mut reference =
+            qwen3::ModelForCausalLM::new(&config, testing::weights(&varmap)).unwrap();
+
+        for (tokens, index) in steps() {
+            let expected = to_vec(reference.forward(&input(tokens), index).unwrap());
+            assert_close(&forward(&mut backend, tokens, index), &expected);
+        }
+    }
+
+    #[test]
+    fn test_llama_logits_match_candle() {
+        let config = testing::llama_config();
+        let varmap = VarMap::new();
+        let mut backend = LlamaBackend::new(&config, testing::weights(&varmap)).unwrap();
+        let reference = llama::Llama::load(testing::weights(&varmap), &config).unwrap();
+        let mut cache = llama::Cache::new(true, DType::F32, &config, &Device::Cpu).unwrap();
+
+        for (tokens, index) in steps() {
+            let expected = to_vec(
+                reference
+                    .forward(&input(tokens), index, &mut cache)
+                    .unwrap(),
+            );
+            assert_close(&forward(&mut backend, tokens, index), &expected);
+        }
+    }
+}
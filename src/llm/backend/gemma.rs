@@ -1,7 +1,7 @@
 use crate::error::Error;
 use crate::llm::backend::{extract_last_token_logits, ModelBackend};
 use crate::llm::tool_call::{GemmaToolCallParser, ToolCallParser};
-use candle_core::Tensor;
+use candle_core::{DType, Tensor};
 use candle_nn::VarBuilder;
 use candle_transformers::models::gemma3::{self as gemma3_model, Config as Gemma3Config};
 use serde_json::Value;
@@ -10,6 +10,7 @@ use std::path::PathBuf;
 
 pub struct Gemma3Backend {
     model: gemma3_model::Model,
+    dtype: DType,
     tool_call_parser: GemmaToolCallParser,
 }
 
@@ -32,11 +33,13 @@ impl Gemma3Backend {
             }
         };
 
+        let dtype = vb.dtype();
         let model = gemma3_model::Model::new(use_flash, &gemma3_config, vb)
             .map_err(|e| Error::ExecutionError(e.to_string()))?;
 
         Ok(Self {
             model,
+            dtype,
             tool_call_parser: GemmaToolCallParser,
         })
     }
@@ -58,4 +61,8 @@ impl ModelBackend for Gemma3Backend {
     fn tool_call_parser(&self) -> Option<&dyn ToolCallParser> {
         Some(&self.tool_call_parser)
     }
+
+    fn dtype(&self) -> DType {
+        self.dtype
+    }
 }
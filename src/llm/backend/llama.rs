@@ -1,64 +1,153 @@
+use std::f32::consts::PI;
 use std::fs::File;
 use std::path::PathBuf;
 
-use candle_core::{Device, Tensor};
-use candle_nn::VarBuilder;
-use candle_transformers::models::llama::{self as llama_model, Llama, LlamaConfig};
+use candle_core::{DType, Tensor};
+use candle_nn::{Activation, VarBuilder};
+use candle_transformers::models::llama::{self as llama_model, Llama3RopeType, LlamaConfig};
 
 use crate::error::Error;
 use crate::llm::tool_call::{LlamaToolCallParser, ToolCallParser};
 
-use super::{extract_last_token_logits, ModelBackend};
+use super::decoder::{Decoder, DecoderConfig};
+use super::{extract_last_token_logits, KvCacheSnapshot, ModelBackend};
 
 pub struct LlamaBackend {
-    model: Llama,
-    cache: llama_model::Cache,
-    config: llama_model::Config,
-    device: Device,
+    decoder: Decoder,
+    dtype: DType,
     tool_call_parser: LlamaToolCallParser,
 }
 
 impl LlamaBackend {
     /// Load Llama weights from sharded safetensors files.
-    pub fn from_safetensors(
-        vb: VarBuilder,
-        model_config_file: &PathBuf,
-        device: &Device,
-    ) -> Result<Self, Error> {
+    pub fn from_safetensors(vb: VarBuilder, model_config_file: &PathBuf) -> Result<Self, Error> {
         let mut config_file = File::open(model_config_file)?;
         let llama_config: LlamaConfig = serde_json::from_reader(&mut config_file)?;
-        let config = llama_config.into_config(false);
 
-        let model = Llama::load(vb, &config).map_err(|e| Error::ExecutionError(e.to_string()))?;
-        let cache = llama_model::Cache::new(true, candle_core::DType::BF16, &config, device)
+        Self::new(&llama_config.into_config(cfg!(feature = "flash-attn")), vb)
+    }
+
+    pub fn new(config: &llama_model::Config, vb: VarBuilder) -> Result<Self, Error> {
+        let dtype = vb.dtype();
+        let decoder = Decoder::new(&decoder_config(config), vb)
             .map_err(|e| Error::ExecutionError(e.to_string()))?;
 
         Ok(Self {
-            model,
-            cache,
-            config,
-            device: device.clone(),
+            decoder,
+            dtype,
             tool_call_parser: LlamaToolCallParser,
         })
     }
 }
 
+/// Maps the Llama config onto the shared decoder.
+fn decoder_config(config: &llama_model::Config) -> DecoderConfig {
+    let head_dim = config.hidden_size / config.num_attention_heads;
+
+    DecoderConfig {
+        vocab_size: config.vocab_size,
+        hidden_size: config.hidden_size,
+        intermediate_size: config.intermediate_size,
+        num_hidden_layers: config.num_hidden_layers,
+        num_attention_heads: config.num_attention_heads,
+        num_key_value_heads: config.num_key_value_heads,
+        head_dim,
+        max_position_embeddings: config.max_position_embeddings,
+        rms_norm_eps: config.rms_norm_eps,
+        hidden_act: Activation::Silu,
+        tie_word_embeddings: config.tie_word_embeddings,
+        attention_bias: false,
+        qk_norm: false,
+        attention_f32: true,
+        use_flash_attn: config.use_flash_attn,
+        inv_freq: inv_freq(config, head_dim),
+    }
+}
+
+/// Returns the inverse frequencies of the rotary embedding, scaled for long contexts as
+/// Llama 3.1 does.
+fn inv_freq(config: &llama_model::Config, head_dim: usize) -> Vec<f32> {
+    let inv_freq = DecoderConfig::default_inv_freq(head_dim, config.rope_theta);
+
+    let Some(scaling) = config
+        .rope_scaling
+        .as_ref()
+        .filter(|scaling| matches!(scaling.rope_type, Llama3RopeType::Llama3))
+    else {
+        return inv_freq;
+    };
+
+    let original = scaling.original_max_position_embeddings as f32;
+    let low_freq_wavelen = original / scaling.low_freq_factor;
+    let high_freq_wavelen = original / scaling.high_freq_factor;
+
+    inv_freq
+        .into_iter()
+        .map(|freq| {
+            let wavelen = 2. * PI / freq;
+
+            if wavelen < high_freq_wavelen {
+                freq
+            } else if wavelen > low_freq_wavelen {
+                freq / scaling.factor
+            } else {
+                let smooth = (original / wavelen - scaling.low_freq_factor)
+                    / (scaling.high_freq_factor - scaling.low_freq_factor);
+                (1. - smooth) * freq / scaling.factor + smooth * freq
+            }
+        })
+        .collect()
+}
+
 impl ModelBackend for LlamaBackend {
     fn forward(&mut self, input: &Tensor, index: usize) -> Result<Tensor, Error> {
-        let logits = self
-            .model
-            .forward(input, index, &mut self.cache)
+        let hidden = self
+            .decoder
+            .forward(input, index)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        let seq_len = hidden
+            .dim(1)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        let logits = hidden
+            .narrow(1, seq_len - 1, 1)
+            .and_then(|h| self.decoder.logits(&h))
             .map_err(|e| Error::ExecutionError(e.to_string()))?;
         extract_last_token_logits(logits)
     }
 
+    fn forward_all(&mut self, input: &Tensor, index: usize) -> Result<Tensor, Error> {
+        self.decoder
+            .forward(input, index)
+            .and_then(|hidden| self.decoder.logits(&hidden))
+            .and_then(|logits| logits.squeeze(0))
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+
     fn clear_kv_cache(&mut self) {
-        self.cache =
-            llama_model::Cache::new(true, candle_core::DType::BF16, &self.config, &self.device)
-                .expect("Failed to recreate cache");
+        self.decoder.clear_kv_cache();
     }
 
     fn tool_call_parser(&self) -> Option<&dyn ToolCallParser> {
         Some(&self.tool_call_parser)
     }
+
+    fn dtype(&self) -> DType {
+        self.dtype
+    }
+
+    fn snapshot_kv_cache(&self) -> Option<KvCacheSnapshot> {
+        self.decoder.kv_cache().map(KvCacheSnapshot::Tensors)
+    }
+
+    fn restore_kv_cache(&mut self, snapshot: &KvCacheSnapshot) -> Result<(), Error> {
+        let KvCacheSnapshot::Tensors(kvs) = snapshot else {
+            return Err(Error::ExecutionError(
+                "KV cache snapshot does not belong to a Llama model".to_string(),
+            ));
+        };
+
+        self.decoder
+            .set_kv_cache(kvs)
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+    }
 }
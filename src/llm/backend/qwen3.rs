@@ -1,17 +1,23 @@
 use std::fs::File;
 use std::path::PathBuf;
 
-use candle_core::Tensor;
+use candle_core::{DType, Tensor};
 use candle_nn::VarBuilder;
-use candle_transformers::models::qwen3::{self as qwen3_model, Config as Qwen3Config};
+use candle_transformers::models::qwen3::Config as Qwen3Config;
 
 use crate::error::Error;
 use crate::llm::tool_call::{Qwen3ToolCallParser, ToolCallParser};
 
-use super::{extract_last_token_logits, ModelBackend};
+use super::decoder::{Decoder, DecoderConfig};
+use super::{extract_last_token_logits, KvCacheSnapshot, ModelBackend};
 
+/// Qwen3 decoder and language model head.
+///
+/// The decoder returns the hidden states of every position, so that
+/// [`ModelBackend::forward_all`] can project every position in a single forward pass.
 pub struct Qwen3Backend {
-    model: qwen3_model::ModelForCausalLM,
+    decoder: Decoder,
+    dtype: DType,
     tool_call_parser: Qwen3ToolCallParser,
 }
 
@@ -21,30 +27,93 @@ impl Qwen3Backend {
         let mut config_file = File::open(model_config_file)?;
         let qwen3_config: Qwen3Config = serde_json::from_reader(&mut config_file)?;
 
-        let model = qwen3_model::ModelForCausalLM::new(&qwen3_config, vb)
+        Self::new(&qwen3_config, vb)
+    }
+
+    pub fn new(config: &Qwen3Config, vb: VarBuilder) -> Result<Self, Error> {
+        let dtype = vb.dtype();
+        let decoder = Decoder::new(&decoder_config(config), vb)
             .map_err(|e| Error::ExecutionError(e.to_string()))?;
 
         Ok(Self {
-            model,
+            decoder,
+            dtype,
             tool_call_parser: Qwen3ToolCallParser,
         })
     }
 }
 
+/// Maps the Qwen3 config onto the shared decoder.
+fn decoder_config(config: &Qwen3Config) -> DecoderConfig {
+    DecoderConfig {
+        vocab_size: config.vocab_size,
+        hidden_size: config.hidden_size,
+        intermediate_size: config.intermediate_size,
+        num_hidden_layers: config.num_hidden_layers,
+        num_attention_heads: config.num_attention_heads,
+        num_key_value_heads: config.num_key_value_heads,
+        head_dim: config.head_dim,
+        max_position_embeddings: config.max_position_embeddings,
+        rms_norm_eps: config.rms_norm_eps,
+        hidden_act: config.hidden_act,
+        tie_word_embeddings: config.tie_word_embeddings,
+        attention_bias: config.attention_bias,
+        qk_norm: true,
+        attention_f32: false,
+        use_flash_attn: cfg!(feature = "flash-attn"),
+        inv_freq: DecoderConfig::default_inv_freq(config.head_dim, config.rope_theta as f32),
+    }
+}
+
 impl ModelBackend for Qwen3Backend {
     fn forward(&mut self, input: &Tensor, index: usize) -> Result<Tensor, Error> {
-        let logits = self
-            .model
+        let hidden = self
+            .decoder
             .forward(input, index)
             .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        let seq_len = hidden
+            .dim(1)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        let logits = hidden
+            .narrow(1, seq_len - 1, 1)
+            .and_then(|h| self.decoder.logits(&h))
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
         extract_last_token_logits(logits)
     }
 
+    fn forward_all(&mut self, input: &Tensor, index: usize) -> Result<Tensor, Error> {
+        self.decoder
+            .forward(input, index)
+            .and_then(|hidden| self.decoder.logits(&hidden))
+            .and_then(|logits| logits.squeeze(0))
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+
     fn clear_kv_cache(&mut self) {
-        self.model.clear_kv_cache();
+        self.decoder.clear_kv_cache();
     }
 
     fn tool_call_parser(&self) -> Option<&dyn ToolCallParser> {
         Some(&self.tool_call_parser)
     }
+
+    fn dtype(&self) -> DType {
+        self.dtype
+    }
+
+    fn snapshot_kv_cache(&self) -> Option<KvCacheSnapshot> {
+        self.decoder.kv_cache().map(KvCacheSnapshot::Tensors)
+    }
+
+    fn restore_kv_cache(&mut self, snapshot: &KvCacheSnapshot) -> Result<(), Error> {
+        let KvCacheSnapshot::Tensors(kvs) = snapshot else {
+            return Err(Error::ExecutionError(
+                "KV cache snapshot does not belong to a Qwen3 model".to_string(),
+            ));
+        };
+
+        self.decoder
+            .set_kv_cache(kvs)
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+    }
 }
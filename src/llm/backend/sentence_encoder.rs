@@ -0,0 +1,89 @@
+use std::fs::File;
+use std::path::PathBuf;
+
+use candle_core::{DType, Device, Tensor, D};
+use candle_nn::VarBuilder;
+use candle_transformers::models::bert::{self, BertModel};
+
+use crate::error::Error;
+
+/// Data type used to load sentence encoder weights.
+///
+/// Encoder models are small, loading them in full precision keeps embeddings comparable across
+/// devices.
+pub const SENTENCE_ENCODER_DTYPE: DType = DType::F32;
+
+/// BERT bi-encoder embedding a text into a single vector by mean pooling its token embeddings,
+/// e.g. `sentence-transformers/all-MiniLM-L6-v2`.
+pub struct SentenceEncoder {
+    model: BertModel,
+}
+
+impl SentenceEncoder {
+    /// Load sentence encoder weights from one or more safetensors files.
+    pub fn from_safetensors(
+        paths: &[PathBuf],
+        model_config_file: &PathBuf,
+        device: &Device,
+    ) -> Result<Self, Error> {
+        let mut config_file = File::open(model_config_file)?;
+        let config: serde_json::Value = serde_json::from_reader(&mut config_file)?;
+
+        match config.get("model_type").and_then(|t| t.as_str()) {
+            Some("bert") => {}
+            other => {
+                return Err(Error::UnsupportedModelType(format!(
+                    "Sentence encoder model type {other:?}"
+                )))
+            }
+        }
+
+        let bert_config: bert::Config = serde_json::from_value(config)?;
+
+        let vb = unsafe {
+            VarBuilder::from_mmaped_safetensors(paths, SENTENCE_ENCODER_DTYPE, device)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?
+        };
+
+        // Weights with and without the `bert.` prefix are both resolved by the model
+        let model =
+            BertModel::load(vb, &bert_config).map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        Ok(Self { model })
+    }
+
+    /// Returns the L2-normalized embedding of each encoded text.
+    ///
+    /// `input_ids`, `token_type_ids` and `attention_mask` are shaped [batch, seq_len].
+    pub fn embed(
+        &self,
+        input_ids: &Tensor,
+        token_type_ids: &Tensor,
+        attention_mask: &Tensor,
+    ) -> Result<Vec<Vec<f32>>, Error> {
+        (|| {
+            let hidden = self
+                .model
+                .forward(input_ids, token_type_ids, Some(attention_mask))?;
+
+            // Mean over the tokens covered by the attention mask
+            let mask = attention_mask
+                .to_dtype(hidden.dtype())?
+                .unsqueeze(D::Minus1)?;
+            let sum = hidden.broadcast_mul(&mask)?.sum(1)?;
+            let count = mask.sum(1)?.clamp(1e-9, f64::MAX)?;
+            let mean = sum.broadcast_div(&count)?;
+
+            let norm = mean
+                .sqr()?
+                .sum_keepdim(D::Minus1)?
+                .sqrt()?
+                .clamp(1e-12, f64::MAX)?;
+
+            mean.broadcast_div(&norm)?
+                .to_dtype(DType::F32)?
+                .to_vec2::<f32>()
+        })()
+        .map_err(|e: candle_core::Error| Error::ExecutionError(e.to_string()))
+    }
+}
@@ -0,0 +1,46 @@
+//! Cancellation of running queries
+//!
+//! Models run queries in the worker thread of their runtime, which does not receive control
+//! messages until the query has been answered. A [`CancellationToken`] is shared with the model
+//! instead, which checks it between prefill blocks and generated tokens.
+
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
+/// Shared flag cancelling the query currently run by a model.
+///
+/// Clones share the same flag.
+///
+/// # Example
+///
+/// ```
+/// use tauri_plugin_llm::CancellationToken;
+///
+/// let token = CancellationToken::default();
+/// let shared = token.clone();
+///
+/// shared.cancel();
+/// assert!(token.is_cancelled());
+///
+/// token.reset();
+/// assert!(!shared.is_cancelled());
+/// ```
+#[derive(Debug, Clone, Default)]
+pub struct CancellationToken(Arc<AtomicBool>);
+
+impl CancellationToken {
+    /// Cancels the running query.
+    pub fn cancel(&self) {
+        self.0.store(true, Ordering::SeqCst);
+    }
+
+    /// Returns `true`, if the running query has been cancelled.
+    pub fn is_cancelled(&self) -> bool {
+        self.0.load(Ordering::SeqCst)
+    }
+
+    /// Clears the flag before the next query is run.
+    pub fn reset(&self) {
+        self.0.store(false, Ordering::SeqCst);
+    }
+}
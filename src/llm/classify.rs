@@ -0,0 +1,82 @@
+//! Zero-shot classification
+//!
+//! Picks one of several candidate labels by their likelihood as the model's answer. The prompt is
+//! templated and prefilled once, each label is scored as a continuation of the shared prefix. The
+//! label log-likelihoods are normalized into a probability distribution, nothing is sampled.
+
+use serde::{Deserialize, Serialize};
+
+use crate::Error;
+
+/// Probability distribution over the candidate labels of a classification.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Classification {
+    /// Most likely label
+    pub label: String,
+
+    /// Candidate labels in requested order
+    pub labels: Vec<LabelProbability>,
+}
+
+/// Probability of a single candidate label.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct LabelProbability {
+    pub label: String,
+
+    /// Probability normalized over all candidate labels
+    pub probability: f32,
+
+    /// Sum of the label token log-probabilities
+    pub log_likelihood: f32,
+}
+
+impl Classification {
+    /// Normalizes the `log_likelihoods` of `labels` into a [`Classification`].
+    ///
+    /// # Errors
+    ///
+    /// Returns [`Error::MessageEncodingError`], if no labels are given or the number of labels and
+    /// log-likelihoods differ.
+    pub fn new(labels: &[String], log_likelihoods: &[f32]) -> Result<Self, Error> {
+        if labels.is_empty() {
+            return Err(Error::MessageEncodingError(
+                "Classification requires at least one label".to_string(),
+            ));
+        }
+
+        if labels.len() != log_likelihoods.len() {
+            return Err(Error::MessageEncodingError(format!(
+                "Got {} log-likelihoods for {} labels",
+                log_likelihoods.len(),
+                labels.len()
+            )));
+        }
+
+        // Softmax over the log-likelihoods, shifted by the maximum for numerical stability
+        let max = log_likelihoods
+            .iter()
+            .copied()
+            .fold(f32::NEG_INFINITY, f32::max);
+        let weights: Vec<f32> = log_likelihoods.iter().map(|l| (l - max).exp()).collect();
+        let total: f32 = weights.iter().sum();
+
+        let labels: Vec<LabelProbability> = labels
+            .iter()
+            .zip(log_likelihoods)
+            .zip(weights)
+            .map(|((label, log_likelihood), weight)| LabelProbability {
+                label: label.clone(),
+                probability: weight / total,
+                log_likelihood: *log_likelihood,
+            })
+            .collect();
+
+        let label = labels
+            .iter()
+            .max_by(|a, b| a.probability.total_cmp(&b.probability))
+            .map(|l| l.label.clone())
+            .unwrap_or_default();
+
+        Ok(Self { label, labels })
+    }
+}
@@ -0,0 +1,74 @@
+//! Context shifting
+//!
+//! Once prompt and generated tokens fill the context window of a model, a span of older tokens
+//! following a kept prefix (e.g. the system prompt) is discarded. The KV cache of the kept prefix
+//! is reused and the tokens following it are prefilled again, which re-positions them at the start
+//! of the context window, and generation continues.
+
+use serde::{Deserialize, Serialize};
+
+/// Context shift settings.
+///
+/// # Example
+///
+/// ```
+/// use tauri_plugin_llm::ContextShift;
+///
+/// let shift = ContextShift {
+///     discard: Some(2),
+///     ..Default::default()
+/// };
+///
+/// let (tokens, discarded) = shift.shift(&[1, 2, 3, 4, 5, 6], 1, 6).unwrap();
+///
+/// assert_eq!(tokens, vec![1, 4, 5, 6]);
+/// assert_eq!(discarded, 2);
+/// ```
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct ContextShift {
+    /// Context length in tokens. Defaults to `max_position_embeddings` of the model's `config.json`.
+    pub context_length: Option<usize>,
+
+    /// Number of leading tokens that are never discarded.
+    ///
+    /// Defaults to the tokens of the leading `system` messages of a prompt. At most half of the
+    /// context window is kept.
+    pub keep: Option<usize>,
+
+    /// Number of tokens discarded per shift. Defaults to half of the tokens after the kept prefix.
+    pub discard: Option<usize>,
+}
+
+impl ContextShift {
+    /// Discards tokens following the first `keep` tokens, so that `tokens` fit into a context
+    /// window of `context_length` tokens with room for at least one more token.
+    ///
+    /// Returns the remaining tokens and the number of discarded tokens, or `None` if nothing
+    /// can be discarded.
+    pub fn shift(
+        &self,
+        tokens: &[u32],
+        keep: usize,
+        context_length: usize,
+    ) -> Option<(Vec<u32>, usize)> {
+        let keep = self.keep.unwrap_or(keep).min(context_length / 2);
+        let shiftable = tokens.len().checked_sub(keep)?;
+        let required = (tokens.len() + 1).saturating_sub(context_length);
+
+        let discard = self
+            .discard
+            .unwrap_or(shiftable / 2)
+            .max(required)
+            .min(shiftable);
+
+        if discard == 0 {
+            return None;
+        }
+
+        let mut shifted = Vec::with_capacity(tokens.len() - discard);
+        shifted.extend_from_slice(&tokens[..keep]);
+        shifted.extend_from_slice(&tokens[keep + discard..]);
+
+        Some((shifted, discard))
+    }
+}
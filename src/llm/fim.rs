@@ -0,0 +1,162 @@
+//! Fill-in-the-middle
+//!
+//! Code models trained for fill-in-the-middle (FIM) complete the gap between a `prefix` and a
+//! `suffix`. The prompt is built from model specific marker tokens, which are either configured
+//! explicitly or detected from the added tokens declared in `tokenizer_config.json`.
+
+use crate::{Error, TokenizerConfig};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use tokenizers::Tokenizer;
+
+/// Model specific fill-in-the-middle marker tokens.
+///
+/// The prompt is built in prefix-suffix-middle order:
+///
+/// ```text
+/// {prefix}<prefix code>{suffix}<suffix code>{middle}
+/// ```
+#[derive(Deserialize, Serialize, Debug, Clone, PartialEq, Eq)]
+pub struct FimTokens {
+    /// Token preceding the prefix code, e.g. `<|fim_prefix|>`
+    pub prefix: String,
+
+    /// Token preceding the suffix code, e.g. `<|fim_suffix|>`
+    pub suffix: String,
+
+    /// Token after which the model generates the middle segment, e.g. `<|fim_middle|>`
+    pub middle: String,
+
+    /// Tokens ending the middle segment in addition to the model's EOS tokens.
+    ///
+    /// Tokens not present in the vocabulary are ignored.
+    #[serde(default)]
+    pub stop: Vec<String>,
+}
+
+/// [`FimTokens`] resolved against a tokenizer vocabulary.
+#[derive(Debug, Clone)]
+pub(crate) struct FimTokenIds {
+    pub(crate) prefix: u32,
+    pub(crate) suffix: u32,
+    pub(crate) middle: u32,
+    pub(crate) stop: Vec<u32>,
+}
+
+impl FimTokens {
+    fn new(prefix: &str, suffix: &str, middle: &str, stop: &[&str]) -> Self {
+        Self {
+            prefix: prefix.to_string(),
+            suffix: suffix.to_string(),
+            middle: middle.to_string(),
+            stop: stop.iter().map(|s| s.to_string()).collect(),
+        }
+    }
+
+    /// Returns the FIM token sets of known code model families.
+    pub fn known() -> Vec<Self> {
+        vec![
+            // Qwen2.5-Coder, CodeGemma
+            Self::new(
+                "<|fim_prefix|>",
+                "<|fim_suffix|>",
+                "<|fim_middle|>",
+                &[
+                    "<|fim_pad|>",
+                    "<|endoftext|>",
+                    "<|file_sep|>",
+                    "<|repo_name|>",
+                    "<|file_separator|>",
+                ],
+            ),
+            // StarCoder, StarCoder2
+            Self::new(
+                "<fim_prefix>",
+                "<fim_suffix>",
+                "<fim_middle>",
+                &["<|endoftext|>", "<file_sep>", "<fim_pad>"],
+            ),
+            // CodeLlama
+            Self::new("▁<PRE>", "▁<SUF>", "▁<MID>", &["▁<EOT>"]),
+            // DeepSeek-Coder
+            Self::new(
+                "<｜fim▁begin｜>",
+                "<｜fim▁hole｜>",
+                "<｜fim▁end｜>",
+                &["<|EOT|>"],
+            ),
+        ]
+    }
+
+    /// Detects the FIM tokens of a model from the added tokens of its `tokenizer_config.json`.
+    ///
+    /// Returns `None`, if the tokenizer config does not declare a known set of FIM tokens.
+    pub fn detect(config: &TokenizerConfig) -> Option<Self> {
+        let added: HashSet<&str> = config
+            .added_tokens_decoder
+            .as_ref()?
+            .values()
+            .map(|token| token.content.as_str())
+            .collect();
+
+        Self::known().into_iter().find(|fim| {
+            [&fim.prefix, &fim.suffix, &fim.middle]
+                .iter()
+                .all(|token| added.contains(token.as_str()))
+        })
+    }
+
+    /// Resolves the marker tokens to token ids.
+    ///
+    /// # Errors
+    ///
+    /// Fails if one of the prefix, suffix or middle tokens is not part of the vocabulary.
+    pub(crate) fn resolve(&self, tokenizer: &Tokenizer) -> Result<FimTokenIds, Error> {
+        let id = |token: &str| {
+            tokenizer
+                .token_to_id(token)
+                .ok_or(Error::MissingConfigLLM(format!(
+                    "FIM token '{token}' is not part of the vocabulary"
+                )))
+        };
+
+        Ok(FimTokenIds {
+            prefix: id(self.prefix.as_str())?,
+            suffix: id(self.suffix.as_str())?,
+            middle: id(self.middle.as_str())?,
+            stop: self
+                .stop
+                .iter()
+                .filter_map(|token| tokenizer.token_to_id(token))
+                .collect(),
+        })
+    }
+}
+
+impl FimTokenIds {
+    /// Builds the prompt from already encoded `prefix` and `suffix` segments.
+    ///
+    /// `leading` holds special tokens the tokenizer places in front of every input, e.g. BOS.
+    pub(crate) fn build_prompt(&self, leading: &[u32], prefix: &[u32], suffix: &[u32]) -> Vec<u32> {
+        let mut tokens = Vec::with_capacity(leading.len() + prefix.len() + suffix.len() + 3);
+
+        tokens.extend_from_slice(leading);
+        tokens.push(self.prefix);
+        tokens.extend_from_slice(prefix);
+        tokens.push(self.suffix);
+        tokens.extend_from_slice(suffix);
+        tokens.push(self.middle);
+
+        tokens
+    }
+
+    /// Returns all tokens ending the middle segment.
+    ///
+    /// Besides the configured stop tokens this includes the FIM markers themselves, since
+    /// models occasionally start a new FIM block instead of ending the middle segment.
+    pub(crate) fn stop_tokens(&self) -> Vec<u32> {
+        let mut stop = self.stop.clone();
+        stop.extend([self.prefix, self.suffix, self.middle]);
+        stop
+    }
+}
@@ -0,0 +1,79 @@
+//! Chunked prefill
+//!
+//! Prefilling a long prompt in a single forward pass allocates attention tensors quadratic in the
+//! prompt length, reports nothing until the first token is sampled and cannot be interrupted. With
+//! chunked prefill, the prompt is fed to the model in blocks of `block_size` tokens. Progress is
+//! reported after each block and cancellation is checked before the next block.
+
+use crate::{CancellationToken, Error};
+use serde::{Deserialize, Serialize};
+use std::ops::Range;
+
+/// Default number of prompt tokens per block.
+pub const DEFAULT_BLOCK_SIZE: usize = 512;
+
+/// Chunked prefill settings.
+///
+/// # Example
+///
+/// ```
+/// use tauri_plugin_llm::ChunkedPrefill;
+///
+/// let prefill = ChunkedPrefill {
+///     block_size: Some(4),
+/// };
+///
+/// let blocks: Vec<_> = prefill.blocks(2..12).collect();
+///
+/// assert_eq!(blocks, vec![2..6, 6..10, 10..12]);
+/// ```
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct ChunkedPrefill {
+    /// Number of prompt tokens fed to the model per forward pass. Defaults to `512`.
+    pub block_size: Option<usize>,
+}
+
+impl ChunkedPrefill {
+    /// Prefills the whole prompt in a single forward pass.
+    pub(crate) const UNCHUNKED: Self = Self {
+        block_size: Some(usize::MAX),
+    };
+
+    /// Splits the prompt positions `tokens` into consecutive blocks of at most `block_size`
+    /// tokens.
+    pub fn blocks(&self, tokens: Range<usize>) -> impl Iterator<Item = Range<usize>> {
+        let block_size = self.block_size.unwrap_or(DEFAULT_BLOCK_SIZE).max(1);
+        let end = tokens.end;
+
+        tokens
+            .step_by(block_size)
+            .map(move |start| start..start.saturating_add(block_size).min(end))
+    }
+
+    /// Passes each block of `tokens` to `forward` and returns the output of the last block.
+    ///
+    /// Returns `None` without running the remaining blocks, as soon as `cancellation` has been
+    /// cancelled.
+    pub fn run<T, F>(
+        &self,
+        tokens: Range<usize>,
+        cancellation: &CancellationToken,
+        mut forward: F,
+    ) -> Result<Option<T>, Error>
+    where
+        F: FnMut(Range<usize>) -> Result<T, Error>,
+    {
+        let mut output = None;
+
+        for block in self.blocks(tokens) {
+            if cancellation.is_cancelled() {
+                tracing::debug!("Prefill has been cancelled before token {}", block.start);
+                return Ok(None);
+            }
+
+            output = Some(forward(block)?);
+        }
+
+        Ok(output)
+    }
+}
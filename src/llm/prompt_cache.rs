@@ -0,0 +1,289 @@
+//! Prompt cache
+//!
+//! Long shared prompt prefixes, e.g. a system prompt, are prefilled once and their KV cache is
+//! kept around. Generations starting with a cached prefix restore the KV cache instead of
+//! running a forward pass over the prefix tokens.
+//!
+//! Snapshots consisting of plain KV tensors are additionally persisted to a cache directory,
+//! keyed by model name, dtype and a hash of the prefix tokens, so that they survive restarts.
+//! Backends only exposing an opaque snapshot are cached in memory for the lifetime of the runtime.
+
+use crate::llm::backend::{KvCacheSnapshot, ModelBackend};
+use crate::{Error, QueryMessage};
+use candle_core::{DType, Device, Tensor};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+/// Name of the tensor holding the prefix tokens in a persisted cache file.
+const TOKENS_TENSOR: &str = "tokens";
+
+/// Prompt prefixes whose KV cache is computed once and reused across generations.
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct PromptCacheConfig {
+    /// Prefixes to cache
+    #[serde(default)]
+    pub prefixes: Vec<CachedPrefix>,
+
+    /// Directory to persist KV caches in. Defaults to `prompt-cache` inside the app cache directory.
+    pub cache_dir: Option<PathBuf>,
+}
+
+/// A cached prompt prefix.
+#[derive(Deserialize, Serialize, Debug, Clone)]
+#[serde(untagged)]
+pub enum CachedPrefix {
+    /// Leading messages of a conversation, e.g. the system prompt, rendered with the chat template.
+    ///
+    /// The prefix is only used for prompts whose tokens start with the rendered messages.
+    /// Templates placing tools or dates in front of the first message may prevent a match.
+    Messages { messages: Vec<QueryMessage> },
+
+    /// Raw text, encoded as is. Used for [`Query::Completion`](crate::Query::Completion) prompts.
+    Text { text: String },
+}
+
+/// A prefix and the KV cache after processing it
+struct CachedEntry {
+    tokens: Vec<u32>,
+    snapshot: KvCacheSnapshot,
+}
+
+/// KV cache snapshots of prompt prefixes for a single model.
+pub(crate) struct PromptCache {
+    model: String,
+    dtype: DType,
+    dir: Option<PathBuf>,
+    entries: Vec<CachedEntry>,
+}
+
+impl PromptCache {
+    pub(crate) fn new(model: &str, dtype: DType, dir: Option<PathBuf>) -> Self {
+        Self {
+            model: model.to_string(),
+            dtype,
+            dir,
+            entries: vec![],
+        }
+    }
+
+    /// Prefills `tokens` and stores the resulting KV cache.
+    ///
+    /// A snapshot persisted by an earlier run is restored instead of prefilling. Returns `false`,
+    /// if the backend cannot capture its KV cache.
+    pub(crate) fn insert(
+        &mut self,
+        backend: &mut dyn ModelBackend,
+        device: &Device,
+        tokens: Vec<u32>,
+    ) -> Result<bool, Error> {
+        if tokens.is_empty() || self.entries.iter().any(|e| e.tokens == tokens) {
+            return Ok(true);
+        }
+
+        let path = self.path(&tokens);
+
+        if let Some(snapshot) = path.as_ref().and_then(|p| Self::load(p, device, &tokens)) {
+            tracing::info!("Restored prompt cache from {path:?}");
+            self.entries.push(CachedEntry { tokens, snapshot });
+            return Ok(true);
+        }
+
+        backend.clear_kv_cache();
+
+        let input = Tensor::new(tokens.as_slice(), device)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?
+            .unsqueeze(0)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        backend.forward(&input, 0)?;
+
+        let snapshot = backend.snapshot_kv_cache();
+        backend.clear_kv_cache();
+
+        let Some(snapshot) = snapshot else {
+            return Ok(false);
+        };
+
+        match (&path, &snapshot) {
+            (Some(path), KvCacheSnapshot::Tensors(kvs)) => {
+                if let Err(error) = Self::save(path, &tokens, kvs) {
+                    tracing::warn!("Failed to persist prompt cache to {path:?}: {error}");
+                }
+            }
+            _ => tracing::debug!("Prompt cache for {} tokens is kept in memory", tokens.len()),
+        }
+
+        self.entries.push(CachedEntry { tokens, snapshot });
+
+        Ok(true)
+    }
+
+    /// Restores the KV cache of the longest cached prefix of `tokens` into `backend`.
+    ///
+    /// At least one token is left for the forward pass, since its logits are needed for
+    /// sampling. Returns the number of restored tokens, `0` if no prefix matched.
+    pub(crate) fn restore(&self, backend: &mut dyn ModelBackend, tokens: &[u32]) -> usize {
+        let Some(entry) = self
+            .entries
+            .iter()
+            .filter(|e| e.tokens.len() < tokens.len() && tokens.starts_with(&e.tokens))
+            .max_by_key(|e| e.tokens.len())
+        else {
+            return 0;
+        };
+
+        match backend.restore_kv_cache(&entry.snapshot) {
+            Ok(()) => {
+                tracing::debug!(
+                    "Restored {} prefix tokens from prompt cache",
+                    entry.tokens.len()
+                );
+                entry.tokens.len()
+            }
+            Err(error) => {
+                tracing::warn!("Failed to restore prompt cache: {error}");
+                backend.clear_kv_cache();
+                0
+            }
+        }
+    }
+
+    /// Returns the cache file path for `tokens`, if a cache directory is configured.
+    fn path(&self, tokens: &[u32]) -> Option<PathBuf> {
+        let dir = self.dir.as_ref()?;
+
+        Some(dir.join(format!("{}.safetensors", self.key(tokens))))
+    }
+
+    /// Returns the cache key derived from model name, dtype and the prefix tokens.
+    fn key(&self, tokens: &[u32]) -> String {
+        let model: String = self
+            .model
+            .chars()
+            .map(|c| if c.is_ascii_alphanumeric() { c } else { '-' })
+            .collect();
+
+        let mut hasher = Sha256::new();
+        hasher.update(self.model.as_bytes());
+        hasher.update(self.dtype.as_str().as_bytes());
+        for token in tokens {
+            hasher.update(token.to_le_bytes());
+        }
+
+        format!("{model}-{}-{:x}", self.dtype.as_str(), hasher.finalize())
+    }
+
+    fn save(path: &Path, tokens: &[u32], kvs: &[(Tensor, Tensor)]) -> Result<(), Error> {
+        let mut tensors = HashMap::new();
+
+        tensors.insert(
+            TOKENS_TENSOR.to_string(),
+            Tensor::new(tokens, &Device::Cpu).map_err(|e| Error::ExecutionError(e.to_string()))?,
+        );
+
+        for (layer, (k, v)) in kvs.iter().enumerate() {
+            tensors.insert(format!("{layer}.key"), k.clone());
+            tensors.insert(format!("{layer}.value"), v.clone());
+        }
+
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+
+        // Write to a temporary file first, an interrupted write must not leave a corrupt cache
+        let tmp = path.with_extension("tmp");
+        candle_core::safetensors::save(&tensors, &tmp)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        std::fs::rename(&tmp, path)?;
+
+        Ok(())
+    }
+
+    /// Loads a persisted snapshot. Returns `None`, if the file is missing, unreadable or was
+    /// written for different tokens.
+    fn load(path: &Path, device: &Device, tokens: &[u32]) -> Option<KvCacheSnapshot> {
+        if !path.exists() {
+            return None;
+        }
+
+        let mut tensors = match candle_core::safetensors::load(path, device) {
+            Ok(tensors) => tensors,
+            Err(error) => {
+                tracing::warn!("Ignoring unreadable prompt cache {path:?}: {error}");
+                return None;
+            }
+        };
+
+        let stored = tensors.remove(TOKENS_TENSOR)?.to_vec1::<u32>().ok()?;
+        if stored != tokens {
+            tracing::warn!("Ignoring prompt cache {path:?} written for different tokens");
+            return None;
+        }
+
+        let mut kvs = vec![];
+        while let (Some(k), Some(v)) = (
+            tensors.remove(&format!("{}.key", kvs.len())),
+            tensors.remove(&format!("{}.value", kvs.len())),
+        ) {
+            kvs.push((k, v));
+        }
+
+        Some(KvCacheSnapshot::Tensors(kvs))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::backend::testing::{self, assert_close, forward};
+
+    #[test]
+    fn test_persisted_snapshot_restores_logits() -> Result<(), Error> {
+        let dir = std::env::temp_dir().join("test_persisted_snapshot_restores_logits");
+        let _ = std::fs::remove_dir_all(&dir);
+
+        let device = Device::Cpu;
+        let prefix = vec![1u32, 5, 9, 13, 17, 21];
+        let prompt = [prefix.as_slice(), &[25, 29, 33]].concat();
+
+        for backend in [
+            &mut testing::qwen3() as &mut dyn ModelBackend,
+            &mut testing::llama(),
+        ] {
+            backend.clear_kv_cache();
+            let expected = forward(backend, &prompt, 0);
+
+            let mut cache = PromptCache::new("Tiny", DType::F32, Some(dir.clone()));
+            assert!(cache.insert(backend, &device, prefix.clone())?);
+
+            let path = cache.path(&prefix).unwrap();
+            assert!(path.exists());
+
+            // the snapshot read back from disk continues the prompt like a full forward pass
+            let snapshot = PromptCache::load(&path, &device, &prefix).unwrap();
+            backend.clear_kv_cache();
+            backend.restore_kv_cache(&snapshot)?;
+            assert_close(
+                &forward(backend, &prompt[prefix.len()..], prefix.len()),
+                &expected,
+            );
+
+            // a new cache restores the persisted snapshot
+            let mut cache = PromptCache::new("Tiny", DType::F32, Some(dir.clone()));
+            assert!(cache.insert(backend, &device, prefix.clone())?);
+            assert_eq!(cache.restore(backend, &prompt), prefix.len());
+            assert_close(
+                &forward(backend, &prompt[prefix.len()..], prefix.len()),
+                &expected,
+            );
+
+            // snapshots written for other tokens are ignored
+            assert!(PromptCache::load(&path, &device, &prompt).is_none());
+
+            let _ = std::fs::remove_dir_all(&dir);
+        }
+
+        Ok(())
+    }
+}
@@ -0,0 +1,143 @@
+//! Repetition loop detection
+//!
+//! Small models tend to repeat the same sentence until `max_tokens` is reached. The generated
+//! tokens are checked for a span repeating itself at the end of the output. A detected loop either
+//! ends generation with [`FinishReason::Repetition`](crate::FinishReason::Repetition) or raises
+//! the repeat penalty step by step.
+
+use serde::{Deserialize, Serialize};
+
+/// Repetition loop detection settings.
+///
+/// A loop is detected, if the generated output ends with a span of `min_period` to `max_period`
+/// tokens repeated `repetitions` times in a row.
+///
+/// # Example
+///
+/// ```
+/// use tauri_plugin_llm::RepetitionGuard;
+///
+/// let guard = RepetitionGuard {
+///     min_period: Some(2),
+///     repetitions: Some(3),
+///     ..Default::default()
+/// };
+///
+/// assert_eq!(guard.detect(&[9, 1, 2, 1, 2, 1, 2]), Some(2));
+/// assert_eq!(guard.detect(&[9, 1, 2, 1, 2, 1, 3]), None);
+/// ```
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct RepetitionGuard {
+    /// Minimum length of a repeated span in tokens. Defaults to `4`.
+    pub min_period: Option<usize>,
+
+    /// Maximum length of a repeated span in tokens. Defaults to `128`.
+    pub max_period: Option<usize>,
+
+    /// Number of consecutive repetitions considered a loop. Defaults to `3`, lower values are
+    /// more sensitive.
+    pub repetitions: Option<usize>,
+
+    /// Action taken when a loop is detected. Defaults to [`RepetitionAction::Stop`].
+    #[serde(default)]
+    pub action: RepetitionAction,
+
+    /// Increase of the repeat penalty per detected loop, if the action is
+    /// [`RepetitionAction::Penalize`]. Defaults to `0.3`.
+    pub penalty_step: Option<f32>,
+
+    /// Number of penalty increases before generation is stopped, if the action is
+    /// [`RepetitionAction::Penalize`]. Defaults to `3`.
+    pub max_penalties: Option<usize>,
+}
+
+/// Action taken when a repetition loop is detected.
+#[derive(Deserialize, Serialize, Debug, Clone, Default, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum RepetitionAction {
+    /// End generation
+    #[default]
+    Stop,
+
+    /// Raise the repeat penalty and continue. Generation is stopped, if the loop persists.
+    Penalize,
+}
+
+impl RepetitionGuard {
+    /// Returns the length of the shortest span repeating itself at the end of `tokens`.
+    pub fn detect(&self, tokens: &[u32]) -> Option<usize> {
+        let repetitions = self.repetitions.unwrap_or(3).max(2);
+        let min_period = self.min_period.unwrap_or(4).max(1);
+        let max_period = self.max_period.unwrap_or(128);
+
+        (min_period..=max_period)
+            .take_while(|period| period * repetitions <= tokens.len())
+            .find(|&period| {
+                let tail = &tokens[tokens.len() - period * repetitions..];
+                let span = &tail[..period];
+
+                tail.chunks(period).all(|chunk| chunk == span)
+            })
+    }
+}
+
+/// Decision of the [`RepetitionWatchdog`] for the latest token.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub(crate) enum RepetitionVerdict {
+    Continue,
+
+    /// Continue with the base repeat penalty raised by the given amount
+    Penalize(f32),
+
+    Stop,
+}
+
+/// Tracks loop detections of a single generation.
+pub(crate) struct RepetitionWatchdog<'a> {
+    guard: &'a RepetitionGuard,
+    penalties: usize,
+
+    /// Remaining tokens before the next check, a loop is only penalized once per period
+    cooldown: usize,
+}
+
+impl<'a> RepetitionWatchdog<'a> {
+    pub(crate) fn new(guard: &'a RepetitionGuard) -> Self {
+        Self {
+            guard,
+            penalties: 0,
+            cooldown: 0,
+        }
+    }
+
+    /// Checks the generated `tokens` after a new token has been appended.
+    pub(crate) fn check(&mut self, tokens: &[u32]) -> RepetitionVerdict {
+        if self.cooldown > 0 {
+            self.cooldown -= 1;
+            return RepetitionVerdict::Continue;
+        }
+
+        let Some(period) = self.guard.detect(tokens) else {
+            return RepetitionVerdict::Continue;
+        };
+
+        tracing::debug!("Detected repetition loop with a period of {period} tokens");
+
+        match self.guard.action {
+            RepetitionAction::Stop => RepetitionVerdict::Stop,
+            RepetitionAction::Penalize
+                if self.penalties >= self.guard.max_penalties.unwrap_or(3) =>
+            {
+                RepetitionVerdict::Stop
+            }
+            RepetitionAction::Penalize => {
+                self.penalties += 1;
+                self.cooldown = period;
+
+                RepetitionVerdict::Penalize(
+                    self.guard.penalty_step.unwrap_or(0.3) * self.penalties as f32,
+                )
+            }
+        }
+    }
+}
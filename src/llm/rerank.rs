@@ -0,0 +1,36 @@
+//! Reranking
+//!
+//! Cross-encoder models score the relevance of candidate documents to a query. Each
+//! `(query, document)` pair is encoded jointly and mapped to a relevance score by a sequence
+//! classification head. Rerankers are configured with [`ModelKind::Reranker`](crate::ModelKind).
+
+use serde::{Deserialize, Serialize};
+
+/// Relevance of a single document to the query.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RerankResult {
+    /// Position of the document in the request
+    pub index: usize,
+
+    /// Relevance score in `[0, 1]`
+    pub score: f32,
+}
+
+/// Orders the document `scores` by descending relevance and keeps the `top_n` most relevant.
+///
+/// Documents of equal relevance keep their order of the request.
+pub fn rank(scores: &[f32], top_n: Option<usize>) -> Vec<RerankResult> {
+    let mut results: Vec<RerankResult> = scores
+        .iter()
+        .enumerate()
+        .map(|(index, score)| RerankResult {
+            index,
+            score: *score,
+        })
+        .collect();
+
+    results.sort_by(|a, b| b.score.total_cmp(&a.score));
+    results.truncate(top_n.unwrap_or(scores.len()));
+
+    results
+}
@@ -0,0 +1,445 @@
+//! Response cache
+//!
+//! Generations of deterministic queries, i.e. queries with a fixed [`GenerationSeed`] or
+//! [`SamplingConfig::ArgMax`] sampling, are fully determined by the query and the model. Their
+//! responses are cached and replayed for identical queries instead of running the model again.
+//!
+//! A query is identified by a hash of its canonical JSON form, without fields that do not affect
+//! the generated tokens like `timestamp`, `chunk_size` or `flush`, and the identity of the model:
+//! its config along with path, size and modification time of its weight files. Changing the
+//! config or replacing the weights invalidates all cached responses.
+//!
+//! Responses are persisted in the cache directory, keyed by model name, so that they survive
+//! restarts. Replayed responses are chunked according to the `chunk_size` of the new query.
+
+use crate::util::{self, now};
+use crate::{
+    CacheHit, Error, FinishReason, GenerationSeed, LLMRuntimeConfig, Query, QueryChunkType,
+    SamplingConfig, TokenUsage,
+};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use sha2::{Digest, Sha256};
+use std::path::PathBuf;
+use std::time::UNIX_EPOCH;
+
+/// Default number of cached responses per model.
+pub const DEFAULT_MAX_ENTRIES: usize = 256;
+
+/// Query fields ignored by the cache key, since they do not affect the generated tokens.
+pub(crate) const VOLATILE_FIELDS: [&str; 5] = ["timestamp", "chunk_size", "flush", "stream", "model"];
+
+/// Opt-in cache of deterministic responses.
+#[derive(Deserialize, Serialize, Debug, Clone)]
+pub struct ResponseCacheConfig {
+    /// Maximum number of cached responses. The least recently used response is evicted first.
+    #[serde(default = "default_max_entries")]
+    pub max_entries: usize,
+
+    /// Seconds a response is replayed after it was generated. Responses do not expire if not set.
+    pub ttl: Option<u64>,
+
+    /// Persists responses across restarts. Defaults to `true`.
+    #[serde(default = "default_persist")]
+    pub persist: bool,
+
+    /// Directory to persist responses in. Defaults to `response-cache` inside the app cache
+    /// directory.
+    pub cache_dir: Option<PathBuf>,
+}
+
+impl Default for ResponseCacheConfig {
+    fn default() -> Self {
+        Self {
+            max_entries: DEFAULT_MAX_ENTRIES,
+            ttl: None,
+            persist: true,
+            cache_dir: None,
+        }
+    }
+}
+
+fn default_max_entries() -> usize {
+    DEFAULT_MAX_ENTRIES
+}
+
+fn default_persist() -> bool {
+    true
+}
+
+/// Kind of a cached chunk.
+///
+/// [`QueryChunkType`] serializes untagged, which does not survive a roundtrip.
+#[derive(Deserialize, Serialize, Debug, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+enum ChunkKind {
+    String,
+    Bytes,
+    ToolCall,
+}
+
+impl From<&QueryChunkType> for ChunkKind {
+    fn from(kind: &QueryChunkType) -> Self {
+        match kind {
+            QueryChunkType::String => Self::String,
+            QueryChunkType::Bytes => Self::Bytes,
+            QueryChunkType::ToolCall => Self::ToolCall,
+        }
+    }
+}
+
+impl From<ChunkKind> for QueryChunkType {
+    fn from(kind: ChunkKind) -> Self {
+        match kind {
+            ChunkKind::String => Self::String,
+            ChunkKind::Bytes => Self::Bytes,
+            ChunkKind::ToolCall => Self::ToolCall,
+        }
+    }
+}
+
+#[derive(Deserialize, Serialize, Debug, Clone)]
+struct CachedChunk {
+    id: usize,
+    data: Vec<u8>,
+    kind: ChunkKind,
+}
+
+/// The streamed response of a query.
+#[derive(Deserialize, Serialize, Debug, Clone)]
+pub(crate) struct CachedResponse {
+    key: String,
+
+    /// Seconds since the Unix epoch the response was generated at
+    created: u64,
+
+    /// The prompt the query was rendered into
+    prompt: Option<String>,
+
+    chunks: Vec<CachedChunk>,
+
+    usage: Option<TokenUsage>,
+
+    finish_reason: Option<FinishReason>,
+}
+
+impl CachedResponse {
+    /// Returns the key the response is cached under.
+    pub(crate) fn key(&self) -> &str {
+        &self.key
+    }
+
+    /// Returns `true`, if the response has been generated more than `ttl` seconds ago.
+    pub(crate) fn is_expired(&self, ttl: Option<u64>) -> bool {
+        ttl.is_some_and(|ttl| now().saturating_sub(self.created) >= ttl)
+    }
+
+    /// Returns the rendered prompt of the cached query.
+    pub(crate) fn prompt(&self) -> Option<&str> {
+        self.prompt.as_deref()
+    }
+
+    /// Returns the chunks and the end of the response, carrying `timestamp` of the new query and
+    /// the cache the response is replayed from.
+    ///
+    /// The chunks are split into chunks of `chunk_size` tokens, if set. Otherwise the chunks are
+    /// replayed as they were recorded.
+    pub(crate) fn replay(
+        &self,
+        timestamp: Option<u64>,
+        chunk_size: Option<usize>,
+        cache_hit: CacheHit,
+    ) -> Vec<Query> {
+        let chunks = match chunk_size {
+            Some(chunk_size) => self.rechunk(chunk_size),
+            None => self.chunks.clone(),
+        };
+
+        chunks
+            .into_iter()
+            .map(|chunk| Query::Chunk {
+                id: chunk.id,
+                data: chunk.data,
+                timestamp,
+                kind: chunk.kind.into(),
+            })
+            .chain(std::iter::once(Query::End {
+                usage: self.usage.clone(),
+                finish_reason: self.finish_reason,
+                cache_hit: Some(cache_hit),
+            }))
+            .collect()
+    }
+
+    /// Splits the generated text into chunks of about `chunk_size` tokens, estimated from the
+    /// average length of the generated tokens. Tool call chunks follow the text as they are.
+    fn rechunk(&self, chunk_size: usize) -> Vec<CachedChunk> {
+        let (tool_calls, text): (Vec<&CachedChunk>, Vec<&CachedChunk>) = self
+            .chunks
+            .iter()
+            .partition(|chunk| chunk.kind == ChunkKind::ToolCall);
+
+        let kind = text.first().map_or(ChunkKind::String, |chunk| chunk.kind);
+        let text: Vec<u8> = text
+            .into_iter()
+            .flat_map(|chunk| chunk.data.iter().copied())
+            .collect();
+
+        let tokens = self
+            .usage
+            .as_ref()
+            .map(|usage| usage.completion_tokens)
+            .filter(|tokens| *tokens > 0)
+            .unwrap_or(text.len())
+            .max(1);
+        let bytes = (text.len() * chunk_size.max(1)).div_ceil(tokens).max(1);
+
+        let mut chunks = vec![];
+        let mut start = 0;
+
+        while start < text.len() {
+            // Chunks end at character boundaries, UTF-8 continuation bytes start with `0b10`
+            let mut end = (start + bytes).min(text.len());
+            while end < text.len() && text[end] & 0xC0 == 0x80 {
+                end += 1;
+            }
+
+            chunks.push(CachedChunk {
+                id: chunks.len(),
+                data: text[start..end].to_vec(),
+                kind,
+            });
+            start = end;
+        }
+
+        for chunk in tool_calls {
+            chunks.push(CachedChunk {
+                id: chunks.len(),
+                ..chunk.clone()
+            });
+        }
+
+        chunks
+    }
+}
+
+/// A response recorded while it is streamed, cached once the stream has ended.
+#[derive(Default)]
+pub(crate) struct Recording {
+    chunks: Vec<CachedChunk>,
+}
+
+impl Recording {
+    /// Records a chunk of the response.
+    pub(crate) fn push(&mut self, id: usize, data: &[u8], kind: &QueryChunkType) {
+        self.chunks.push(CachedChunk {
+            id,
+            data: data.to_vec(),
+            kind: kind.into(),
+        });
+    }
+
+    /// Returns the recorded response cached under `key`, ended by the end of the stream.
+    pub(crate) fn finish(
+        &self,
+        key: String,
+        prompt: Option<String>,
+        usage: Option<TokenUsage>,
+        finish_reason: Option<FinishReason>,
+    ) -> CachedResponse {
+        CachedResponse {
+            key,
+            created: now(),
+            prompt,
+            chunks: self.chunks.clone(),
+            usage,
+            finish_reason,
+        }
+    }
+}
+
+/// Cached responses of deterministic queries to a single model.
+pub(crate) struct ResponseCache {
+    identity: String,
+    max_entries: usize,
+    ttl: Option<u64>,
+    path: Option<PathBuf>,
+
+    /// Responses ordered from least to most recently used
+    entries: Vec<CachedResponse>,
+}
+
+impl ResponseCache {
+    /// Creates the cache of the model configured by `config`, restoring persisted responses.
+    pub(crate) fn new(model: &LLMRuntimeConfig, config: &ResponseCacheConfig) -> Self {
+        let path = config
+            .cache_dir
+            .as_ref()
+            .filter(|_| config.persist)
+            .map(|dir| dir.join(format!("{}.json", file_name(&model.name))));
+
+        let mut cache = Self {
+            identity: identity(model),
+            max_entries: config.max_entries,
+            ttl: config.ttl,
+            path,
+            entries: vec![],
+        };
+
+        if let Some(path) = cache.path.as_ref() {
+            match util::read_json(path) {
+                Ok(entries) => cache.entries = entries,
+                Err(error) => {
+                    tracing::warn!("Ignoring unreadable response cache {path:?}: {error}")
+                }
+            }
+        }
+
+        cache.evict();
+        cache
+    }
+
+    /// Returns the cache key of `query`, or `None` if its response is not deterministic.
+    pub(crate) fn key(&self, query: &Query) -> Option<String> {
+        let (seed, sampling_config) = match query {
+            Query::Prompt {
+                seed,
+                sampling_config,
+                ..
+            }
+            | Query::Completion {
+                seed,
+                sampling_config,
+                ..
+            }
+            | Query::Infill {
+                seed,
+                sampling_config,
+                ..
+            } => (seed, sampling_config),
+            _ => return None,
+        };
+
+        if !matches!(seed, Some(GenerationSeed::Fixed(_)))
+            && !matches!(sampling_config, Some(SamplingConfig::ArgMax))
+        {
+            return None;
+        }
+
+        let mut value = serde_json::to_value(query).ok()?;
+        if let Some(fields) = value.as_object_mut() {
+            for field in VOLATILE_FIELDS {
+                fields.remove(field);
+            }
+        }
+
+        let mut hasher = Sha256::new();
+        hasher.update(self.identity.as_bytes());
+        hasher.update(canonical(&value).as_bytes());
+
+        Some(format!("{:x}", hasher.finalize()))
+    }
+
+    /// Returns the response cached for `key`, if it has not expired yet.
+    pub(crate) fn get(&mut self, key: &str) -> Option<CachedResponse> {
+        self.evict();
+
+        let index = self.entries.iter().position(|e| e.key == key)?;
+
+        // Move the response to the back, the most recently used position
+        let entry = self.entries.remove(index);
+        self.entries.push(entry.clone());
+
+        Some(entry)
+    }
+
+    /// Caches `response`, evicting expired and least recently used responses.
+    pub(crate) fn insert(&mut self, response: CachedResponse) {
+        self.entries.retain(|e| e.key != response.key);
+        self.entries.push(response);
+        self.evict();
+
+        if let Err(error) = self.persist() {
+            tracing::warn!("Failed to persist response cache: {error}");
+        }
+    }
+
+    fn evict(&mut self) {
+        let ttl = self.ttl;
+        self.entries.retain(|e| !e.is_expired(ttl));
+
+        let excess = self.entries.len().saturating_sub(self.max_entries);
+        self.entries.drain(..excess);
+    }
+
+    /// Writes the responses to the file of the cache, if any.
+    fn persist(&self) -> Result<(), Error> {
+        match self.path.as_ref() {
+            Some(path) => util::write_json(path, &self.entries),
+            None => Ok(()),
+        }
+    }
+}
+
+/// Returns the identity of a model, a hash of its config and the metadata of its weight files.
+fn identity(config: &LLMRuntimeConfig) -> String {
+    let mut hasher = Sha256::new();
+
+    // The cache settings do not affect responses
+    let mut value = serde_json::to_value(config).unwrap_or_default();
+    if let Some(fields) = value.as_object_mut() {
+        fields.remove("response_cache");
+        fields.remove("semantic_cache");
+    }
+    hasher.update(canonical(&value).as_bytes());
+
+    let mut files = config.weight_files();
+    files.sort();
+
+    for file in files {
+        hasher.update(file.to_string_lossy().as_bytes());
+
+        if let Ok(metadata) = std::fs::metadata(&file) {
+            hasher.update(metadata.len().to_le_bytes());
+
+            let modified = metadata
+                .modified()
+                .ok()
+                .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+                .map(|d| d.as_nanos())
+                .unwrap_or_default();
+            hasher.update(modified.to_le_bytes());
+        }
+    }
+
+    format!("{:x}", hasher.finalize())
+}
+
+/// Renders `value` as JSON with the keys of all objects sorted.
+pub(crate) fn canonical(value: &Value) -> String {
+    match value {
+        Value::Object(fields) => {
+            let mut keys: Vec<&String> = fields.keys().collect();
+            keys.sort();
+
+            let fields: Vec<String> = keys
+                .into_iter()
+                .map(|key| format!("{}:{}", Value::from(key.as_str()), canonical(&fields[key])))
+                .collect();
+
+            format!("{{{}}}", fields.join(","))
+        }
+        Value::Array(values) => {
+            let values: Vec<String> = values.iter().map(canonical).collect();
+            format!("[{}]", values.join(","))
+        }
+        value => value.to_string(),
+    }
+}
+
+/// Returns `name` with all characters unsafe in file names replaced.
+fn file_name(name: &str) -> String {
+    name.chars()
+        .map(|c| if c.is_ascii_alphanumeric() { c } else { '-' })
+        .collect()
+}
@@ -1,17 +1,38 @@
 //! LLM Inference
 
+pub mod embedding;
 pub mod local;
 mod mock;
+pub mod reranker;
 
 use crate::error::Error;
+use crate::llm::rerank::RerankResult;
+use crate::llm::response_cache::{Recording, ResponseCache};
+use crate::llm::semantic_cache::{SemanticCache, SemanticKey};
+use crate::llm::structured;
+use crate::metrics::Metrics;
+use crate::runtime::embedding::EmbeddingRuntime;
 use crate::runtime::local::LocalRuntime;
 use crate::runtime::mock::Mock;
+use crate::runtime::reranker::RerankerRuntime;
+use crate::usage::{UsageStore, BACKEND_WINDOW};
+use crate::CacheHit;
+use crate::CancellationToken;
+use crate::DefaultSystemPrompt;
+use crate::FinishReason;
 use crate::LLMRuntimeConfig;
+use crate::ModelKind;
 use crate::Query;
+use crate::QueryChunkType;
+use crate::TokenUsage;
 use anyhow::Result;
 use candle_core::Device;
+use schemars::JsonSchema;
+use serde::de::DeserializeOwned;
+use serde_json::{Map, Value};
 use std::sync::mpsc::{Receiver, Sender};
 use std::sync::{Arc, Mutex, RwLock};
+use std::time::{Duration, Instant};
 
 #[allow(clippy::type_complexity)]
 pub struct LLMRuntime {
@@ -23,6 +44,214 @@ pub struct LLMRuntime {
         Arc<Mutex<Option<Receiver<Query>>>>,
     ),
     response: (Arc<Sender<Query>>, Arc<Mutex<Receiver<Query>>>),
+
+    metrics: Arc<Metrics>,
+
+    /// Timings of the generation currently streamed
+    timings: Arc<Mutex<Option<RequestTimings>>>,
+
+    /// Accounts the token usage of generations, if set
+    usage: Option<Arc<Mutex<UsageStore>>>,
+
+    /// Cancels the query currently run by the model
+    cancellation: CancellationToken,
+
+    /// Default system prompt injected into prompts
+    system_prompt: Option<DefaultSystemPrompt>,
+
+    /// Variables of the application available to the default system prompt
+    prompt_variables: Map<String, Value>,
+
+    /// The last generating query sent to the model
+    last_request: Arc<Mutex<Option<RenderedRequest>>>,
+
+    /// Responses of deterministic queries, if enabled
+    response_cache: Option<Arc<Mutex<ResponseCache>>>,
+
+    /// Responses of similar prompts, if enabled
+    semantic_cache: Option<Arc<Mutex<SemanticCache>>>,
+
+    /// The response currently streamed, cached once the stream has ended
+    recording: Arc<Mutex<Option<PendingResponse>>>,
+}
+
+/// A response recorded for the caches it will be inserted into.
+struct PendingResponse {
+    recording: Recording,
+
+    /// Key of the response in the response cache
+    exact: Option<String>,
+
+    /// Key of the response in the semantic cache
+    semantic: Option<SemanticKey>,
+}
+
+/// Replays cached responses in the worker, through the stream of generated responses.
+struct ResponseReplay {
+    model: String,
+    metrics: Arc<Metrics>,
+    timings: Arc<Mutex<Option<RequestTimings>>>,
+    last_request: Arc<Mutex<Option<RenderedRequest>>>,
+    response_cache: Option<Arc<Mutex<ResponseCache>>>,
+    semantic_cache: Option<Arc<Mutex<SemanticCache>>>,
+    recording: Arc<Mutex<Option<PendingResponse>>>,
+}
+
+impl ResponseReplay {
+    /// Replays the cached response of `query` or of a similar prompt through `response_tx`.
+    /// Otherwise starts recording the response for the caches `query` is eligible for.
+    /// Returns `true`, if a response has been replayed.
+    fn replay_cached(&self, query: &Query, response_tx: &Sender<Query>) -> Result<bool, Error> {
+        let mut recording = self
+            .recording
+            .lock()
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+        *recording = None;
+
+        let mut exact = None;
+        if let Some(cache) = self.response_cache.as_ref() {
+            let mut cache = cache
+                .lock()
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+            if let Some(key) = cache.key(query) {
+                if let Some(cached) = cache.get(&key) {
+                    tracing::debug!("Replaying cached response");
+                    self.metrics.record_response_cache_hit(&self.model);
+
+                    let responses =
+                        cached.replay(query.timestamp(), query.chunk_size(), CacheHit::Exact);
+                    self.replay(cached.prompt(), responses, response_tx)?;
+                    return Ok(true);
+                }
+                exact = Some(key);
+            }
+        }
+
+        let mut semantic = None;
+        if let Some(cache) = self.semantic_cache.as_ref() {
+            let mut cache = cache
+                .lock()
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+            // Failing to embed the prompt must not fail the query
+            match cache.key(query) {
+                Ok(Some(key)) => {
+                    if let Some((cached, similarity)) = cache.get(&key) {
+                        tracing::debug!("Replaying response of a similar prompt ({similarity})");
+                        self.metrics.record_semantic_cache_hit(&self.model);
+
+                        // The cached prompt differs from the prompt of `query`
+                        let responses = cached.replay(
+                            query.timestamp(),
+                            query.chunk_size(),
+                            CacheHit::Semantic { similarity },
+                        );
+                        self.replay(None, responses, response_tx)?;
+                        return Ok(true);
+                    }
+                    semantic = Some(key);
+                }
+                Ok(None) => {}
+                Err(error) => tracing::warn!("Skipping semantic cache: {error}"),
+            }
+        }
+
+        if exact.is_some() || semantic.is_some() {
+            *recording = Some(PendingResponse {
+                recording: Recording::default(),
+                exact,
+                semantic,
+            });
+        }
+
+        Ok(false)
+    }
+
+    /// Sends cached `responses` through `response_tx`, restoring the rendered `prompt` of the
+    /// last request.
+    fn replay(
+        &self,
+        prompt: Option<&str>,
+        responses: Vec<Query>,
+        response_tx: &Sender<Query>,
+    ) -> Result<(), Error> {
+        if let Ok(mut last) = self.last_request.lock() {
+            if let Some(last) = last.as_mut() {
+                last.prompt = prompt.map(str::to_string);
+            }
+        }
+
+        // Replayed responses are not reported as generated by the model
+        if let Ok(mut timings) = self.timings.lock() {
+            if let Some(timings) = timings.as_mut() {
+                timings.replayed = true;
+            }
+        }
+
+        for response in responses {
+            response_tx
+                .send(response)
+                .map_err(|e| Error::StreamError(e.to_string()))?;
+        }
+
+        Ok(())
+    }
+}
+
+/// A generating query as processed by the model.
+#[derive(Debug, Clone)]
+pub struct RenderedRequest {
+    /// The query after the default system prompt has been applied
+    pub query: Query,
+
+    /// The prompt text the query has been fed to the model as, if the model renders prompts
+    pub prompt: Option<String>,
+}
+
+/// Records the prompt text of the running query in the [`RenderedRequest`] of the runtime, see
+/// [`LLMRuntimeModel::set_prompt_recorder`].
+#[derive(Debug, Clone, Default)]
+pub struct PromptRecorder(Arc<Mutex<Option<RenderedRequest>>>);
+
+impl PromptRecorder {
+    /// Records `prompt` as the prompt text of the running query.
+    pub fn record(&self, prompt: String) {
+        if let Ok(mut last) = self.0.lock() {
+            if let Some(last) = last.as_mut() {
+                last.prompt = Some(prompt);
+            }
+        }
+    }
+}
+
+/// Timings of a generating query, recorded while its response is received.
+struct RequestTimings {
+    sent: Instant,
+    first_chunk: Option<Instant>,
+
+    /// Time the worker spent loading the model before running the request
+    load: Option<Duration>,
+
+    /// Label of the window sending the request, used to account its usage
+    window: String,
+
+    /// Set, if the response is replayed from a cache instead of being generated
+    replayed: bool,
+}
+
+/// Returns the kind of a query handled by a model, used to label metrics.
+fn request_kind(query: &Query) -> Option<&'static str> {
+    match query {
+        Query::Prompt { .. } => Some("prompt"),
+        Query::Completion { .. } => Some("completion"),
+        Query::Infill { .. } => Some("infill"),
+        Query::Score { .. } => Some("score"),
+        Query::Classify { .. } => Some("classify"),
+        Query::Rerank { .. } => Some("rerank"),
+        Query::Embed { .. } => Some("embed"),
+        _ => None,
+    }
 }
 
 pub trait LLMRuntimeModel: Send + Sync {
@@ -37,11 +266,60 @@ pub trait LLMRuntimeModel: Send + Sync {
     fn execute(&mut self, _: Query, _: Arc<Sender<Query>>) -> Result<(), Error>;
 
     /// Sends a [`Query`] to the loaded model and accepts a response sender to send chunked messages
+    ///
+    /// Returns the token usage and the reason the generation finished.
     fn inference(
         &mut self,
         q: crate::Query,
         response_tx: Arc<std::sync::mpsc::Sender<crate::Query>>,
-    ) -> Result<Option<crate::TokenUsage>, crate::Error>;
+    ) -> Result<Option<(crate::TokenUsage, crate::FinishReason)>, crate::Error>;
+
+    /// Computes the log-likelihood of `continuation` following `context` in a single pass,
+    /// without generating any tokens.
+    fn score(&mut self, context: &str, continuation: &str) -> Result<crate::Score, crate::Error>;
+
+    /// Computes the probability of each of `labels` being the answer to `messages`, without
+    /// generating any tokens.
+    fn classify(
+        &mut self,
+        messages: &[crate::QueryMessage],
+        labels: &[String],
+    ) -> Result<crate::Classification, crate::Error>;
+
+    /// Scores the relevance of each of `documents` to `query` and returns the `top_n` most
+    /// relevant documents, ordered by descending relevance.
+    ///
+    /// Only supported by [`ModelKind::Reranker`] models.
+    fn rerank(
+        &mut self,
+        _query: &str,
+        _documents: &[String],
+        _top_n: Option<usize>,
+    ) -> Result<Vec<RerankResult>, crate::Error> {
+        Err(crate::Error::UnsupportedModelType(
+            "Reranking requires a reranker model".to_string(),
+        ))
+    }
+
+    /// Embeds each of `texts` into a normalized vector.
+    ///
+    /// Only supported by [`ModelKind::Embedding`] models.
+    fn embed(&mut self, _texts: &[String]) -> Result<Vec<Vec<f32>>, crate::Error> {
+        Err(crate::Error::UnsupportedModelType(
+            "Embeddings require an embedding model".to_string(),
+        ))
+    }
+
+    /// Sets the token cancelling the query currently run by the model.
+    ///
+    /// Models supporting cancellation check it between prefill blocks and generated tokens.
+    fn set_cancellation(&mut self, _cancellation: CancellationToken) {}
+
+    /// Sets the recorder of the prompt text generating queries are fed to the model as.
+    ///
+    /// Models rendering queries record the prompt before the end of the response, after the chat
+    /// template, token healing and context shifts have been applied.
+    fn set_prompt_recorder(&mut self, _recorder: PromptRecorder) {}
 
     /// Returns an arbitrary default chunk size.
     ///
@@ -69,6 +347,15 @@ impl LLMRuntime {
         let (response_stream_tx, response_stream_rx) = std::sync::mpsc::channel();
 
         Ok(Self {
+            system_prompt: DefaultSystemPrompt::from_config(&config),
+            prompt_variables: Map::new(),
+            last_request: Arc::new(Mutex::new(None)),
+            response_cache: config
+                .response_cache
+                .as_ref()
+                .map(|cache| Arc::new(Mutex::new(ResponseCache::new(&config, cache)))),
+            semantic_cache: None,
+            recording: Arc::new(Mutex::new(None)),
             config,
 
             worker: Arc::new(RwLock::new(None)),
@@ -80,12 +367,76 @@ impl LLMRuntime {
                 Arc::new(response_stream_tx),
                 Arc::new(Mutex::new(response_stream_rx)),
             ),
+            metrics: Arc::new(Metrics::default()),
+            timings: Arc::new(Mutex::new(None)),
+            usage: None,
+            cancellation: CancellationToken::default(),
         })
     }
 
-    /// Creates a model instance based on the model name.
+    /// Records the metrics of this runtime in `metrics` instead of its own registry.
+    ///
+    /// Must be called before [`Self::run_stream`].
+    pub fn set_metrics(&mut self, metrics: Arc<Metrics>) {
+        self.metrics = metrics;
+    }
+
+    /// Accounts the token usage of every generation in `usage`.
+    pub fn set_usage_store(&mut self, usage: Arc<Mutex<UsageStore>>) {
+        self.usage = Some(usage);
+    }
+
+    /// Shares `cancellation` with the model, e.g. to cancel queries without access to this
+    /// runtime.
+    ///
+    /// Must be called before [`Self::run_stream`].
+    pub fn set_cancellation(&mut self, cancellation: CancellationToken) {
+        self.cancellation = cancellation;
+    }
+
+    /// Cancels the query currently run by the model.
+    ///
+    /// Generating queries end with [`FinishReason::Cancelled`](crate::FinishReason::Cancelled)
+    /// once the current prefill block or token has been computed.
+    pub fn cancel(&self) {
+        self.cancellation.cancel();
+    }
+
+    /// Replays responses of prompts similar to previous prompts from `cache`.
+    pub(crate) fn set_semantic_cache(&mut self, cache: SemanticCache) {
+        self.semantic_cache = Some(Arc::new(Mutex::new(cache)));
+    }
+
+    /// Sets the variables available to the default system prompt, in addition to the built-in
+    /// variables of [`DefaultSystemPrompt`].
+    pub fn set_prompt_variables(&mut self, variables: Map<String, Value>) {
+        self.prompt_variables = variables;
+    }
+
+    /// Returns the last generating query sent to this runtime along with its rendered prompt.
+    ///
+    /// The rendered prompt is available as soon as the first response has been received.
+    pub fn last_request(&self) -> Option<RenderedRequest> {
+        self.last_request.lock().ok().and_then(|last| last.clone())
+    }
+
+    /// Returns the [`Metrics`] of this runtime
+    pub fn metrics(&self) -> &Arc<Metrics> {
+        &self.metrics
+    }
+
+    /// Returns the [`LLMRuntimeConfig`] of this runtime
+    pub fn config(&self) -> &LLMRuntimeConfig {
+        &self.config
+    }
+
+    /// Creates a model instance based on the model name and kind.
     /// Called lazily when the first Query::Prompt is received.
-    fn create_model(model_name: &str, device: Device) -> Result<Box<dyn LLMRuntimeModel>, Error> {
+    fn create_model(
+        model_name: &str,
+        kind: ModelKind,
+        device: Device,
+    ) -> Result<Box<dyn LLMRuntimeModel>, Error> {
         tracing::debug!("Loading Model: {model_name}");
         match model_name {
             // LocalRuntime must be checked first - it's a generic runtime that can load different model formats
@@ -93,7 +444,15 @@ impl LLMRuntime {
             name if name.starts_with("Mock") => {
                 tracing::debug!("Using Mock Runtime.");
 
-                Ok(Box::new(Mock))
+                Ok(Box::new(Mock::default()))
+            }
+            _ if kind == ModelKind::Reranker => {
+                tracing::info!("Using RerankerRuntime for model: {model_name}");
+                Ok(Box::new(RerankerRuntime::new(device)))
+            }
+            _ if kind == ModelKind::Embedding => {
+                tracing::info!("Using EmbeddingRuntime for model: {model_name}");
+                Ok(Box::new(EmbeddingRuntime::new(device)))
             }
             _ => {
                 // Fall back to LocalRuntime for unknown models - it will determine
@@ -105,7 +464,7 @@ impl LLMRuntime {
     }
 
     /// Loads the best default device that can be detected
-    fn load_default_device() -> Device {
+    pub(crate) fn load_default_device() -> Device {
         if cfg!(target_os = "macos") {
             match Device::new_metal(0) {
                 Ok(device) => {
@@ -215,6 +574,19 @@ impl LLMRuntime {
         };
 
         let response_tx = self.response.0.clone();
+        let metrics = self.metrics.clone();
+        let timings = self.timings.clone();
+        let last_request = self.last_request.clone();
+        let cancellation = self.cancellation.clone();
+        let replay = ResponseReplay {
+            model: config.name.clone(),
+            metrics: metrics.clone(),
+            timings: timings.clone(),
+            last_request: last_request.clone(),
+            response_cache: self.response_cache.clone(),
+            semantic_cache: self.semantic_cache.clone(),
+            recording: self.recording.clone(),
+        };
 
         tracing::debug!("Spawning worker thread (model will be loaded on first prompt)");
 
@@ -224,35 +596,79 @@ impl LLMRuntime {
             loop {
                 match control_rx.recv() {
                     Ok(message) => match message {
-                        Query::Prompt {
-                            model: ref query_model,
-                            ..
-                        } => {
+                        Query::Prompt { .. }
+                        | Query::Completion { .. }
+                        | Query::Infill { .. }
+                        | Query::Score { .. }
+                        | Query::Classify { .. }
+                        | Query::Rerank { .. }
+                        | Query::Embed { .. } => {
+                            metrics.record_dequeued(&config.name);
+
+                            // Cancelling applies to the query currently run, not to the next one
+                            cancellation.reset();
+
+                            // Cached responses are replayed without loading the model
+                            if matches!(
+                                message,
+                                Query::Prompt { .. }
+                                    | Query::Completion { .. }
+                                    | Query::Infill { .. }
+                            ) {
+                                match replay.replay_cached(&message, &response_tx) {
+                                    Ok(true) => continue,
+                                    Ok(false) => {}
+                                    Err(error) => {
+                                        tracing::warn!("Skipping response caches: {error}")
+                                    }
+                                }
+                            }
+
+                            if let Some(kind) = request_kind(&message) {
+                                metrics.record_request(&config.name, kind);
+                            }
+
                             if current_model.is_none() {
-                                let model_name = query_model
-                                    .as_ref()
-                                    .map(|s| s.as_str())
-                                    .unwrap_or(&config.name);
+                                let model_name = message.model().unwrap_or(config.name.as_str());
 
                                 tracing::debug!("Creating model: {}", model_name);
 
                                 let device = LLMRuntime::load_default_device();
+                                let loading = Instant::now();
 
-                                match Self::create_model(model_name, device) {
+                                match Self::create_model(
+                                    model_name,
+                                    config.kind.clone().unwrap_or_default(),
+                                    device,
+                                ) {
                                     Ok(mut model) => {
                                         tracing::debug!("Initializing model");
                                         if let Err(error) = model.init(&config) {
                                             tracing::error!("Error initializing model: {}", error);
+                                            metrics.record_error(&config.name, &error);
 
                                             let _ = response_tx.send(Query::Status {
                                                 msg: error.to_string(),
                                             });
                                             break;
                                         }
+                                        metrics.record_load(&config, loading.elapsed());
+
+                                        // The first request is reported without the load time
+                                        if let Ok(mut timings) = timings.lock() {
+                                            if let Some(timings) = timings.as_mut() {
+                                                timings.load = Some(loading.elapsed());
+                                            }
+                                        }
+                                        model.set_cancellation(cancellation.clone());
+                                        model.set_prompt_recorder(PromptRecorder(
+                                            last_request.clone(),
+                                        ));
                                         current_model = Some(model);
                                     }
                                     Err(error) => {
                                         tracing::error!("Error Creating Runtime: {error}");
+                                        metrics.record_error(&config.name, &error);
                                         let _ = response_tx.send(Query::Status {
                                             msg: error.to_string(),
                                         });
@@ -263,15 +679,66 @@ impl LLMRuntime {
 
                             if let Some(ref mut m) = current_model {
                                 tracing::debug!("Sending message to model");
-                                if let Err(error) = m.execute(message, response_tx.clone()) {
+
+                                let result = match message {
+                                    Query::Score {
+                                        context,
+                                        continuation,
+                                        timestamp,
+                                        ..
+                                    } => m.score(&context, &continuation).and_then(|score| {
+                                        response_tx
+                                            .send(Query::Scored { score, timestamp })
+                                            .map_err(|e| Error::StreamError(e.to_string()))
+                                    }),
+                                    Query::Classify {
+                                        messages,
+                                        labels,
+                                        timestamp,
+                                        ..
+                                    } => {
+                                        m.classify(&messages, &labels).and_then(|classification| {
+                                            response_tx
+                                                .send(Query::Classified {
+                                                    classification,
+                                                    timestamp,
+                                                })
+                                                .map_err(|e| Error::StreamError(e.to_string()))
+                                        })
+                                    }
+                                    Query::Rerank {
+                                        query,
+                                        documents,
+                                        top_n,
+                                        timestamp,
+                                        ..
+                                    } => m.rerank(&query, &documents, top_n).and_then(|results| {
+                                        response_tx
+                                            .send(Query::Reranked { results, timestamp })
+                                            .map_err(|e| Error::StreamError(e.to_string()))
+                                    }),
+                                    Query::Embed {
+                                        texts, timestamp, ..
+                                    } => m.embed(&texts).and_then(|embeddings| {
+                                        response_tx
+                                            .send(Query::Embedded {
+                                                embeddings,
+                                                timestamp,
+                                            })
+                                            .map_err(|e| Error::StreamError(e.to_string()))
+                                    }),
+                                    message => m.execute(message, response_tx.clone()),
+                                };
+
+                                // Rejected requests end with a status, the model stays loaded
+                                // for the next request
+                                if let Err(error) = result {
                                     tracing::error!("Error execute streaming: {error}");
+                                    metrics.record_error(&config.name, &error);
 
                                     let _ = response_tx.send(Query::Status {
                                         msg: error.to_string(),
                                     });
-
-                                    
-                                    break;
                                 }
                             }
                         }
@@ -283,6 +750,8 @@ impl LLMRuntime {
                     }
                 }
             }
+
+            metrics.record_unload(&config.name);
         });
 
         *self.worker.write().expect("Failed to acquire write lock") = Some(worker);
@@ -290,23 +759,347 @@ impl LLMRuntime {
         Ok(())
     }
 
+    /// Sends `msg` to the worker, see [`Self::send_stream_from`]. The usage of generations is
+    /// accounted for the [`BACKEND_WINDOW`].
     pub fn send_stream(&self, msg: Query) -> Result<(), Error> {
-        self.control
+        self.send_stream_from(msg, BACKEND_WINDOW)
+    }
+
+    /// Sends `msg` to the worker. The responses are received with [`Self::recv_stream`].
+    ///
+    /// The usage of generations is accounted for the label of the sending `window`.
+    pub fn send_stream_from(&self, msg: Query, window: &str) -> Result<(), Error> {
+        // The system prompt is rendered at request time, so that variables like the date are current
+        let msg = match self.system_prompt.as_ref() {
+            Some(system_prompt) => system_prompt.apply_query(msg, &self.prompt_variables)?,
+            None => msg,
+        };
+
+        let enqueued = request_kind(&msg).is_some();
+
+        if enqueued {
+            *self
+                .timings
+                .lock()
+                .map_err(|e| Error::ExecutionError(e.to_string()))? = Some(RequestTimings {
+                sent: Instant::now(),
+                first_chunk: None,
+                load: None,
+                window: window.to_string(),
+                replayed: false,
+            });
+        }
+
+        if matches!(
+            msg,
+            Query::Prompt { .. } | Query::Completion { .. } | Query::Infill { .. }
+        ) {
+            *self
+                .last_request
+                .lock()
+                .map_err(|e| Error::ExecutionError(e.to_string()))? = Some(RenderedRequest {
+                query: msg.clone(),
+                prompt: None,
+            });
+        }
+
+        if enqueued {
+            // Counted before sending, the worker may pick up the query right away
+            self.metrics.record_enqueued(&self.config.name);
+        }
+
+        let result = self
+            .control
             .0
             .read()
             .map_err(|e| Error::ExecutionError(e.to_string()))?
             .send(msg)
-            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+            .map_err(|e| Error::ExecutionError(e.to_string()));
 
-        Ok(())
+        if enqueued && result.is_err() {
+            self.metrics.record_dequeued(&self.config.name);
+        }
+
+        result
     }
 
     pub fn recv_stream(&self) -> Result<Query, Error> {
-        self.response
+        let message = self
+            .response
             .1
             .lock()
             .map_err(|e| Error::StreamError(e.to_string()))?
             .recv()
-            .map_err(|e| Error::StreamError(e.to_string()))
+            .map_err(|e| Error::StreamError(e.to_string()))?;
+
+        self.record_response(&message);
+        self.cache_response(&message);
+
+        Ok(message)
+    }
+
+    /// Records the chunks of a cacheable response and caches it at the end of the stream.
+    fn cache_response(&self, message: &Query) {
+        let Ok(mut recording) = self.recording.lock() else {
+            return;
+        };
+
+        match message {
+            Query::Chunk { id, data, kind, .. } => {
+                if let Some(pending) = recording.as_mut() {
+                    pending.recording.push(*id, data, kind);
+                }
+            }
+            Query::End {
+                usage,
+                finish_reason,
+                ..
+            } => {
+                let Some(pending) = recording.take() else {
+                    return;
+                };
+                let prompt = self.last_request().and_then(|last| last.prompt);
+
+                // Cancelled or aborted responses are truncated and would be replayed as such
+                let complete = matches!(
+                    finish_reason,
+                    Some(FinishReason::Stop | FinishReason::Length)
+                );
+
+                if let (Some(key), Some(cache)) = (
+                    pending.exact.filter(|_| complete),
+                    self.response_cache.as_ref(),
+                ) {
+                    let response = pending.recording.finish(
+                        key,
+                        prompt.clone(),
+                        usage.clone(),
+                        *finish_reason,
+                    );
+
+                    if let Ok(mut cache) = cache.lock() {
+                        cache.insert(response);
+                    }
+                }
+
+                if let (Some(key), Some(cache)) = (
+                    pending.semantic.filter(|_| complete),
+                    self.semantic_cache.as_ref(),
+                ) {
+                    let response = pending.recording.finish(
+                        key.scope().to_string(),
+                        prompt,
+                        usage.clone(),
+                        *finish_reason,
+                    );
+
+                    if let Ok(mut cache) = cache.lock() {
+                        cache.insert(key, response);
+                    }
+                }
+            }
+            Query::Status { .. } => *recording = None,
+            _ => {}
+        }
+    }
+
+    /// Accounts the `usage` of the generation of `request` in the usage store, if set.
+    fn account_usage(&self, request: &RequestTimings, usage: &TokenUsage) {
+        let Some(store) = self.usage.as_ref() else {
+            return;
+        };
+
+        let recorded = store
+            .lock()
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+            .and_then(|mut store| {
+                store.record(
+                    &self.config.name,
+                    &request.window,
+                    usage,
+                    request.sent.elapsed(),
+                )
+            });
+
+        if let Err(e) = recorded {
+            tracing::warn!("Error recording usage: {e}");
+        }
+    }
+
+    /// Records time to first token, decode rate and token usage of a streamed generation.
+    fn record_response(&self, message: &Query) {
+        let Ok(mut timings) = self.timings.lock() else {
+            return;
+        };
+        let model = self.config.name.as_str();
+
+        match (message, timings.as_mut()) {
+            (Query::Chunk { .. }, Some(timings))
+                if timings.first_chunk.is_none() && !timings.replayed =>
+            {
+                let now = Instant::now();
+                match timings.load {
+                    Some(load) => {
+                        self.metrics
+                            .record_first_request_token(model, now - timings.sent, load)
+                    }
+                    None => self.metrics.record_first_token(model, now - timings.sent),
+                }
+                timings.first_chunk = Some(now);
+            }
+            (Query::End { usage, .. }, Some(request)) => {
+                if let Some(usage) = usage {
+                    if !request.replayed {
+                        let decode = request.first_chunk.map(|first| first.elapsed());
+                        self.metrics.record_usage(model, usage, decode);
+                    }
+
+                    self.account_usage(request, usage);
+                }
+                *timings = None;
+            }
+            (
+                Query::Status { .. }
+                | Query::Scored { .. }
+                | Query::Classified { .. }
+                | Query::Reranked { .. }
+                | Query::Embedded { .. },
+                _,
+            ) => *timings = None,
+            _ => {}
+        }
+    }
+}
+
+/// Completion impl
+impl LLMRuntime {
+    /// Sends `query` and blocks until the generation ended. Returns the complete text output,
+    /// tool call chunks are skipped.
+    pub fn complete(&self, query: Query) -> Result<String, Error> {
+        self.send_stream(query)?;
+
+        let mut output = vec![];
+
+        loop {
+            match self.recv_stream()? {
+                Query::Chunk {
+                    kind: QueryChunkType::ToolCall,
+                    ..
+                } => {}
+                Query::Chunk { data, .. } => output.extend(data),
+                Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+                Query::End { .. } => break,
+                _ => {}
+            }
+        }
+
+        Ok(String::from_utf8_lossy(&output).into_owned())
+    }
+
+    /// Scores `continuation` following `context` and blocks until the score is computed.
+    pub fn score(&self, context: &str, continuation: &str) -> Result<crate::Score, Error> {
+        self.send_stream(Query::Score {
+            context: context.to_string(),
+            continuation: continuation.to_string(),
+            model: None,
+            timestamp: None,
+        })?;
+
+        loop {
+            match self.recv_stream()? {
+                Query::Scored { score, .. } => return Ok(score),
+                Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+                _ => {}
+            }
+        }
+    }
+
+    /// Classifies `messages` into one of `labels` and blocks until the label probabilities are
+    /// computed.
+    pub fn classify(
+        &self,
+        messages: Vec<crate::QueryMessage>,
+        labels: Vec<String>,
+    ) -> Result<crate::Classification, Error> {
+        self.send_stream(Query::Classify {
+            messages,
+            labels,
+            model: None,
+            timestamp: None,
+        })?;
+
+        loop {
+            match self.recv_stream()? {
+                Query::Classified { classification, .. } => return Ok(classification),
+                Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+                _ => {}
+            }
+        }
+    }
+
+    /// Reranks `documents` by their relevance to `query` and blocks until the documents are
+    /// scored. Returns the `top_n` most relevant documents, or all if `None`.
+    pub fn rerank(
+        &self,
+        query: &str,
+        documents: Vec<String>,
+        top_n: Option<usize>,
+    ) -> Result<Vec<RerankResult>, Error> {
+        self.send_stream(Query::Rerank {
+            query: query.to_string(),
+            documents,
+            top_n,
+            model: None,
+            timestamp: None,
+        })?;
+
+        loop {
+            match self.recv_stream()? {
+                Query::Reranked { results, .. } => return Ok(results),
+                Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+                _ => {}
+            }
+        }
+    }
+
+    /// Embeds each of `texts` and blocks until the embeddings are computed.
+    pub fn embed(&self, texts: Vec<String>) -> Result<Vec<Vec<f32>>, Error> {
+        self.send_stream(Query::Embed {
+            texts,
+            model: None,
+            timestamp: None,
+        })?;
+
+        loop {
+            match self.recv_stream()? {
+                Query::Embedded { embeddings, .. } => return Ok(embeddings),
+                Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+                _ => {}
+            }
+        }
+    }
+
+    /// Sends a [`Query::Prompt`] and deserializes the output into `T`.
+    ///
+    /// The JSON schema of `T` is added to the leading system message. Output not matching `T`
+    /// is sent back to the model with a corrective message, at most `max_retries` times.
+    ///
+    /// # Errors
+    ///
+    /// Returns [`Error::StructuredOutput`] with the raw output of the last attempt, if no attempt
+    /// could be deserialized, and [`Error::UnexpectedMessage`] for queries other than
+    /// [`Query::Prompt`].
+    pub fn complete_structured<T>(&self, query: Query, max_retries: usize) -> Result<T, Error>
+    where
+        T: DeserializeOwned + JsonSchema,
+    {
+        structured::complete(query, max_retries, |query| self.complete(query)).inspect_err(
+            |error| {
+                // Errors of the generations are counted by the worker
+                if structured::is_rejection(error) {
+                    self.metrics.record_error(&self.config.name, error);
+                }
+            },
+        )
     }
 }
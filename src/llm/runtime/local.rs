@@ -4,18 +4,24 @@ use std::fs::File;
 use std::sync::Arc;
 
 use crate::error::Error;
-use crate::iter::IntoIterChunks;
-use crate::runtime::{LLMRuntimeModel, Query};
+use crate::iter::{FlushPolicy, IntoIterChunks};
+use crate::runtime::{LLMRuntimeModel, PromptRecorder, Query};
 use crate::{
-    GenerationSeed, LLMRuntimeConfig, SamplingConfig, TemplateProcessor, TokenUsage,
-    TokenizerConfig,
+    CancellationToken, ChunkedPrefill, Classification, CompletionInput, ContextShift, FinishReason,
+    GenerationSeed, LLMRuntimeConfig, MessageNormalization, QueryMessage, RepetitionGuard,
+    SamplingConfig, Score, SpecialTokenPolicy, TemplateProcessor, TokenHealing, TokenLogprob,
+    TokenUsage, TokenizerConfig,
 };
-use candle_core::{Device, Tensor};
+use candle_core::{DType, Device, Tensor, D};
 use candle_transformers::generation::{LogitsProcessor, Sampling};
 use rand::Rng;
 use tokenizers::Tokenizer;
 
 use crate::llm::backend::{self, ModelBackend};
+use crate::llm::fim::{FimTokenIds, FimTokens};
+use crate::llm::prompt_cache::{CachedPrefix, PromptCache};
+use crate::llm::repetition::{RepetitionVerdict, RepetitionWatchdog};
+use crate::llm::token_healing::{strip_common_prefix, Healer, VocabText};
 
 /// A generic local runtime that can load models in different formats.
 ///
@@ -30,7 +36,137 @@ pub struct LocalRuntime {
     pub(crate) backend: Option<Box<dyn ModelBackend>>,
     pub(crate) template: Option<String>,
     pub(crate) template_proc: Option<TemplateProcessor>,
+    pub(crate) message_normalization: Option<MessageNormalization>,
     pub(crate) eos_token_ids: Vec<u32>,
+    pub(crate) fim_token_ids: Option<FimTokenIds>,
+    pub(crate) prompt_cache: Option<PromptCache>,
+    pub(crate) context_shift: Option<ContextShift>,
+    pub(crate) chunked_prefill: Option<ChunkedPrefill>,
+
+    /// Cancels the query currently run, checked between prefill blocks and generated tokens
+    pub(crate) cancellation: CancellationToken,
+
+    /// Records the prompt text fed to the model
+    pub(crate) prompt_recorder: PromptRecorder,
+
+    /// Context length declared by the model config
+    pub(crate) context_length: Option<usize>,
+    pub(crate) repetition_guard: Option<RepetitionGuard>,
+    pub(crate) special_token_policy: SpecialTokenPolicy,
+    pub(crate) bos_token: Option<String>,
+    pub(crate) token_healing: Option<TokenHealing>,
+
+    /// Decoded vocabulary, built on first use by token healing
+    pub(crate) vocab_text: Option<VocabText>,
+}
+
+/// Sampling, stopping and streaming options shared by all generating [`Query`] variants.
+pub(crate) struct GenerationOptions {
+    pub(crate) chunk_size: usize,
+
+    /// When generated tokens are flushed as a chunk
+    pub(crate) flush: FlushPolicy,
+
+    pub(crate) timestamp: Option<u64>,
+    pub(crate) max_tokens: usize,
+    pub(crate) temperature: Option<f32>,
+    pub(crate) top_k: Option<f32>,
+    pub(crate) top_p: Option<f32>,
+    pub(crate) penalty: f32,
+    pub(crate) seed: Option<GenerationSeed>,
+    pub(crate) sampling_config: Option<SamplingConfig>,
+
+    /// Tokens ending generation in addition to the model's EOS tokens
+    pub(crate) stop_token_ids: Vec<u32>,
+
+    /// Whether the output is parsed for tool calls
+    pub(crate) parse_tool_calls: bool,
+
+    /// Leading prompt tokens kept when the context is shifted
+    pub(crate) keep_tokens: usize,
+
+    /// Per-query override of [`SpecialTokenPolicy::add_special_tokens`]
+    pub(crate) add_special_tokens: Option<bool>,
+
+    /// Per-query override of [`SpecialTokenPolicy::skip_special_tokens`]
+    pub(crate) skip_special_tokens: Option<bool>,
+
+    /// Text removed from the end of the prompt, or of the infill prefix, by token healing
+    pub(crate) healed_text: Option<String>,
+}
+
+impl GenerationOptions {
+    /// Extracts the generation options from a [`Query::Prompt`], [`Query::Completion`] or
+    /// [`Query::Infill`].
+    ///
+    /// Returns `None` for any other variant.
+    pub(crate) fn from_query(query: &Query, default_chunksize: usize) -> Option<Self> {
+        match query {
+            Query::Prompt {
+                chunk_size,
+                timestamp,
+                max_tokens,
+                temperature,
+                top_k,
+                top_p,
+                penalty,
+                seed,
+                sampling_config,
+                add_special_tokens,
+                skip_special_tokens,
+                flush,
+                ..
+            }
+            | Query::Completion {
+                chunk_size,
+                timestamp,
+                max_tokens,
+                temperature,
+                top_k,
+                top_p,
+                penalty,
+                seed,
+                sampling_config,
+                add_special_tokens,
+                skip_special_tokens,
+                flush,
+                ..
+            }
+            | Query::Infill {
+                chunk_size,
+                timestamp,
+                max_tokens,
+                temperature,
+                top_k,
+                top_p,
+                penalty,
+                seed,
+                sampling_config,
+                add_special_tokens,
+                skip_special_tokens,
+                flush,
+                ..
+            } => Some(Self {
+                chunk_size: chunk_size.unwrap_or(default_chunksize),
+                flush: flush.unwrap_or_default(),
+                timestamp: *timestamp,
+                max_tokens: max_tokens.unwrap_or(500),
+                temperature: *temperature,
+                top_k: *top_k,
+                top_p: *top_p,
+                penalty: penalty.unwrap_or(1.1).max(0.1),
+                seed: seed.clone(),
+                sampling_config: sampling_config.clone(),
+                stop_token_ids: vec![],
+                parse_tool_calls: matches!(query, Query::Prompt { .. }),
+                keep_tokens: 0,
+                add_special_tokens: *add_special_tokens,
+                skip_special_tokens: *skip_special_tokens,
+                healed_text: None,
+            }),
+            _ => None,
+        }
+    }
 }
 
 impl LocalRuntime {
@@ -87,6 +223,687 @@ impl LocalRuntime {
 
         LogitsProcessor::from_sampling(seed, sampling)
     }
+
+    /// Renders the chat template for a [`Query::Prompt`].
+    ///
+    /// Falls back to plain `role: content` lines, if the model does not provide a template.
+    /// A trailing partial `assistant` message is left open, if the query continues it.
+    fn render_prompt(&self, message: &Query) -> Result<String, Error> {
+        match self.template.as_ref() {
+            Some(template) => {
+                let proc = self.template_proc.as_ref().ok_or(Error::ExecutionError(
+                    "Template processor is not initialized".to_string(),
+                ))?;
+
+                match message {
+                    Query::Prompt {
+                        continue_final_message: true,
+                        ..
+                    } => message.apply_template_continue_final_message(template, proc),
+                    _ => message.apply_template(template, proc),
+                }
+            }
+            None => {
+                let Query::Prompt { messages, .. } = message else {
+                    return Err(Error::UnexpectedMessage);
+                };
+
+                tracing::warn!("No template found. Using plain message content");
+                Ok(messages
+                    .iter()
+                    .map(|m| format!("{}: {}", m.role, m.content))
+                    .collect::<Vec<_>>()
+                    .join("\n"))
+            }
+        }
+    }
+
+    /// Renders the chat template for `messages`, followed by the generation prompt opening the
+    /// assistant's answer.
+    ///
+    /// Falls back to plain `role: content` lines, if the model does not provide a template.
+    fn render_messages(&self, messages: &[QueryMessage]) -> Result<String, Error> {
+        let (Some(template), Some(proc)) = (self.template.as_ref(), self.template_proc.as_ref())
+        else {
+            tracing::warn!("No template found. Using plain message content");
+            return Ok(messages
+                .iter()
+                .map(|m| format!("{}: {}", m.role, m.content))
+                .chain(std::iter::once("assistant: ".to_string()))
+                .collect::<Vec<_>>()
+                .join("\n"));
+        };
+
+        let context = serde_json::json!({
+            "messages": messages,
+            "add_generation_prompt": true,
+        });
+
+        proc.render(template, &context.to_string())
+    }
+
+    /// Returns whether special tokens are added when encoding the prompt `text`.
+    ///
+    /// Unless requested or configured otherwise, special tokens are only added if the prompt
+    /// does not already start with the BOS token.
+    fn add_special_tokens(&self, requested: Option<bool>, text: &str) -> bool {
+        requested
+            .or(self.special_token_policy.add_special_tokens)
+            .unwrap_or_else(|| {
+                !self
+                    .bos_token
+                    .as_deref()
+                    .is_some_and(|bos| !bos.is_empty() && text.starts_with(bos))
+            })
+    }
+
+    /// Encodes a prompt `text`, adding special tokens according to [`Self::add_special_tokens`].
+    fn encode_prompt(&self, text: &str, requested: Option<bool>) -> Result<Vec<u32>, Error> {
+        self.encode(text, self.add_special_tokens(requested, text))
+    }
+
+    /// Encodes `text` into token ids
+    fn encode(&self, text: &str, add_special_tokens: bool) -> Result<Vec<u32>, Error> {
+        let tokenizer = self.tokenizer.as_ref().ok_or(Error::ExecutionError(
+            "Tokenizer is not initialized".to_string(),
+        ))?;
+
+        let encoding = tokenizer
+            .encode(text, add_special_tokens)
+            .map_err(|e| Error::MessageEncodingError(e.to_string()))?;
+
+        Ok(encoding.get_ids().to_vec())
+    }
+
+    /// Decodes prompt `tokens` including their special tokens.
+    fn decode_prompt(tokenizer: &Tokenizer, tokens: &[u32]) -> Result<String, Error> {
+        tokenizer
+            .decode(tokens, false)
+            .map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+
+    /// Returns the token ids of a cached prompt prefix.
+    ///
+    /// Messages are normalized and rendered with the chat template like a regular prompt.
+    fn encode_prefix(&self, prefix: &CachedPrefix) -> Result<Vec<u32>, Error> {
+        let messages = match prefix {
+            CachedPrefix::Text { text } => return self.encode_prompt(text, None),
+            CachedPrefix::Messages { messages } => match self.message_normalization.as_ref() {
+                Some(rules) => rules.apply(messages.clone()),
+                None => messages.clone(),
+            },
+        };
+
+        let (Some(template), Some(proc)) = (self.template.as_ref(), self.template_proc.as_ref())
+        else {
+            return Err(Error::MissingConfigLLM(
+                "Caching message prefixes requires a chat template".to_string(),
+            ));
+        };
+
+        let context = serde_json::json!({ "messages": messages }).to_string();
+        self.encode_prompt(&proc.render(template, &context)?, None)
+    }
+
+    /// Returns the number of leading `tokens` belonging to the leading `system` messages of a
+    /// [`Query::Prompt`]. These are kept when the context is shifted.
+    fn system_prefix_len(&self, message: &Query, tokens: &[u32]) -> usize {
+        let Query::Prompt { messages, .. } = message else {
+            return 0;
+        };
+
+        let messages: Vec<_> = messages
+            .iter()
+            .take_while(|m| m.role.eq("system"))
+            .cloned()
+            .collect();
+
+        if messages.is_empty() {
+            return 0;
+        }
+
+        match self.encode_prefix(&CachedPrefix::Messages { messages }) {
+            Ok(prefix) if tokens.starts_with(&prefix) => prefix.len(),
+            _ => 0,
+        }
+    }
+
+    /// Returns the token ids for raw text completion, bypassing the chat template.
+    fn encode_completion_input(
+        &self,
+        input: &CompletionInput,
+        add_special_tokens: Option<bool>,
+    ) -> Result<Vec<u32>, Error> {
+        match input {
+            CompletionInput::Prompt(text) => self.encode_prompt(text, add_special_tokens),
+            CompletionInput::TokenIds(ids) => {
+                let tokenizer = self.tokenizer.as_ref().ok_or(Error::ExecutionError(
+                    "Tokenizer is not initialized".to_string(),
+                ))?;
+                let vocab_size = tokenizer.get_vocab_size(true);
+
+                if let Some(id) = ids.iter().find(|id| **id as usize >= vocab_size) {
+                    return Err(Error::MessageEncodingError(format!(
+                        "Token id {id} exceeds the vocabulary size ({vocab_size})"
+                    )));
+                }
+
+                Ok(ids.clone())
+            }
+        }
+    }
+
+    /// Builds the fill-in-the-middle prompt for `prefix` and `suffix`.
+    ///
+    /// Returns the prompt tokens, the tokens ending the middle segment and the text removed from
+    /// the end of the prefix by token healing.
+    fn encode_infill(
+        &mut self,
+        prefix: &str,
+        suffix: &str,
+        add_special_tokens: Option<bool>,
+    ) -> Result<(Vec<u32>, Vec<u32>, Option<String>), Error> {
+        let fim = self.fim_token_ids.clone().ok_or(Error::MissingConfigLLM(
+            "Model does not provide fill-in-the-middle tokens".to_string(),
+        ))?;
+
+        // Special tokens the tokenizer puts around any input (e.g. BOS) are placed in front of
+        // the FIM prompt, encoding the segments with special tokens would scatter them
+        let leading: Vec<u32> = self
+            .encode("", self.add_special_tokens(add_special_tokens, prefix))?
+            .into_iter()
+            .filter(|id| !self.eos_token_ids.contains(id))
+            .collect();
+
+        let prefix = self.encode(prefix, false)?;
+        let suffix = self.encode(suffix, false)?;
+
+        // The middle segment continues the prefix, so the end of the prefix is healed. The prefix
+        // marker is kept in front, so that the first prefix token can be removed as well.
+        let mut head = [&[fim.prefix], prefix.as_slice()].concat();
+        let healed_text = self.heal_prompt(&mut head)?;
+
+        Ok((
+            fim.build_prompt(&leading, &head[1..], &suffix),
+            fim.stop_tokens(),
+            healed_text,
+        ))
+    }
+
+    /// Removes the last prompt tokens for token healing, if enabled.
+    ///
+    /// Returns the removed text, which the first generated tokens are constrained to.
+    fn heal_prompt(&mut self, tokens: &mut Vec<u32>) -> Result<Option<String>, Error> {
+        let Some(healing) = self.token_healing.as_ref() else {
+            return Ok(None);
+        };
+
+        let tokenizer = self.tokenizer.as_ref().ok_or(Error::ExecutionError(
+            "Tokenizer is not initialized".to_string(),
+        ))?;
+
+        if self.vocab_text.is_none() {
+            tracing::debug!("Decoding vocabulary for token healing");
+            self.vocab_text = Some(VocabText::new(tokenizer)?);
+        }
+
+        let vocab = self.vocab_text.as_ref().unwrap();
+
+        let Some((kept, removed)) = healing.back_off(tokens, tokenizer, vocab)? else {
+            return Ok(None);
+        };
+
+        tracing::debug!("Token healing removed '{removed}' from the prompt");
+        tokens.truncate(kept);
+
+        Ok(Some(removed))
+    }
+
+    /// Prepares the KV cache for a prefill of `tokens` and returns the number of leading tokens
+    /// it already holds.
+    ///
+    /// The KV cache of the first `kept` tokens is truncated and reused, e.g. the prefix retained
+    /// by a context shift, whose positions do not change. Otherwise the KV cache is cleared and
+    /// the longest cached prompt prefix is restored.
+    fn reuse_kv_cache(
+        backend: &mut dyn ModelBackend,
+        prompt_cache: Option<&PromptCache>,
+        tokens: &[u32],
+        kept: usize,
+    ) -> usize {
+        // At least one token is left for the forward pass, since its logits are needed for sampling
+        let kept = kept.min(tokens.len().saturating_sub(1));
+
+        if let Some(snapshot) = backend
+            .snapshot_kv_cache()
+            .filter(|_| kept > 0)
+            .and_then(|snapshot| snapshot.truncate(kept))
+        {
+            match backend.restore_kv_cache(&snapshot) {
+                Ok(()) => return kept,
+                Err(error) => tracing::warn!("Failed to truncate the KV cache: {error}"),
+            }
+        }
+
+        backend.clear_kv_cache();
+
+        prompt_cache
+            .map(|cache| cache.restore(backend, tokens))
+            .unwrap_or(0)
+    }
+
+    /// Fills the KV cache holding the first `cached` of `tokens` with the remaining tokens and
+    /// returns the logits of the last token.
+    ///
+    /// The remaining tokens are fed in the blocks of `chunked`, `on_block` is called with the
+    /// number of prefilled tokens after each block. Returns `None`, if `cancellation` has been
+    /// cancelled before the last block.
+    fn prefill(
+        backend: &mut dyn ModelBackend,
+        device: &Device,
+        tokens: &[u32],
+        cached: usize,
+        chunked: &ChunkedPrefill,
+        cancellation: &CancellationToken,
+        on_block: &mut dyn FnMut(usize),
+    ) -> Result<Option<Tensor>, Error> {
+        chunked.run(cached..tokens.len(), cancellation, |block| {
+            let input = Tensor::new(&tokens[block.clone()], device)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?
+                .unsqueeze(0)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+            let logits = backend.forward(&input, block.start)?;
+            on_block(block.end);
+
+            Ok(logits)
+        })
+    }
+
+    /// Returns the log-probability of each of `tokens` and whether it is the most likely token
+    /// at its position. `logits` [tokens, vocab_size] are the logits predicting `tokens`.
+    fn token_logprobs(logits: &Tensor, tokens: &[u32]) -> Result<Vec<(f32, bool)>, Error> {
+        let logprobs = logits
+            .to_dtype(DType::F32)
+            .and_then(|logits| candle_nn::ops::log_softmax(&logits, D::Minus1))
+            .and_then(|logprobs| logprobs.to_vec2::<f32>())
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        tokens
+            .iter()
+            .zip(logprobs)
+            .map(|(id, logprobs)| {
+                // Tokenizers may add tokens beyond the vocabulary of the model
+                let logprob = *logprobs.get(*id as usize).ok_or_else(|| {
+                    Error::MessageEncodingError(format!(
+                        "Token id {id} exceeds the vocabulary size of the model ({})",
+                        logprobs.len()
+                    ))
+                })?;
+
+                Ok((logprob, logprobs.iter().all(|other| *other <= logprob)))
+            })
+            .collect()
+    }
+
+    /// Runs the generation loop for the prompt `tokens` and streams the decoded chunks.
+    fn generate(
+        &mut self,
+        tokens: &[u32],
+        options: GenerationOptions,
+        response_tx: Arc<std::sync::mpsc::Sender<Query>>,
+    ) -> Result<(TokenUsage, FinishReason), Error> {
+        let GenerationOptions {
+            chunk_size,
+            flush,
+            timestamp,
+            max_tokens: generate_num_samples,
+            temperature,
+            top_k,
+            top_p,
+            penalty,
+            seed,
+            sampling_config,
+            stop_token_ids,
+            parse_tool_calls,
+            keep_tokens,
+            add_special_tokens: _,
+            skip_special_tokens,
+            healed_text,
+        } = options;
+
+        let skip_special_tokens = skip_special_tokens
+            .or(self.special_token_policy.skip_special_tokens)
+            .unwrap_or(true);
+
+        if tokens.is_empty() {
+            return Err(Error::MessageEncodingError(
+                "Prompt does not contain any tokens".to_string(),
+            ));
+        }
+
+        // Create logits processor with runtime parameters
+        let mut logits_processor =
+            Self::create_logits_processor(temperature, top_k, top_p, seed, sampling_config);
+
+        let tokenizer = self.tokenizer.as_ref().unwrap();
+        let backend = self.backend.as_mut().unwrap();
+        let device = self.device.as_ref().unwrap();
+        let prompt_cache = self.prompt_cache.as_ref();
+        let context_shift = self.context_shift.as_ref();
+        let context_length =
+            context_shift.and_then(|shift| shift.context_length.or(self.context_length));
+        let chunked = self
+            .chunked_prefill
+            .clone()
+            .unwrap_or(ChunkedPrefill::UNCHUNKED);
+        let report_progress = self.chunked_prefill.is_some();
+        let cancellation = &self.cancellation;
+        let prompt_recorder = &self.prompt_recorder;
+
+        // Shifts `context` to fit into the context window and notifies the client. Returns the
+        // number of leading tokens left in place, or `None` if nothing can be discarded.
+        let shift_tx = response_tx.clone();
+        let shift = |context: &mut Vec<u32>, context_length: usize| -> Option<usize> {
+            let (shifted, discarded) = context_shift
+                .and_then(|shift| shift.shift(context, keep_tokens, context_length))?;
+
+            tracing::info!("Context window is full, discarding {discarded} tokens");
+            let kept = context
+                .iter()
+                .zip(&shifted)
+                .take_while(|(old, new)| old == new)
+                .count();
+            *context = shifted;
+
+            if let Err(e) = shift_tx.send(Query::ContextShift {
+                discarded,
+                kept: context.len(),
+                timestamp,
+            }) {
+                tracing::warn!("Error sending context shift: {e}");
+            }
+
+            Some(kept)
+        };
+
+        // Tokens currently held in the KV cache
+        let mut context = tokens.to_vec();
+
+        if let Some(context_length) = context_length.filter(|l| context.len() >= *l) {
+            if shift(&mut context, context_length).is_none() {
+                return Err(Error::MessageEncodingError(format!(
+                    "Prompt of {} tokens exceeds the context length of {context_length} tokens",
+                    context.len()
+                )));
+            }
+
+            prompt_recorder.record(Self::decode_prompt(tokenizer, &context)?);
+        }
+
+        // Constrains the first tokens to the text removed by token healing, which is stripped
+        // from the output again
+        let mut healer = healed_text
+            .clone()
+            .zip(self.vocab_text.as_ref())
+            .map(|(removed, vocab)| Healer::new(vocab, removed));
+        let mut strip_prefix = healed_text.unwrap_or_default();
+
+        // Reports the prefilled prompt tokens after each block
+        let total = context.len();
+        let mut on_block = |processed: usize| {
+            if !report_progress {
+                return;
+            }
+
+            if let Err(e) = response_tx.send(Query::PrefillProgress {
+                processed,
+                total,
+                timestamp,
+            }) {
+                tracing::warn!("Error sending prefill progress: {e}");
+            }
+        };
+
+        // Get first token
+        let mut next_token = {
+            let cached = Self::reuse_kv_cache(backend.as_mut(), prompt_cache, &context, 0);
+
+            let Some(logits) = Self::prefill(
+                backend.as_mut(),
+                device,
+                &context,
+                cached,
+                &chunked,
+                cancellation,
+                &mut on_block,
+            )?
+            else {
+                tracing::debug!("Generation has been cancelled during prefill");
+
+                return Ok((
+                    TokenUsage {
+                        prompt_tokens: tokens.len(),
+                        completion_tokens: 0,
+                        total_tokens: tokens.len(),
+                    },
+                    FinishReason::Cancelled,
+                ));
+            };
+
+            let logits = logits
+                .squeeze(0)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+            let logits = match healer.as_ref() {
+                Some(healer) => healer.constrain(&logits)?,
+                None => logits,
+            };
+
+            let token = logits_processor
+                .sample(&logits)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+            if let Some(healer) = healer.as_mut() {
+                healer.accept(token);
+            }
+
+            token
+        };
+
+        let mut all_tokens = vec![next_token];
+
+        let eos_token_ids = &self.eos_token_ids;
+
+        let mut index = 0usize;
+        let mut done = false;
+        let mut sample_error: Option<Error> = None;
+        let mut finish_reason = FinishReason::Length;
+
+        // Raised by the repetition watchdog, if the model is caught in a loop
+        let mut penalty_boost = 0f32;
+        let mut watchdog = self.repetition_guard.as_ref().map(RepetitionWatchdog::new);
+
+        // Token iterator: yields tokens until EOS, max_tokens, repetition loop, or error
+        let token_iter = std::iter::once(next_token).chain(std::iter::from_fn(|| {
+            if done || index >= generate_num_samples {
+                return None;
+            }
+
+            if cancellation.is_cancelled() {
+                tracing::debug!("Generation has been cancelled");
+                finish_reason = FinishReason::Cancelled;
+                return None;
+            }
+
+            index += 1;
+
+            let result = (|| -> Result<Option<u32>, Error> {
+                // Rebuild the KV cache from the shifted context once the window is full. Only the
+                // tokens following the kept prefix are moved and prefilled again.
+                if let Some(context_length) = context_length.filter(|l| context.len() >= *l) {
+                    let Some(kept) = shift(&mut context, context_length) else {
+                        tracing::warn!("Reached the context length of {context_length} tokens");
+                        return Ok(None);
+                    };
+
+                    let cached =
+                        Self::reuse_kv_cache(backend.as_mut(), prompt_cache, &context, kept);
+                    let rebuilt = Self::prefill(
+                        backend.as_mut(),
+                        device,
+                        &context,
+                        cached,
+                        &chunked,
+                        cancellation,
+                        &mut |_| {},
+                    )?;
+
+                    if rebuilt.is_none() {
+                        finish_reason = FinishReason::Cancelled;
+                        return Ok(None);
+                    }
+                }
+
+                let input = Tensor::new(&[next_token], device)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?
+                    .unsqueeze(0)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+                let logits = backend.forward(&input, context.len())?;
+                context.push(next_token);
+
+                let logits = logits
+                    .squeeze(0)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+                let start_at = all_tokens.len().saturating_sub(128);
+                let logits = candle_transformers::utils::apply_repeat_penalty(
+                    &logits,
+                    penalty + penalty_boost,
+                    &all_tokens[start_at..],
+                )
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+                let logits = match healer.as_ref() {
+                    Some(healer) => healer.constrain(&logits)?,
+                    None => logits,
+                };
+
+                let token = logits_processor
+                    .sample(&logits)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+                if let Some(healer) = healer.as_mut() {
+                    healer.accept(token);
+                }
+
+                Ok(Some(token))
+            })();
+
+            match result {
+                Ok(Some(token)) => {
+                    next_token = token;
+                    all_tokens.push(token);
+                    if eos_token_ids.contains(&token) || stop_token_ids.contains(&token) {
+                        tracing::debug!("FOUND EOS TOKEN");
+                        finish_reason = FinishReason::Stop;
+                        done = true;
+                    } else if let Some(watchdog) = watchdog.as_mut() {
+                        match watchdog.check(&all_tokens) {
+                            RepetitionVerdict::Continue => {}
+                            RepetitionVerdict::Penalize(boost) => {
+                                tracing::debug!("Raising repeat penalty by {boost}");
+                                penalty_boost = boost;
+                            }
+                            RepetitionVerdict::Stop => {
+                                tracing::warn!("Stopping generation caught in a repetition loop");
+                                finish_reason = FinishReason::Repetition;
+                                done = true;
+                            }
+                        }
+                    }
+                    Some(token)
+                }
+                Ok(None) => None,
+                Err(e) => {
+                    sample_error = Some(e);
+                    None
+                }
+            }
+        }));
+
+        let mut last_chunk_id = 0usize;
+
+        for (id, chunk) in token_iter.chunks_with(chunk_size, flush).enumerate() {
+            let chunk_tokens: Vec<u32> = chunk.into_iter().collect();
+            let mut text = tokenizer
+                .decode(&chunk_tokens, skip_special_tokens)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+            if !strip_prefix.is_empty() {
+                strip_common_prefix(&mut text, &mut strip_prefix);
+            }
+
+            let data = text.into_bytes();
+
+            tracing::debug!("Sending Chunk {id}");
+            last_chunk_id = id;
+
+            if let Err(e) = response_tx.send(Query::Chunk {
+                id,
+                kind: crate::QueryChunkType::String,
+                data,
+                timestamp,
+            }) {
+                tracing::error!("Error sending chunk: {e}");
+                return Err(Error::StreamError(e.to_string()));
+            }
+        }
+
+        if let Some(e) = sample_error {
+            return Err(e);
+        }
+
+        // Tool call post-processing: parse the full output for tool calls
+        if let Some(parser) = backend.tool_call_parser().filter(|_| parse_tool_calls) {
+            let full_text = tokenizer
+                .decode(&all_tokens, true)
+                .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+            if let Some(tool_calls) = parser.parse(&full_text) {
+                tracing::debug!("Detected {} tool call(s) in model output", tool_calls.len());
+
+                let data = serde_json::to_vec(&tool_calls)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+                if let Err(e) = response_tx.send(Query::Chunk {
+                    id: last_chunk_id + 1,
+                    kind: crate::QueryChunkType::ToolCall,
+                    data,
+                    timestamp,
+                }) {
+                    tracing::error!("Error sending tool call chunk: {e}");
+                    return Err(Error::StreamError(e.to_string()));
+                }
+            }
+        }
+
+        let prompt_tokens = tokens.len();
+        let completion_tokens = all_tokens.len();
+
+        tracing::debug!(
+            "Finished inference. Prompt tokens: {prompt_tokens}, Completion tokens: {completion_tokens}"
+        );
+
+        Ok((
+            TokenUsage {
+                prompt_tokens,
+                completion_tokens,
+                total_tokens: prompt_tokens + completion_tokens,
+            },
+            finish_reason,
+        ))
+    }
 }
 
 impl LLMRuntimeModel for LocalRuntime {
@@ -123,6 +940,11 @@ impl LLMRuntimeModel for LocalRuntime {
                 let mut file = File::open(model_config_path)?;
                 let json_value: serde_json::Value = serde_json::from_reader(&mut file)?;
 
+                self.context_length = json_value
+                    .get("max_position_embeddings")
+                    .and_then(|n| n.as_u64())
+                    .map(|n| n as usize);
+
                 if let Some(eos) = json_value.get("eos_token_id") {
                     match eos {
                         serde_json::Value::Number(n) => {
@@ -202,6 +1024,17 @@ impl LLMRuntimeModel for LocalRuntime {
             None
         };
 
+        self.message_normalization = config.message_normalization.clone();
+        self.context_shift = config.context_shift.clone();
+        self.chunked_prefill = config.chunked_prefill.clone();
+        self.repetition_guard = config.repetition_guard.clone();
+        self.special_token_policy = config.special_tokens.clone().unwrap_or_default();
+        self.token_healing = config.token_healing.clone();
+        self.vocab_text = None;
+        self.bos_token = tokenizer_config_json
+            .as_ref()
+            .and_then(|tc| tc.bos_token.clone());
+
         // Initialize tokenizer
         tracing::info!("Loading Tokenizer");
         self.tokenizer =
@@ -229,9 +1062,25 @@ impl LLMRuntimeModel for LocalRuntime {
             tracing::warn!("No EOS token IDs resolved — generation will only stop at max_tokens");
         }
 
+        // Resolve fill-in-the-middle tokens for code models. Explicitly configured tokens must
+        // be part of the vocabulary, detected tokens are optional.
+        let tokenizer = self.tokenizer.as_ref().unwrap();
+        self.fim_token_ids = match &config.fim_tokens {
+            Some(fim) => Some(fim.resolve(tokenizer)?),
+            None => tokenizer_config_json
+                .as_ref()
+                .and_then(FimTokens::detect)
+                .and_then(|fim| fim.resolve(tokenizer).ok()),
+        };
+
+        if let Some(fim) = &self.fim_token_ids {
+            tracing::info!("Fill-in-the-middle is supported: {fim:?}");
+        }
+
         // Load backend — infer format from config fields
         tracing::info!("Loading Model Backend");
         let device = self.device.as_ref().ok_or(Error::MissingDevice)?;
+        let dtype = config.dtype.unwrap_or_default().into();
 
         self.backend = Some(if config.is_safetensors_with_index_file() {
             let model_index = config
@@ -258,6 +1107,7 @@ impl LLMRuntimeModel for LocalRuntime {
                 model_index,
                 model_dir,
                 model_config_file,
+                dtype,
             )?
         } else if config.is_safetensors_inidividual_file() {
             let model_file = config.model_file.as_ref().ok_or(Error::MissingConfigLLM(
@@ -272,7 +1122,13 @@ impl LLMRuntimeModel for LocalRuntime {
                         "Model config file is missing for Safetensors".to_owned(),
                     ))?;
 
-            backend::create_backend_by_model_file(name, device, model_file, model_config_file)?
+            backend::create_backend_by_model_file(
+                name,
+                device,
+                model_file,
+                model_config_file,
+                dtype,
+            )?
         } else {
             return Err(Error::ExecutionError(
                 "Cannot infer model format: neither model_index_file nor model_file is set"
@@ -280,6 +1136,24 @@ impl LLMRuntimeModel for LocalRuntime {
             ));
         });
 
+        // Prefill cached prompt prefixes once, or restore them from disk
+        if let Some(cache_config) = &config.prompt_cache {
+            let backend = self.backend.as_mut().unwrap();
+            let mut cache = PromptCache::new(name, backend.dtype(), cache_config.cache_dir.clone());
+
+            for prefix in &cache_config.prefixes {
+                let tokens = self.encode_prefix(prefix)?;
+                let backend = self.backend.as_mut().unwrap();
+
+                if !cache.insert(backend.as_mut(), device, tokens)? {
+                    tracing::warn!("Model backend does not support prompt caching");
+                    break;
+                }
+            }
+
+            self.prompt_cache = Some(cache);
+        }
+
         tracing::info!("Runtime has been initialized");
 
         Ok(())
@@ -290,13 +1164,17 @@ impl LLMRuntimeModel for LocalRuntime {
         q: Query,
         response_tx: Arc<std::sync::mpsc::Sender<Query>>,
     ) -> Result<(), Error> {
-        let usage = self.inference(q, response_tx.clone())?;
+        let (usage, finish_reason) = self.inference(q, response_tx.clone())?.unzip();
 
         tracing::debug!("LocalRuntime inference ended. Sending end termination");
 
         response_tx
             .clone()
-            .send(Query::End { usage })
+            .send(Query::End {
+                usage,
+                finish_reason,
+                cache_hit: None,
+            })
             .map_err(|e| Error::StreamError(e.to_string()))?;
 
         Ok(())
@@ -306,219 +1184,558 @@ impl LLMRuntimeModel for LocalRuntime {
         &mut self,
         message: Query,
         response_tx: Arc<std::sync::mpsc::Sender<Query>>,
-    ) -> Result<Option<TokenUsage>, Error> {
-        if let Query::Prompt {
-            messages,
-            tools: _,
-            chunk_size,
-            timestamp,
-            max_tokens,
-            temperature,
-            top_k,
-            top_p,
-            think: _,
-            stream: _,
-            model: _,
-            penalty,
-            seed,
-            sampling_config,
-        } = message.clone()
-        {
-            let chunk_size = chunk_size.unwrap_or(self.default_chunksize());
+    ) -> Result<Option<(TokenUsage, FinishReason)>, Error> {
+        // Normalize messages before templating, restrictive templates would reject them otherwise
+        let message = match self.message_normalization.as_ref() {
+            Some(rules) => rules.normalize_query(message),
+            None => message,
+        };
 
-            // Create logits processor with runtime parameters
-            let mut logits_processor = Self::create_logits_processor(
-                temperature,
-                top_k,
-                top_p,
-                seed,
-                sampling_config.clone(),
+        let Some(options) = GenerationOptions::from_query(&message, self.default_chunksize())
+        else {
+            tracing::warn!(
+                "Got unhandled `Query` type: discriminant({:?}), actual type: ({:?})",
+                std::mem::discriminant(&message),
+                message
             );
 
-            // Preprocess message by applying chat template
-            let processed_message = {
-                match self.template.as_ref() {
-                    Some(template) => {
-                        let proc = self.template_proc.as_ref().ok_or(Error::ExecutionError(
-                            "Template processor is not initialized".to_string(),
-                        ))?;
-                        message.apply_template(template, proc)?
-                    }
-                    None => {
-                        tracing::warn!("No template found. Using plain message content");
-                        messages
-                            .iter()
-                            .map(|m| format!("{}: {}", m.role, m.content))
-                            .collect::<Vec<_>>()
-                            .join("\n")
-                    }
-                }
-            };
+            return Ok(None);
+        };
 
-            let generate_num_samples = max_tokens.unwrap_or(500);
+        let mut options = options;
 
-            let tokenizer = self.tokenizer.as_ref().unwrap();
-            let backend = self.backend.as_mut().unwrap();
-            let device = self.device.as_ref().unwrap();
+        let (tokens, prompt) = match &message {
+            Query::Completion { input, .. } => {
+                let tokens = self.encode_completion_input(input, options.add_special_tokens)?;
+                let prompt = match input {
+                    CompletionInput::Prompt(text) => Some(text.clone()),
+                    CompletionInput::TokenIds(_) => None,
+                };
+                (tokens, prompt)
+            }
+            Query::Infill { prefix, suffix, .. } => {
+                let (tokens, stop_token_ids, healed_text) =
+                    self.encode_infill(prefix, suffix, options.add_special_tokens)?;
+                options.stop_token_ids.extend(stop_token_ids);
+                options.healed_text = healed_text;
+                (tokens, None)
+            }
+            _ => {
+                let processed_message = self.render_prompt(&message)?;
+                let tokens = self.encode_prompt(&processed_message, options.add_special_tokens)?;
+                (tokens, Some(processed_message))
+            }
+        };
 
-            // Encode message
-            let tokens = tokenizer
-                .encode(processed_message, true)
-                .map_err(|e| Error::MessageEncodingError(e.to_string()))?;
+        if self.context_shift.is_some() {
+            options.keep_tokens = self.system_prefix_len(&message, &tokens);
+        }
 
-            let tokens = tokens.get_ids();
+        // Heal the prompt boundary of text continuations, infill prompts heal their prefix
+        let mut tokens = tokens;
+        if matches!(
+            &message,
+            Query::Completion {
+                input: CompletionInput::Prompt(_),
+                ..
+            } | Query::Prompt {
+                continue_final_message: true,
+                ..
+            }
+        ) {
+            options.healed_text = self.heal_prompt(&mut tokens)?;
+        }
 
-            // Clear cache for fresh generation
-            backend.clear_kv_cache();
+        // The prompt is recorded without the text removed by token healing. A context shift
+        // records the shifted prompt again.
+        let prompt = match (prompt, options.healed_text.as_deref()) {
+            (Some(prompt), Some(removed)) => match prompt.strip_suffix(removed) {
+                Some(kept) => Some(kept.to_string()),
+                None => Some(Self::decode_prompt(
+                    self.tokenizer.as_ref().unwrap(),
+                    &tokens,
+                )?),
+            },
+            (prompt, _) => prompt,
+        };
+        if let Some(prompt) = prompt {
+            self.prompt_recorder.record(prompt);
+        }
+
+        self.generate(&tokens, options, response_tx).map(Some)
+    }
+
+    fn score(&mut self, context: &str, continuation: &str) -> Result<Score, Error> {
+        let context_tokens = self.encode_prompt(context, None)?;
+        let continuation_tokens = self.encode(continuation, false)?;
+
+        if context_tokens.is_empty() {
+            return Err(Error::MessageEncodingError(
+                "Context does not contain any tokens".to_string(),
+            ));
+        }
+
+        if continuation_tokens.is_empty() {
+            return Err(Error::MessageEncodingError(
+                "Continuation does not contain any tokens".to_string(),
+            ));
+        }
+
+        let tokens = [context_tokens.as_slice(), continuation_tokens.as_slice()].concat();
+
+        if let Some(context_length) = self.context_length.filter(|l| tokens.len() > *l) {
+            return Err(Error::MessageEncodingError(format!(
+                "Scoring {} tokens exceeds the context length of {context_length} tokens",
+                tokens.len()
+            )));
+        }
+
+        let tokenizer = self.tokenizer.as_ref().unwrap();
+        let backend = self.backend.as_mut().unwrap();
+        let device = self.device.as_ref().unwrap();
+
+        // The logits at position `i` predict the token at `i + 1`, the last token is not fed
+        backend.clear_kv_cache();
+
+        let input = Tensor::new(&tokens[..tokens.len() - 1], device)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?
+            .unsqueeze(0)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        let logits = backend
+            .forward_all(&input, 0)?
+            .narrow(0, context_tokens.len() - 1, continuation_tokens.len())
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        let logprobs = Self::token_logprobs(&logits, &continuation_tokens)?;
+
+        let mut is_greedy = true;
+        let mut scored = Vec::with_capacity(continuation_tokens.len());
+
+        for (id, (logprob, greedy)) in continuation_tokens.iter().zip(logprobs) {
+            is_greedy &= greedy;
+
+            scored.push(TokenLogprob {
+                id: *id,
+                text: tokenizer
+                    .decode(&[*id], false)
+                    .map_err(|e| Error::ExecutionError(e.to_string()))?,
+                logprob,
+            });
+        }
+
+        tracing::debug!(
+            "Scored {} continuation tokens after {} context tokens",
+            continuation_tokens.len(),
+            context_tokens.len()
+        );
 
-            // Get first token
-            let mut next_token = {
-                let input = Tensor::new(tokens, device)
+        Ok(Score::new(scored, is_greedy))
+    }
+
+    fn set_cancellation(&mut self, cancellation: CancellationToken) {
+        self.cancellation = cancellation;
+    }
+
+    fn set_prompt_recorder(&mut self, recorder: PromptRecorder) {
+        self.prompt_recorder = recorder;
+    }
+
+    fn classify(
+        &mut self,
+        messages: &[QueryMessage],
+        labels: &[String],
+    ) -> Result<Classification, Error> {
+        if labels.is_empty() {
+            return Err(Error::MessageEncodingError(
+                "Classification requires at least one label".to_string(),
+            ));
+        }
+
+        let messages = match self.message_normalization.as_ref() {
+            Some(rules) => rules.apply(messages.to_vec()),
+            None => messages.to_vec(),
+        };
+
+        let prompt = self.render_messages(&messages)?;
+        let tokens = self.encode_prompt(&prompt, None)?;
+
+        let label_tokens = labels
+            .iter()
+            .map(|label| self.encode(label, false))
+            .collect::<Result<Vec<_>, _>>()?;
+
+        if let Some((label, _)) = labels
+            .iter()
+            .zip(&label_tokens)
+            .find(|(_, tokens)| tokens.is_empty())
+        {
+            return Err(Error::MessageEncodingError(format!(
+                "Label '{label}' does not contain any tokens"
+            )));
+        }
+
+        let longest = label_tokens.iter().map(Vec::len).max().unwrap_or_default();
+
+        if let Some(context_length) = self.context_length.filter(|l| tokens.len() + longest > *l) {
+            return Err(Error::MessageEncodingError(format!(
+                "Classifying {} prompt tokens with labels of up to {longest} tokens exceeds the \
+                 context length of {context_length} tokens",
+                tokens.len()
+            )));
+        }
+
+        let backend = self.backend.as_mut().unwrap();
+        let device = self.device.as_ref().unwrap();
+        let prompt_cache = self.prompt_cache.as_ref();
+        let chunked = self
+            .chunked_prefill
+            .clone()
+            .unwrap_or(ChunkedPrefill::UNCHUNKED);
+        let cancellation = &self.cancellation;
+        let cancelled = || Error::ExecutionError("Classification has been cancelled".to_string());
+
+        // The prompt is prefilled once, its KV cache is restored before scoring the next label.
+        // Backends unable to capture their KV cache prefill the prompt again.
+        let cached = Self::reuse_kv_cache(backend.as_mut(), prompt_cache, &tokens, 0);
+        let first_logits = Self::prefill(
+            backend.as_mut(),
+            device,
+            &tokens,
+            cached,
+            &chunked,
+            cancellation,
+            &mut |_| {},
+        )?
+        .ok_or_else(cancelled)?;
+        let snapshot = backend.snapshot_kv_cache();
+        let mut extended = false;
+
+        let mut log_likelihoods = Vec::with_capacity(labels.len());
+
+        for label in &label_tokens {
+            // Single token labels are predicted by the prompt logits alone
+            let logits = if label.len() > 1 {
+                if extended {
+                    match snapshot.as_ref() {
+                        Some(snapshot) => backend.restore_kv_cache(snapshot)?,
+                        None => {
+                            let cached =
+                                Self::reuse_kv_cache(backend.as_mut(), prompt_cache, &tokens, 0);
+                            Self::prefill(
+                                backend.as_mut(),
+                                device,
+                                &tokens,
+                                cached,
+                                &chunked,
+                                cancellation,
+                                &mut |_| {},
+                            )?
+                            .ok_or_else(cancelled)?;
+                        }
+                    }
+                }
+
+                let input = Tensor::new(&label[..label.len() - 1], device)
                     .map_err(|e| Error::ExecutionError(e.to_string()))?
                     .unsqueeze(0)
                     .map_err(|e| Error::ExecutionError(e.to_string()))?;
 
-                let logits = backend.forward(&input, 0)?;
-                let logits = logits
-                    .squeeze(0)
-                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+                let logits = backend.forward_all(&input, tokens.len())?;
+                extended = true;
 
-                logits_processor
-                    .sample(&logits)
+                Tensor::cat(&[&first_logits, &logits], 0)
                     .map_err(|e| Error::ExecutionError(e.to_string()))?
+            } else {
+                first_logits.clone()
             };
 
-            let mut all_tokens = vec![next_token];
+            let log_likelihood = Self::token_logprobs(&logits, label)?
+                .into_iter()
+                .map(|(logprob, _)| logprob)
+                .sum();
 
-            let eos_token_ids = &self.eos_token_ids;
+            log_likelihoods.push(log_likelihood);
+        }
 
-            let penalty = penalty.unwrap_or(1.1).max(0.1);
-            let mut index = 0usize;
-            let mut done = false;
-            let mut sample_error: Option<Error> = None;
+        tracing::debug!(
+            "Classified {} prompt tokens into {} labels",
+            tokens.len(),
+            labels.len()
+        );
 
-            // Token iterator: yields tokens until EOS, max_tokens, or error
-            let token_iter = std::iter::once(next_token).chain(std::iter::from_fn(|| {
-                if done || index >= generate_num_samples {
-                    return None;
-                }
+        Classification::new(labels, &log_likelihoods)
+    }
+}
 
-                let current_index = index;
-                index += 1;
-
-                let result = (|| -> Result<u32, Error> {
-                    let input = Tensor::new(&[next_token], device)
-                        .map_err(|e| Error::ExecutionError(e.to_string()))?
-                        .unsqueeze(0)
-                        .map_err(|e| Error::ExecutionError(e.to_string()))?;
-
-                    let logits = backend.forward(&input, tokens.len() + current_index)?;
-                    let logits = logits
-                        .squeeze(0)
-                        .map_err(|e| Error::ExecutionError(e.to_string()))?;
-
-                    let start_at = all_tokens.len().saturating_sub(128);
-                    let logits = candle_transformers::utils::apply_repeat_penalty(
-                        &logits,
-                        penalty,
-                        &all_tokens[start_at..],
-                    )
-                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::backend::testing::{self, assert_close};
+    use crate::runtime::RenderedRequest;
+    use std::str::FromStr;
+
+    /// Returns a runtime for `backend` with a word level tokenizer of the tokens `t0` to `t63`.
+    fn runtime(backend: impl ModelBackend + 'static) -> LocalRuntime {
+        let vocab: serde_json::Map<String, serde_json::Value> =
+            (0..64u32).map(|id| (format!("t{id}"), id.into())).collect();
+
+        let tokenizer = serde_json::json!({
+            "version": "1.0",
+            "truncation": null,
+            "padding": null,
+            "added_tokens": [],
+            "normalizer": null,
+            "pre_tokenizer": { "type": "Whitespace" },
+            "post_processor": null,
+            "decoder": null,
+            "model": { "type": "WordLevel", "vocab": vocab, "unk_token": "t0" }
+        });
 
-                    logits_processor
-                        .sample(&logits)
-                        .map_err(|e| Error::ExecutionError(e.to_string()))
-                })();
-
-                match result {
-                    Ok(token) => {
-                        next_token = token;
-                        all_tokens.push(token);
-                        if eos_token_ids.contains(&token) {
-                            tracing::debug!("FOUND EOS TOKEN");
-                            done = true;
-                        }
-                        Some(token)
-                    }
-                    Err(e) => {
-                        sample_error = Some(e);
-                        None
-                    }
-                }
-            }));
+        LocalRuntime {
+            device: Some(Device::Cpu),
+            tokenizer: Some(Tokenizer::from_str(&tokenizer.to_string()).unwrap()),
+            backend: Some(Box::new(backend)),
+            ..Default::default()
+        }
+    }
+
+    /// Returns a greedy completion of the token ids `prompt`.
+    fn completion(prompt: Vec<u32>, max_tokens: usize) -> Query {
+        Query::Completion {
+            input: CompletionInput::TokenIds(prompt),
+            chunk_size: Some(1),
+            timestamp: None,
+            max_tokens: Some(max_tokens),
+            temperature: None,
+            top_k: None,
+            top_p: None,
+            stream: true,
+            model: None,
+            penalty: Some(1.0),
+            seed: Some(GenerationSeed::Fixed(0)),
+            sampling_config: Some(SamplingConfig::ArgMax),
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
+        }
+    }
 
-            let mut last_chunk_id = 0usize;
+    /// Runs `query` and returns the streamed events, the usage and the finish reason.
+    fn run(runtime: &mut LocalRuntime, query: Query) -> (Vec<Query>, TokenUsage, FinishReason) {
+        let (tx, rx) = std::sync::mpsc::channel();
+        let (usage, finish_reason) = runtime.inference(query, Arc::new(tx)).unwrap().unwrap();
 
-            for (id, chunk) in token_iter.chunks(chunk_size).enumerate() {
-                let chunk_tokens: Vec<u32> = chunk.into_iter().collect();
-                let data = tokenizer
-                    .decode(&chunk_tokens, true)
-                    .map_err(|e| Error::ExecutionError(e.to_string()))?
-                    .as_bytes()
-                    .to_vec();
+        (rx.try_iter().collect(), usage, finish_reason)
+    }
 
-                tracing::debug!("Sending Chunk {id}");
-                last_chunk_id = id;
+    fn prompt(len: u32) -> Vec<u32> {
+        (0..len).map(|id| (id * 7) % 64).collect()
+    }
 
-                if let Err(e) = response_tx.send(Query::Chunk {
-                    id,
-                    kind: crate::QueryChunkType::String,
-                    data,
-                    timestamp,
-                }) {
-                    tracing::error!("Error sending chunk: {e}");
-                    return Err(Error::StreamError(e.to_string()));
-                }
-            }
+    #[test]
+    fn test_context_length_requires_context_shift() {
+        let mut runtime = runtime(testing::qwen3());
+        runtime.context_length = Some(8);
 
-            if let Some(e) = sample_error {
-                return Err(e);
-            }
+        // without context shifting, the context length of the model config is not enforced
+        let (_, usage, finish_reason) = run(&mut runtime, completion(prompt(12), 4));
+        assert_eq!(usage.prompt_tokens, 12);
+        assert_eq!(finish_reason, FinishReason::Length);
+    }
 
-            // Tool call post-processing: parse the full output for tool calls
-            if let Some(parser) = backend.tool_call_parser() {
-                let full_text = tokenizer
-                    .decode(&all_tokens, true)
-                    .map_err(|e| Error::ExecutionError(e.to_string()))?;
+    #[test]
+    fn test_context_shift_generation() {
+        let mut runtime = runtime(testing::llama());
+        runtime.context_shift = Some(ContextShift {
+            context_length: Some(16),
+            keep: Some(4),
+            discard: None,
+        });
 
-                if let Some(tool_calls) = parser.parse(&full_text) {
-                    tracing::debug!("Detected {} tool call(s) in model output", tool_calls.len());
+        let (events, usage, finish_reason) = run(&mut runtime, completion(prompt(10), 24));
+
+        let shifts: Vec<_> = events
+            .iter()
+            .filter_map(|event| match event {
+                Query::ContextShift {
+                    discarded, kept, ..
+                } => Some((*discarded, *kept)),
+                _ => None,
+            })
+            .collect();
+        assert!(shifts.len() > 1, "{shifts:?}");
+        assert!(shifts.iter().all(|(_, kept)| *kept < 16));
+
+        let chunks = events
+            .iter()
+            .filter(|event| matches!(event, Query::Chunk { .. }))
+            .count();
+        assert_eq!(chunks, usage.completion_tokens);
+        assert_eq!(finish_reason, FinishReason::Length);
+    }
 
-                    let data = serde_json::to_vec(&tool_calls)
-                        .map_err(|e| Error::ExecutionError(e.to_string()))?;
+    #[test]
+    fn test_reuse_kept_prefix() -> Result<(), Error> {
+        let context = prompt(12);
+        let shifted = [&context[..4], &context[8..]].concat();
+        let chunked = ChunkedPrefill {
+            block_size: Some(1),
+        };
+        let cancellation = CancellationToken::default();
 
-                    if let Err(e) = response_tx.send(Query::Chunk {
-                        id: last_chunk_id + 1,
-                        kind: crate::QueryChunkType::ToolCall,
-                        data,
-                        timestamp,
-                    }) {
-                        tracing::error!("Error sending tool call chunk: {e}");
-                        return Err(Error::StreamError(e.to_string()));
-                    }
-                }
-            }
+        for backend in [
+            &mut testing::qwen3() as &mut dyn ModelBackend,
+            &mut testing::llama(),
+        ] {
+            backend.clear_kv_cache();
+            testing::forward(backend, &shifted, 0);
+            let expected = testing::forward(backend, &[3], shifted.len());
 
-            let prompt_tokens = tokens.len();
-            let completion_tokens = all_tokens.len();
+            backend.clear_kv_cache();
+            testing::forward(backend, &context, 0);
+
+            // only the tokens following the kept prefix are prefilled again
+            let cached = LocalRuntime::reuse_kv_cache(backend, None, &shifted, 4);
+            assert_eq!(cached, 4);
+
+            let mut blocks = 0;
+            LocalRuntime::prefill(
+                backend,
+                &Device::Cpu,
+                &shifted,
+                cached,
+                &chunked,
+                &cancellation,
+                &mut |_| blocks += 1,
+            )?;
+            assert_eq!(blocks, shifted.len() - 4);
+
+            assert_close(&testing::forward(backend, &[3], shifted.len()), &expected);
+        }
 
-            tracing::debug!(
-                "Finished inference. Prompt tokens: {prompt_tokens}, Completion tokens: {completion_tokens}"
-            );
+        Ok(())
+    }
 
-            return Ok(Some(TokenUsage {
-                prompt_tokens,
-                completion_tokens,
-                total_tokens: prompt_tokens + completion_tokens,
-            }));
+    #[test]
+    fn test_chunked_prefill_logits() -> Result<(), Error> {
+        let tokens = prompt(12);
+        let cancellation = CancellationToken::default();
+        let logits = |tensor: Tensor| tensor.flatten_all().and_then(|t| t.to_vec1::<f32>());
+
+        for backend in [
+            &mut testing::qwen3() as &mut dyn ModelBackend,
+            &mut testing::llama(),
+        ] {
+            backend.clear_kv_cache();
+            let unchunked = LocalRuntime::prefill(
+                backend,
+                &Device::Cpu,
+                &tokens,
+                0,
+                &ChunkedPrefill::UNCHUNKED,
+                &cancellation,
+                &mut |_| {},
+            )?
+            .unwrap();
+            let next = testing::forward(backend, &[3], tokens.len());
+
+            backend.clear_kv_cache();
+            let mut blocks = vec![];
+            let chunked = LocalRuntime::prefill(
+                backend,
+                &Device::Cpu,
+                &tokens,
+                0,
+                &ChunkedPrefill {
+                    block_size: Some(5),
+                },
+                &cancellation,
+                &mut |processed| blocks.push(processed),
+            )?
+            .unwrap();
+            assert_eq!(blocks, vec![5, 10, 12]);
+
+            // the blocks attend to the KV cache of the earlier blocks like a single forward pass
+            assert_close(&logits(chunked).unwrap(), &logits(unchunked).unwrap());
+            assert_close(&testing::forward(backend, &[3], tokens.len()), &next);
+        }
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_recorded_prompt() {
+        let mut runtime = runtime(testing::llama());
+        let last = Arc::new(std::sync::Mutex::new(Some(RenderedRequest {
+            query: completion(vec![], 1),
+            prompt: None,
+        })));
+        runtime.set_prompt_recorder(PromptRecorder(last.clone()));
+        let recorded = || last.lock().unwrap().as_ref().unwrap().prompt.clone();
+
+        let mut query = completion(vec![], 1);
+        if let Query::Completion { input, .. } = &mut query {
+            *input = CompletionInput::Prompt("t1 t2 t3".to_string());
         }
+        run(&mut runtime, query);
+        assert_eq!(recorded().as_deref(), Some("t1 t2 t3"));
+
+        // the prompt is recorded as shifted into the context window
+        runtime.context_shift = Some(ContextShift {
+            context_length: Some(16),
+            keep: Some(4),
+            discard: None,
+        });
+        run(&mut runtime, completion(prompt(20), 1));
+
+        let tokens = runtime.encode(&recorded().unwrap(), false).unwrap();
+        assert!(tokens.len() < 16, "{tokens:?}");
+        assert_eq!(tokens[..4], prompt(20)[..4]);
+    }
 
-        tracing::warn!(
-            "Got unhandled `Query` type: discriminant({:?}), actual type: ({:?})",
-            std::mem::discriminant(&message),
-            message
+    #[test]
+    fn test_token_logprobs_beyond_vocabulary() {
+        let logits = Tensor::zeros((2, 4), DType::F32, &Device::Cpu).unwrap();
+
+        assert_eq!(
+            LocalRuntime::token_logprobs(&logits, &[1, 3])
+                .unwrap()
+                .len(),
+            2
         );
+        assert!(matches!(
+            LocalRuntime::token_logprobs(&logits, &[1, 4]),
+            Err(Error::MessageEncodingError(_))
+        ));
+    }
+
+    #[test]
+    fn test_infill_heals_prefix() {
+        let mut runtime = runtime(testing::llama());
+        runtime.fim_token_ids = Some(FimTokenIds {
+            prefix: 60,
+            suffix: 61,
+            middle: 62,
+            stop: vec![63],
+        });
+
+        let (tokens, stop, healed) = runtime.encode_infill("t1 t2", "t3", None).unwrap();
+        assert_eq!(tokens, [60, 1, 2, 61, 3, 62]);
+        assert_eq!(stop, [63, 60, 61, 62]);
+        assert_eq!(healed, None);
 
-        Ok(None)
+        // the end of the prefix is removed, not the end of the prompt
+        runtime.token_healing = Some(TokenHealing {
+            max_tokens: Some(1),
+        });
+        let (tokens, _, healed) = runtime.encode_infill("t1 t2", "t3", None).unwrap();
+        assert_eq!(tokens, [60, 1, 61, 3, 62]);
+        assert_eq!(healed.as_deref(), Some(" t2"));
+
+        // a prefix of a single token is healed as well
+        let (tokens, _, healed) = runtime.encode_infill("t1", "t3", None).unwrap();
+        assert_eq!(tokens, [60, 61, 3, 62]);
+        assert_eq!(healed.as_deref(), Some(" t1"));
     }
 }
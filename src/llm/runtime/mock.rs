@@ -1,10 +1,31 @@
-use crate::{iter::*, runtime::LLMRuntimeModel, Query, QueryMessage};
+use crate::{
+    iter::*,
+    llm::rerank,
+    llm::tool_call::{Qwen3ToolCallParser, ToolCallParser},
+    runtime::{LLMRuntimeModel, PromptRecorder},
+    CancellationToken, ChunkedPrefill, Classification, CompletionInput, Query, QueryMessage,
+    RerankResult, Score, TokenLogprob,
+};
 use std::sync::Arc;
 
-pub struct Mock;
+/// Dimension of the embeddings of the Mock runtime
+const MOCK_EMBEDDING_SIZE: usize = 64;
+
+#[derive(Default)]
+pub struct Mock {
+    /// Records the prompt text, rendered as plain `role: content` lines
+    prompt_recorder: PromptRecorder,
+
+    /// Cancels the running query between prefill blocks and chunks
+    cancellation: CancellationToken,
+
+    /// Prefills the prompt bytes in blocks with progress events, if configured
+    chunked_prefill: Option<ChunkedPrefill>,
+}
 
 impl LLMRuntimeModel for Mock {
-    fn init(&mut self, _: &crate::LLMRuntimeConfig) -> Result<(), crate::Error> {
+    fn init(&mut self, config: &crate::LLMRuntimeConfig) -> Result<(), crate::Error> {
+        self.chunked_prefill = config.chunked_prefill.clone();
         Ok(())
     }
 
@@ -16,13 +37,17 @@ impl LLMRuntimeModel for Mock {
         tracing::debug!("Run Inference");
 
         // Run inference internally
-        let usage = self.inference(message, response_tx.clone())?;
+        let (usage, finish_reason) = self.inference(message, response_tx.clone())?.unzip();
 
         tracing::debug!("Inference ended. Got {usage:?}");
 
         // inference is done, so we have to indicate the end
         response_tx
-            .send(crate::Query::End { usage })
+            .send(crate::Query::End {
+                usage,
+                finish_reason,
+                cache_hit: None,
+            })
             .map_err(|e| crate::Error::StreamError(e.to_string()))?;
 
         tracing::debug!("Send Query End");
@@ -34,63 +59,430 @@ impl LLMRuntimeModel for Mock {
         &mut self,
         q: crate::Query,
         response_tx: Arc<std::sync::mpsc::Sender<crate::Query>>,
-    ) -> Result<Option<crate::TokenUsage>, crate::Error> {
-        if let Query::Prompt {
-            messages,
-            chunk_size,
-            timestamp,
-            ..
-        } = q
-        {
-            let prompt_tokens = serde_json::to_vec(&messages).map(|v| v.len()).unwrap_or(0);
-            let chunk_size = chunk_size.unwrap_or(self.default_chunksize());
-            let mock_message_bytes = match messages.as_slice() {
-                [] => "No messages for the Mock runtime have been provided.".as_bytes(),
-                [first] => first.content.as_bytes(),
-                [_, ..] => {
-                    if let Some(QueryMessage { content, .. }) = messages
+    ) -> Result<Option<(crate::TokenUsage, crate::FinishReason)>, crate::Error> {
+        match q {
+            Query::Prompt {
+                messages,
+                tools,
+                chunk_size,
+                timestamp,
+                flush,
+                ..
+            } => {
+                self.prompt_recorder.record(
+                    messages
                         .iter()
-                        .find(|m| m.role.eq_ignore_ascii_case("user"))
-                    {
-                        content.as_bytes()
-                    } else {
-                        return Err(crate::Error::UnexpectedMessage);
+                        .map(|m| format!("{}: {}", m.role, m.content))
+                        .collect::<Vec<_>>()
+                        .join("\n"),
+                );
+
+                let prompt_tokens = serde_json::to_vec(&messages).map(|v| v.len()).unwrap_or(0);
+                let chunk_size = chunk_size.unwrap_or(self.default_chunksize());
+                let mock_message_bytes = match messages.as_slice() {
+                    [] => "No messages for the Mock runtime have been provided.".as_bytes(),
+                    [first] => first.content.as_bytes(),
+                    [_, ..] => {
+                        if let Some(QueryMessage { content, .. }) = messages
+                            .iter()
+                            .find(|m| m.role.eq_ignore_ascii_case("user"))
+                        {
+                            content.as_bytes()
+                        } else {
+                            return Err(crate::Error::UnexpectedMessage);
+                        }
                     }
-                }
-            };
+                };
+
+                let (usage, finish_reason, chunks) = self.echo(
+                    prompt_tokens,
+                    mock_message_bytes,
+                    chunk_size,
+                    flush.unwrap_or_default(),
+                    timestamp,
+                    &response_tx,
+                )?;
 
-            mock_message_bytes
-                .iter()
-                .chunks(chunk_size)
-                .enumerate()
-                .try_for_each(|(id, chunk)| {
-                    let data: Vec<u8> = chunk.cloned().collect();
+                // Tool calls in the echoed message are parsed, if tools are given
+                let tool_calls = Some(String::from_utf8_lossy(mock_message_bytes))
+                    .filter(|_| !tools.is_empty() && finish_reason == crate::FinishReason::Stop)
+                    .and_then(|text| Qwen3ToolCallParser.parse(&text));
 
+                if let Some(tool_calls) = tool_calls {
                     let chunk = crate::Query::Chunk {
-                        id,
-                        data,
-                        kind: crate::QueryChunkType::String,
+                        id: chunks,
+                        data: serde_json::to_vec(&tool_calls)?,
+                        kind: crate::QueryChunkType::ToolCall,
                         timestamp,
                     };
 
-                    if let Err(error) = response_tx.send(chunk) {
-                        return Err(crate::Error::StreamError(error.to_string()));
+                    response_tx
+                        .send(chunk)
+                        .map_err(|e| crate::Error::StreamError(e.to_string()))?;
+                }
+
+                Ok(Some((usage, finish_reason)))
+            }
+            Query::Completion {
+                input,
+                chunk_size,
+                timestamp,
+                flush,
+                ..
+            } => {
+                let chunk_size = chunk_size.unwrap_or(self.default_chunksize());
+
+                // The Mock runtime echoes the raw prompt, token ids are echoed space separated
+                let (prompt_tokens, mock_message) = match input {
+                    CompletionInput::Prompt(text) => {
+                        self.prompt_recorder.record(text.clone());
+                        (text.len(), text)
                     }
+                    CompletionInput::TokenIds(ids) => (
+                        ids.len(),
+                        ids.iter()
+                            .map(|id| id.to_string())
+                            .collect::<Vec<_>>()
+                            .join(" "),
+                    ),
+                };
+
+                let (usage, finish_reason, _) = self.echo(
+                    prompt_tokens,
+                    mock_message.as_bytes(),
+                    chunk_size,
+                    flush.unwrap_or_default(),
+                    timestamp,
+                    &response_tx,
+                )?;
+
+                Ok(Some((usage, finish_reason)))
+            }
+            Query::Infill {
+                prefix,
+                suffix,
+                chunk_size,
+                timestamp,
+                flush,
+                ..
+            } => {
+                let chunk_size = chunk_size.unwrap_or(self.default_chunksize());
+
+                // The Mock runtime fills the middle with the prefix
+                let (usage, finish_reason, _) = self.echo(
+                    prefix.len() + suffix.len(),
+                    prefix.as_bytes(),
+                    chunk_size,
+                    flush.unwrap_or_default(),
+                    timestamp,
+                    &response_tx,
+                )?;
+
+                Ok(Some((usage, finish_reason)))
+            }
+            _ => Err(crate::Error::StreamError(
+                "Unknown `Query` type".to_string(),
+            )),
+        }
+    }
+
+    fn score(&mut self, context: &str, continuation: &str) -> Result<Score, crate::Error> {
+        if continuation.is_empty() {
+            return Err(crate::Error::MessageEncodingError(
+                "Continuation does not contain any tokens".to_string(),
+            ));
+        }
+
+        // The Mock runtime scores every byte as a token, bytes occurring in the context are
+        // more likely than others
+        let tokens: Vec<TokenLogprob> = continuation
+            .bytes()
+            .map(|byte| TokenLogprob {
+                id: byte as u32,
+                text: (byte as char).to_string(),
+                logprob: if context.as_bytes().contains(&byte) {
+                    0.5f32.ln()
+                } else {
+                    (1.0f32 / 256.0).ln()
+                },
+            })
+            .collect();
+
+        let is_greedy = continuation
+            .bytes()
+            .all(|b| context.as_bytes().contains(&b));
+
+        Ok(Score::new(tokens, is_greedy))
+    }
+
+    fn classify(
+        &mut self,
+        messages: &[QueryMessage],
+        labels: &[String],
+    ) -> Result<Classification, crate::Error> {
+        // The Mock runtime classifies the last message, instructions in earlier messages
+        // mentioning the labels are ignored
+        let context = messages
+            .last()
+            .map(|m| m.content.as_str())
+            .unwrap_or_default();
+
+        let log_likelihoods = labels
+            .iter()
+            .map(|label| self.score(context, label).map(|s| s.log_likelihood))
+            .collect::<Result<Vec<_>, _>>()?;
+
+        Classification::new(labels, &log_likelihoods)
+    }
+
+    fn set_cancellation(&mut self, cancellation: CancellationToken) {
+        self.cancellation = cancellation;
+    }
+
+    fn set_prompt_recorder(&mut self, recorder: PromptRecorder) {
+        self.prompt_recorder = recorder;
+    }
+
+    fn rerank(
+        &mut self,
+        query: &str,
+        documents: &[String],
+        top_n: Option<usize>,
+    ) -> Result<Vec<RerankResult>, crate::Error> {
+        // The Mock runtime scores documents by the share of query words they contain
+        let words = |text: &str| -> Vec<String> {
+            text.split(|c: char| !c.is_alphanumeric())
+                .filter(|w| !w.is_empty())
+                .map(str::to_lowercase)
+                .collect()
+        };
+
+        let query_words = words(query);
+
+        let scores: Vec<f32> = documents
+            .iter()
+            .map(|document| {
+                let document_words = words(document);
+                let shared = query_words
+                    .iter()
+                    .filter(|w| document_words.contains(w))
+                    .count();
+
+                shared as f32 / query_words.len().max(1) as f32
+            })
+            .collect();
 
-                    Ok(())
-                })?;
+        Ok(rerank::rank(&scores, top_n))
+    }
+
+    fn embed(&mut self, texts: &[String]) -> Result<Vec<Vec<f32>>, crate::Error> {
+        // The Mock runtime embeds texts as normalized bags of lowercase words, so that texts
+        // sharing more words are more similar
+        Ok(texts
+            .iter()
+            .map(|text| {
+                let mut embedding = vec![0.0f32; MOCK_EMBEDDING_SIZE];
+
+                for word in text
+                    .split(|c: char| !c.is_alphanumeric())
+                    .filter(|w| !w.is_empty())
+                {
+                    let hash = word.to_lowercase().bytes().fold(0usize, |hash, b| {
+                        hash.wrapping_mul(31).wrapping_add(b as usize)
+                    });
+                    embedding[hash % MOCK_EMBEDDING_SIZE] += 1.0;
+                }
+
+                let norm = embedding
+                    .iter()
+                    .map(|v| v * v)
+                    .sum::<f32>()
+                    .sqrt()
+                    .max(1e-12);
+                embedding.iter().map(|v| v / norm).collect()
+            })
+            .collect())
+    }
+}
 
-            let completion_tokens = mock_message_bytes.len();
+impl Mock {
+    /// Prefills `prompt_tokens` and echoes `bytes` as the completion, stopping early if the
+    /// query is cancelled.
+    ///
+    /// Returns the token usage, the finish reason and the number of sent chunks.
+    fn echo(
+        &self,
+        prompt_tokens: usize,
+        bytes: &[u8],
+        chunk_size: usize,
+        flush: FlushPolicy,
+        timestamp: Option<u64>,
+        response_tx: &std::sync::mpsc::Sender<crate::Query>,
+    ) -> Result<(crate::TokenUsage, crate::FinishReason, usize), crate::Error> {
+        let usage = |completion_tokens: usize| crate::TokenUsage {
+            prompt_tokens,
+            completion_tokens,
+            total_tokens: prompt_tokens + completion_tokens,
+        };
 
-            return Ok(Some(crate::TokenUsage {
-                prompt_tokens,
-                completion_tokens,
-                total_tokens: prompt_tokens + completion_tokens,
-            }));
+        if !self.prefill(prompt_tokens, timestamp, response_tx)? {
+            return Ok((usage(0), crate::FinishReason::Cancelled, 0));
         }
 
-        Err(crate::Error::StreamError(
-            "Unknown `Query` type".to_string(),
-        ))
+        let (chunks, completion_tokens) =
+            self.stream_bytes(bytes, chunk_size, flush, timestamp, response_tx)?;
+
+        let finish_reason = if completion_tokens < bytes.len() {
+            crate::FinishReason::Cancelled
+        } else {
+            crate::FinishReason::Stop
+        };
+
+        Ok((usage(completion_tokens), finish_reason, chunks))
+    }
+
+    /// Prefills `prompt_tokens` in the blocks of the chunked prefill and reports the progress
+    /// after each block.
+    ///
+    /// Returns `false`, if the query has been cancelled.
+    fn prefill(
+        &self,
+        prompt_tokens: usize,
+        timestamp: Option<u64>,
+        response_tx: &std::sync::mpsc::Sender<crate::Query>,
+    ) -> Result<bool, crate::Error> {
+        if let Some(chunked) = self.chunked_prefill.as_ref() {
+            chunked.run(0..prompt_tokens, &self.cancellation, |block| {
+                response_tx
+                    .send(crate::Query::PrefillProgress {
+                        processed: block.end,
+                        total: prompt_tokens,
+                        timestamp,
+                    })
+                    .map_err(|e| crate::Error::StreamError(e.to_string()))
+            })?;
+        }
+
+        Ok(!self.cancellation.is_cancelled())
+    }
+
+    /// Sends `bytes` as [`Query::Chunk`]s of up to `chunk_size`, flushed according to `flush`,
+    /// until the query is cancelled.
+    ///
+    /// Returns the number of sent chunks and bytes.
+    fn stream_bytes(
+        &self,
+        bytes: &[u8],
+        chunk_size: usize,
+        flush: FlushPolicy,
+        timestamp: Option<u64>,
+        response_tx: &std::sync::mpsc::Sender<crate::Query>,
+    ) -> Result<(usize, usize), crate::Error> {
+        let mut sent = (0, 0);
+
+        for (id, chunk) in bytes.iter().chunks_with(chunk_size, flush).enumerate() {
+            if self.cancellation.is_cancelled() {
+                break;
+            }
+
+            let data: Vec<u8> = chunk.cloned().collect();
+            let len = data.len();
+
+            let chunk = crate::Query::Chunk {
+                id,
+                data,
+                kind: crate::QueryChunkType::String,
+                timestamp,
+            };
+
+            response_tx
+                .send(chunk)
+                .map_err(|e| crate::Error::StreamError(e.to_string()))?;
+
+            sent = (id + 1, sent.1 + len);
+        }
+
+        Ok(sent)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::mpsc;
+
+    fn prompt(content: &str) -> Query {
+        Query::Prompt {
+            messages: vec![QueryMessage {
+                role: "user".to_string(),
+                content: content.to_string(),
+            }],
+            tools: vec![],
+            max_tokens: None,
+            temperature: None,
+            top_k: None,
+            top_p: None,
+            think: false,
+            continue_final_message: false,
+            stream: true,
+            model: None,
+            penalty: None,
+            seed: None,
+            sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
+            chunk_size: Some(4),
+            timestamp: None,
+        }
+    }
+
+    #[test]
+    fn test_mock_prefill_and_cancellation() -> Result<(), crate::Error> {
+        let cancellation = CancellationToken::default();
+        let mut mock = Mock {
+            chunked_prefill: Some(ChunkedPrefill {
+                block_size: Some(8),
+            }),
+            ..Default::default()
+        };
+        mock.set_cancellation(cancellation.clone());
+
+        let (tx, rx) = mpsc::channel();
+        let tx = Arc::new(tx);
+
+        // the prompt is prefilled in blocks before the message is echoed
+        let (usage, finish_reason) = mock.inference(prompt("Hello, Mock"), tx.clone())?.unwrap();
+        assert_eq!(finish_reason, crate::FinishReason::Stop);
+        assert_eq!(usage.completion_tokens, "Hello, Mock".len());
+
+        let events: Vec<Query> = rx.try_iter().collect();
+        let progress: Vec<(usize, usize)> = events
+            .iter()
+            .filter_map(|event| match event {
+                Query::PrefillProgress {
+                    processed, total, ..
+                } => Some((*processed, *total)),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(progress.len(), usage.prompt_tokens.div_ceil(8));
+        assert_eq!(
+            progress.last(),
+            Some(&(usage.prompt_tokens, usage.prompt_tokens))
+        );
+        assert!(matches!(
+            events.last(),
+            Some(Query::Chunk { data, .. }) if data == b"ock"
+        ));
+
+        // a cancelled query neither prefills nor generates
+        cancellation.cancel();
+        let (usage, finish_reason) = mock.inference(prompt("Hello, Mock"), tx)?.unwrap();
+        assert_eq!(finish_reason, crate::FinishReason::Cancelled);
+        assert_eq!(usage.completion_tokens, 0);
+        assert_eq!(rx.try_iter().count(), 0);
+
+        Ok(())
     }
 }
@@ -0,0 +1,178 @@
+//! Runtime for cross-encoder reranker models.
+
+use std::sync::Arc;
+
+use candle_core::{Device, Tensor};
+use tokenizers::{Tokenizer, TruncationParams, TruncationStrategy};
+
+use crate::error::Error;
+use crate::llm::backend::cross_encoder::CrossEncoder;
+use crate::llm::rerank::{self, RerankResult};
+use crate::loaders::IndexFile;
+use crate::runtime::{LLMRuntimeModel, Query};
+use crate::{Classification, LLMRuntimeConfig, QueryMessage, Score};
+
+/// Default maximum sequence length of encoder models, if the tokenizer config does not
+/// declare one.
+const DEFAULT_MAX_LENGTH: usize = 512;
+
+/// Scores `(query, document)` pairs with a [`CrossEncoder`].
+///
+/// Rerankers do not generate text, generating, scoring and classifying queries are rejected.
+#[derive(Default)]
+pub struct RerankerRuntime {
+    pub(crate) device: Option<Device>,
+    pub(crate) tokenizer: Option<Tokenizer>,
+    pub(crate) model: Option<CrossEncoder>,
+}
+
+impl RerankerRuntime {
+    pub fn new(device: Device) -> Self {
+        Self {
+            device: Some(device),
+            ..Default::default()
+        }
+    }
+
+    fn unsupported(operation: &str) -> Error {
+        Error::UnsupportedModelType(format!("Reranker models do not support {operation}"))
+    }
+}
+
+impl LLMRuntimeModel for RerankerRuntime {
+    fn init(&mut self, config: &LLMRuntimeConfig) -> Result<(), Error> {
+        let device = self.device.as_ref().ok_or(Error::MissingDevice)?;
+
+        let max_length = match &config.tokenizer_config_file {
+            Some(path) => {
+                let mut file = std::fs::File::open(path)?;
+                let tokenizer_config: serde_json::Value = serde_json::from_reader(&mut file)?;
+
+                // Tokenizers without a limit declare a huge sentinel value
+                tokenizer_config
+                    .get("model_max_length")
+                    .and_then(|l| l.as_u64())
+                    .filter(|l| *l <= DEFAULT_MAX_LENGTH as u64 * 64)
+                    .map(|l| l as usize)
+            }
+            None => None,
+        }
+        .unwrap_or(DEFAULT_MAX_LENGTH);
+
+        tracing::info!("Loading Tokenizer");
+        let mut tokenizer = Tokenizer::from_file(config.tokenizer_file.as_ref().ok_or(
+            Error::MissingConfigLLM("Tokenizer file is missing".to_owned()),
+        )?)
+        .map_err(|e| Error::LoadingFile(format!("{:?}", config.tokenizer_file), e.to_string()))?;
+
+        // Long documents are truncated, the query is kept intact
+        tokenizer
+            .with_truncation(Some(TruncationParams {
+                max_length,
+                strategy: TruncationStrategy::OnlySecond,
+                ..Default::default()
+            }))
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        let model_config_file =
+            config
+                .model_config_file
+                .as_ref()
+                .ok_or(Error::MissingConfigLLM(
+                    "Model config file is missing for Safetensors".to_owned(),
+                ))?;
+
+        let paths = if config.is_safetensors_with_index_file() {
+            let model_index = config.model_index_file.as_ref().unwrap();
+            let model_dir = config.model_dir.as_ref().ok_or(Error::MissingConfigLLM(
+                "Model directory is missing for Safetensors".to_owned(),
+            ))?;
+
+            IndexFile::from_path(model_index)?.files(model_dir)
+        } else if config.is_safetensors_inidividual_file() {
+            vec![config.model_file.clone().unwrap()]
+        } else {
+            return Err(Error::ExecutionError(
+                "Cannot infer model format: neither model_index_file nor model_file is set"
+                    .to_owned(),
+            ));
+        };
+
+        tracing::info!("Loading Cross-Encoder Weights");
+        self.model = Some(CrossEncoder::from_safetensors(
+            &paths,
+            model_config_file,
+            device,
+        )?);
+        self.tokenizer = Some(tokenizer);
+
+        tracing::info!("Reranker has been initialized");
+
+        Ok(())
+    }
+
+    fn execute(&mut self, _: Query, _: Arc<std::sync::mpsc::Sender<Query>>) -> Result<(), Error> {
+        Err(Self::unsupported("text generation"))
+    }
+
+    fn inference(
+        &mut self,
+        _: Query,
+        _: Arc<std::sync::mpsc::Sender<Query>>,
+    ) -> Result<Option<(crate::TokenUsage, crate::FinishReason)>, Error> {
+        Err(Self::unsupported("text generation"))
+    }
+
+    fn score(&mut self, _: &str, _: &str) -> Result<Score, Error> {
+        Err(Self::unsupported("scoring"))
+    }
+
+    fn classify(&mut self, _: &[QueryMessage], _: &[String]) -> Result<Classification, Error> {
+        Err(Self::unsupported("classification"))
+    }
+
+    fn rerank(
+        &mut self,
+        query: &str,
+        documents: &[String],
+        top_n: Option<usize>,
+    ) -> Result<Vec<RerankResult>, Error> {
+        let tokenizer = self.tokenizer.as_ref().ok_or(Error::ExecutionError(
+            "Tokenizer is not initialized".to_string(),
+        ))?;
+        let model = self.model.as_ref().ok_or(Error::ExecutionError(
+            "Model is not initialized".to_string(),
+        ))?;
+        let device = self.device.as_ref().ok_or(Error::MissingDevice)?;
+
+        // Documents are encoded one at a time, which avoids padding the batch
+        let scores = documents
+            .iter()
+            .map(|document| {
+                let encoding = tokenizer
+                    .encode((query, document.as_str()), true)
+                    .map_err(|e| Error::MessageEncodingError(e.to_string()))?;
+
+                let tensor = |ids: &[u32]| {
+                    Tensor::new(ids, device)
+                        .and_then(|t| t.unsqueeze(0))
+                        .map_err(|e| Error::ExecutionError(e.to_string()))
+                };
+
+                let relevance = model.relevance(
+                    &tensor(encoding.get_ids())?,
+                    &tensor(encoding.get_type_ids())?,
+                    &tensor(encoding.get_attention_mask())?,
+                )?;
+
+                relevance.first().copied().ok_or(Error::ExecutionError(
+                    "Cross-encoder did not return a relevance score".to_string(),
+                ))
+            })
+            .collect::<Result<Vec<f32>, Error>>()?;
+
+        tracing::debug!("Reranked {} documents", documents.len());
+
+        Ok(rerank::rank(&scores, top_n))
+    }
+}
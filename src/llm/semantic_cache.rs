@@ -0,0 +1,189 @@
+//! Semantic response cache
+//!
+//! Prompts of FAQ-style features are often paraphrases of each other. The semantic cache embeds
+//! the last user message of a [`Query::Prompt`] with an embedding model and replays the response
+//! of a cached prompt whose embedding is at least as similar as the configured threshold. The
+//! replayed [`Query::End`] carries a [`CacheHit::Semantic`](crate::CacheHit::Semantic).
+//!
+//! Prompts are only compared within the same scope: the model, the system prompt, the earlier
+//! turns of the conversation, the tools and the generation options, e.g. `max_tokens`, `think`,
+//! the sampling parameters and the seed, must match exactly.
+//!
+//! The cache is kept in memory for the lifetime of the runtime.
+
+use crate::llm::response_cache::{canonical, CachedResponse, VOLATILE_FIELDS};
+use crate::runtime::LLMRuntime;
+use crate::{Error, Query};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+/// Default minimum cosine similarity of a prompt to a cached prompt.
+pub const DEFAULT_SIMILARITY_THRESHOLD: f32 = 0.92;
+
+/// Default number of cached responses.
+pub const DEFAULT_MAX_ENTRIES: usize = 256;
+
+/// Cache of responses to similar prompts.
+#[derive(Deserialize, Serialize, Debug, Clone)]
+pub struct SemanticCacheConfig {
+    /// Name of the config of the [`ModelKind::Embedding`](crate::ModelKind::Embedding) model
+    pub model: String,
+
+    /// Minimum cosine similarity of a prompt to a cached prompt to replay its response.
+    #[serde(default = "default_threshold")]
+    pub threshold: f32,
+
+    /// Maximum number of cached responses. The least recently used response is evicted first.
+    #[serde(default = "default_max_entries")]
+    pub max_entries: usize,
+
+    /// Seconds a response is replayed after it was generated. Responses do not expire if not set.
+    pub ttl: Option<u64>,
+}
+
+fn default_threshold() -> f32 {
+    DEFAULT_SIMILARITY_THRESHOLD
+}
+
+fn default_max_entries() -> usize {
+    DEFAULT_MAX_ENTRIES
+}
+
+/// Scope and embedding of a prompt.
+#[derive(Debug, Clone)]
+pub(crate) struct SemanticKey {
+    scope: String,
+    embedding: Vec<f32>,
+}
+
+impl SemanticKey {
+    /// Returns the scope of the prompt, the key its response is cached under.
+    pub(crate) fn scope(&self) -> &str {
+        &self.scope
+    }
+}
+
+struct SemanticEntry {
+    embedding: Vec<f32>,
+    response: CachedResponse,
+}
+
+/// Responses of a single model, looked up by the embeddings of their prompts.
+pub(crate) struct SemanticCache {
+    model: String,
+    embedder: LLMRuntime,
+    threshold: f32,
+    max_entries: usize,
+    ttl: Option<u64>,
+
+    /// Responses ordered from least to most recently used
+    entries: Vec<SemanticEntry>,
+}
+
+impl SemanticCache {
+    /// Creates the cache of `model`, embedding prompts with the runtime of an embedding model.
+    pub(crate) fn new(model: &str, config: &SemanticCacheConfig, embedder: LLMRuntime) -> Self {
+        Self {
+            model: model.to_string(),
+            embedder,
+            threshold: config.threshold,
+            max_entries: config.max_entries,
+            ttl: config.ttl,
+            entries: vec![],
+        }
+    }
+
+    /// Returns the scope and embedding of `query`, or `None` if `query` is not a prompt ending
+    /// with a user message.
+    pub(crate) fn key(&self, query: &Query) -> Result<Option<SemanticKey>, Error> {
+        let Query::Prompt {
+            messages,
+            continue_final_message: false,
+            ..
+        } = query
+        else {
+            return Ok(None);
+        };
+
+        let Some((last, context)) = messages
+            .split_last()
+            .filter(|(last, _)| last.role == "user")
+        else {
+            return Ok(None);
+        };
+
+        // The scope covers all fields affecting the response, except the last user message
+        let mut scope = serde_json::to_value(query)?;
+        if let Some(fields) = scope.as_object_mut() {
+            for field in VOLATILE_FIELDS {
+                fields.remove(field);
+            }
+            fields.insert("messages".to_string(), serde_json::to_value(context)?);
+        }
+
+        let mut hasher = Sha256::new();
+        hasher.update(self.model.as_bytes());
+        hasher.update(canonical(&scope).as_bytes());
+
+        let embedding = self
+            .embedder
+            .embed(vec![last.content.clone()])?
+            .pop()
+            .ok_or(Error::ExecutionError(
+                "Embedding model did not return an embedding".to_string(),
+            ))?;
+
+        Ok(Some(SemanticKey {
+            scope: format!("{:x}", hasher.finalize()),
+            embedding,
+        }))
+    }
+
+    /// Returns the response of the most similar prompt in the scope of `key` along with its
+    /// similarity, if it reaches the threshold.
+    pub(crate) fn get(&mut self, key: &SemanticKey) -> Option<(CachedResponse, f32)> {
+        self.evict();
+
+        let (index, similarity) = self
+            .entries
+            .iter()
+            .enumerate()
+            .filter(|(_, e)| e.response.key() == key.scope)
+            .map(|(i, e)| (i, cosine_similarity(&e.embedding, &key.embedding)))
+            .filter(|(_, similarity)| *similarity >= self.threshold)
+            .max_by(|(_, a), (_, b)| a.total_cmp(b))?;
+
+        // Move the response to the back, the most recently used position
+        let entry = self.entries.remove(index);
+        let response = entry.response.clone();
+        self.entries.push(entry);
+
+        Some((response, similarity))
+    }
+
+    /// Caches `response` to the prompt of `key`, evicting expired and least recently used
+    /// responses.
+    pub(crate) fn insert(&mut self, key: SemanticKey, response: CachedResponse) {
+        self.entries.push(SemanticEntry {
+            embedding: key.embedding,
+            response,
+        });
+        self.evict();
+    }
+
+    fn evict(&mut self) {
+        let ttl = self.ttl;
+        self.entries.retain(|e| !e.response.is_expired(ttl));
+
+        let excess = self.entries.len().saturating_sub(self.max_entries);
+        self.entries.drain(..excess);
+    }
+}
+
+/// Returns the cosine similarity of two embeddings.
+pub fn cosine_similarity(a: &[f32], b: &[f32]) -> f32 {
+    let dot: f32 = a.iter().zip(b).map(|(a, b)| a * b).sum();
+    let norm = |v: &[f32]| v.iter().map(|x| x * x).sum::<f32>().sqrt();
+
+    dot / (norm(a) * norm(b)).max(f32::EPSILON)
+}
@@ -0,0 +1,126 @@
+//! Special tokens
+//!
+//! Controls whether the tokenizer's special tokens (e.g. BOS) are added when a prompt is encoded
+//! and whether special tokens are visible in the decoded output. The special tokens of a model
+//! can be listed with [`SpecialTokens`].
+
+use crate::{Error, LLMRuntimeConfig, TokenizerConfig};
+use serde::{Deserialize, Serialize};
+use std::fs::File;
+use tokenizers::Tokenizer;
+
+/// Special token handling of a model.
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct SpecialTokenPolicy {
+    /// Adds the tokenizer's special tokens (e.g. BOS) when a prompt is encoded.
+    ///
+    /// If not set, special tokens are added unless the rendered prompt already starts with the
+    /// BOS token, as many chat templates insert it themselves.
+    pub add_special_tokens: Option<bool>,
+
+    /// Removes special tokens from the decoded output. Defaults to `true`.
+    pub skip_special_tokens: Option<bool>,
+}
+
+/// A special token and its id.
+#[derive(Deserialize, Serialize, Debug, Clone, PartialEq, Eq)]
+pub struct SpecialToken {
+    /// Token id, `None` if the token is not part of the vocabulary
+    pub id: Option<u32>,
+
+    pub content: String,
+
+    /// Whether the tokenizer treats the token as special, i.e. it is removed when decoding with
+    /// `skip_special_tokens`
+    pub special: bool,
+}
+
+/// Special tokens of a model's tokenizer.
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct SpecialTokens {
+    pub bos_token: Option<SpecialToken>,
+    pub eos_token: Option<SpecialToken>,
+    pub pad_token: Option<SpecialToken>,
+
+    /// Added tokens, ordered by id
+    pub added_tokens: Vec<SpecialToken>,
+}
+
+impl SpecialTokens {
+    /// Collects the special tokens from `tokenizer_config.json` and `tokenizer.json` of `config`.
+    ///
+    /// Missing or empty file paths result in empty entries.
+    pub fn from_config(config: &LLMRuntimeConfig) -> Result<Self, Error> {
+        let tokenizer_config: TokenizerConfig = match config
+            .tokenizer_config_file
+            .as_ref()
+            .filter(|path| !path.as_os_str().is_empty())
+        {
+            Some(path) => serde_json::from_reader(File::open(path)?)?,
+            None => TokenizerConfig::default(),
+        };
+
+        let tokenizer = config
+            .tokenizer_file
+            .as_ref()
+            .filter(|path| !path.as_os_str().is_empty())
+            .map(|path| {
+                Tokenizer::from_file(path)
+                    .map_err(|e| Error::LoadingFile(format!("{path:?}"), e.to_string()))
+            })
+            .transpose()?;
+
+        Ok(Self::new(&tokenizer_config, tokenizer.as_ref()))
+    }
+
+    /// Collects the special tokens from a tokenizer config and the tokenizer's vocabulary.
+    ///
+    /// Added tokens are taken from `added_tokens_decoder` of the tokenizer config, or from the
+    /// tokenizer if the config does not declare any.
+    pub fn new(tokenizer_config: &TokenizerConfig, tokenizer: Option<&Tokenizer>) -> Self {
+        let mut added_tokens: Vec<SpecialToken> = match &tokenizer_config.added_tokens_decoder {
+            Some(decoder) => decoder
+                .iter()
+                .map(|(id, token)| SpecialToken {
+                    id: id.parse().ok(),
+                    content: token.content.clone(),
+                    special: token.special,
+                })
+                .collect(),
+            None => tokenizer
+                .map(|t| {
+                    t.get_added_tokens_decoder()
+                        .into_iter()
+                        .map(|(id, token)| SpecialToken {
+                            id: Some(id),
+                            content: token.content,
+                            special: token.special,
+                        })
+                        .collect()
+                })
+                .unwrap_or_default(),
+        };
+
+        added_tokens.sort_by_key(|token| token.id);
+
+        let lookup = |content: &Option<String>| {
+            let content = content.as_ref()?;
+            let added = added_tokens.iter().find(|t| t.content.eq(content));
+
+            Some(SpecialToken {
+                id: added
+                    .and_then(|t| t.id)
+                    .or_else(|| tokenizer.and_then(|t| t.token_to_id(content))),
+                content: content.clone(),
+                special: added.map(|t| t.special).unwrap_or(true),
+            })
+        };
+
+        Self {
+            bos_token: lookup(&tokenizer_config.bos_token),
+            eos_token: lookup(&tokenizer_config.eos_token),
+            pad_token: lookup(&tokenizer_config.pad_token),
+            added_tokens,
+        }
+    }
+}
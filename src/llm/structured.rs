@@ -0,0 +1,147 @@
+//! Structured output
+//!
+//! Deserializes model output directly into Rust types. The JSON schema of the target type is
+//! derived with [`schemars`] and added to the prompt. The output is validated against the schema
+//! and deserialized into the target type. On failure, the model is asked to correct its answer, up
+//! to a retry limit.
+
+use crate::{Error, Query, QueryMessage};
+use jsonschema::Validator;
+use schemars::JsonSchema;
+use serde::de::DeserializeOwned;
+
+/// Default number of corrective retries of a structured completion.
+pub const DEFAULT_STRUCTURED_RETRIES: usize = 2;
+
+/// Returns the JSON schema of `T`, pretty printed.
+pub fn json_schema<T: JsonSchema>() -> String {
+    let schema = schemars::schema_for!(T);
+
+    serde_json::to_string_pretty(&schema).unwrap_or_default()
+}
+
+/// Runs a structured completion of `query`, see
+/// [`LLMRuntime::complete_structured`](crate::runtime::LLMRuntime::complete_structured).
+///
+/// `complete` runs a single attempt and returns its output.
+pub(crate) fn complete<T, F>(query: Query, max_retries: usize, mut complete: F) -> Result<T, Error>
+where
+    T: DeserializeOwned + JsonSchema,
+    F: FnMut(Query) -> Result<String, Error>,
+{
+    let mut query = query;
+
+    let Query::Prompt { messages, .. } = &mut query else {
+        return Err(Error::UnexpectedMessage);
+    };
+
+    let schema = serde_json::to_value(schemars::schema_for!(T))?;
+    let validator = jsonschema::validator_for(&schema)
+        .map_err(|e| Error::ExecutionError(format!("Invalid JSON schema: {e}")))?;
+    instruct(messages, &serde_json::to_string_pretty(&schema)?);
+
+    let mut attempts = 0;
+
+    loop {
+        let raw = complete(query.clone())?;
+        attempts += 1;
+
+        let message = match parse::<T>(&raw, &validator) {
+            Ok(value) => return Ok(value),
+            Err(message) => message,
+        };
+
+        tracing::debug!("Rejected structured output (attempt {attempts}): {message}");
+
+        if attempts > max_retries {
+            return Err(Error::StructuredOutput {
+                message,
+                raw,
+                attempts,
+            });
+        }
+
+        if let Query::Prompt { messages, .. } = &mut query {
+            correct(messages, &raw, &message);
+        }
+    }
+}
+
+/// Returns `true`, if `error` has been raised by [`complete`] itself rather than by a
+/// generation.
+pub(crate) fn is_rejection(error: &Error) -> bool {
+    matches!(
+        error,
+        Error::StructuredOutput { .. } | Error::UnexpectedMessage
+    )
+}
+
+/// Adds the instruction to answer with JSON matching `schema` to the leading system message.
+///
+/// A system message is inserted, if the conversation does not start with one.
+pub(crate) fn instruct(messages: &mut Vec<QueryMessage>, schema: &str) {
+    let instruction = format!(
+        "Respond only with a JSON value matching the following JSON schema, without any \
+         explanation or markdown formatting:\n{schema}"
+    );
+
+    match messages.first_mut() {
+        Some(message) if message.role.eq_ignore_ascii_case("system") => {
+            message.content = format!("{}\n\n{instruction}", message.content);
+        }
+        _ => messages.insert(
+            0,
+            QueryMessage {
+                role: "system".to_string(),
+                content: instruction,
+            },
+        ),
+    }
+}
+
+/// Appends the rejected output and a corrective message to the conversation.
+pub(crate) fn correct(messages: &mut Vec<QueryMessage>, raw: &str, error: &str) {
+    messages.push(QueryMessage {
+        role: "assistant".to_string(),
+        content: raw.to_string(),
+    });
+
+    messages.push(QueryMessage {
+        role: "user".to_string(),
+        content: format!(
+            "Your response is not valid: {error}. Respond again with only a JSON value matching \
+             the schema."
+        ),
+    });
+}
+
+/// Parses the first JSON value of `raw` into `T`, if it is valid against the schema of
+/// `validator`.
+///
+/// A leading reasoning block (`<think>...</think>`), markdown code fences and text around the
+/// JSON value are ignored.
+pub(crate) fn parse<T: DeserializeOwned>(raw: &str, validator: &Validator) -> Result<T, String> {
+    let text = raw
+        .rsplit_once("</think>")
+        .map(|(_, answer)| answer)
+        .unwrap_or(raw);
+
+    let start = text
+        .find(['{', '['])
+        .ok_or_else(|| "no JSON object or array found".to_string())?;
+
+    let value = serde_json::Deserializer::from_str(&text[start..])
+        .into_iter::<serde_json::Value>()
+        .next()
+        .ok_or_else(|| "no JSON value found".to_string())?
+        .map_err(|e| format!("invalid JSON ({e})"))?;
+
+    if let Some(error) = validator.iter_errors(&value).next() {
+        return Err(format!(
+            "JSON does not match the schema ({error} at '{}')",
+            error.instance_path
+        ));
+    }
+
+    serde_json::from_value(value).map_err(|e| format!("JSON does not match the schema ({e})"))
+}
@@ -0,0 +1,326 @@
+//! Token healing
+//!
+//! A prompt ending mid-token (e.g. a prefilled `"http:"`) is tokenized differently than the same
+//! text followed by its continuation, which skews the first generated tokens. Token healing removes
+//! the last prompt tokens and constrains the first generated tokens to those whose text starts with
+//! the removed text. The removed text is not repeated in the output.
+
+use crate::Error;
+use candle_core::{DType, Tensor};
+use serde::{Deserialize, Serialize};
+use tokenizers::Tokenizer;
+
+/// Token healing settings.
+///
+/// Healing is applied to [`Query::Completion`](crate::Query::Completion) text prompts, to
+/// [`Query::Prompt`](crate::Query::Prompt)s continuing the final message and to the prefix of
+/// [`Query::Infill`](crate::Query::Infill)s.
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct TokenHealing {
+    /// Maximum number of prompt tokens removed from the end of the prompt. Defaults to `1`.
+    pub max_tokens: Option<usize>,
+}
+
+/// Decoded text of every token in the vocabulary. Special tokens map to an empty string.
+///
+/// The table is built once per tokenizer, when the first prompt is healed.
+pub(crate) struct VocabText(Vec<String>);
+
+impl VocabText {
+    pub(crate) fn new(tokenizer: &Tokenizer) -> Result<Self, Error> {
+        let ids: Vec<[u32; 1]> = (0..tokenizer.get_vocab_size(true) as u32)
+            .map(|id| [id])
+            .collect();
+        let sentences: Vec<&[u32]> = ids.iter().map(|id| id.as_slice()).collect();
+
+        let texts = tokenizer
+            .decode_batch(&sentences, true)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?
+            .into_iter()
+            .zip(0u32..)
+            .map(|(text, id)| {
+                // SentencePiece decoders strip the leading space of the first token
+                match tokenizer.id_to_token(id) {
+                    Some(token) if token.starts_with('▁') && !text.starts_with(' ') => {
+                        format!(" {text}")
+                    }
+                    _ => text,
+                }
+            })
+            .collect();
+
+        Ok(Self(texts))
+    }
+
+    fn get(&self, id: u32) -> &str {
+        self.0
+            .get(id as usize)
+            .map(String::as_str)
+            .unwrap_or_default()
+    }
+}
+
+impl TokenHealing {
+    /// Removes up to [`Self::max_tokens`] tokens from the end of `tokens`.
+    ///
+    /// Returns the number of kept tokens and the removed text, or `None` if nothing can be
+    /// removed. Special tokens and the first prompt token are never removed.
+    pub(crate) fn back_off(
+        &self,
+        tokens: &[u32],
+        tokenizer: &Tokenizer,
+        vocab: &VocabText,
+    ) -> Result<Option<(usize, String)>, Error> {
+        let max_tokens = self.max_tokens.unwrap_or(1);
+
+        let removable = tokens
+            .iter()
+            .skip(1)
+            .rev()
+            .take(max_tokens)
+            .take_while(|id| !vocab.get(**id).is_empty())
+            .count();
+
+        if removable == 0 {
+            return Ok(None);
+        }
+
+        let kept = tokens.len() - removable;
+
+        let decode = |ids: &[u32]| {
+            tokenizer
+                .decode(ids, true)
+                .map_err(|e| Error::ExecutionError(e.to_string()))
+        };
+
+        let full = decode(tokens)?;
+        let prefix = decode(&tokens[..kept])?;
+
+        Ok(full
+            .strip_prefix(prefix.as_str())
+            .filter(|removed| !removed.is_empty())
+            .map(|removed| (kept, removed.to_string())))
+    }
+}
+
+/// Constrains the first generated tokens to the text removed from the prompt.
+pub(crate) struct Healer<'a> {
+    vocab: &'a VocabText,
+
+    /// Removed text not yet covered by generated tokens
+    remaining: String,
+}
+
+impl<'a> Healer<'a> {
+    pub(crate) fn new(vocab: &'a VocabText, removed: String) -> Self {
+        Self {
+            vocab,
+            remaining: removed,
+        }
+    }
+
+    /// Returns `true`, once the generated tokens cover the removed text.
+    pub(crate) fn is_healed(&self) -> bool {
+        self.remaining.is_empty()
+    }
+
+    /// Masks all tokens not continuing the removed text.
+    pub(crate) fn constrain(&self, logits: &Tensor) -> Result<Tensor, Error> {
+        if self.is_healed() {
+            return Ok(logits.clone());
+        }
+
+        let mut values = logits
+            .to_dtype(DType::F32)
+            .and_then(|l| l.to_vec1::<f32>())
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        let mut any_allowed = false;
+
+        for (id, value) in values.iter_mut().enumerate() {
+            let text = self.vocab.get(id as u32);
+            let allowed = !text.is_empty()
+                && (text.starts_with(self.remaining.as_str()) || self.remaining.starts_with(text));
+
+            if allowed {
+                any_allowed = true;
+            } else {
+                *value = f32::NEG_INFINITY;
+            }
+        }
+
+        // Sampling fails if every token is masked, generation continues unconstrained instead
+        if !any_allowed {
+            tracing::warn!(
+                "No token continues '{}', skipping token healing",
+                self.remaining
+            );
+            return Ok(logits.clone());
+        }
+
+        Tensor::new(values, logits.device()).map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+
+    /// Advances past a sampled token.
+    pub(crate) fn accept(&mut self, token: u32) {
+        let text = self.vocab.get(token);
+
+        self.remaining = match self.remaining.strip_prefix(text) {
+            Some(rest) if !text.is_empty() => rest.to_string(),
+            _ => String::new(),
+        };
+    }
+}
+
+/// Removes `prefix` from the start of `text`, as far as both match.
+///
+/// The stripped part is removed from `prefix` as well, so that the rest is stripped from the
+/// following text. Once `text` diverges from `prefix`, `prefix` is cleared.
+pub(crate) fn strip_common_prefix(text: &mut String, prefix: &mut String) {
+    let len: usize = text
+        .chars()
+        .zip(prefix.chars())
+        .take_while(|(a, b)| a == b)
+        .map(|(c, _)| c.len_utf8())
+        .sum();
+
+    text.drain(..len);
+
+    if text.is_empty() {
+        prefix.drain(..len);
+    } else {
+        prefix.clear();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use candle_core::Device;
+    use std::str::FromStr;
+
+    /// Returns a tokenizer concatenating its tokens without spaces, with `<s>` as special token.
+    fn tokenizer() -> Tokenizer {
+        let tokenizer = serde_json::json!({
+            "version": "1.0",
+            "truncation": null,
+            "padding": null,
+            "added_tokens": [{
+                "id": 0,
+                "content": "<s>",
+                "single_word": false,
+                "lstrip": false,
+                "rstrip": false,
+                "normalized": false,
+                "special": true
+            }],
+            "normalizer": null,
+            "pre_tokenizer": null,
+            "post_processor": null,
+            "decoder": { "type": "Fuse" },
+            "model": {
+                "type": "WordLevel",
+                "vocab": { "<s>": 0, "http": 1, ":": 2, "://": 3, "/": 4, "ht": 5, "tp": 6, "x": 7 },
+                "unk_token": "x"
+            }
+        });
+
+        Tokenizer::from_str(&tokenizer.to_string()).unwrap()
+    }
+
+    fn back_off(max_tokens: usize, tokens: &[u32]) -> Option<(usize, String)> {
+        let tokenizer = tokenizer();
+        let vocab = VocabText::new(&tokenizer).unwrap();
+        let healing = TokenHealing {
+            max_tokens: Some(max_tokens),
+        };
+
+        healing.back_off(tokens, &tokenizer, &vocab).unwrap()
+    }
+
+    #[test]
+    fn test_vocab_text() {
+        let vocab = VocabText::new(&tokenizer()).unwrap();
+
+        assert_eq!(vocab.get(0), "");
+        assert_eq!(vocab.get(3), "://");
+        assert_eq!(vocab.get(64), "");
+    }
+
+    #[test]
+    fn test_back_off() {
+        assert_eq!(back_off(1, &[0, 1, 2]), Some((2, ":".to_string())));
+        assert_eq!(back_off(3, &[0, 1, 2]), Some((1, "http:".to_string())));
+        assert_eq!(back_off(1, &[0, 1]), Some((1, "http".to_string())));
+
+        // the first prompt token and special tokens are never removed
+        assert_eq!(back_off(1, &[1]), None);
+        assert_eq!(back_off(1, &[1, 0]), None);
+        assert_eq!(back_off(2, &[1, 0, 2]), Some((2, ":".to_string())));
+    }
+
+    #[test]
+    fn test_healer_constrain() {
+        let vocab = VocabText::new(&tokenizer()).unwrap();
+        let logits = Tensor::zeros(8, DType::F32, &Device::Cpu).unwrap();
+
+        let healer = Healer::new(&vocab, ":".to_string());
+        let constrained = healer.constrain(&logits).unwrap().to_vec1::<f32>().unwrap();
+        let allowed: Vec<usize> = constrained
+            .iter()
+            .enumerate()
+            .filter(|(_, value)| value.is_finite())
+            .map(|(id, _)| id)
+            .collect();
+        assert_eq!(allowed, vec![2, 3]);
+
+        // tokens covering a part of the removed text are allowed as well
+        let healer = Healer::new(&vocab, "http:".to_string());
+        let constrained = healer.constrain(&logits).unwrap().to_vec1::<f32>().unwrap();
+        assert!(constrained[1].is_finite() && constrained[5].is_finite());
+        assert!(constrained[6].is_infinite());
+
+        // generation continues unconstrained, if no token continues the removed text
+        let healer = Healer::new(&vocab, "?".to_string());
+        let constrained = healer.constrain(&logits).unwrap().to_vec1::<f32>().unwrap();
+        assert!(constrained.iter().all(|value| *value == 0.));
+    }
+
+    #[test]
+    fn test_healer_accept() {
+        let vocab = VocabText::new(&tokenizer()).unwrap();
+
+        let mut healer = Healer::new(&vocab, "http:".to_string());
+        healer.accept(5);
+        assert!(!healer.is_healed());
+        healer.accept(6);
+        assert!(!healer.is_healed());
+        healer.accept(3);
+        assert!(healer.is_healed());
+
+        // a token diverging from the removed text ends healing
+        let mut healer = Healer::new(&vocab, "http:".to_string());
+        healer.accept(7);
+        assert!(healer.is_healed());
+
+        // so does a special token
+        let mut healer = Healer::new(&vocab, "http:".to_string());
+        healer.accept(0);
+        assert!(healer.is_healed());
+    }
+
+    #[test]
+    fn test_strip_common_prefix() {
+        let strip = |text: &str, prefix: &str| {
+            let (mut text, mut prefix) = (text.to_string(), prefix.to_string());
+            strip_common_prefix(&mut text, &mut prefix);
+            (text, prefix)
+        };
+
+        assert_eq!(strip("ht", "http:"), ("".to_string(), "tp:".to_string()));
+        assert_eq!(strip("://x", ":"), ("//x".to_string(), "".to_string()));
+        assert_eq!(strip("hx", "http"), ("x".to_string(), "".to_string()));
+        assert_eq!(strip("x", ""), ("x".to_string(), "".to_string()));
+        assert_eq!(strip("", "http"), ("".to_string(), "http".to_string()));
+    }
+}
@@ -0,0 +1,308 @@
+//! Metrics
+//!
+//! Counters and histograms of the runtimes of a [`LLMService`](crate::LLMService), collected in a
+//! Prometheus registry. The metrics are rendered in the Prometheus text format by
+//! [`Metrics::gather`] and can be served on a localhost `/metrics` endpoint with
+//! [`Metrics::serve`].
+
+use std::io::{BufRead, BufReader, Write};
+use std::net::{Ipv4Addr, SocketAddr, TcpListener, TcpStream};
+use std::sync::Arc;
+use std::time::Duration;
+
+use prometheus::{
+    Encoder, HistogramOpts, HistogramVec, IntCounterVec, IntGaugeVec, Opts, Registry, TextEncoder,
+};
+
+use crate::{Error, LLMRuntimeConfig, TokenUsage};
+
+/// Model label of errors of a service without active runtime
+pub(crate) const NO_MODEL: &str = "none";
+
+/// Metrics of all runtimes of a service, labeled by model.
+#[derive(Clone)]
+pub struct Metrics {
+    registry: Registry,
+
+    /// Requests by model and kind of query
+    requests: IntCounterVec,
+
+    prompt_tokens: IntCounterVec,
+
+    completion_tokens: IntCounterVec,
+
+    /// Time from sending a generating query to receiving the first chunk
+    time_to_first_token: HistogramVec,
+
+    /// Time to first token of the request loading the model, without the load time
+    first_request_time_to_first_token: HistogramVec,
+
+    /// Generated tokens per second after the first chunk
+    decode_rate: HistogramVec,
+
+    load_duration: HistogramVec,
+
+    /// Errors by model and [`Error::kind`]
+    errors: IntCounterVec,
+
+    /// Queries sent to a runtime, which have not been picked up by its worker yet
+    queue_depth: IntGaugeVec,
+
+    /// Size of the weight files of the loaded model
+    weights_bytes: IntGaugeVec,
+
+    /// Generations replayed from the response cache
+    response_cache_hits: IntCounterVec,
+
+    /// Generations replayed from the response of a similar prompt
+    semantic_cache_hits: IntCounterVec,
+}
+
+impl Default for Metrics {
+    fn default() -> Self {
+        Self::new().expect("Failed to register metrics")
+    }
+}
+
+impl Metrics {
+    /// Creates the metrics in a new registry.
+    pub fn new() -> Result<Self, Error> {
+        Self::with_registry(Registry::new())
+    }
+
+    /// Creates the metrics and registers them in `registry`, e.g. to serve them along with
+    /// metrics of the application.
+    pub fn with_registry(registry: Registry) -> Result<Self, Error> {
+        let counter = |name: &str, help: &str, labels: &[&str]| {
+            let counter = IntCounterVec::new(Opts::new(name, help), labels)?;
+            registry.register(Box::new(counter.clone()))?;
+            Ok::<_, prometheus::Error>(counter)
+        };
+
+        let histogram = |name: &str, help: &str, buckets: Vec<f64>| {
+            let histogram =
+                HistogramVec::new(HistogramOpts::new(name, help).buckets(buckets), &["model"])?;
+            registry.register(Box::new(histogram.clone()))?;
+            Ok::<_, prometheus::Error>(histogram)
+        };
+
+        let gauge = |name: &str, help: &str| {
+            let gauge = IntGaugeVec::new(Opts::new(name, help), &["model"])?;
+            registry.register(Box::new(gauge.clone()))?;
+            Ok::<_, prometheus::Error>(gauge)
+        };
+
+        (|| {
+            Ok(Self {
+                requests: counter(
+                    "llm_requests_total",
+                    "Requests by model and kind of query",
+                    &["model", "kind"],
+                )?,
+                prompt_tokens: counter(
+                    "llm_prompt_tokens_total",
+                    "Prompt tokens processed",
+                    &["model"],
+                )?,
+                completion_tokens: counter(
+                    "llm_completion_tokens_total",
+                    "Tokens generated",
+                    &["model"],
+                )?,
+                time_to_first_token: histogram(
+                    "llm_time_to_first_token_seconds",
+                    "Time from sending a query to receiving the first chunk",
+                    vec![0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0],
+                )?,
+                first_request_time_to_first_token: histogram(
+                    "llm_first_request_time_to_first_token_seconds",
+                    "Time to first token of the request loading a model, without the load time",
+                    vec![0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0],
+                )?,
+                decode_rate: histogram(
+                    "llm_decode_tokens_per_second",
+                    "Generated tokens per second after the first chunk",
+                    vec![1.0, 2.0, 5.0, 10.0, 20.0, 50.0, 100.0, 200.0, 500.0],
+                )?,
+                load_duration: histogram(
+                    "llm_model_load_duration_seconds",
+                    "Time to load and initialize a model",
+                    vec![0.5, 1.0, 2.5, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0],
+                )?,
+                errors: counter(
+                    "llm_errors_total",
+                    "Errors by model and kind",
+                    &["model", "kind"],
+                )?,
+                queue_depth: gauge("llm_queue_depth", "Queries waiting for the runtime worker")?,
+                weights_bytes: gauge(
+                    "llm_model_weights_bytes",
+                    "Size of the weight files of the loaded model",
+                )?,
+                response_cache_hits: counter(
+                    "llm_response_cache_hits_total",
+                    "Generations replayed from the response cache",
+                    &["model"],
+                )?,
+                semantic_cache_hits: counter(
+                    "llm_semantic_cache_hits_total",
+                    "Generations replayed from the response of a similar prompt",
+                    &["model"],
+                )?,
+                registry: registry.clone(),
+            })
+        })()
+        .map_err(|e: prometheus::Error| Error::ExecutionError(e.to_string()))
+    }
+
+    /// Returns the registry the metrics are registered in.
+    pub fn registry(&self) -> &Registry {
+        &self.registry
+    }
+
+    /// Renders all metrics of the registry in the Prometheus text format.
+    pub fn gather(&self) -> Result<String, Error> {
+        let mut buffer = vec![];
+
+        TextEncoder::new()
+            .encode(&self.registry.gather(), &mut buffer)
+            .map_err(|e| Error::ExecutionError(e.to_string()))?;
+
+        String::from_utf8(buffer).map_err(|e| Error::ExecutionError(e.to_string()))
+    }
+
+    /// Serves the metrics on `http://127.0.0.1:<port>/metrics` in a background thread.
+    ///
+    /// Pass port `0` to bind any free port. Returns the bound address.
+    pub fn serve(self: Arc<Self>, port: u16) -> Result<SocketAddr, Error> {
+        let listener = TcpListener::bind((Ipv4Addr::LOCALHOST, port))?;
+        let addr = listener.local_addr()?;
+
+        tracing::info!("Serving metrics on http://{addr}/metrics");
+
+        std::thread::spawn(move || {
+            for stream in listener.incoming() {
+                match stream {
+                    Ok(stream) => {
+                        if let Err(e) = self.respond(stream) {
+                            tracing::warn!("Error serving metrics: {e}");
+                        }
+                    }
+                    Err(e) => tracing::warn!("Error accepting metrics connection: {e}"),
+                }
+            }
+        });
+
+        Ok(addr)
+    }
+
+    /// Answers a single HTTP request of a scraper.
+    fn respond(&self, mut stream: TcpStream) -> Result<(), Error> {
+        stream.set_read_timeout(Some(Duration::from_secs(5)))?;
+
+        let mut request_line = String::new();
+        BufReader::new(&stream).read_line(&mut request_line)?;
+
+        let (status, content_type, body) = match request_line.split_whitespace().nth(1) {
+            Some("/metrics") if request_line.starts_with("GET ") => (
+                "200 OK",
+                "text/plain; version=0.0.4; charset=utf-8",
+                self.gather()?,
+            ),
+            _ => ("404 Not Found", "text/plain", "Not Found".to_string()),
+        };
+
+        write!(
+            stream,
+            "HTTP/1.1 {status}\r\nContent-Type: {content_type}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{body}",
+            body.len()
+        )?;
+
+        Ok(())
+    }
+}
+
+/// Recording
+impl Metrics {
+    pub(crate) fn record_request(&self, model: &str, kind: &str) {
+        self.requests.with_label_values(&[model, kind]).inc();
+    }
+
+    pub(crate) fn record_error(&self, model: &str, error: &Error) {
+        self.errors.with_label_values(&[model, error.kind()]).inc();
+    }
+
+    pub(crate) fn record_load(&self, config: &LLMRuntimeConfig, duration: Duration) {
+        self.load_duration
+            .with_label_values(&[&config.name])
+            .observe(duration.as_secs_f64());
+        self.weights_bytes
+            .with_label_values(&[&config.name])
+            .set(weights_size(config) as i64);
+    }
+
+    pub(crate) fn record_unload(&self, model: &str) {
+        self.weights_bytes.with_label_values(&[model]).set(0);
+        self.queue_depth.with_label_values(&[model]).set(0);
+    }
+
+    pub(crate) fn record_enqueued(&self, model: &str) {
+        self.queue_depth.with_label_values(&[model]).inc();
+    }
+
+    pub(crate) fn record_dequeued(&self, model: &str) {
+        self.queue_depth.with_label_values(&[model]).dec();
+    }
+
+    pub(crate) fn record_response_cache_hit(&self, model: &str) {
+        self.response_cache_hits.with_label_values(&[model]).inc();
+    }
+
+    pub(crate) fn record_semantic_cache_hit(&self, model: &str) {
+        self.semantic_cache_hits.with_label_values(&[model]).inc();
+    }
+
+    pub(crate) fn record_first_token(&self, model: &str, duration: Duration) {
+        self.time_to_first_token
+            .with_label_values(&[model])
+            .observe(duration.as_secs_f64());
+    }
+
+    /// Records the time to first token of the request, which loaded the model for `load`.
+    pub(crate) fn record_first_request_token(
+        &self,
+        model: &str,
+        duration: Duration,
+        load: Duration,
+    ) {
+        self.first_request_time_to_first_token
+            .with_label_values(&[model])
+            .observe(duration.saturating_sub(load).as_secs_f64());
+    }
+
+    /// Records the token `usage` of a generation, which decoded for `decode` after the first chunk.
+    pub(crate) fn record_usage(&self, model: &str, usage: &TokenUsage, decode: Option<Duration>) {
+        self.prompt_tokens
+            .with_label_values(&[model])
+            .inc_by(usage.prompt_tokens as u64);
+        self.completion_tokens
+            .with_label_values(&[model])
+            .inc_by(usage.completion_tokens as u64);
+
+        if let Some(decode) = decode.filter(|d| !d.is_zero() && usage.completion_tokens > 1) {
+            self.decode_rate
+                .with_label_values(&[model])
+                .observe((usage.completion_tokens - 1) as f64 / decode.as_secs_f64());
+        }
+    }
+}
+
+/// Returns the size of the weight files of `config` in bytes.
+fn weights_size(config: &LLMRuntimeConfig) -> u64 {
+    config
+        .weight_files()
+        .iter()
+        .filter_map(|path| std::fs::metadata(path).ok())
+        .map(|metadata| metadata.len())
+        .sum()
+}
@@ -1,10 +1,11 @@
+use schemars::JsonSchema;
 use serde::de::DeserializeOwned;
 use tauri::{
     plugin::{PluginApi, PluginHandle},
-    AppHandle, Runtime,
+    AppHandle, Manager, Runtime,
 };
 
-use crate::models::*;
+use crate::{LLMPluginConfig, PluginState, Query};
 
 #[cfg(target_os = "ios")]
 tauri::ios_plugin_binding!(init_plugin_tauri_plugin_llm);
@@ -13,28 +14,37 @@ tauri::ios_plugin_binding!(init_plugin_tauri_plugin_llm);
 pub fn init<R: Runtime, C: DeserializeOwned>(
     app: &AppHandle<R>,
     api: PluginApi<R, C>,
-    config: mcpurify::Config,
+    config: LLMPluginConfig,
 ) -> crate::Result<TauriPluginLlm<R>> {
     #[cfg(target_os = "android")]
-    let handle = api.register_android_plugin("", "ExamplePlugin")?;
+    let mobile_plugin = api.register_android_plugin("", "ExamplePlugin")?;
     #[cfg(target_os = "ios")]
-    let handle = api.register_ios_plugin(init_plugin_tauri_plugin_llm)?;
+    let mobile_plugin = api.register_ios_plugin(init_plugin_tauri_plugin_llm)?;
     Ok(TauriPluginLlm {
         handle: app.clone(),
-        mcpurify_config: config,
+        _mobile_plugin: mobile_plugin,
+        _config: config,
     })
 }
 
 /// Access to the tauri-plugin-llm APIs.
 pub struct TauriPluginLlm<R: Runtime> {
     handle: AppHandle<R>,
-    mcpurify_config: mcpurify::Config,
+    _mobile_plugin: PluginHandle<R>,
+    _config: LLMPluginConfig,
 }
 
 impl<R: Runtime> TauriPluginLlm<R> {
-    pub fn ping(&self, payload: PingRequest) -> crate::Result<PingResponse> {
-        self.0
-            .run_mobile_plugin("ping", payload)
-            .map_err(Into::into)
+    /// Sends a [`Query::Prompt`] to the active model and deserializes the output into `T`.
+    ///
+    /// Blocks until the generation ended. Invalid output is retried with a corrective message,
+    /// see [`LLMRuntime::complete_structured`](crate::runtime::LLMRuntime::complete_structured).
+    pub fn complete_structured<T>(&self, query: Query) -> crate::Result<T>
+    where
+        T: DeserializeOwned + JsonSchema,
+    {
+        self.handle
+            .state::<PluginState>()
+            .complete_structured(query)
     }
 }
@@ -1,4 +1,9 @@
-use crate::{error::Error, TemplateProcessor};
+use crate::{
+    error::Error, iter::FlushPolicy, ChunkedPrefill, Classification, ContextShift, FimTokens,
+    MessageNormalization, Persona, PromptCacheConfig, RepetitionGuard, RerankResult,
+    ResponseCacheConfig, SemanticCacheConfig, SpecialTokenPolicy, SystemPromptPolicy,
+    TemplateProcessor, TokenHealing,
+};
 use serde::{Deserialize, Serialize};
 use std::{
     collections::HashMap,
@@ -37,6 +42,108 @@ pub enum Query {
         #[serde(default)]
         think: bool,
 
+        /// Continues the trailing `assistant` message instead of starting a new turn.
+        ///
+        /// The chat template is rendered without the generation prompt and the partial
+        /// assistant content is left open, so that the output continues it. Use this to
+        /// prefill the beginning of a response or to continue a response cut off at `max_tokens`.
+        #[serde(default)]
+        continue_final_message: bool,
+
+        #[serde(default)]
+        stream: bool,
+
+        model: Option<String>,
+
+        /// Repetition penalty. Defaults to 1.1 if not provided.
+        penalty: Option<f32>,
+
+        /// Generation seed. Defaults to Random if not provided.
+        seed: Option<GenerationSeed>,
+
+        /// Sampling configuration. Defaults to All if not provided.
+        sampling_config: Option<SamplingConfig>,
+
+        /// Adds the tokenizer's special tokens (e.g. BOS) to the prompt.
+        /// Overrides [`SpecialTokenPolicy::add_special_tokens`].
+        add_special_tokens: Option<bool>,
+
+        /// Removes special tokens from the output.
+        /// Overrides [`SpecialTokenPolicy::skip_special_tokens`].
+        skip_special_tokens: Option<bool>,
+
+        /// Decides when generated tokens are flushed as a chunk. Defaults to every `chunk_size`
+        /// tokens if not provided.
+        flush: Option<FlushPolicy>,
+    },
+
+    /// Raw text completion for base models.
+    ///
+    /// The input is fed into the model as is, without applying the chat template.
+    Completion {
+        /// Either the raw `prompt` text or pre-tokenized `token_ids`
+        #[serde(flatten)]
+        input: CompletionInput,
+
+        chunk_size: Option<usize>,
+
+        timestamp: Option<u64>,
+
+        max_tokens: Option<usize>,
+
+        temperature: Option<f32>,
+
+        top_k: Option<f32>,
+
+        top_p: Option<f32>,
+
+        #[serde(default)]
+        stream: bool,
+
+        model: Option<String>,
+
+        /// Repetition penalty. Defaults to 1.1 if not provided.
+        penalty: Option<f32>,
+
+        /// Generation seed. Defaults to Random if not provided.
+        seed: Option<GenerationSeed>,
+
+        /// Sampling configuration. Defaults to All if not provided.
+        sampling_config: Option<SamplingConfig>,
+
+        /// Adds the tokenizer's special tokens (e.g. BOS) to the prompt.
+        /// Overrides [`SpecialTokenPolicy::add_special_tokens`].
+        add_special_tokens: Option<bool>,
+
+        /// Removes special tokens from the output.
+        /// Overrides [`SpecialTokenPolicy::skip_special_tokens`].
+        skip_special_tokens: Option<bool>,
+
+        /// Decides when generated tokens are flushed as a chunk. Defaults to every `chunk_size`
+        /// tokens if not provided.
+        flush: Option<FlushPolicy>,
+    },
+
+    /// Fill-in-the-middle completion for code models.
+    ///
+    /// The model generates the code between `prefix` and `suffix`. Only the middle segment is streamed.
+    Infill {
+        prefix: String,
+
+        suffix: String,
+
+        chunk_size: Option<usize>,
+
+        timestamp: Option<u64>,
+
+        max_tokens: Option<usize>,
+
+        temperature: Option<f32>,
+
+        top_k: Option<f32>,
+
+        top_p: Option<f32>,
+
         #[serde(default)]
         stream: bool,
 
@@ -50,6 +157,71 @@ pub enum Query {
 
         /// Sampling configuration. Defaults to All if not provided.
         sampling_config: Option<SamplingConfig>,
+
+        /// Adds the tokenizer's special tokens (e.g. BOS) to the prompt.
+        /// Overrides [`SpecialTokenPolicy::add_special_tokens`].
+        add_special_tokens: Option<bool>,
+
+        /// Removes special tokens from the output.
+        /// Overrides [`SpecialTokenPolicy::skip_special_tokens`].
+        skip_special_tokens: Option<bool>,
+
+        /// Decides when generated tokens are flushed as a chunk. Defaults to every `chunk_size`
+        /// tokens if not provided.
+        flush: Option<FlushPolicy>,
+    },
+
+    /// Scores `continuation` following `context` instead of generating text.
+    ///
+    /// Answered with a [`Query::Scored`].
+    Score {
+        context: String,
+
+        continuation: String,
+
+        model: Option<String>,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Picks the most likely of `labels` as the answer to `messages` instead of generating text.
+    ///
+    /// Answered with a [`Query::Classified`].
+    Classify {
+        messages: Vec<QueryMessage>,
+
+        labels: Vec<String>,
+
+        model: Option<String>,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Scores the relevance of `documents` to `query` with a [`ModelKind::Reranker`] model.
+    ///
+    /// Answered with a [`Query::Reranked`].
+    Rerank {
+        query: String,
+
+        documents: Vec<String>,
+
+        /// Number of most relevant documents returned. Defaults to all documents.
+        top_n: Option<usize>,
+
+        model: Option<String>,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Embeds each of `texts` with a [`ModelKind::Embedding`] model.
+    ///
+    /// Answered with a [`Query::Embedded`].
+    Embed {
+        texts: Vec<String>,
+
+        model: Option<String>,
+
+        timestamp: Option<u64>,
     },
 
     Response {
@@ -65,8 +237,67 @@ pub enum Query {
         kind: QueryChunkType,
     },
 
+    /// Older tokens have been discarded to continue generating beyond the context window.
+    ContextShift {
+        /// Number of discarded tokens
+        discarded: usize,
+
+        /// Number of tokens remaining in the context window
+        kept: usize,
+
+        timestamp: Option<u64>,
+    },
+
+    /// A block of the prompt has been prefilled, see [`ChunkedPrefill`].
+    PrefillProgress {
+        /// Number of prompt tokens in the KV cache, including tokens restored from the prompt
+        /// cache
+        processed: usize,
+
+        /// Number of prompt tokens
+        total: usize,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Log-likelihood of a [`Query::Score`]
+    Scored {
+        score: Score,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Label probabilities of a [`Query::Classify`]
+    Classified {
+        classification: Classification,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Documents of a [`Query::Rerank`], ordered by descending relevance
+    Reranked {
+        results: Vec<RerankResult>,
+
+        timestamp: Option<u64>,
+    },
+
+    /// Normalized embeddings of the texts of a [`Query::Embed`], in the same order
+    Embedded {
+        embeddings: Vec<Vec<f32>>,
+
+        timestamp: Option<u64>,
+    },
+
     End {
         usage: Option<TokenUsage>,
+
+        /// Reason the generation finished
+        #[serde(default)]
+        finish_reason: Option<FinishReason>,
+
+        /// Set, if the response has been replayed from a cache instead of being generated
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        cache_hit: Option<CacheHit>,
     },
     Exit,
     Status {
@@ -90,6 +321,32 @@ impl ToolCall {
             arguments,
         }
     }
+
+    /// Returns the id of the call
+    pub fn id(&self) -> &str {
+        &self.id
+    }
+
+    /// Returns the name of the called tool
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    /// Returns the arguments of the call
+    pub fn arguments(&self) -> &serde_json::Value {
+        &self.arguments
+    }
+}
+
+/// Input of a [`Query::Completion`].
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum CompletionInput {
+    /// Raw prompt text, encoded by the model's tokenizer
+    Prompt(String),
+
+    /// Pre-tokenized prompt
+    TokenIds(Vec<u32>),
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
@@ -107,6 +364,37 @@ pub enum QueryChunkType {
     ToolCall,
 }
 
+/// Reason a generation finished
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FinishReason {
+    /// The model generated an EOS or stop token
+    Stop,
+
+    /// `max_tokens` or the context length has been reached
+    Length,
+
+    /// A repetition loop has been detected
+    Repetition,
+
+    /// The query has been cancelled, see [`CancellationToken`](crate::CancellationToken)
+    Cancelled,
+}
+
+/// Cache a response has been replayed from
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum CacheHit {
+    /// The response cache, holding responses of identical deterministic queries
+    Exact,
+
+    /// The semantic cache, holding responses of similar prompts
+    Semantic {
+        /// Cosine similarity of the prompt to the cached prompt
+        similarity: f32,
+    },
+}
+
 /// Metrics on actual token usage
 #[derive(Debug, Clone, Serialize, Deserialize)]
 
@@ -121,6 +409,49 @@ pub struct TokenUsage {
     pub total_tokens: usize,
 }
 
+/// Log-likelihood of a continuation given a context
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Score {
+    /// Log-probabilities of the continuation tokens
+    pub tokens: Vec<TokenLogprob>,
+
+    /// Sum of the token log-probabilities
+    pub log_likelihood: f32,
+
+    /// Perplexity of the continuation, `exp(-log_likelihood / tokens)`
+    pub perplexity: f32,
+
+    /// Whether every continuation token is the most likely token at its position
+    pub is_greedy: bool,
+}
+
+/// Log-probability of a single token
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TokenLogprob {
+    pub id: u32,
+
+    /// Decoded token
+    pub text: String,
+
+    /// Natural logarithm of the token probability
+    pub logprob: f32,
+}
+
+impl Score {
+    /// Creates a [`Score`] from the continuation token log-probabilities.
+    pub fn new(tokens: Vec<TokenLogprob>, is_greedy: bool) -> Self {
+        let log_likelihood: f32 = tokens.iter().map(|t| t.logprob).sum();
+        let perplexity = (-log_likelihood / tokens.len().max(1) as f32).exp();
+
+        Self {
+            tokens,
+            log_likelihood,
+            perplexity,
+            is_greedy,
+        }
+    }
+}
+
 impl Query {
     /// Applies [`Self`] with the given template and returns the rendered version as String
     pub fn apply_template(&self, template: &str, tp: &TemplateProcessor) -> Result<String, Error> {
@@ -128,15 +459,120 @@ impl Query {
         tp.render(template, &json_context)
     }
 
+    /// Applies [`Self`] with the given template, leaving the trailing `assistant` message open.
+    ///
+    /// The template is rendered without the generation prompt. Everything the template appends
+    /// after the content of the final message (e.g. an end-of-turn token) is cut off, so that
+    /// the model continues the partial message.
+    pub fn apply_template_continue_final_message(
+        &self,
+        template: &str,
+        tp: &TemplateProcessor,
+    ) -> Result<String, Error> {
+        let Query::Prompt { messages, .. } = self else {
+            return Err(Error::UnexpectedMessage);
+        };
+
+        let partial = match messages.last() {
+            Some(last) if last.role.eq("assistant") => last.content.trim(),
+            _ => {
+                return Err(Error::TemplateError(
+                    "Continuing the final message requires a trailing assistant message"
+                        .to_string(),
+                ))
+            }
+        };
+
+        let mut context = serde_json::to_value(self)?;
+        if let Some(obj) = context.as_object_mut() {
+            // An empty partial message has nothing to continue, so a regular turn is started
+            if partial.is_empty() {
+                if let Some(serde_json::Value::Array(messages)) = obj.get_mut("messages") {
+                    messages.pop();
+                }
+            }
+
+            obj.insert(
+                "add_generation_prompt".to_string(),
+                serde_json::Value::Bool(partial.is_empty()),
+            );
+        }
+
+        let rendered = tp.render(template, &context.to_string())?;
+
+        if partial.is_empty() {
+            return Ok(rendered);
+        }
+
+        let end = rendered
+            .rfind(partial)
+            .map(|start| start + partial.len())
+            .ok_or(Error::TemplateError(
+                "Final assistant message not found in the rendered template".to_string(),
+            ))?;
+
+        Ok(rendered[..end].to_string())
+    }
+
     pub fn try_render_as_event_name(&self) -> Result<String, Error> {
         match self {
             Query::Chunk { .. } => Ok("query-stream-chunk".to_string()),
+            Query::ContextShift { .. } => Ok("query-stream-context-shift".to_string()),
+            Query::PrefillProgress { .. } => Ok("query-stream-prefill-progress".to_string()),
             Query::End { .. } => Ok("query-stream-end".to_string()),
             Query::Status { .. } => Ok("query-stream-error".to_string()),
 
-            Query::Prompt { .. } | Query::Response { .. } | Query::Exit => {
-                Err(Error::UndefinedClientEvent(format!("{self:?}")))
-            }
+            Query::Prompt { .. }
+            | Query::Completion { .. }
+            | Query::Infill { .. }
+            | Query::Score { .. }
+            | Query::Scored { .. }
+            | Query::Classify { .. }
+            | Query::Classified { .. }
+            | Query::Rerank { .. }
+            | Query::Reranked { .. }
+            | Query::Embed { .. }
+            | Query::Embedded { .. }
+            | Query::Response { .. }
+            | Query::Exit => Err(Error::UndefinedClientEvent(format!("{self:?}"))),
+        }
+    }
+
+    /// Returns the requested model of a query processed by a model, if any.
+    pub fn model(&self) -> Option<&str> {
+        match self {
+            Query::Prompt { model, .. }
+            | Query::Completion { model, .. }
+            | Query::Infill { model, .. }
+            | Query::Score { model, .. }
+            | Query::Classify { model, .. }
+            | Query::Rerank { model, .. }
+            | Query::Embed { model, .. } => model.as_deref(),
+            _ => None,
+        }
+    }
+
+    /// Returns the timestamp of a query processed by a model, if any.
+    pub fn timestamp(&self) -> Option<u64> {
+        match self {
+            Query::Prompt { timestamp, .. }
+            | Query::Completion { timestamp, .. }
+            | Query::Infill { timestamp, .. }
+            | Query::Score { timestamp, .. }
+            | Query::Classify { timestamp, .. }
+            | Query::Rerank { timestamp, .. }
+            | Query::Embed { timestamp, .. } => *timestamp,
+            _ => None,
+        }
+    }
+
+    /// Returns the requested chunk size of a generating query, if any.
+    pub fn chunk_size(&self) -> Option<usize> {
+        match self {
+            Query::Prompt { chunk_size, .. }
+            | Query::Completion { chunk_size, .. }
+            | Query::Infill { chunk_size, .. } => *chunk_size,
+            _ => None,
         }
     }
 }
@@ -173,6 +609,103 @@ pub struct LLMRuntimeConfig {
     /// If the models ships with a separate template file, this can be configured here.
     /// Given a `tokenizer_config_file`, the template file setting will be ignored.
     pub template_file: Option<PathBuf>,
+
+    /// Rules to normalize messages before the chat template is applied.
+    ///
+    /// Use this setting for models with restrictive chat templates, e.g. templates rejecting
+    /// a `system` role or requiring strictly alternating `user` / `assistant` turns.
+    pub message_normalization: Option<MessageNormalization>,
+
+    /// Fill-in-the-middle tokens of code models.
+    ///
+    /// If not set, the tokens are detected from the added tokens declared in `tokenizer_config.json`.
+    pub fim_tokens: Option<FimTokens>,
+
+    /// Prompt prefixes whose KV cache is computed once and restored for matching prompts.
+    pub prompt_cache: Option<PromptCacheConfig>,
+
+    /// Replays cached responses of deterministic queries instead of generating them again.
+    pub response_cache: Option<ResponseCacheConfig>,
+
+    /// Replays cached responses of prompts similar to earlier prompts, e.g. paraphrased questions.
+    pub semantic_cache: Option<SemanticCacheConfig>,
+
+    /// Discards older tokens once the context window is full, instead of ending generation.
+    pub context_shift: Option<ContextShift>,
+
+    /// Prefills prompts in blocks, reporting progress and checking for cancellation in between.
+    pub chunked_prefill: Option<ChunkedPrefill>,
+
+    /// Detects repetition loops and ends generation early or raises the repeat penalty.
+    pub repetition_guard: Option<RepetitionGuard>,
+
+    /// Controls special tokens when encoding prompts and decoding output.
+    pub special_tokens: Option<SpecialTokenPolicy>,
+
+    /// Heals the prompt boundary of prompts ending mid-token.
+    pub token_healing: Option<TokenHealing>,
+
+    /// Kind of the model. Defaults to [`ModelKind::Generation`].
+    pub kind: Option<ModelKind>,
+
+    /// Data type the model weights and KV cache are loaded with. Defaults to [`ModelDType::BF16`].
+    pub dtype: Option<ModelDType>,
+
+    /// Default system prompt, injected into prompts according to [`Self::system_prompt_policy`].
+    ///
+    /// The prompt is a Jinja template, see [`DefaultSystemPrompt`](crate::DefaultSystemPrompt) for the available variables.
+    pub system_prompt: Option<String>,
+
+    /// Identity the model answers as, added to the default system prompt.
+    pub persona: Option<Persona>,
+
+    /// Combination of the default system prompt with `system` messages of a prompt. Defaults to
+    /// [`SystemPromptPolicy::IfMissing`].
+    pub system_prompt_policy: Option<SystemPromptPolicy>,
+
+    /// Named overrides of this config, of which the selected one is applied by the
+    /// [`ConfigLoader`](crate::config::ConfigLoader). Empty once the config is resolved.
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub profiles: HashMap<String, serde_json::Value>,
+}
+
+/// Kind of a model, selecting the runtime it is loaded with.
+#[derive(Deserialize, Serialize, Debug, Clone, Default, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum ModelKind {
+    /// Text generation model
+    #[default]
+    Generation,
+
+    /// Cross-encoder with a sequence classification head (BERT, XLM-RoBERTa), used to rerank
+    /// documents by their relevance to a query
+    Reranker,
+
+    /// BERT bi-encoder producing sentence embeddings, e.g.
+    /// `sentence-transformers/all-MiniLM-L6-v2`
+    Embedding,
+}
+
+/// Data type of model weights and KV cache.
+#[derive(Deserialize, Serialize, Debug, Clone, Copy, Default, PartialEq, Eq, Hash)]
+#[serde(rename_all = "lowercase")]
+pub enum ModelDType {
+    F32,
+
+    F16,
+
+    #[default]
+    BF16,
+}
+
+impl std::fmt::Display for ModelDType {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::F32 => write!(f, "f32"),
+            Self::F16 => write!(f, "f16"),
+            Self::BF16 => write!(f, "bf16"),
+        }
+    }
 }
 
 #[derive(Deserialize, Serialize, Debug, Default, Clone)]
@@ -198,12 +731,18 @@ pub enum SamplingConfig {
 }
 
 /// Use this to deserialize the `tokenizer_config.json`
+///
+/// Special tokens are stored either as string or as `AddedToken` object, whose `content` is used.
 #[derive(Deserialize, Serialize, Debug, Clone, Default)]
 pub struct TokenizerConfig {
+    #[serde(default, deserialize_with = "deserialize_special_token")]
     pub bos_token: Option<String>,
     pub chat_template: Option<String>,
     pub clean_up_tokenization_spaces: bool,
+    #[serde(default, deserialize_with = "deserialize_special_token")]
     pub eos_token: Option<String>,
+    #[serde(default, deserialize_with = "deserialize_special_token")]
+    pub pad_token: Option<String>,
 
     // TODO: this field is not being used, maybe we just skip the
     // deserialization?
@@ -213,6 +752,26 @@ pub struct TokenizerConfig {
     pub added_tokens_decoder: Option<HashMap<String, AddedToken>>,
 }
 
+/// Deserializes a special token of the `tokenizer_config.json` given as string or as
+/// `AddedToken` object.
+fn deserialize_special_token<'de, D>(deserializer: D) -> Result<Option<String>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    #[derive(Deserialize)]
+    #[serde(untagged)]
+    enum Token {
+        Content(String),
+        Added { content: String },
+    }
+
+    Ok(
+        Option::<Token>::deserialize(deserializer)?.map(|token| match token {
+            Token::Content(content) | Token::Added { content } => content,
+        }),
+    )
+}
+
 impl LLMRuntimeConfig {
     /// Returns true if a `model_index_file` is present, indicating Safetensors format
     pub fn is_safetensors_with_index_file(&self) -> bool {
@@ -241,6 +800,18 @@ impl LLMRuntimeConfig {
             .unwrap_or(false)
     }
 
+    /// Returns the paths of the weight files, the shards of a `model_index_file` or the
+    /// `model_file`.
+    pub fn weight_files(&self) -> Vec<PathBuf> {
+        match (&self.model_index_file, &self.model_dir, &self.model_file) {
+            (Some(index), Some(dir), _) => crate::loaders::IndexFile::from_path(index)
+                .map(|mut index| index.files(dir))
+                .unwrap_or_default(),
+            (_, _, Some(file)) => vec![file.clone()],
+            _ => vec![],
+        }
+    }
+
     /// Loads a config from path
     pub fn from_path<P>(path: P) -> Result<Self, Error>
     where
@@ -341,6 +912,7 @@ impl LLMRuntimeConfig {
             model_file,
             model_dir,
             template_file: None,
+            ..Default::default()
         })
     }
 
@@ -0,0 +1,187 @@
+//! Message normalization
+//!
+//! Chat templates differ in which message sequences they accept. Gemma templates reject a
+//! `system` role, and several templates raise an exception if `user` and `assistant` turns
+//! do not alternate. [`MessageNormalization`] rewrites a list of [`QueryMessage`]s before it
+//! is handed to the [`TemplateProcessor`](crate::TemplateProcessor), so that valid requests
+//! are not rejected by restrictive templates.
+
+use crate::{Query, QueryMessage};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// Roles that are understood by common chat templates and therefore never treated as unknown.
+const KNOWN_ROLES: [&str; 4] = ["system", "user", "assistant", "tool"];
+
+/// Default separator used when message contents are joined.
+const DEFAULT_SEPARATOR: &str = "\n\n";
+
+/// Per-model message normalization rules.
+///
+/// The rules are applied in the following order:
+///
+/// 1. roles are mapped by [`Self::role_map`], remaining unknown roles are replaced by [`Self::unknown_role`]
+/// 2. `system` messages are handled according to [`Self::system`]
+/// 3. consecutive messages of the same role are merged, if [`Self::merge_consecutive`] is set
+///
+/// # Example
+///
+/// Rules for Gemma models, which neither support a `system` role nor non-alternating turns:
+///
+/// ```
+/// use tauri_plugin_llm::{MessageNormalization, QueryMessage, SystemMessagePolicy};
+///
+/// let rules = MessageNormalization {
+///     system: SystemMessagePolicy::MergeIntoFirstUser,
+///     merge_consecutive: true,
+///     unknown_role: Some("user".to_string()),
+///     ..Default::default()
+/// };
+///
+/// let messages = rules.apply(vec![
+///     QueryMessage { role: "system".to_string(), content: "Be brief.".to_string() },
+///     QueryMessage { role: "user".to_string(), content: "Hello".to_string() },
+///     QueryMessage { role: "user".to_string(), content: "World".to_string() },
+/// ]);
+///
+/// assert_eq!(messages.len(), 1);
+/// assert_eq!(messages[0].role, "user");
+/// assert_eq!(messages[0].content, "Be brief.\n\nHello\n\nWorld");
+/// ```
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct MessageNormalization {
+    /// How `system` messages are handled. Defaults to [`SystemMessagePolicy::Keep`].
+    #[serde(default)]
+    pub system: SystemMessagePolicy,
+
+    /// Merges consecutive messages sharing the same role into a single message.
+    #[serde(default)]
+    pub merge_consecutive: bool,
+
+    /// Separator inserted between merged message contents. Defaults to an empty line.
+    pub separator: Option<String>,
+
+    /// Explicit role mappings, e.g. `{ "model": "assistant", "human": "user" }`.
+    #[serde(default)]
+    pub role_map: HashMap<String, String>,
+
+    /// Replacement for roles that are neither known nor mapped by [`Self::role_map`].
+    ///
+    /// Unknown roles are kept as they are if this is not set.
+    pub unknown_role: Option<String>,
+}
+
+/// Handling of `system` messages.
+#[derive(Deserialize, Serialize, Debug, Clone, Default, PartialEq, Eq)]
+pub enum SystemMessagePolicy {
+    /// Keep `system` messages untouched.
+    #[default]
+    Keep,
+
+    /// Fold all `system` messages into the first `user` message.
+    ///
+    /// If there is no `user` message, a new one is inserted at the beginning.
+    MergeIntoFirstUser,
+
+    /// Remove all `system` messages.
+    Drop,
+}
+
+impl MessageNormalization {
+    /// Applies all rules to `messages` and returns the normalized list.
+    pub fn apply(&self, messages: Vec<QueryMessage>) -> Vec<QueryMessage> {
+        let messages: Vec<QueryMessage> = messages
+            .into_iter()
+            .map(|message| QueryMessage {
+                role: self.map_role(message.role),
+                content: message.content,
+            })
+            .collect();
+
+        let messages = match self.system {
+            SystemMessagePolicy::Keep => messages,
+            SystemMessagePolicy::MergeIntoFirstUser => self.merge_system_into_first_user(messages),
+            SystemMessagePolicy::Drop => messages
+                .into_iter()
+                .filter(|m| !m.role.eq("system"))
+                .collect(),
+        };
+
+        if self.merge_consecutive {
+            self.merge_consecutive_roles(messages)
+        } else {
+            messages
+        }
+    }
+
+    /// Applies all rules to the messages of a [`Query::Prompt`]. Other variants are returned as is.
+    pub fn normalize_query(&self, mut query: Query) -> Query {
+        if let Query::Prompt { messages, .. } = &mut query {
+            *messages = self.apply(std::mem::take(messages));
+        }
+
+        query
+    }
+
+    fn separator(&self) -> &str {
+        self.separator.as_deref().unwrap_or(DEFAULT_SEPARATOR)
+    }
+
+    fn map_role(&self, role: String) -> String {
+        if let Some(mapped) = self.role_map.get(&role) {
+            return mapped.clone();
+        }
+
+        match &self.unknown_role {
+            Some(replacement) if !KNOWN_ROLES.contains(&role.as_str()) => replacement.clone(),
+            _ => role,
+        }
+    }
+
+    fn merge_system_into_first_user(&self, messages: Vec<QueryMessage>) -> Vec<QueryMessage> {
+        let (system, mut rest): (Vec<_>, Vec<_>) =
+            messages.into_iter().partition(|m| m.role.eq("system"));
+
+        if system.is_empty() {
+            return rest;
+        }
+
+        let system_content = system
+            .into_iter()
+            .map(|m| m.content)
+            .collect::<Vec<_>>()
+            .join(self.separator());
+
+        match rest.iter_mut().find(|m| m.role.eq("user")) {
+            Some(first_user) => {
+                first_user.content =
+                    format!("{system_content}{}{}", self.separator(), first_user.content);
+            }
+            None => rest.insert(
+                0,
+                QueryMessage {
+                    role: "user".to_string(),
+                    content: system_content,
+                },
+            ),
+        }
+
+        rest
+    }
+
+    fn merge_consecutive_roles(&self, messages: Vec<QueryMessage>) -> Vec<QueryMessage> {
+        let mut merged: Vec<QueryMessage> = Vec::with_capacity(messages.len());
+
+        for message in messages {
+            match merged.last_mut() {
+                Some(last) if last.role.eq(&message.role) => {
+                    last.content.push_str(self.separator());
+                    last.content.push_str(&message.content);
+                }
+                _ => merged.push(message),
+            }
+        }
+
+        merged
+    }
+}
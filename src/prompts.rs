@@ -0,0 +1,320 @@
+//! Prompt library
+//!
+//! Named task prompts, e.g. "summarize" or "extract action items", with typed variables. The
+//! system and user messages of a [`PromptTemplate`] are Jinja templates rendered with the
+//! [`TemplateProcessor`]. Templates are provided by the plugin config and saved in the app data
+//! directory by the application.
+
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+
+use crate::util;
+use crate::{Error, GenerationSeed, Query, QueryMessage, SamplingConfig, TemplateProcessor};
+
+/// Type of a [`PromptVariable`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum VariableType {
+    #[default]
+    String,
+    Number,
+    Integer,
+    Boolean,
+    Array,
+    Object,
+}
+
+impl VariableType {
+    /// Returns `true`, if `value` is of this type.
+    fn accepts(&self, value: &Value) -> bool {
+        match self {
+            Self::String => value.is_string(),
+            Self::Number => value.is_number(),
+            Self::Integer => value.is_i64() || value.is_u64(),
+            Self::Boolean => value.is_boolean(),
+            Self::Array => value.is_array(),
+            Self::Object => value.is_object(),
+        }
+    }
+}
+
+/// A variable of a [`PromptTemplate`].
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PromptVariable {
+    pub name: String,
+
+    #[serde(rename = "type", default)]
+    pub kind: VariableType,
+
+    pub description: Option<String>,
+
+    /// Value used if the variable is not provided. Variables without a default are required.
+    pub default: Option<Value>,
+}
+
+/// A named prompt rendered into a [`Query::Prompt`].
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct PromptTemplate {
+    pub name: String,
+
+    pub description: Option<String>,
+
+    /// Jinja template of the system message
+    pub system: Option<String>,
+
+    /// Jinja template of the user message
+    pub template: String,
+
+    #[serde(default)]
+    pub variables: Vec<PromptVariable>,
+
+    /// Generation settings of the prompt, which can be overridden per run
+    #[serde(default)]
+    pub settings: PromptOverrides,
+}
+
+/// Generation settings applied to a rendered [`PromptTemplate`].
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct PromptOverrides {
+    pub model: Option<String>,
+
+    pub max_tokens: Option<usize>,
+
+    pub temperature: Option<f32>,
+
+    pub top_k: Option<f32>,
+
+    pub top_p: Option<f32>,
+
+    pub penalty: Option<f32>,
+
+    pub seed: Option<GenerationSeed>,
+
+    pub sampling_config: Option<SamplingConfig>,
+
+    pub chunk_size: Option<usize>,
+}
+
+impl PromptOverrides {
+    /// Returns the settings of `self`, falling back to those of `defaults`.
+    fn or(self, defaults: &PromptOverrides) -> Self {
+        Self {
+            model: self.model.or(defaults.model.clone()),
+            max_tokens: self.max_tokens.or(defaults.max_tokens),
+            temperature: self.temperature.or(defaults.temperature),
+            top_k: self.top_k.or(defaults.top_k),
+            top_p: self.top_p.or(defaults.top_p),
+            penalty: self.penalty.or(defaults.penalty),
+            seed: self.seed.or(defaults.seed.clone()),
+            sampling_config: self.sampling_config.or(defaults.sampling_config.clone()),
+            chunk_size: self.chunk_size.or(defaults.chunk_size),
+        }
+    }
+}
+
+impl PromptTemplate {
+    /// Validates `vars` against the declared variables and fills in defaults.
+    fn context(&self, vars: &Map<String, Value>) -> Result<Map<String, Value>, Error> {
+        if let Some(unknown) = vars
+            .keys()
+            .find(|name| !self.variables.iter().any(|v| &v.name == *name))
+        {
+            return Err(Error::TemplateError(format!(
+                "Prompt '{}' does not declare the variable '{unknown}'",
+                self.name
+            )));
+        }
+
+        self.variables
+            .iter()
+            .map(|variable| {
+                let value = vars
+                    .get(&variable.name)
+                    .or(variable.default.as_ref())
+                    .ok_or(Error::TemplateError(format!(
+                        "Prompt '{}' requires the variable '{}'",
+                        self.name, variable.name
+                    )))?;
+
+                if !variable.kind.accepts(value) {
+                    return Err(Error::TemplateError(format!(
+                        "Variable '{}' of prompt '{}' must be of type {:?}",
+                        variable.name, self.name, variable.kind
+                    )));
+                }
+
+                Ok((variable.name.clone(), value.clone()))
+            })
+            .collect()
+    }
+
+    /// Renders the system and user messages with `vars`.
+    pub fn render(&self, vars: &Map<String, Value>) -> Result<Vec<QueryMessage>, Error> {
+        let context = Value::Object(self.context(vars)?).to_string();
+        let processor = TemplateProcessor::with_jinja_template();
+
+        let mut messages = vec![];
+
+        if let Some(system) = &self.system {
+            messages.push(QueryMessage {
+                role: "system".to_string(),
+                content: processor.render(system, &context)?,
+            });
+        }
+
+        messages.push(QueryMessage {
+            role: "user".to_string(),
+            content: processor.render(&self.template, &context)?,
+        });
+
+        Ok(messages)
+    }
+
+    /// Renders the template into a streaming [`Query::Prompt`]. `overrides` take precedence over
+    /// the settings of the template.
+    pub fn query(
+        &self,
+        vars: &Map<String, Value>,
+        overrides: PromptOverrides,
+    ) -> Result<Query, Error> {
+        let PromptOverrides {
+            model,
+            max_tokens,
+            temperature,
+            top_k,
+            top_p,
+            penalty,
+            seed,
+            sampling_config,
+            chunk_size,
+        } = overrides.or(&self.settings);
+
+        Ok(Query::Prompt {
+            messages: self.render(vars)?,
+            tools: vec![],
+            chunk_size,
+            timestamp: None,
+            max_tokens,
+            temperature,
+            top_k,
+            top_p,
+            think: false,
+            continue_final_message: false,
+            stream: true,
+            model,
+            penalty,
+            seed,
+            sampling_config,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
+        })
+    }
+}
+
+/// Prompt templates of the plugin config and those saved by the application.
+///
+/// Saved templates are persisted as a JSON file and take precedence over configured templates of
+/// the same name. Configured templates cannot be removed.
+#[derive(Debug, Default)]
+pub struct PromptLibrary {
+    path: Option<PathBuf>,
+    configured: BTreeMap<String, PromptTemplate>,
+    saved: BTreeMap<String, PromptTemplate>,
+}
+
+impl PromptLibrary {
+    /// Creates a library of the `configured` templates, which is kept in memory only.
+    pub fn new(configured: Vec<PromptTemplate>) -> Self {
+        Self {
+            path: None,
+            configured: configured
+                .into_iter()
+                .map(|t| (t.name.clone(), t))
+                .collect(),
+            saved: BTreeMap::new(),
+        }
+    }
+
+    /// Loads the templates saved at `path` in addition to the `configured` templates. A missing
+    /// file is created when the first template is saved.
+    pub fn open<P>(path: P, configured: Vec<PromptTemplate>) -> Result<Self, Error>
+    where
+        P: AsRef<Path>,
+    {
+        let path = path.as_ref().to_path_buf();
+
+        let saved: Vec<PromptTemplate> = util::read_json(&path)?;
+
+        Ok(Self {
+            path: Some(path),
+            saved: saved.into_iter().map(|t| (t.name.clone(), t)).collect(),
+            ..Self::new(configured)
+        })
+    }
+
+    /// Returns the template `name`.
+    pub fn get(&self, name: &str) -> Result<&PromptTemplate, Error> {
+        self.saved
+            .get(name)
+            .or(self.configured.get(name))
+            .ok_or(Error::TemplateError(format!("Unknown prompt '{name}'")))
+    }
+
+    /// Returns all templates ordered by name.
+    pub fn list(&self) -> Vec<PromptTemplate> {
+        let mut templates = self.configured.clone();
+        templates.extend(self.saved.clone());
+
+        templates.into_values().collect()
+    }
+
+    /// Saves `template`, replacing a saved template of the same name.
+    pub fn save(&mut self, template: PromptTemplate) -> Result<(), Error> {
+        // Rejects templates, which cannot be parsed
+        let env = minijinja::Environment::new();
+        for source in template.system.iter().chain([&template.template]) {
+            env.template_from_str(source)
+                .map_err(|e| Error::TemplateError(e.to_string()))?;
+        }
+
+        self.saved.insert(template.name.clone(), template);
+        self.persist()
+    }
+
+    /// Removes the saved template `name`.
+    pub fn remove(&mut self, name: &str) -> Result<(), Error> {
+        if self.saved.remove(name).is_none() {
+            return Err(Error::TemplateError(
+                match self.configured.contains_key(name) {
+                    true => format!("Prompt '{name}' is configured and cannot be removed"),
+                    false => format!("Unknown prompt '{name}'"),
+                },
+            ));
+        }
+
+        self.persist()
+    }
+
+    /// Renders the template `name` into a [`Query::Prompt`], see [`PromptTemplate::query`].
+    pub fn query(
+        &self,
+        name: &str,
+        vars: &Map<String, Value>,
+        overrides: PromptOverrides,
+    ) -> Result<Query, Error> {
+        self.get(name)?.query(vars, overrides)
+    }
+
+    fn persist(&self) -> Result<(), Error> {
+        let Some(path) = self.path.as_ref() else {
+            return Ok(());
+        };
+
+        let saved: Vec<&PromptTemplate> = self.saved.values().collect();
+        util::write_json(path, &saved)
+    }
+}
@@ -0,0 +1,203 @@
+//! Default system prompts
+//!
+//! A model can be configured with a `system_prompt` and a [`Persona`], so that callers do not
+//! have to prepend the right `system` message for each model. Both are Jinja templates rendered
+//! with the [`TemplateProcessor`] when a [`Query::Prompt`] is sent, which resolves variables like
+//! the current date at request time. [`SystemPromptPolicy`] decides how the default system
+//! prompt is combined with `system` messages of the query.
+
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+
+use crate::util;
+use crate::{Error, LLMRuntimeConfig, Query, QueryMessage, TemplateProcessor};
+
+/// Separator between the parts of a system prompt.
+const SEPARATOR: &str = "\n\n";
+
+/// Identity a model answers as.
+#[derive(Deserialize, Serialize, Debug, Clone, Default)]
+pub struct Persona {
+    /// Name of the assistant, e.g. `"Ada"`
+    pub name: String,
+
+    /// Personality of the assistant, e.g. tone and style of its responses. Rendered as template.
+    pub description: Option<String>,
+}
+
+/// Combination of the default system prompt with `system` messages of a query.
+#[derive(Deserialize, Serialize, Debug, Clone, Copy, Default, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum SystemPromptPolicy {
+    /// Inserts the default system prompt only if the query has no `system` message.
+    #[default]
+    IfMissing,
+
+    /// Puts the default system prompt in front of the first `system` message.
+    Prepend,
+
+    /// Appends the default system prompt to the first `system` message.
+    Append,
+
+    /// Replaces all `system` messages with the default system prompt.
+    Replace,
+}
+
+/// The default system prompt of a model, see [`LLMRuntimeConfig::system_prompt`] and
+/// [`LLMRuntimeConfig::persona`].
+///
+/// The templates can use the following variables, along with those set by the application with
+/// [`LLMService::set_prompt_variable`](crate::LLMService::set_prompt_variable), e.g. `app_name`:
+///
+/// | Variable  | Value                                  |
+/// | --------- | -------------------------------------- |
+/// | `date`    | Current day in `YYYY-MM-DD` format (UTC) |
+/// | `time`    | Current time in `HH:MM` format (UTC)     |
+/// | `model`   | Name of the model                      |
+/// | `persona` | Name of the persona                    |
+///
+/// # Example
+///
+/// ```
+/// use serde_json::Map;
+/// use tauri_plugin_llm::{DefaultSystemPrompt, LLMRuntimeConfig, Persona, QueryMessage};
+///
+/// let config = LLMRuntimeConfig {
+///     name: "Qwen".to_string(),
+///     system_prompt: Some("Answer concisely.".to_string()),
+///     persona: Some(Persona {
+///         name: "Ada".to_string(),
+///         description: None,
+///     }),
+///     ..Default::default()
+/// };
+///
+/// let messages = DefaultSystemPrompt::from_config(&config)
+///     .unwrap()
+///     .apply(
+///         vec![QueryMessage { role: "user".to_string(), content: "Hello".to_string() }],
+///         &Map::new(),
+///     )
+///     .unwrap();
+///
+/// assert_eq!(messages[0].role, "system");
+/// assert_eq!(messages[0].content, "Answer concisely.\n\nYou are Ada.");
+/// ```
+#[derive(Debug, Clone)]
+pub struct DefaultSystemPrompt {
+    model: String,
+    template: Option<String>,
+    persona: Option<Persona>,
+    policy: SystemPromptPolicy,
+}
+
+impl DefaultSystemPrompt {
+    /// Returns the default system prompt of `config`, or `None` if neither a system prompt nor a
+    /// persona is configured.
+    pub fn from_config(config: &LLMRuntimeConfig) -> Option<Self> {
+        if config.system_prompt.is_none() && config.persona.is_none() {
+            return None;
+        }
+
+        Some(Self {
+            model: config.name.clone(),
+            template: config.system_prompt.clone(),
+            persona: config.persona.clone(),
+            policy: config.system_prompt_policy.unwrap_or_default(),
+        })
+    }
+
+    /// Renders the system prompt. `variables` take precedence over the built-in variables.
+    pub fn render(&self, variables: &Map<String, Value>) -> Result<String, Error> {
+        let processor = TemplateProcessor::with_jinja_template();
+        let context = Value::Object(self.context(variables)).to_string();
+
+        let mut parts = vec![];
+
+        if let Some(template) = &self.template {
+            parts.push(processor.render(template, &context)?);
+        }
+
+        if let Some(persona) = &self.persona {
+            parts.push(format!("You are {}.", persona.name));
+
+            if let Some(description) = &persona.description {
+                parts.push(processor.render(description, &context)?);
+            }
+        }
+
+        Ok(parts
+            .into_iter()
+            .map(|part| part.trim().to_string())
+            .filter(|part| !part.is_empty())
+            .collect::<Vec<_>>()
+            .join(SEPARATOR))
+    }
+
+    /// Combines the rendered system prompt with the `system` messages of `messages` according to
+    /// the [`SystemPromptPolicy`].
+    pub fn apply(
+        &self,
+        mut messages: Vec<QueryMessage>,
+        variables: &Map<String, Value>,
+    ) -> Result<Vec<QueryMessage>, Error> {
+        let first_system = messages.iter().position(|m| m.role.eq("system"));
+
+        if self.policy == SystemPromptPolicy::IfMissing && first_system.is_some() {
+            return Ok(messages);
+        }
+
+        let prompt = self.render(variables)?;
+
+        match (self.policy, first_system) {
+            (SystemPromptPolicy::Prepend, Some(index)) => {
+                let content = &mut messages[index].content;
+                *content = format!("{prompt}{SEPARATOR}{content}");
+            }
+            (SystemPromptPolicy::Append, Some(index)) => {
+                let content = &mut messages[index].content;
+                *content = format!("{content}{SEPARATOR}{prompt}");
+            }
+            _ => {
+                messages.retain(|m| !m.role.eq("system"));
+                messages.insert(
+                    0,
+                    QueryMessage {
+                        role: "system".to_string(),
+                        content: prompt,
+                    },
+                );
+            }
+        }
+
+        Ok(messages)
+    }
+
+    /// Applies the system prompt to the messages of a [`Query::Prompt`]. Other variants are
+    /// returned as is.
+    pub fn apply_query(
+        &self,
+        mut query: Query,
+        variables: &Map<String, Value>,
+    ) -> Result<Query, Error> {
+        if let Query::Prompt { messages, .. } = &mut query {
+            *messages = self.apply(std::mem::take(messages), variables)?;
+        }
+
+        Ok(query)
+    }
+
+    fn context(&self, variables: &Map<String, Value>) -> Map<String, Value> {
+        let mut context = Map::new();
+        context.insert("date".to_string(), util::today().into());
+        context.insert("time".to_string(), util::time_of_day().into());
+        context.insert("model".to_string(), self.model.clone().into());
+
+        if let Some(persona) = &self.persona {
+            context.insert("persona".to_string(), persona.name.clone().into());
+        }
+
+        context.extend(variables.clone());
+        context
+    }
+}
@@ -0,0 +1,173 @@
+//! Usage accounting
+//!
+//! Aggregates the [`TokenUsage`] of generations per model, window label and day (UTC), so that
+//! the usage of local models can be analyzed across restarts. The plugin persists the
+//! [`UsageStore`] as `usage.json` in the app data directory.
+
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use serde::{Deserialize, Serialize};
+
+use crate::util::{self, today};
+use crate::{Error, TokenUsage};
+
+/// Window label of generations not sent by a window, e.g. by
+/// [`LLMService::complete`](crate::LLMService::complete) or an evaluation.
+pub const BACKEND_WINDOW: &str = "backend";
+
+/// Accumulated usage.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct UsageTotals {
+    /// Number of generations
+    pub requests: u64,
+
+    pub prompt_tokens: u64,
+
+    pub completion_tokens: u64,
+
+    /// Time from sending the query to the end of the generation
+    pub generation_ms: u64,
+}
+
+impl UsageTotals {
+    fn add(&mut self, other: &UsageTotals) {
+        self.requests += other.requests;
+        self.prompt_tokens += other.prompt_tokens;
+        self.completion_tokens += other.completion_tokens;
+        self.generation_ms += other.generation_ms;
+    }
+}
+
+/// Usage of a model by a window on a single day.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct UsageEntry {
+    pub model: String,
+
+    /// Label of the window sending the queries
+    pub window: String,
+
+    /// Day in `YYYY-MM-DD` format (UTC)
+    pub day: String,
+
+    #[serde(flatten)]
+    pub totals: UsageTotals,
+}
+
+/// Usage aggregated by model, window and day.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct UsageReport {
+    pub total: UsageTotals,
+
+    pub models: BTreeMap<String, UsageTotals>,
+
+    pub windows: BTreeMap<String, UsageTotals>,
+
+    pub days: BTreeMap<String, UsageTotals>,
+
+    pub entries: Vec<UsageEntry>,
+}
+
+/// Persistent store of [`UsageEntry`]s.
+///
+/// Every recorded generation is written to disk immediately, a store without a path is kept in
+/// memory only.
+#[derive(Debug, Default)]
+pub struct UsageStore {
+    path: Option<PathBuf>,
+    entries: Vec<UsageEntry>,
+}
+
+impl UsageStore {
+    /// Opens the store persisted at `path`. A missing file is created with the first record.
+    pub fn open<P>(path: P) -> Result<Self, Error>
+    where
+        P: AsRef<Path>,
+    {
+        let path = path.as_ref().to_path_buf();
+
+        let entries = util::read_json(&path)?;
+
+        Ok(Self {
+            path: Some(path),
+            entries,
+        })
+    }
+
+    /// Adds the `usage` of a generation of `model`, sent by `window` and taking `duration`.
+    pub fn record(
+        &mut self,
+        model: &str,
+        window: &str,
+        usage: &TokenUsage,
+        duration: Duration,
+    ) -> Result<(), Error> {
+        let day = today();
+        let totals = UsageTotals {
+            requests: 1,
+            prompt_tokens: usage.prompt_tokens as u64,
+            completion_tokens: usage.completion_tokens as u64,
+            generation_ms: duration.as_millis() as u64,
+        };
+
+        match self
+            .entries
+            .iter_mut()
+            .find(|e| e.model == model && e.window == window && e.day == day)
+        {
+            Some(entry) => entry.totals.add(&totals),
+            None => self.entries.push(UsageEntry {
+                model: model.to_string(),
+                window: window.to_string(),
+                day,
+                totals,
+            }),
+        }
+
+        self.persist()
+    }
+
+    /// Returns the usage aggregated by model, window and day.
+    pub fn report(&self) -> UsageReport {
+        let mut report = UsageReport {
+            entries: self.entries.clone(),
+            ..Default::default()
+        };
+
+        for entry in &self.entries {
+            report.total.add(&entry.totals);
+            report
+                .models
+                .entry(entry.model.clone())
+                .or_default()
+                .add(&entry.totals);
+            report
+                .windows
+                .entry(entry.window.clone())
+                .or_default()
+                .add(&entry.totals);
+            report
+                .days
+                .entry(entry.day.clone())
+                .or_default()
+                .add(&entry.totals);
+        }
+
+        report
+    }
+
+    /// Removes all recorded usage.
+    pub fn reset(&mut self) -> Result<(), Error> {
+        self.entries.clear();
+        self.persist()
+    }
+
+    /// Writes the entries to the file of the store, if any.
+    fn persist(&self) -> Result<(), Error> {
+        match self.path.as_ref() {
+            Some(path) => util::write_json(path, &self.entries),
+            None => Ok(()),
+        }
+    }
+}
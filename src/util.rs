@@ -0,0 +1,73 @@
+//! Helpers shared across modules
+
+use std::path::Path;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+use crate::Error;
+
+/// Returns the seconds since the Unix epoch.
+pub(crate) fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or_default()
+}
+
+/// Returns the current day in `YYYY-MM-DD` format (UTC).
+pub(crate) fn today() -> String {
+    let days = (now() / 86_400) as i64;
+
+    // Converts days since the epoch into a proleptic Gregorian date, see
+    // https://howardhinnant.github.io/date_algorithms.html#civil_from_days
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let doe = z.rem_euclid(146_097);
+    let yoe = (doe - doe / 1_460 + doe / 36_524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + i64::from(month <= 2);
+
+    format!("{year:04}-{month:02}-{day:02}")
+}
+
+/// Returns the current time in `HH:MM` format (UTC).
+pub(crate) fn time_of_day() -> String {
+    let seconds = now();
+    format!("{:02}:{:02}", seconds / 3_600 % 24, seconds / 60 % 60)
+}
+
+/// Reads the JSON file at `path`. A missing file is read as the default value.
+pub(crate) fn read_json<T>(path: &Path) -> Result<T, Error>
+where
+    T: DeserializeOwned + Default,
+{
+    match std::fs::read_to_string(path) {
+        Ok(content) => Ok(serde_json::from_str(&content)?),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(T::default()),
+        Err(e) => Err(e.into()),
+    }
+}
+
+/// Writes `value` as JSON to `path`, creating its directory if needed.
+///
+/// The JSON is written to a temporary file, which then replaces `path`, so that a crash does
+/// not leave a truncated file behind.
+pub(crate) fn write_json<T>(path: &Path, value: &T) -> Result<(), Error>
+where
+    T: Serialize + ?Sized,
+{
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir)?;
+    }
+
+    let tmp = path.with_extension("json.tmp");
+    std::fs::write(&tmp, serde_json::to_string_pretty(value)?)?;
+    std::fs::rename(tmp, path)?;
+
+    Ok(())
+}
@@ -0,0 +1,105 @@
+use tauri_plugin_llm::bench::{Benchmark, BenchmarkConfig, BenchmarkReport, BenchmarkResult};
+use tauri_plugin_llm::{Error, LLMRuntimeConfig, ModelDType};
+use tauri_plugin_llm_macros::hf_test;
+
+fn result(prompt_length: usize, prefill: f64, decode: f64, ttft_ms: f64) -> BenchmarkResult {
+    BenchmarkResult {
+        dtype: ModelDType::BF16,
+        prompt_length,
+        time_to_first_token_ms: ttft_ms,
+        prefill_tokens_per_second: prefill,
+        decode_tokens_per_second: decode,
+        peak_memory_bytes: Some(1024 * 1024 * 1024),
+    }
+}
+
+fn report(results: Vec<BenchmarkResult>) -> BenchmarkReport {
+    BenchmarkReport {
+        model: "Qwen/Qwen3-0.6B".to_string(),
+        device: "Cpu".to_string(),
+        version: "0.1.0".to_string(),
+        os: "linux".to_string(),
+        arch: "x86_64".to_string(),
+        timestamp: 0,
+        config: BenchmarkConfig::default(),
+        results,
+    }
+}
+
+#[test]
+fn test_deserialize_dtype_config() {
+    let json = serde_json::json!({
+        "name": "Qwen/Qwen3-4B-Instruct-2507",
+        "dtype": "f16"
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    assert_eq!(config.dtype, Some(ModelDType::F16));
+    assert_eq!(ModelDType::default(), ModelDType::BF16);
+}
+
+#[test]
+fn test_benchmark_compare() {
+    let baseline = report(vec![
+        result(128, 1000.0, 50.0, 128.0),
+        result(512, 2000.0, 45.0, 256.0),
+    ]);
+
+    // Decode throughput of the first case dropped by 20%, the second case is within tolerance
+    let current = report(vec![
+        result(128, 1000.0, 40.0, 128.0),
+        result(512, 1900.0, 45.0, 260.0),
+        result(2048, 1800.0, 40.0, 1100.0),
+    ]);
+
+    let regressions = current.compare(&baseline, 0.1);
+
+    assert_eq!(regressions.len(), 1);
+    assert_eq!(regressions[0].prompt_length, 128);
+    assert_eq!(regressions[0].metric, "decode_tokens_per_second");
+    assert!((regressions[0].change + 0.2).abs() < 1e-9);
+
+    assert!(baseline.compare(&baseline, 0.0).is_empty());
+}
+
+#[test]
+fn test_benchmark_report_roundtrip() -> Result<(), Error> {
+    let report = report(vec![result(128, 1000.0, 50.0, 128.0)]);
+
+    let path = std::env::temp_dir().join("test_benchmark_report.json");
+    report.write(&path)?;
+
+    let loaded = BenchmarkReport::from_path(&path)?;
+    assert_eq!(loaded.results.len(), 1);
+    assert_eq!(loaded.results[0].dtype, ModelDType::BF16);
+
+    let table = loaded.to_string();
+    assert!(table.contains("| bf16 | 128 | 128.0 | 1000.0 | 50.0 | 1024 |"));
+
+    Ok(())
+}
+
+#[hf_test(model = "Qwen/Qwen3-4B-Instruct-2507", cleanup = false)]
+fn test_benchmark_qwen3(config: LLMRuntimeConfig) {
+    let settings = BenchmarkConfig {
+        prompt_lengths: vec![32, 128],
+        dtypes: vec![ModelDType::BF16],
+        decode_tokens: 8,
+        repetitions: 1,
+    };
+
+    let report = Benchmark::new(config, settings).run()?;
+
+    assert_eq!(report.results.len(), 2);
+    assert!(report
+        .results
+        .iter()
+        .all(|r| r.prefill_tokens_per_second > 0.0));
+    assert!(report
+        .results
+        .iter()
+        .all(|r| r.decode_tokens_per_second > 0.0));
+
+    Ok(())
+}
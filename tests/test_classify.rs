@@ -0,0 +1,56 @@
+use tauri_plugin_llm::{Classification, Error, LLMRuntimeConfig, LLMService, QueryMessage};
+
+fn labels(labels: &[&str]) -> Vec<String> {
+    labels.iter().map(|l| l.to_string()).collect()
+}
+
+#[test]
+fn test_classification_is_normalized() -> Result<(), Error> {
+    let classification =
+        Classification::new(&labels(&["yes", "no", "maybe"]), &[-0.5, -2.0, -700.0])?;
+
+    let total: f32 = classification.labels.iter().map(|l| l.probability).sum();
+
+    assert!((total - 1.0).abs() < 1e-5);
+    assert_eq!(classification.label, "yes");
+    assert_eq!(classification.labels[1].log_likelihood, -2.0);
+    assert!(classification.labels[0].probability > classification.labels[1].probability);
+    assert!(classification.labels[2].probability >= 0.0);
+
+    Ok(())
+}
+
+#[test]
+fn test_classification_requires_labels() {
+    assert!(Classification::new(&[], &[]).is_err());
+    assert!(Classification::new(&labels(&["yes", "no"]), &[-1.0]).is_err());
+}
+
+#[test]
+fn test_classify_mock() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    let messages = vec![QueryMessage {
+        role: "user".to_string(),
+        content: "Is this review positive or negative? 'Great phone!'".to_string(),
+    }];
+
+    // The Mock runtime prefers labels made of bytes occurring in the messages
+    let classification = service.classify(messages.clone(), labels(&["positive", "xyz"]))?;
+
+    assert_eq!(classification.label, "positive");
+    assert_eq!(classification.labels.len(), 2);
+
+    assert!(service.classify(messages.clone(), vec![]).is_err());
+    assert!(service
+        .classify(messages.clone(), labels(&["positive", ""]))
+        .is_err());
+
+    // rejected label lists keep the model loaded for the next request
+    let classification = service.classify(messages, labels(&["positive", "xyz"]))?;
+    assert_eq!(classification.label, "positive");
+
+    Ok(())
+}
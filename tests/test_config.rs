@@ -2,7 +2,7 @@ mod common;
 
 use proptest::prelude::*;
 use std::path::PathBuf;
-use tauri_plugin_llm::{LLMRuntimeConfig, Query};
+use tauri_plugin_llm::{CachedPrefix, CompletionInput, LLMRuntimeConfig, Query};
 use tauri_plugin_llm_macros::hf_test;
 
 pub fn random() -> impl Strategy<Value = LLMRuntimeConfig> {
@@ -50,6 +50,7 @@ pub fn random() -> impl Strategy<Value = LLMRuntimeConfig> {
                     model_file,
                     model_dir,
                     template_file: template,
+                    ..Default::default()
                 }
             },
         )
@@ -84,6 +85,73 @@ fn test_deserialize_default() {
     assert!(result.is_ok(), "{:?}", result);
 }
 
+#[test]
+fn test_deserialize_completion() {
+    let text = serde_json::json!({ "prompt": "def fib(n):", "max_tokens": 32 }).to_string();
+    let result: Query = serde_json::from_str(&text).expect("Failed to deserialize completion");
+    assert!(matches!(
+        result,
+        Query::Completion {
+            input: CompletionInput::Prompt(_),
+            max_tokens: Some(32),
+            ..
+        }
+    ));
+
+    let ids = serde_json::json!({ "token_ids": [1, 2, 3], "stream": true }).to_string();
+    let result: Query = serde_json::from_str(&ids).expect("Failed to deserialize completion");
+    assert!(matches!(
+        result,
+        Query::Completion {
+            input: CompletionInput::TokenIds(_),
+            stream: true,
+            ..
+        }
+    ));
+}
+
+#[test]
+fn test_deserialize_prompt_cache() {
+    let json = serde_json::json!({
+        "name": "Qwen/Qwen3-4B-Instruct-2507",
+        "prompt_cache": {
+            "prefixes": [
+                { "messages": [{ "role": "system", "content": "You are a helpful assistant." }] },
+                { "text": "def main():" }
+            ]
+        }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let prompt_cache = config.prompt_cache.expect("Missing prompt cache");
+
+    assert!(prompt_cache.cache_dir.is_none());
+    assert!(matches!(
+        prompt_cache.prefixes.as_slice(),
+        [CachedPrefix::Messages { .. }, CachedPrefix::Text { .. }]
+    ));
+}
+
+#[test]
+fn test_deserialize_token_healing() {
+    let json = serde_json::json!({
+        "name": "Qwen/Qwen3-4B-Instruct-2507",
+        "token_healing": { "max_tokens": 2 }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let token_healing = config.token_healing.expect("Missing token healing");
+
+    assert_eq!(token_healing.max_tokens, Some(2));
+
+    let config = LLMRuntimeConfig::from_raw(r#"{ "name": "Qwen/Qwen3-4B-Instruct-2507" }"#)
+        .expect("Failed to deserialize config");
+
+    assert!(config.token_healing.is_none());
+}
+
 #[hf_test(
     model = "meta-llama/Llama-3.2-3B-Instruct",
     cleanup = false,
@@ -0,0 +1,235 @@
+use serde_json::json;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use tauri_plugin_llm::config::{merge, ConfigLoader};
+use tauri_plugin_llm::{Error, LLMService, ModelDType, SystemMessagePolicy};
+
+const CONFIG_DIR: &str = "tests/fixtures/configs";
+
+#[test]
+fn test_merge() {
+    let mut base = json!({
+        "name": "Base",
+        "dtype": "bf16",
+        "role_map": { "model": "assistant", "human": "user" },
+        "labels": ["a", "b"]
+    });
+
+    merge(
+        &mut base,
+        json!({
+            "dtype": "f16",
+            "role_map": { "human": "assistant" },
+            "labels": ["c"]
+        }),
+    );
+
+    assert_eq!(
+        base,
+        json!({
+            "name": "Base",
+            "dtype": "f16",
+            "role_map": { "model": "assistant", "human": "assistant" },
+            "labels": ["c"]
+        })
+    );
+}
+
+#[test]
+fn test_from_dir_resolves_inheritance() -> Result<(), Error> {
+    let loader = ConfigLoader::new().variable("MODELS", "/models");
+    let service = LLMService::from_dir_with_loader(CONFIG_DIR, loader)?;
+
+    // configs extending each other or unknown configs are skipped
+    let mut models = service.list_models();
+    models.sort();
+    assert_eq!(models, vec!["Base", "Base-F16"]);
+
+    Ok(())
+}
+
+#[test]
+fn test_resolve_config() -> Result<(), Error> {
+    let configs: HashMap<String, serde_json::Value> = ["base", "base_f16"]
+        .iter()
+        .map(|file| {
+            let raw = ConfigLoader::read(format!("{CONFIG_DIR}/{file}.json"))?;
+            Ok((ConfigLoader::name_of(&raw).unwrap().to_string(), raw))
+        })
+        .collect::<Result<_, Error>>()?;
+
+    let loader = ConfigLoader::new().variable("MODELS", "/models");
+
+    let base = loader.resolve("Base", &configs)?;
+    assert_eq!(base.model_file, Some(PathBuf::from("/models/model.gguf")));
+    assert_eq!(
+        base.template_file,
+        Some(PathBuf::from("${MODELS}/template.jinja"))
+    );
+    assert_eq!(base.dtype, None);
+
+    let config = loader.resolve("Base-F16", &configs)?;
+    assert_eq!(config.name, "Base-F16");
+    assert_eq!(config.dtype, Some(ModelDType::F16));
+    assert_eq!(
+        config.tokenizer_file,
+        Some(PathBuf::from("/models/tokenizer.json"))
+    );
+
+    let normalization = config.message_normalization.unwrap();
+    assert_eq!(
+        normalization.system,
+        SystemMessagePolicy::MergeIntoFirstUser
+    );
+    assert_eq!(normalization.separator.as_deref(), Some("\n"));
+    assert!(normalization.merge_consecutive);
+
+    // the profile of the extended config is applied before the extending config is merged
+    let loader = loader.profile("ci").app_data_dir("/data");
+    let config = loader.resolve("Base-F16", &configs)?;
+    assert_eq!(config.dtype, Some(ModelDType::F16));
+    assert_eq!(config.model_file, Some(PathBuf::from("/data/model.gguf")));
+
+    let base = loader.resolve("Base", &configs)?;
+    assert_eq!(base.dtype, Some(ModelDType::F32));
+
+    // ${APP_DATA} requires an app data directory
+    assert!(ConfigLoader::new()
+        .profile("ci")
+        .variable("MODELS", "/models")
+        .resolve("Base", &configs)
+        .is_err());
+
+    Ok(())
+}
+
+#[test]
+fn test_interpolate_env() -> Result<(), Error> {
+    std::env::set_var("TEST_CONFIG_LOADER_DIR", "/env");
+
+    let config = ConfigLoader::new().resolve_value(json!({
+        "llmconfig": { "model_dir": "${TEST_CONFIG_LOADER_DIR}/models" },
+        "profiles": { "dev": { "metrics_port": 9464 } }
+    }))?;
+
+    assert_eq!(
+        config,
+        json!({ "llmconfig": { "model_dir": "/env/models" } })
+    );
+
+    let config = ConfigLoader::new()
+        .profile("dev")
+        .resolve_value(json!({ "profiles": { "dev": { "metrics_port": 9464 } } }))?;
+    assert_eq!(config, json!({ "metrics_port": 9464 }));
+
+    assert!(ConfigLoader::new()
+        .resolve_value(json!({ "model_dir": "${TEST_CONFIG_LOADER_UNDEFINED}" }))
+        .is_err());
+    assert!(ConfigLoader::new()
+        .resolve_value(json!({ "model_dir": "${TEST_CONFIG_LOADER_DIR" }))
+        .is_err());
+
+    Ok(())
+}
+
+#[test]
+fn test_interpolate_paths_only() -> Result<(), Error> {
+    let loader = ConfigLoader::new().variable("MODELS", "/models");
+
+    // templates and other strings are left untouched
+    let config = loader.resolve_value(json!({
+        "llmconfig": {
+            "model_file": "${MODELS}/model.gguf",
+            "prompt_cache": { "cache_dir": "${MODELS}/cache" },
+            "system_prompt": "Hello ${MODELS} {{ app_name }}"
+        },
+        "prompts": [{ "template": "${MODELS}" }]
+    }))?;
+
+    assert_eq!(
+        config,
+        json!({
+            "llmconfig": {
+                "model_file": "/models/model.gguf",
+                "prompt_cache": { "cache_dir": "/models/cache" },
+                "system_prompt": "Hello ${MODELS} {{ app_name }}"
+            },
+            "prompts": [{ "template": "${MODELS}" }]
+        })
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_nested_profiles() -> Result<(), Error> {
+    let config = ConfigLoader::new().profile("ci").resolve_value(json!({
+        "llmconfig": {
+            "name": "Qwen",
+            "profiles": { "ci": { "dtype": "f32" } }
+        },
+        "profiles": { "ci": { "metrics_port": 9464 } }
+    }))?;
+
+    assert_eq!(
+        config,
+        json!({
+            "llmconfig": { "name": "Qwen", "dtype": "f32" },
+            "metrics_port": 9464
+        })
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_add_config_extends() -> Result<(), Error> {
+    let mut service = LLMService::from_path("tests/fixtures/test_runtime_mock.json")?;
+
+    service
+        .add_config(json!({ "name": "Mock-F32", "extends": "Mock", "dtype": "f32" }).to_string())?;
+    assert!(service.list_models().contains(&"Mock-F32".to_string()));
+
+    assert!(service
+        .add_config(json!({ "name": "Orphan", "extends": "Unknown" }).to_string())
+        .is_err());
+
+    Ok(())
+}
+
+#[test]
+fn test_add_config_keeps_escaped_variables() -> Result<(), Error> {
+    let path = std::env::temp_dir().join("test_add_config_keeps_escaped_variables.json");
+    std::fs::write(
+        &path,
+        json!({ "name": "Mock", "template_file": "$${MODELS}/template.jinja" }).to_string(),
+    )?;
+
+    // configs read by the service are extended as they were read
+    let mut service = LLMService::from_path(&path)?;
+    service.set_config_loader(ConfigLoader::new().variable("MODELS", "/models"));
+    service
+        .add_config(json!({ "name": "Mock-F32", "extends": "Mock", "dtype": "f32" }).to_string())?;
+
+    let config = service.activate("Mock-F32".to_string())?.config().clone();
+    assert_eq!(
+        config.template_file,
+        Some(PathBuf::from("${MODELS}/template.jinja"))
+    );
+
+    // resolved configs are extended as they are
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.set_config_loader(ConfigLoader::new().variable("MODELS", "/models"));
+    service.add_config(
+        json!({ "name": "Mock-F16", "extends": "Mock-F32", "dtype": "f16" }).to_string(),
+    )?;
+
+    let config = service.activate("Mock-F16".to_string())?.config().clone();
+    assert_eq!(config.dtype, Some(ModelDType::F16));
+    assert_eq!(
+        config.template_file,
+        Some(PathBuf::from("${MODELS}/template.jinja"))
+    );
+
+    Ok(())
+}
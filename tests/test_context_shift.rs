@@ -0,0 +1,70 @@
+use tauri_plugin_llm::{ContextShift, LLMRuntimeConfig, Query};
+
+#[test]
+fn test_shift_keeps_prefix() {
+    let shift = ContextShift::default();
+    let tokens: Vec<u32> = (0..10).collect();
+
+    let (shifted, discarded) = shift
+        .shift(&tokens, 2, 10)
+        .expect("Failed to shift context");
+
+    assert_eq!(discarded, 4);
+    assert_eq!(shifted, vec![0, 1, 6, 7, 8, 9]);
+}
+
+#[test]
+fn test_shift_discards_at_least_the_overflow() {
+    let shift = ContextShift {
+        discard: Some(1),
+        ..Default::default()
+    };
+    let tokens: Vec<u32> = (0..12).collect();
+
+    let (shifted, discarded) = shift.shift(&tokens, 0, 8).expect("Failed to shift context");
+
+    assert_eq!(discarded, 5);
+    assert_eq!(shifted.len(), 7);
+    assert_eq!(shifted.last(), Some(&11));
+}
+
+#[test]
+fn test_shift_limits_kept_prefix() {
+    let shift = ContextShift {
+        keep: Some(100),
+        ..Default::default()
+    };
+    let tokens: Vec<u32> = (0..8).collect();
+
+    let (shifted, _) = shift.shift(&tokens, 0, 8).expect("Failed to shift context");
+
+    assert!(shifted.starts_with(&[0, 1, 2, 3]));
+    assert!(shifted.len() < 8);
+}
+
+#[test]
+fn test_shift_without_discardable_tokens() {
+    let shift = ContextShift::default();
+
+    assert!(shift.shift(&[0, 1], 2, 4).is_none());
+}
+
+#[test]
+fn test_deserialize_context_shift() {
+    let json = serde_json::json!({
+        "name": "Qwen/Qwen3-4B-Instruct-2507",
+        "context_shift": { "discard": 256 }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let shift = config.context_shift.expect("Missing context shift");
+
+    assert_eq!(shift.discard, Some(256));
+    assert!(shift.context_length.is_none());
+
+    let event =
+        serde_json::json!({ "discarded": 256, "kept": 1024, "timestamp": null }).to_string();
+    let query: Query = serde_json::from_str(&event).expect("Failed to deserialize event");
+    assert!(matches!(query, Query::ContextShift { discarded: 256, .. }));
+}
@@ -0,0 +1,149 @@
+use tauri_plugin_llm::eval::{EvalDataset, Evaluator, Expectation};
+use tauri_plugin_llm::{Error, LLMRuntimeConfig, LLMService};
+
+fn mock_service() -> Result<LLMService, Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    Ok(LLMService::from_runtime_configs(&[config]))
+}
+
+#[test]
+fn test_deserialize_eval_dataset() -> Result<(), Error> {
+    let dataset = EvalDataset::from_path("tests/fixtures/test_eval_dataset.jsonl")?;
+
+    assert_eq!(dataset.cases.len(), 8);
+    assert!(matches!(
+        dataset.cases[0].expect,
+        Expectation::ExactMatch(_)
+    ));
+    assert!(matches!(
+        dataset.cases[2].expect,
+        Expectation::JsonSchema(_)
+    ));
+    assert!(matches!(
+        dataset.cases[4].expect,
+        Expectation::ToolCall {
+            arguments: Some(_),
+            ..
+        }
+    ));
+    assert_eq!(dataset.cases[4].tools.len(), 1);
+    assert_eq!(dataset.cases[5].max_tokens, Some(16));
+
+    Ok(())
+}
+
+#[test]
+fn test_invalid_eval_dataset() {
+    let jsonl = r#"{"id": "a", "messages": [], "expect": {"exact_match": "a"}}
+{"id": "b", "messages": [], "expect": {"unknown": "b"}}"#;
+
+    let error = EvalDataset::from_jsonl(jsonl).unwrap_err();
+    assert!(error.to_string().contains("line 2"));
+}
+
+#[test]
+fn test_eval_mock() -> Result<(), Error> {
+    let dataset = EvalDataset::from_path("tests/fixtures/test_eval_dataset.jsonl")?;
+    let mut service = mock_service()?;
+
+    // The Mock runtime echoes the user message
+    let report = Evaluator::new().run(&mut service, &dataset, &["Mock".to_string()])?;
+
+    assert_eq!(report.models.len(), 1);
+
+    let model = &report.models[0];
+    let passed: Vec<&str> = model
+        .results
+        .iter()
+        .filter(|r| r.passed)
+        .map(|r| r.id.as_str())
+        .collect();
+
+    assert_eq!(passed, vec!["exact", "regex", "json", "tool"]);
+    assert_eq!(model.total, 8);
+    assert_eq!(model.passed, 4);
+    assert!((model.accuracy - 0.5).abs() < 1e-9);
+    assert!(model.tokens_per_second > 0.0);
+
+    let failures: Vec<&str> = model.failures().map(|r| r.id.as_str()).collect();
+    assert_eq!(
+        failures,
+        vec!["wrong", "judge", "tool_arguments", "judge_fail"]
+    );
+
+    // Tool calls are checked against the expected arguments
+    let tool = model
+        .results
+        .iter()
+        .find(|r| r.id == "tool_arguments")
+        .unwrap();
+    assert!(tool.failure.as_ref().unwrap().contains("called with"));
+
+    // Judged cases fail without a judge model
+    let judge = model.results.iter().find(|r| r.id == "judge").unwrap();
+    assert!(judge.failure.as_ref().unwrap().contains("judge"));
+
+    let summary = report.to_string();
+    assert!(summary.contains("| Mock | 4/8 | 50.0% |"));
+
+    let path = std::env::temp_dir().join("test_eval_mock_report.json");
+    report.write(&path)?;
+
+    let written: serde_json::Value = serde_json::from_str(&std::fs::read_to_string(&path)?)?;
+    assert_eq!(written["models"][0]["passed"], 4);
+
+    Ok(())
+}
+
+#[test]
+fn test_eval_judge_mock() -> Result<(), Error> {
+    let dataset = EvalDataset::from_path("tests/fixtures/test_eval_dataset.jsonl")?;
+    let mut service = mock_service()?;
+
+    // The Mock judge prefers the label made of bytes occurring in the graded conversation
+    let report =
+        Evaluator::new()
+            .judge("Mock")
+            .run(&mut service, &dataset, &["Mock".to_string()])?;
+
+    let model = &report.models[0];
+    let result = |id: &str| model.results.iter().find(|r| r.id == id).unwrap();
+
+    assert!(result("judge").passed);
+    assert!(result("judge").failure.is_none());
+
+    assert!(!result("judge_fail").passed);
+    assert!(result("judge_fail")
+        .failure
+        .as_ref()
+        .unwrap()
+        .contains("Judge rejected"));
+
+    assert_eq!(model.passed, 5);
+
+    Ok(())
+}
+
+#[test]
+fn test_eval_errors_excluded_from_latency() -> Result<(), Error> {
+    // The Mock runtime fails on conversations without a user message
+    let jsonl = r#"{"id": "ok", "messages": [{"role": "user", "content": "Paris"}], "expect": {"exact_match": "Paris"}}
+{"id": "error", "messages": [{"role": "system", "content": "a"}, {"role": "assistant", "content": "b"}], "expect": {"exact_match": "b"}}"#;
+    let dataset = EvalDataset::from_jsonl(jsonl)?;
+    let mut service = mock_service()?;
+
+    let report = Evaluator::new().run(&mut service, &dataset, &["Mock".to_string()])?;
+    let model = &report.models[0];
+
+    let ok = &model.results[0];
+    let error = &model.results[1];
+
+    assert!(!ok.errored);
+    assert!(error.errored);
+    assert!(!error.passed);
+
+    assert_eq!(model.total, 2);
+    assert!((model.mean_latency_ms - ok.latency_ms).abs() < 1e-9);
+
+    Ok(())
+}
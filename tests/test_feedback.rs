@@ -0,0 +1,226 @@
+use serde_json::{json, Value};
+use tauri_plugin_llm::feedback::{DatasetFormat, FeedbackStore, GenerationRecord};
+use tauri_plugin_llm::runtime::RenderedRequest;
+use tauri_plugin_llm::{Error, LLMService, Query, QueryMessage, ToolCall};
+
+fn message(role: &str, content: &str) -> QueryMessage {
+    QueryMessage {
+        role: role.to_string(),
+        content: content.to_string(),
+    }
+}
+
+fn prompt(content: &str) -> Query {
+    Query::Prompt {
+        messages: vec![message("user", content)],
+        tools: vec![],
+        chunk_size: None,
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: Some(0.7),
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+fn generation(request_id: &str, content: &str, output: &str) -> GenerationRecord {
+    GenerationRecord::new(
+        request_id.to_string(),
+        "Mock".to_string(),
+        RenderedRequest {
+            query: prompt(content),
+            prompt: Some(format!("user: {content}")),
+        },
+        output.to_string(),
+    )
+}
+
+fn export(store: &FeedbackStore, format: DatasetFormat) -> Result<Vec<Value>, Error> {
+    let mut output = vec![];
+    let lines = store.export(&mut output, format)?;
+
+    let values = String::from_utf8(output)
+        .unwrap()
+        .lines()
+        .map(serde_json::from_str)
+        .collect::<Result<Vec<Value>, _>>()?;
+    assert_eq!(values.len(), lines);
+
+    Ok(values)
+}
+
+#[test]
+fn test_last_request_mock() -> Result<(), Error> {
+    let mut service = LLMService::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let runtime = service.activate("Mock".to_string())?;
+
+    assert!(runtime.last_request().is_none());
+    assert_eq!(
+        runtime.complete(prompt("Hello, Feedback"))?,
+        "Hello, Feedback"
+    );
+
+    let request = runtime.last_request().unwrap();
+    assert_eq!(request.prompt.as_deref(), Some("user: Hello, Feedback"));
+
+    let record = GenerationRecord::new(
+        "1".to_string(),
+        "Mock".to_string(),
+        request,
+        "Hello, Feedback".to_string(),
+    );
+    assert_eq!(record.messages.len(), 1);
+    assert_eq!(record.messages[0].content, "Hello, Feedback");
+    assert_eq!(record.sampling.max_tokens, Some(100));
+    assert_eq!(record.sampling.temperature, Some(0.7));
+
+    Ok(())
+}
+
+#[test]
+fn test_submit_feedback() -> Result<(), Error> {
+    let mut store = FeedbackStore::default().with_capacity(2);
+
+    store.record(generation("1", "Capital of France?", "Paris"));
+    store.record(generation("2", "Capital of Italy?", "Rome"));
+    store.record(generation("3", "Capital of Spain?", "Madrid"));
+
+    // the oldest generation is discarded once the capacity is reached
+    assert!(store.submit("1", 1, None).is_err());
+    assert!(store.submit("unknown", 1, None).is_err());
+
+    store.submit("2", 1, None)?;
+    assert_eq!(store.entries().len(), 1);
+    assert_eq!(store.entries()[0].generation.output, "Rome");
+
+    // rating a generation again replaces its feedback
+    store.submit("2", -1, Some("Rome.".to_string()))?;
+    assert_eq!(store.entries().len(), 1);
+    assert_eq!(store.entries()[0].feedback.rating, -1);
+
+    Ok(())
+}
+
+#[test]
+fn test_feedback_persistence() -> Result<(), Error> {
+    let dir = std::env::temp_dir().join("test_feedback_persistence");
+    let path = dir.join("feedback.json");
+    let _ = std::fs::remove_dir_all(&dir);
+
+    let mut store = FeedbackStore::open(&path)?;
+    assert!(store.entries().is_empty());
+
+    store.record(generation("1", "Capital of France?", "Paris"));
+    store.record(generation("2", "Capital of Italy?", "Rome"));
+    store.submit("1", 1, None)?;
+
+    // only rated generations are persisted
+    let store = FeedbackStore::open(&path)?;
+    assert_eq!(store.entries().len(), 1);
+    assert_eq!(
+        store.entries()[0].generation.prompt.as_deref(),
+        Some("user: Capital of France?")
+    );
+
+    let _ = std::fs::remove_dir_all(&dir);
+
+    Ok(())
+}
+
+#[test]
+fn test_export_conversations() -> Result<(), Error> {
+    let mut store = FeedbackStore::default();
+
+    let mut call = generation("1", "Weather in Paris?", "");
+    call.tools = vec![json!({ "name": "weather" }).to_string()];
+    call.tool_calls = vec![ToolCall::new(
+        "call_0".to_string(),
+        "weather".to_string(),
+        json!({ "city": "Paris" }),
+    )];
+    store.record(call);
+    store.record(generation("2", "Capital of France?", "Paris"));
+    store.record(generation("3", "Capital of Italy?", "Milan"));
+    store.record(generation("4", "Capital of Spain?", "Barcelona"));
+
+    store.submit("1", 1, None)?;
+    store.submit("2", 1, None)?;
+    store.submit("3", -1, Some("Rome".to_string()))?;
+    store.submit("4", -1, None)?;
+
+    // negatively rated generations without a correction are not exported
+    let lines = export(&store, DatasetFormat::OpenAi)?;
+    assert_eq!(lines.len(), 3);
+
+    assert_eq!(lines[0]["tools"], json!([{ "name": "weather" }]));
+    let answer = &lines[0]["messages"][1];
+    assert_eq!(answer["role"], "assistant");
+    assert_eq!(answer["tool_calls"][0]["function"]["name"], "weather");
+    assert_eq!(
+        answer["tool_calls"][0]["function"]["arguments"],
+        json!({ "city": "Paris" }).to_string()
+    );
+
+    assert_eq!(
+        lines[2]["messages"],
+        json!([
+            { "role": "user", "content": "Capital of Italy?" },
+            { "role": "assistant", "content": "Rome" }
+        ])
+    );
+
+    let lines = export(&store, DatasetFormat::ShareGpt)?;
+    assert_eq!(lines.len(), 3);
+    assert_eq!(lines[0]["conversations"][1]["from"], "function_call");
+    assert_eq!(
+        lines[1]["conversations"],
+        json!([
+            { "from": "human", "value": "Capital of France?" },
+            { "from": "gpt", "value": "Paris" }
+        ])
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_export_preference_pairs() -> Result<(), Error> {
+    let mut store = FeedbackStore::default();
+
+    store.record(generation("1", "Capital of Italy?", "Rome"));
+    store.record(generation("2", "Capital of Italy?", "Milan"));
+    store.record(generation("3", "Capital of Spain?", "Barcelona"));
+    store.record(generation("4", "Capital of France?", "Paris"));
+
+    store.submit("1", 1, None)?;
+    store.submit("2", -1, None)?;
+    store.submit("3", -1, Some("Madrid".to_string()))?;
+    store.submit("4", 1, None)?;
+
+    // a positive rating without a rejected output yields no pair
+    let lines = export(&store, DatasetFormat::Dpo)?;
+    assert_eq!(lines.len(), 2);
+
+    assert_eq!(
+        lines[0],
+        json!({
+            "prompt": [{ "role": "user", "content": "Capital of Italy?" }],
+            "chosen": [{ "role": "assistant", "content": "Rome" }],
+            "rejected": [{ "role": "assistant", "content": "Milan" }]
+        })
+    );
+    assert_eq!(lines[1]["chosen"][0]["content"], "Madrid");
+    assert_eq!(lines[1]["rejected"][0]["content"], "Barcelona");
+
+    Ok(())
+}
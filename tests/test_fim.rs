@@ -0,0 +1,83 @@
+use tauri_plugin_llm::{FimTokens, LLMRuntimeConfig, TokenizerConfig};
+
+fn added_token(content: &str) -> serde_json::Value {
+    serde_json::json!({
+        "content": content,
+        "single_word": false,
+        "lstrip": false,
+        "rstrip": false,
+        "normalized": false,
+        "special": true
+    })
+}
+
+fn tokenizer_config(tokens: &[&str]) -> TokenizerConfig {
+    let added_tokens_decoder: serde_json::Map<String, serde_json::Value> = tokens
+        .iter()
+        .enumerate()
+        .map(|(id, token)| ((151659 + id).to_string(), added_token(token)))
+        .collect();
+
+    serde_json::from_value(serde_json::json!({
+        "clean_up_tokenization_spaces": false,
+        "added_tokens_decoder": added_tokens_decoder
+    }))
+    .expect("Failed to deserialize TokenizerConfig")
+}
+
+#[test]
+fn test_detect_qwen_coder_fim_tokens() {
+    let config = tokenizer_config(&[
+        "<|endoftext|>",
+        "<|fim_prefix|>",
+        "<|fim_middle|>",
+        "<|fim_suffix|>",
+        "<|fim_pad|>",
+    ]);
+
+    let fim = FimTokens::detect(&config).expect("FIM tokens not detected");
+
+    assert_eq!(fim.prefix, "<|fim_prefix|>");
+    assert_eq!(fim.suffix, "<|fim_suffix|>");
+    assert_eq!(fim.middle, "<|fim_middle|>");
+    assert!(fim.stop.contains(&"<|fim_pad|>".to_string()));
+}
+
+#[test]
+fn test_detect_codellama_fim_tokens() {
+    let config = tokenizer_config(&["▁<PRE>", "▁<SUF>", "▁<MID>", "▁<EOT>"]);
+
+    let fim = FimTokens::detect(&config).expect("FIM tokens not detected");
+
+    assert_eq!(fim.prefix, "▁<PRE>");
+    assert_eq!(fim.stop, vec!["▁<EOT>".to_string()]);
+}
+
+#[test]
+fn test_detect_without_fim_tokens() {
+    let config = tokenizer_config(&["<|endoftext|>", "<|im_start|>", "<|im_end|>"]);
+    assert!(FimTokens::detect(&config).is_none());
+
+    // an incomplete set is not detected
+    let config = tokenizer_config(&["<|fim_prefix|>", "<|fim_suffix|>"]);
+    assert!(FimTokens::detect(&config).is_none());
+}
+
+#[test]
+fn test_configure_fim_tokens() {
+    let json = serde_json::json!({
+        "name": "bigcode/starcoder2-3b",
+        "fim_tokens": {
+            "prefix": "<fim_prefix>",
+            "suffix": "<fim_suffix>",
+            "middle": "<fim_middle>"
+        }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let fim = config.fim_tokens.expect("Missing FIM tokens");
+
+    assert_eq!(fim.middle, "<fim_middle>");
+    assert!(fim.stop.is_empty());
+}
@@ -0,0 +1,131 @@
+use std::time::{Duration, Instant};
+use tauri_plugin_llm::iter::*;
+use tauri_plugin_llm::{runtime::LLMRuntime, Error, LLMRuntimeConfig, Query, QueryMessage};
+
+fn collect<I: Iterator<Item = i32>>(chunks: FlushChunks<I>) -> Vec<Vec<i32>> {
+    chunks.map(|chunk| chunk.into_iter().collect()).collect()
+}
+
+/// Returns the items `1..=n`, each produced after `delay`.
+fn slow(n: i32, delay: Duration) -> impl Iterator<Item = i32> {
+    (1..=n).inspect(move |_| std::thread::sleep(delay))
+}
+
+#[test]
+fn test_flush_tokens() {
+    let chunks = collect((1..=5).chunks_with(2, FlushPolicy::default()));
+    assert_eq!(chunks, vec![vec![1, 2], vec![3, 4], vec![5]]);
+
+    // a size of 0 is treated as 1
+    let chunks = collect((1..=2).chunks_with(0, FlushPolicy::Tokens));
+    assert_eq!(chunks, vec![vec![1], vec![2]]);
+}
+
+#[test]
+fn test_flush_timed() {
+    // items of a slow producer are flushed once the interval has passed
+    let policy = FlushPolicy::Timed { interval_ms: 1 };
+    let chunks = collect(slow(3, Duration::from_millis(5)).chunks_with(10, policy));
+    assert_eq!(chunks, vec![vec![1], vec![2], vec![3]]);
+
+    // chunks are flushed at the latest after `size` items
+    let policy = FlushPolicy::Timed {
+        interval_ms: 60_000,
+    };
+    let chunks = collect(slow(3, Duration::from_millis(5)).chunks_with(2, policy));
+    assert_eq!(chunks, vec![vec![1, 2], vec![3]]);
+}
+
+#[test]
+fn test_flush_timed_waits_for_next_item() {
+    // two fast items are held back until the slow third item arrives, although the interval
+    // passes meanwhile
+    let items = (1..=3).inspect(|item| {
+        if *item == 3 {
+            std::thread::sleep(Duration::from_millis(30));
+        }
+    });
+    let policy = FlushPolicy::Timed { interval_ms: 10 };
+
+    let started = Instant::now();
+    let mut chunks = items.chunks_with(10, policy);
+    let first: Vec<i32> = chunks.next().unwrap().into_iter().collect();
+
+    assert_eq!(first, vec![1, 2, 3]);
+    assert!(started.elapsed() >= Duration::from_millis(30));
+    assert!(chunks.next().is_none());
+}
+
+#[test]
+fn test_flush_adaptive() {
+    // the first item is flushed on its own, fast items fill the chunks
+    let policy = FlushPolicy::Adaptive { target_ms: 50 };
+    let chunks = collect((1..=9).chunks_with(4, policy));
+    assert_eq!(chunks, vec![vec![1], vec![2, 3, 4, 5], vec![6, 7, 8, 9]]);
+
+    // items slower than the target are flushed one by one
+    let policy = FlushPolicy::Adaptive { target_ms: 1 };
+    let chunks = collect(slow(3, Duration::from_millis(30)).chunks_with(4, policy));
+    assert_eq!(chunks, vec![vec![1], vec![2], vec![3]]);
+}
+
+#[test]
+fn test_flush_policy_serde() -> Result<(), Error> {
+    let policy: FlushPolicy = serde_json::from_str(r#"{ "type": "timed", "interval_ms": 100 }"#)?;
+    assert_eq!(policy, FlushPolicy::Timed { interval_ms: 100 });
+
+    let policy: FlushPolicy = serde_json::from_str(r#"{ "type": "adaptive" }"#)?;
+    assert_eq!(
+        policy,
+        FlushPolicy::Adaptive {
+            target_ms: DEFAULT_FLUSH_TARGET_MS
+        }
+    );
+
+    assert!(serde_json::from_str::<FlushPolicy>(r#"{ "type": "timed" }"#).is_err());
+
+    Ok(())
+}
+
+#[test]
+fn test_flush_mock() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut runtime = LLMRuntime::from_config(config)?;
+    runtime.run_stream()?;
+
+    runtime.send_stream(Query::Prompt {
+        messages: vec![QueryMessage {
+            role: "user".to_string(),
+            content: "Hello, Flush".to_string(),
+        }],
+        tools: vec![],
+        max_tokens: None,
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: Some(FlushPolicy::Adaptive { target_ms: 50 }),
+        chunk_size: Some(4),
+        timestamp: None,
+    })?;
+
+    let mut chunks = vec![];
+    while let Ok(message) = runtime.recv_stream() {
+        match message {
+            Query::Chunk { data, .. } => chunks.push(String::from_utf8(data).unwrap()),
+            _ => break,
+        }
+    }
+
+    assert_eq!(chunks, vec!["H", "ello", ", Fl", "ush"]);
+
+    Ok(())
+}
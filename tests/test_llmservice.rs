@@ -47,11 +47,15 @@ async fn test_add_config_at_runtime() -> Result<(), Error> {
         top_k: None,
         top_p: None,
         think: false,
+        continue_final_message: false,
         stream: true,
         model: None,
         penalty: None,
         seed: None,
         sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
     };
 
     runtime.send_stream(query)?;
@@ -78,11 +82,15 @@ async fn test_add_config_at_runtime() -> Result<(), Error> {
         top_k: None,
         top_p: None,
         think: false,
+        continue_final_message: false,
         stream: true,
         model: None,
         penalty: None,
         seed: None,
         sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
     };
 
     runtime.send_stream(query2)?;
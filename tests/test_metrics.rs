@@ -0,0 +1,200 @@
+use std::io::{Read, Write};
+use std::net::TcpStream;
+
+use tauri_plugin_llm::{Error, LLMRuntimeConfig, LLMService, Query, QueryMessage};
+
+/// Returns the value of the sample `name` carrying all `labels`.
+fn sample(text: &str, name: &str, labels: &[&str]) -> Option<f64> {
+    text.lines()
+        .filter(|line| line.starts_with(&format!("{name}{{")))
+        .find(|line| labels.iter().all(|label| line.contains(label)))
+        .and_then(|line| line.rsplit(' ').next())
+        .and_then(|value| value.parse().ok())
+}
+
+fn prompt(messages: Vec<QueryMessage>) -> Query {
+    Query::Prompt {
+        messages,
+        tools: vec![],
+        chunk_size: Some(4),
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+fn message(role: &str, content: &str) -> QueryMessage {
+    QueryMessage {
+        role: role.to_string(),
+        content: content.to_string(),
+    }
+}
+
+#[test]
+fn test_metrics_mock() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    // The Mock runtime echoes the user message, one token per byte
+    let output = service.complete(prompt(vec![message("user", "Hello, Metrics")]))?;
+    assert_eq!(output, "Hello, Metrics");
+
+    let metrics = service.metrics().gather()?;
+    let model = r#"model="Mock""#;
+
+    assert_eq!(
+        sample(&metrics, "llm_requests_total", &[model, r#"kind="prompt""#]),
+        Some(1.0)
+    );
+    assert_eq!(
+        sample(&metrics, "llm_completion_tokens_total", &[model]),
+        Some(14.0)
+    );
+    assert_eq!(sample(&metrics, "llm_queue_depth", &[model]), Some(0.0));
+    assert_eq!(
+        sample(&metrics, "llm_model_weights_bytes", &[model]),
+        Some(0.0)
+    );
+
+    // The request loading the model is reported separately
+    assert_eq!(
+        sample(
+            &metrics,
+            "llm_first_request_time_to_first_token_seconds_count",
+            &[model]
+        ),
+        Some(1.0)
+    );
+    assert_eq!(
+        sample(&metrics, "llm_time_to_first_token_seconds_count", &[model]),
+        None
+    );
+
+    service.complete(prompt(vec![message("user", "Hello again")]))?;
+
+    let metrics = service.metrics().gather()?;
+    assert_eq!(
+        sample(&metrics, "llm_time_to_first_token_seconds_count", &[model]),
+        Some(1.0)
+    );
+    assert_eq!(
+        sample(
+            &metrics,
+            "llm_first_request_time_to_first_token_seconds_count",
+            &[model]
+        ),
+        Some(1.0)
+    );
+
+    // The Mock runtime rejects conversations without a user message
+    let result = service.complete(prompt(vec![
+        message("system", "You are a helpful assistant."),
+        message("assistant", "Hello!"),
+    ]));
+    assert!(result.is_err());
+
+    let metrics = service.metrics().gather()?;
+    assert_eq!(
+        sample(
+            &metrics,
+            "llm_errors_total",
+            &[model, r#"kind="unexpected_message""#]
+        ),
+        Some(1.0)
+    );
+    assert_eq!(
+        sample(&metrics, "llm_requests_total", &[model, r#"kind="prompt""#]),
+        Some(3.0)
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_metrics_service_errors() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+
+    // Errors of the service are counted without active runtime
+    assert!(matches!(
+        service.complete(prompt(vec![message("user", "Hello")])),
+        Err(Error::MissingActiveRuntime)
+    ));
+
+    let metrics = service.metrics().gather()?;
+    assert_eq!(
+        sample(
+            &metrics,
+            "llm_errors_total",
+            &[r#"model="none""#, r#"kind="missing_active_runtime""#]
+        ),
+        Some(1.0)
+    );
+
+    // The Mock runtime echoes the user message, which is not a number
+    service.activate("Mock".to_string())?;
+    assert!(service
+        .complete_structured::<u32>(prompt(vec![message("user", "Hello")]))
+        .is_err());
+
+    let metrics = service.metrics().gather()?;
+    assert_eq!(
+        sample(
+            &metrics,
+            "llm_errors_total",
+            &[r#"model="Mock""#, r#"kind="structured_output""#]
+        ),
+        Some(1.0)
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_metrics_endpoint() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+    service.score("Hello", "Hello")?;
+
+    let addr = service.metrics().serve(0)?;
+    assert!(addr.ip().is_loopback());
+
+    let get = |path: &str| -> Result<String, Error> {
+        let mut stream = TcpStream::connect(addr)?;
+        write!(stream, "GET {path} HTTP/1.1\r\nHost: localhost\r\n\r\n")?;
+
+        let mut response = String::new();
+        stream.read_to_string(&mut response)?;
+        Ok(response)
+    };
+
+    let response = get("/metrics")?;
+    assert!(response.starts_with("HTTP/1.1 200 OK"));
+    assert!(response.contains("# TYPE llm_requests_total counter"));
+    assert_eq!(
+        sample(
+            &response,
+            "llm_requests_total",
+            &[r#"model="Mock""#, r#"kind="score""#]
+        ),
+        Some(1.0)
+    );
+
+    assert!(get("/")?.starts_with("HTTP/1.1 404 Not Found"));
+
+    Ok(())
+}
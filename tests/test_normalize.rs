@@ -0,0 +1,135 @@
+use std::collections::HashMap;
+use tauri_plugin_llm::{LLMRuntimeConfig, MessageNormalization, QueryMessage, SystemMessagePolicy};
+
+fn message(role: &str, content: &str) -> QueryMessage {
+    QueryMessage {
+        role: role.to_string(),
+        content: content.to_string(),
+    }
+}
+
+fn roles(messages: &[QueryMessage]) -> Vec<&str> {
+    messages.iter().map(|m| m.role.as_str()).collect()
+}
+
+#[test]
+fn test_default_rules_keep_messages() {
+    let rules = MessageNormalization::default();
+    let input = vec![
+        message("system", "sys"),
+        message("user", "a"),
+        message("user", "b"),
+        message("model", "c"),
+    ];
+
+    let result = rules.apply(input);
+
+    assert_eq!(roles(&result), vec!["system", "user", "user", "model"]);
+}
+
+#[test]
+fn test_merge_system_into_first_user() {
+    let rules = MessageNormalization {
+        system: SystemMessagePolicy::MergeIntoFirstUser,
+        ..Default::default()
+    };
+
+    let result = rules.apply(vec![
+        message("user", "Hello"),
+        message("system", "Be brief."),
+        message("assistant", "Hi"),
+        message("user", "Bye"),
+    ]);
+
+    assert_eq!(roles(&result), vec!["user", "assistant", "user"]);
+    assert_eq!(result[0].content, "Be brief.\n\nHello");
+    assert_eq!(result[2].content, "Bye");
+}
+
+#[test]
+fn test_merge_system_without_user_message() {
+    let rules = MessageNormalization {
+        system: SystemMessagePolicy::MergeIntoFirstUser,
+        ..Default::default()
+    };
+
+    let result = rules.apply(vec![message("system", "Be brief.")]);
+
+    assert_eq!(roles(&result), vec!["user"]);
+    assert_eq!(result[0].content, "Be brief.");
+}
+
+#[test]
+fn test_drop_system_messages() {
+    let rules = MessageNormalization {
+        system: SystemMessagePolicy::Drop,
+        ..Default::default()
+    };
+
+    let result = rules.apply(vec![message("system", "sys"), message("user", "Hello")]);
+
+    assert_eq!(roles(&result), vec!["user"]);
+}
+
+#[test]
+fn test_merge_consecutive_with_separator() {
+    let rules = MessageNormalization {
+        merge_consecutive: true,
+        separator: Some("\n".to_string()),
+        ..Default::default()
+    };
+
+    let result = rules.apply(vec![
+        message("user", "a"),
+        message("user", "b"),
+        message("assistant", "c"),
+        message("assistant", "d"),
+        message("user", "e"),
+    ]);
+
+    assert_eq!(roles(&result), vec!["user", "assistant", "user"]);
+    assert_eq!(result[0].content, "a\nb");
+    assert_eq!(result[1].content, "c\nd");
+}
+
+#[test]
+fn test_map_roles() {
+    let rules = MessageNormalization {
+        role_map: HashMap::from([("model".to_string(), "assistant".to_string())]),
+        unknown_role: Some("user".to_string()),
+        merge_consecutive: true,
+        ..Default::default()
+    };
+
+    let result = rules.apply(vec![
+        message("human", "a"),
+        message("user", "b"),
+        message("model", "c"),
+        message("tool", "d"),
+    ]);
+
+    assert_eq!(roles(&result), vec!["user", "assistant", "tool"]);
+    assert_eq!(result[0].content, "a\n\nb");
+}
+
+#[test]
+fn test_deserialize_normalization_config() {
+    let json = serde_json::json!({
+        "name": "google/gemma-3-1b-it",
+        "message_normalization": {
+            "system": "MergeIntoFirstUser",
+            "merge_consecutive": true,
+            "role_map": { "model": "assistant" }
+        }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let rules = config
+        .message_normalization
+        .expect("Missing normalization rules");
+
+    assert_eq!(rules.system, SystemMessagePolicy::MergeIntoFirstUser);
+    assert!(rules.merge_consecutive);
+    assert!(rules.unknown_role.is_none());
+}
@@ -0,0 +1,111 @@
+use tauri_plugin_llm::{
+    CancellationToken, ChunkedPrefill, Error, FinishReason, LLMRuntimeConfig, Query,
+};
+
+#[test]
+fn test_blocks_default_block_size() {
+    let prefill = ChunkedPrefill::default();
+
+    let blocks: Vec<_> = prefill.blocks(0..1200).collect();
+    assert_eq!(blocks, vec![0..512, 512..1024, 1024..1200]);
+
+    assert_eq!(prefill.blocks(5..5).count(), 0);
+}
+
+#[test]
+fn test_blocks_zero_block_size() {
+    let prefill = ChunkedPrefill {
+        block_size: Some(0),
+    };
+
+    let blocks: Vec<_> = prefill.blocks(0..3).collect();
+    assert_eq!(blocks, vec![0..1, 1..2, 2..3]);
+}
+
+#[test]
+fn test_run_returns_last_block() -> Result<(), Error> {
+    let prefill = ChunkedPrefill {
+        block_size: Some(4),
+    };
+    let cancellation = CancellationToken::default();
+
+    let mut processed = vec![];
+    let output = prefill.run(0..10, &cancellation, |block| {
+        processed.push(block.end);
+        Ok(block)
+    })?;
+
+    assert_eq!(output, Some(8..10));
+    assert_eq!(processed, vec![4, 8, 10]);
+
+    Ok(())
+}
+
+#[test]
+fn test_run_stops_when_cancelled() -> Result<(), Error> {
+    let prefill = ChunkedPrefill {
+        block_size: Some(4),
+    };
+    let cancellation = CancellationToken::default();
+
+    let mut blocks = 0;
+    let output = prefill.run(0..16, &cancellation, |_| {
+        blocks += 1;
+        if blocks == 2 {
+            cancellation.cancel();
+        }
+        Ok(())
+    })?;
+
+    // the block running while cancelling is completed, the remaining blocks are skipped
+    assert_eq!(output, None);
+    assert_eq!(blocks, 2);
+
+    // errors of a block are returned
+    cancellation.reset();
+    let result = prefill.run(0..16, &cancellation, |_| -> Result<(), Error> {
+        Err(Error::ExecutionError("out of memory".to_string()))
+    });
+    assert!(result.is_err());
+
+    Ok(())
+}
+
+#[test]
+fn test_deserialize_chunked_prefill() {
+    let json = serde_json::json!({
+        "name": "Qwen/Qwen3-4B-Instruct-2507",
+        "chunked_prefill": { "block_size": 256 }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let prefill = config.chunked_prefill.expect("Missing chunked prefill");
+    assert_eq!(prefill.block_size, Some(256));
+
+    let event =
+        serde_json::json!({ "processed": 256, "total": 1024, "timestamp": null }).to_string();
+    let query: Query = serde_json::from_str(&event).expect("Failed to deserialize event");
+    assert!(matches!(
+        query,
+        Query::PrefillProgress {
+            processed: 256,
+            total: 1024,
+            ..
+        }
+    ));
+    assert_eq!(
+        query.try_render_as_event_name().unwrap(),
+        "query-stream-prefill-progress"
+    );
+
+    let end = serde_json::json!({ "usage": null, "finish_reason": "cancelled" }).to_string();
+    let query: Query = serde_json::from_str(&end).expect("Failed to deserialize end");
+    assert!(matches!(
+        query,
+        Query::End {
+            finish_reason: Some(FinishReason::Cancelled),
+            ..
+        }
+    ));
+}
@@ -0,0 +1,142 @@
+use serde_json::{json, Map, Value};
+use tauri_plugin_llm::prompts::{PromptLibrary, PromptOverrides, PromptTemplate};
+use tauri_plugin_llm::{Error, LLMRuntimeConfig, LLMService, Query};
+
+fn summarize() -> PromptTemplate {
+    serde_json::from_value(json!({
+        "name": "summarize",
+        "system": "Summarize in {{ sentences }} sentences.",
+        "template": "Summarize: {{ text }}",
+        "variables": [
+            { "name": "text" },
+            { "name": "sentences", "type": "integer", "default": 3 }
+        ],
+        "settings": { "max_tokens": 100, "temperature": 0.2 }
+    }))
+    .unwrap()
+}
+
+fn vars(value: Value) -> Map<String, Value> {
+    value.as_object().cloned().unwrap_or_default()
+}
+
+#[test]
+fn test_render_prompt() -> Result<(), Error> {
+    let template = summarize();
+
+    let messages = template.render(&vars(json!({ "text": "Hello" })))?;
+    assert_eq!(messages.len(), 2);
+    assert_eq!(messages[0].role, "system");
+    assert_eq!(messages[0].content, "Summarize in 3 sentences.");
+    assert_eq!(messages[1].role, "user");
+    assert_eq!(messages[1].content, "Summarize: Hello");
+
+    let messages = template.render(&vars(json!({ "text": "Hello", "sentences": 1 })))?;
+    assert_eq!(messages[0].content, "Summarize in 1 sentences.");
+
+    Ok(())
+}
+
+#[test]
+fn test_invalid_prompt_variables() {
+    let template = summarize();
+
+    // missing required variable
+    assert!(template.render(&Map::new()).is_err());
+
+    // wrong type
+    assert!(template
+        .render(&vars(json!({ "text": "Hello", "sentences": "three" })))
+        .is_err());
+
+    // undeclared variable
+    assert!(template
+        .render(&vars(json!({ "text": "Hello", "language": "de" })))
+        .is_err());
+}
+
+#[test]
+fn test_prompt_overrides() -> Result<(), Error> {
+    let overrides = PromptOverrides {
+        max_tokens: Some(10),
+        ..Default::default()
+    };
+
+    let Query::Prompt {
+        max_tokens,
+        temperature,
+        stream,
+        ..
+    } = summarize().query(&vars(json!({ "text": "Hello" })), overrides)?
+    else {
+        panic!("Expected a prompt query");
+    };
+
+    assert_eq!(max_tokens, Some(10));
+    assert_eq!(temperature, Some(0.2));
+    assert!(stream);
+
+    Ok(())
+}
+
+#[test]
+fn test_prompt_library_persistence() -> Result<(), Error> {
+    let dir = std::env::temp_dir().join("test_prompt_library_persistence");
+    let path = dir.join("prompts.json");
+    let _ = std::fs::remove_dir_all(&dir);
+
+    let mut library = PromptLibrary::open(&path, vec![summarize()])?;
+    assert_eq!(library.list().len(), 1);
+
+    // configured prompts cannot be removed
+    assert!(library.remove("summarize").is_err());
+    assert!(library.remove("unknown").is_err());
+
+    let mut formal = summarize();
+    formal.name = "rewrite_formally".to_string();
+    formal.system = None;
+    formal.template = "Rewrite formally: {{ text }}".to_string();
+    library.save(formal)?;
+
+    // saved prompts replace configured prompts of the same name
+    let mut short = summarize();
+    short.template = "TL;DR: {{ text }}".to_string();
+    library.save(short)?;
+
+    let mut broken = summarize();
+    broken.name = "broken".to_string();
+    broken.template = "{{ text".to_string();
+    assert!(library.save(broken).is_err());
+
+    let library = PromptLibrary::open(&path, vec![summarize()])?;
+    let names: Vec<String> = library.list().into_iter().map(|t| t.name).collect();
+    assert_eq!(names, vec!["rewrite_formally", "summarize"]);
+    assert_eq!(library.get("summarize")?.template, "TL;DR: {{ text }}");
+
+    let mut library = PromptLibrary::open(&path, vec![summarize()])?;
+    library.remove("summarize")?;
+    assert_eq!(library.get("summarize")?.template, "Summarize: {{ text }}");
+
+    let _ = std::fs::remove_dir_all(&dir);
+
+    Ok(())
+}
+
+#[test]
+fn test_run_prompt_mock() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    let library = PromptLibrary::new(vec![summarize()]);
+    let query = library.query(
+        "summarize",
+        &vars(json!({ "text": "Hello, Prompts" })),
+        PromptOverrides::default(),
+    )?;
+
+    // The Mock runtime echoes the user message
+    assert_eq!(service.complete(query)?, "Summarize: Hello, Prompts");
+
+    Ok(())
+}
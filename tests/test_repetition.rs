@@ -0,0 +1,75 @@
+use tauri_plugin_llm::{LLMRuntimeConfig, Query, RepetitionAction, RepetitionGuard};
+
+#[test]
+fn test_detect_repeated_sentence() {
+    let guard = RepetitionGuard::default();
+    let sentence = [10, 11, 12, 13, 14, 15];
+    let tokens: Vec<u32> = [1, 2, 3]
+        .into_iter()
+        .chain(sentence.iter().copied().cycle().take(sentence.len() * 3))
+        .collect();
+
+    assert_eq!(guard.detect(&tokens), Some(sentence.len()));
+}
+
+#[test]
+fn test_detect_single_token_loop() {
+    let guard = RepetitionGuard::default();
+    let tokens = vec![7u32; 12];
+
+    assert_eq!(guard.detect(&tokens), Some(4));
+    assert_eq!(guard.detect(&tokens[..11]), None);
+}
+
+#[test]
+fn test_no_repetition() {
+    let guard = RepetitionGuard::default();
+    let tokens: Vec<u32> = (0..200).collect();
+
+    assert_eq!(guard.detect(&tokens), None);
+}
+
+#[test]
+fn test_sensitivity() {
+    let tokens: Vec<u32> = [1, 2, 3, 4, 5, 1, 2, 3, 4, 5].to_vec();
+
+    assert_eq!(RepetitionGuard::default().detect(&tokens), None);
+
+    let sensitive = RepetitionGuard {
+        repetitions: Some(2),
+        ..Default::default()
+    };
+    assert_eq!(sensitive.detect(&tokens), Some(5));
+
+    let long_spans_only = RepetitionGuard {
+        repetitions: Some(2),
+        min_period: Some(6),
+        ..Default::default()
+    };
+    assert_eq!(long_spans_only.detect(&tokens), None);
+}
+
+#[test]
+fn test_deserialize_repetition_guard() {
+    let json = serde_json::json!({
+        "name": "Qwen/Qwen3-4B-Instruct-2507",
+        "repetition_guard": { "repetitions": 4, "action": "penalize" }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let guard = config.repetition_guard.expect("Missing repetition guard");
+
+    assert_eq!(guard.repetitions, Some(4));
+    assert_eq!(guard.action, RepetitionAction::Penalize);
+
+    let end = serde_json::json!({ "usage": null, "finish_reason": "repetition" }).to_string();
+    let query: Query = serde_json::from_str(&end).expect("Failed to deserialize end");
+    assert!(matches!(
+        query,
+        Query::End {
+            finish_reason: Some(tauri_plugin_llm::FinishReason::Repetition),
+            ..
+        }
+    ));
+}
@@ -0,0 +1,117 @@
+mod common;
+
+use tauri_plugin_llm::{Error, LLMRuntimeConfig, LLMService, ModelKind, Query};
+use tauri_plugin_llm_macros::hf_test;
+
+fn documents(documents: &[&str]) -> Vec<String> {
+    documents.iter().map(|d| d.to_string()).collect()
+}
+
+#[test]
+fn test_deserialize_reranker_config() {
+    let json = serde_json::json!({
+        "name": "cross-encoder/ms-marco-MiniLM-L-6-v2",
+        "kind": "reranker"
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    assert_eq!(config.kind, Some(ModelKind::Reranker));
+
+    let config = LLMRuntimeConfig::from_raw(r#"{ "name": "Qwen/Qwen3-4B-Instruct-2507" }"#)
+        .expect("Failed to deserialize config");
+    assert_eq!(config.kind.unwrap_or_default(), ModelKind::Generation);
+}
+
+#[test]
+fn test_deserialize_rerank_query() {
+    let json = serde_json::json!({
+        "query": "capital of France",
+        "documents": ["Paris is the capital of France", "Berlin is in Germany"],
+        "top_n": 1
+    })
+    .to_string();
+
+    let query: Query = serde_json::from_str(&json).expect("Failed to deserialize rerank query");
+    assert!(matches!(
+        query,
+        Query::Rerank {
+            top_n: Some(1),
+            ..
+        }
+    ));
+}
+
+#[test]
+fn test_rerank_mock() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    let candidates = documents(&[
+        "Berlin is the capital of Germany",
+        "Paris is the capital of France",
+        "Bananas are yellow",
+    ]);
+
+    // The Mock runtime scores documents by the share of query words they contain
+    let results = service.rerank("What is the capital of France?", candidates.clone(), None)?;
+
+    let indices: Vec<usize> = results.iter().map(|r| r.index).collect();
+    assert_eq!(indices, vec![1, 0, 2]);
+    assert!(results.windows(2).all(|w| w[0].score >= w[1].score));
+
+    let results = service.rerank("What is the capital of France?", candidates, Some(1))?;
+    assert_eq!(results.len(), 1);
+    assert_eq!(results[0].index, 1);
+
+    Ok(())
+}
+
+#[hf_test(
+    model = "cross-encoder/ms-marco-MiniLM-L-6-v2",
+    cleanup = false,
+)]
+fn test_rerank_ms_marco_minilm(config: LLMRuntimeConfig) {
+    let mut config = config;
+    config.kind = Some(ModelKind::Reranker);
+
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("cross-encoder/ms-marco-MiniLM-L-6-v2".to_string())?;
+
+    let results = service.rerank(
+        "How many people live in Berlin?",
+        documents(&[
+            "New York City is famous for the Metropolitan Museum of Art.",
+            "Berlin has a population of 3,520,031 registered inhabitants.",
+        ]),
+        None,
+    )?;
+
+    assert_eq!(results.len(), 2);
+    assert_eq!(results[0].index, 1);
+    assert!(results.iter().all(|r| (0.0..=1.0).contains(&r.score)));
+
+    Ok(())
+}
+
+#[hf_test(
+    model = "Qwen/Qwen3-4B-Instruct-2507",
+    cleanup = false,
+)]
+fn test_rerank_generation_model(config: LLMRuntimeConfig) {
+    let name = config.name.clone();
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate(name)?;
+
+    // generation models reject reranking, but stay loaded for the next request
+    let error = service
+        .rerank("What is the capital of France?", documents(&["Paris"]), None)
+        .unwrap_err();
+    assert!(error.to_string().contains("reranker model"), "{error}");
+
+    let score = service.score("The capital of France is", " Paris")?;
+    assert!(!score.tokens.is_empty());
+
+    Ok(())
+}
@@ -0,0 +1,264 @@
+use tauri_plugin_llm::{
+    CacheHit, Error, FinishReason, GenerationSeed, LLMRuntimeConfig, LLMService, Query,
+    QueryMessage, ResponseCacheConfig,
+};
+
+/// Returns the number of responses of the Mock runtime replayed from the response cache.
+fn hits(service: &LLMService) -> Result<f64, Error> {
+    let metrics = service.metrics().gather()?;
+
+    Ok(metrics
+        .lines()
+        .find(|line| line.starts_with(r#"llm_response_cache_hits_total{model="Mock"}"#))
+        .and_then(|line| line.rsplit(' ').next())
+        .and_then(|value| value.parse().ok())
+        .unwrap_or_default())
+}
+
+fn prompt(content: &str, seed: Option<GenerationSeed>) -> Query {
+    Query::Prompt {
+        messages: vec![QueryMessage {
+            role: "user".to_string(),
+            content: content.to_string(),
+        }],
+        tools: vec![],
+        chunk_size: Some(4),
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+/// Returns the chunks streamed in response to `query`.
+fn chunks(service: &mut LLMService, query: Query) -> Result<Vec<String>, Error> {
+    let runtime = service.active_runtime()?;
+    runtime.send_stream(query)?;
+
+    let mut chunks = vec![];
+    loop {
+        match runtime.recv_stream()? {
+            Query::Chunk { data, .. } => chunks.push(String::from_utf8(data).unwrap()),
+            Query::End { .. } => return Ok(chunks),
+            _ => {}
+        }
+    }
+}
+
+fn cached_service(cache: ResponseCacheConfig) -> Result<LLMService, Error> {
+    let mut config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    config.response_cache = Some(cache);
+
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    Ok(service)
+}
+
+#[test]
+fn test_response_cache_mock() -> Result<(), Error> {
+    let mut service = cached_service(ResponseCacheConfig {
+        persist: false,
+        ..Default::default()
+    })?;
+    let fixed = || Some(GenerationSeed::Fixed(42));
+
+    // responses of random seeds are not cached
+    service.complete(prompt("Hello, Cache", None))?;
+    service.complete(prompt("Hello, Cache", None))?;
+    assert_eq!(hits(&service)?, 0.0);
+
+    assert_eq!(
+        service.complete(prompt("Hello, Cache", fixed()))?,
+        "Hello, Cache"
+    );
+    assert_eq!(
+        service.complete(prompt("Hello, Cache", fixed()))?,
+        "Hello, Cache"
+    );
+    assert_eq!(hits(&service)?, 1.0);
+
+    // the rendered prompt of the cached query is restored
+    let request = service.runtime().unwrap().last_request().unwrap();
+    assert_eq!(request.prompt.as_deref(), Some("user: Hello, Cache"));
+
+    // timestamp and chunk size do not affect the generated tokens
+    let mut query = prompt("Hello, Cache", fixed());
+    if let Query::Prompt {
+        timestamp,
+        chunk_size,
+        ..
+    } = &mut query
+    {
+        *timestamp = Some(1);
+        *chunk_size = Some(1);
+    }
+    assert_eq!(service.complete(query)?, "Hello, Cache");
+    assert_eq!(hits(&service)?, 2.0);
+
+    // other seeds or messages are generated
+    service.complete(prompt("Hello, Cache", Some(GenerationSeed::Fixed(7))))?;
+    service.complete(prompt("Hello, Other", fixed()))?;
+    assert_eq!(hits(&service)?, 2.0);
+
+    Ok(())
+}
+
+/// Streams `query`, cancelling it after the first chunk if `cancel` is set. Returns the number
+/// of streamed bytes, the finish reason and the cache hit.
+fn stream(
+    service: &mut LLMService,
+    query: Query,
+    cancel: bool,
+) -> Result<(usize, Option<FinishReason>, Option<CacheHit>), Error> {
+    let runtime = service.active_runtime()?;
+    runtime.send_stream(query)?;
+
+    let mut bytes = 0;
+    loop {
+        match runtime.recv_stream()? {
+            Query::Chunk { data, .. } => {
+                if cancel && bytes == 0 {
+                    runtime.cancel();
+                }
+                bytes += data.len();
+            }
+            Query::End {
+                finish_reason,
+                cache_hit,
+                ..
+            } => return Ok((bytes, finish_reason, cache_hit)),
+            _ => {}
+        }
+    }
+}
+
+#[test]
+fn test_response_cache_skips_cancelled() -> Result<(), Error> {
+    let mut service = cached_service(ResponseCacheConfig {
+        persist: false,
+        ..Default::default()
+    })?;
+
+    // the Mock runtime echoes the message byte by byte, long enough to be cancelled
+    let content = "Hello, Cancel ".repeat(20_000);
+    let query = || {
+        let mut query = prompt(&content, Some(GenerationSeed::Fixed(42)));
+        if let Query::Prompt { chunk_size, .. } = &mut query {
+            *chunk_size = Some(1);
+        }
+        query
+    };
+
+    let (bytes, finish_reason, _) = stream(&mut service, query(), true)?;
+    assert_eq!(finish_reason, Some(FinishReason::Cancelled));
+    assert!(bytes < content.len());
+
+    // the truncated response is not replayed
+    let (bytes, finish_reason, cache_hit) = stream(&mut service, query(), false)?;
+    assert_eq!(finish_reason, Some(FinishReason::Stop));
+    assert_eq!(bytes, content.len());
+    assert_eq!(cache_hit, None);
+    assert_eq!(hits(&service)?, 0.0);
+
+    // the complete response is
+    let (bytes, _, cache_hit) = stream(&mut service, query(), false)?;
+    assert_eq!(bytes, content.len());
+    assert_eq!(cache_hit, Some(CacheHit::Exact));
+
+    Ok(())
+}
+
+#[test]
+fn test_response_cache_rechunk() -> Result<(), Error> {
+    let mut service = cached_service(ResponseCacheConfig {
+        persist: false,
+        ..Default::default()
+    })?;
+    let query = |size| {
+        let mut query = prompt("Hello, Chunks", Some(GenerationSeed::Fixed(42)));
+        if let Query::Prompt { chunk_size, .. } = &mut query {
+            *chunk_size = Some(size);
+        }
+        query
+    };
+
+    assert_eq!(
+        chunks(&mut service, query(4))?,
+        vec!["Hell", "o, C", "hunk", "s"]
+    );
+
+    // replayed responses are chunked by the chunk size of the new query
+    assert_eq!(
+        chunks(&mut service, query(6))?,
+        vec!["Hello,", " Chunk", "s"]
+    );
+    assert_eq!(hits(&service)?, 1.0);
+
+    Ok(())
+}
+
+#[test]
+fn test_response_cache_eviction() -> Result<(), Error> {
+    let seed = || Some(GenerationSeed::Fixed(42));
+
+    let mut service = cached_service(ResponseCacheConfig {
+        max_entries: 1,
+        persist: false,
+        ..Default::default()
+    })?;
+
+    service.complete(prompt("First", seed()))?;
+    service.complete(prompt("Second", seed()))?;
+    service.complete(prompt("First", seed()))?;
+    assert_eq!(hits(&service)?, 0.0);
+
+    // expired responses are generated again
+    let mut service = cached_service(ResponseCacheConfig {
+        ttl: Some(0),
+        persist: false,
+        ..Default::default()
+    })?;
+
+    service.complete(prompt("First", seed()))?;
+    service.complete(prompt("First", seed()))?;
+    assert_eq!(hits(&service)?, 0.0);
+
+    Ok(())
+}
+
+#[test]
+fn test_response_cache_persistence() -> Result<(), Error> {
+    let dir = std::env::temp_dir().join("test_response_cache_persistence");
+    let _ = std::fs::remove_dir_all(&dir);
+
+    let cache = ResponseCacheConfig {
+        cache_dir: Some(dir.clone()),
+        ..Default::default()
+    };
+    let query = || prompt("Hello, Restart", Some(GenerationSeed::Fixed(42)));
+
+    let mut service = cached_service(cache.clone())?;
+    service.complete(query())?;
+    assert!(dir.join("Mock.json").exists());
+    drop(service);
+
+    let mut service = cached_service(cache)?;
+    assert_eq!(service.complete(query())?, "Hello, Restart");
+    assert_eq!(hits(&service)?, 1.0);
+
+    let _ = std::fs::remove_dir_all(&dir);
+
+    Ok(())
+}
@@ -3,7 +3,8 @@ mod common;
 use proptest::prelude::*;
 use std::vec;
 use tauri_plugin_llm::{
-    runtime::LLMRuntime, Error, LLMRuntimeConfig, LLMService, Query, QueryMessage,
+    runtime::LLMRuntime, CompletionInput, Error, FinishReason, LLMRuntimeConfig, LLMService,
+    Query, QueryMessage,
 };
 use tauri_plugin_llm_macros::hf_test;
 
@@ -33,11 +34,15 @@ fn test_runtime_local_qwen3_safetensors(config: LLMRuntimeConfig) {
         top_k: None,
         top_p: None,
         think: false,
+        continue_final_message: false,
         stream: true,
         model: None,
         penalty: None,
         seed: None,
         sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
         chunk_size: None,
         timestamp: None,
     });
@@ -92,11 +97,15 @@ fn test_runtime_llama_3_2_3b_instruct(config: LLMRuntimeConfig) {
         top_k: None,
         top_p: None,
         think: false,
+        continue_final_message: false,
         stream: true,
         model: None,
         penalty: Some(1.5),
         seed: None,
         sampling_config: Some(tauri_plugin_llm::SamplingConfig::ArgMax),
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
         chunk_size: None,
         timestamp: None,
     });
@@ -144,11 +153,15 @@ async fn test_runtime_mock() -> Result<(), Error> {
         top_k: None,
         top_p: None,
         think: false,
+        continue_final_message: false,
         stream: true,
         model: None,
         penalty: None,
         seed: None,
         sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
         chunk_size: None,
         timestamp: None,
     }) {
@@ -179,11 +192,15 @@ async fn test_runtime_mock_streaming() -> Result<(), Error> {
             top_k: None,
             top_p: None,
             think: false,
+            continue_final_message: false,
             stream: true,
             model: None,
             penalty: None,
             seed: None,
             sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
             chunk_size: Some(25),
             timestamp: None,
         },
@@ -198,11 +215,15 @@ async fn test_runtime_mock_streaming() -> Result<(), Error> {
             top_k: None,
             top_p: None,
             think: false,
+            continue_final_message: false,
             stream: true,
             model: None,
             penalty: None,
             seed: None,
             sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
             chunk_size: Some(25),
             timestamp: None,
         },
@@ -230,6 +251,206 @@ async fn test_runtime_mock_streaming() -> Result<(), Error> {
     Ok(())
 }
 
+#[tokio::test]
+async fn test_runtime_mock_completion() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut runtime = LLMRuntime::from_config(config)?;
+
+    runtime.run_stream()?;
+
+    let inputs = vec![
+        (
+            CompletionInput::Prompt("Once upon a time".to_string()),
+            "Once upon a time",
+        ),
+        (CompletionInput::TokenIds(vec![1, 22, 333]), "1 22 333"),
+    ];
+
+    for (input, expected) in inputs {
+        runtime.send_stream(Query::Completion {
+            input,
+            chunk_size: Some(4),
+            timestamp: None,
+            max_tokens: None,
+            temperature: None,
+            top_k: None,
+            top_p: None,
+            stream: true,
+            model: None,
+            penalty: None,
+            seed: None,
+            sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
+        })?;
+
+        let mut result = vec![];
+
+        while let Ok(message) = runtime.recv_stream() {
+            match message {
+                Query::Chunk { data, .. } => result.extend(data),
+                Query::End { usage, .. } => {
+                    let usage = usage.expect("No token usage generated");
+                    assert_eq!(usage.completion_tokens, expected.len());
+                    break;
+                }
+                other => panic!("Unexpected message: {other:?}"),
+            }
+        }
+
+        assert_eq!(String::from_utf8(result).unwrap(), expected);
+    }
+
+    Ok(())
+}
+
+#[tokio::test]
+async fn test_runtime_mock_infill() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut runtime = LLMRuntime::from_config(config)?;
+
+    runtime.run_stream()?;
+
+    runtime.send_stream(Query::Infill {
+        prefix: "fn add(a: i32, b: i32) -> i32 {".to_string(),
+        suffix: "}".to_string(),
+        chunk_size: Some(8),
+        timestamp: None,
+        max_tokens: None,
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    })?;
+
+    let mut chunks = 0;
+
+    while let Ok(message) = runtime.recv_stream() {
+        match message {
+            Query::Chunk { .. } => chunks += 1,
+            Query::End {
+                usage,
+                finish_reason,
+                ..
+            } => {
+                assert!(usage.is_some());
+                assert_eq!(finish_reason, Some(FinishReason::Stop));
+                break;
+            }
+            other => panic!("Unexpected message: {other:?}"),
+        }
+    }
+
+    assert!(chunks > 0);
+
+    Ok(())
+}
+
+#[test]
+fn test_runtime_mock_score() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    let likely = service.score("The cat sat on the mat", " the cat")?;
+    let unlikely = service.score("The cat sat on the mat", " xyz")?;
+
+    assert_eq!(likely.tokens.len(), " the cat".len());
+    assert!(likely.is_greedy);
+    assert!(!unlikely.is_greedy);
+    assert!(likely.log_likelihood > unlikely.log_likelihood);
+    assert!(likely.perplexity < unlikely.perplexity);
+
+    let sum: f32 = likely.tokens.iter().map(|t| t.logprob).sum();
+    assert!((likely.log_likelihood - sum).abs() < 1e-4);
+
+    // a rejected score keeps the model loaded for the next request
+    assert!(service.score("The cat sat on the mat", "").is_err());
+    let rescored = service.score("The cat sat on the mat", " the cat")?;
+    assert_eq!(rescored.log_likelihood, likely.log_likelihood);
+    assert_eq!(service.complete(user_prompt("Hello, Mock"))?, "Hello, Mock");
+
+    Ok(())
+}
+
+/// Returns a short greedy prompt of a single user message.
+fn user_prompt(content: &str) -> Query {
+    Query::Prompt {
+        messages: vec![QueryMessage {
+            role: "user".to_string(),
+            content: content.to_string(),
+        }],
+        tools: vec![],
+        max_tokens: Some(8),
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+        chunk_size: None,
+        timestamp: None,
+    }
+}
+
+#[hf_test(
+    model = "Qwen/Qwen3-4B-Instruct-2507",
+    cleanup = false,
+)]
+fn test_runtime_qwen3_score(config: LLMRuntimeConfig) {
+    let mut runtime = LLMRuntime::from_config(config)?;
+
+    runtime.run_stream()?;
+
+    let likely = runtime.score("The capital of France is", " Paris")?;
+    let unlikely = runtime.score("The capital of France is", " Banana")?;
+
+    assert!(!likely.tokens.is_empty());
+    assert!(likely.tokens.iter().all(|t| t.logprob <= 0.0));
+    assert!(likely.log_likelihood > unlikely.log_likelihood);
+
+    Ok(())
+}
+
+#[hf_test(
+    model = "Qwen/Qwen3-4B-Instruct-2507",
+    cleanup = false,
+)]
+fn test_runtime_qwen3_rejected_score(config: LLMRuntimeConfig) {
+    let mut runtime = LLMRuntime::from_config(config)?;
+
+    runtime.run_stream()?;
+
+    // the context exceeds the context length of 262144 tokens
+    let context = " word".repeat(300_000);
+    let error = runtime.score(&context, " Paris").unwrap_err();
+    assert!(
+        error.to_string().contains("exceeds the context length"),
+        "{error}"
+    );
+
+    // the worker keeps running with the model loaded
+    assert!(!runtime.complete(user_prompt("Say hello"))?.is_empty());
+    assert!(runtime.score("The capital of France is", " Paris").is_ok());
+
+    Ok(())
+}
+
 #[hf_test(
     model = "Qwen/Qwen3-4B-Instruct-2507",
     cleanup = false,
@@ -251,11 +472,15 @@ fn test_runtime_qwen3_streaming(config: LLMRuntimeConfig) {
             top_k: None,
             top_p: None,
             think: false,
+            continue_final_message: false,
             stream: true,
             model: None,
             penalty: None,
             seed: None,
             sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
             chunk_size: Some(25),
             timestamp: None,
         },
@@ -270,11 +495,15 @@ fn test_runtime_qwen3_streaming(config: LLMRuntimeConfig) {
             top_k: None,
             top_p: None,
             think: false,
+            continue_final_message: false,
             stream: true,
             model: None,
             penalty: None,
             seed: None,
             sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
             chunk_size: Some(25),
             timestamp: None,
         },
@@ -328,11 +557,15 @@ fn test_switching_runtimes() -> Result<(), Error> {
             top_k: None,
             top_p: None,
             think: false,
+            continue_final_message: false,
             stream: true,
             model: None,
             penalty: None,
             seed: None,
             sampling_config: None,
+            add_special_tokens: None,
+            skip_special_tokens: None,
+            flush: None,
             chunk_size: Some(25),
             timestamp: None,
         };
@@ -399,11 +632,15 @@ proptest! {
                 top_k: None,
                 top_p: None,
                 think: false,
+                continue_final_message: false,
                 stream: true,
                 model: None,
                 penalty: None,
                 seed: None,
                 sampling_config: None,
+                add_special_tokens: None,
+                skip_special_tokens: None,
+                flush: None,
                 chunk_size: None,
                 timestamp: None,
             })
@@ -412,7 +649,7 @@ proptest! {
         while let Ok(message) = runtime.recv_stream() {
             match message {
                 Query::Chunk { .. } => {}
-                Query::End { usage } => {
+                Query::End { usage, .. } => {
 
                     let usage = usage.expect("No token usage generated");
                     prop_assert_eq!(usage.prompt_tokens, expected_prompt_tokens);
@@ -105,11 +105,15 @@ fn test_runtime_toolcall(
         top_k: None,
         top_p: None,
         think: false,
+        continue_final_message: false,
         stream: true,
         model: None,
         penalty: None,
         seed: Some(GenerationSeed::Fixed(42)),
         sampling_config: Some(SamplingConfig::ArgMax),
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
         chunk_size: None,
         timestamp: None,
     });
@@ -0,0 +1,221 @@
+use tauri_plugin_llm::{
+    cosine_similarity, CacheHit, Error, FinishReason, LLMRuntimeConfig, LLMService, Query,
+    QueryMessage, SemanticCacheConfig,
+};
+
+fn message(role: &str, content: &str) -> QueryMessage {
+    QueryMessage {
+        role: role.to_string(),
+        content: content.to_string(),
+    }
+}
+
+fn prompt(messages: Vec<QueryMessage>) -> Query {
+    Query::Prompt {
+        messages,
+        tools: vec![],
+        chunk_size: Some(4),
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: Some(0.7),
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+fn question(content: &str) -> Query {
+    prompt(vec![message("user", content)])
+}
+
+fn cached_service(cache: SemanticCacheConfig) -> Result<LLMService, Error> {
+    let mut config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    config.semantic_cache = Some(cache);
+    let embedding = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock_embedding.json")?;
+
+    let mut service = LLMService::from_runtime_configs(&[config, embedding]);
+    service.activate("Mock".to_string())?;
+
+    Ok(service)
+}
+
+fn semantic_cache() -> SemanticCacheConfig {
+    SemanticCacheConfig {
+        model: "Mock-Embedding".to_string(),
+        threshold: 0.9,
+        max_entries: 16,
+        ttl: None,
+    }
+}
+
+/// Sends `query` and returns the output along with the cache hit of its end.
+fn stream(service: &mut LLMService, query: Query) -> Result<(String, Option<CacheHit>), Error> {
+    let runtime = service.runtime().unwrap();
+    runtime.send_stream(query)?;
+
+    let mut output = vec![];
+    loop {
+        match runtime.recv_stream()? {
+            Query::Chunk { data, .. } => output.extend(data),
+            Query::End { cache_hit, .. } => {
+                return Ok((String::from_utf8_lossy(&output).into_owned(), cache_hit))
+            }
+            Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+            _ => {}
+        }
+    }
+}
+
+/// Sends `query`, cancels it after the first chunk and returns the finish reason of its end.
+fn cancel(service: &mut LLMService, query: Query) -> Result<Option<FinishReason>, Error> {
+    let runtime = service.runtime().unwrap();
+    runtime.send_stream(query)?;
+
+    loop {
+        match runtime.recv_stream()? {
+            Query::Chunk { .. } => runtime.cancel(),
+            Query::End { finish_reason, .. } => return Ok(finish_reason),
+            Query::Status { msg } => return Err(Error::ExecutionError(msg)),
+            _ => {}
+        }
+    }
+}
+
+#[test]
+fn test_embed_mock() -> Result<(), Error> {
+    let mut service = LLMService::from_path("tests/fixtures/test_runtime_mock_embedding.json")?;
+    service.activate("Mock-Embedding".to_string())?;
+
+    let embeddings = service.embed(vec![
+        "What are your opening hours?".to_string(),
+        "what are your opening hours".to_string(),
+        "How do I reset my password?".to_string(),
+    ])?;
+    assert_eq!(embeddings.len(), 3);
+
+    let norm: f32 = embeddings[0].iter().map(|v| v * v).sum::<f32>().sqrt();
+    assert!((norm - 1.0).abs() < 1e-4);
+
+    assert!(cosine_similarity(&embeddings[0], &embeddings[1]) > 0.99);
+    assert!(cosine_similarity(&embeddings[0], &embeddings[2]) < 0.5);
+
+    Ok(())
+}
+
+#[test]
+fn test_semantic_cache_mock() -> Result<(), Error> {
+    let mut service = cached_service(semantic_cache())?;
+
+    let (output, cache_hit) = stream(&mut service, question("What are your opening hours?"))?;
+    assert_eq!(output, "What are your opening hours?");
+    assert_eq!(cache_hit, None);
+
+    // paraphrases are answered with the cached response
+    let (output, cache_hit) = stream(&mut service, question("what are your opening hours"))?;
+    assert_eq!(output, "What are your opening hours?");
+    assert!(matches!(cache_hit, Some(CacheHit::Semantic { similarity }) if similarity > 0.99));
+
+    let (output, cache_hit) = stream(&mut service, question("What are your opening hours today?"))?;
+    assert_eq!(output, "What are your opening hours?");
+    assert!(matches!(cache_hit, Some(CacheHit::Semantic { .. })));
+
+    // dissimilar prompts are generated
+    let (output, cache_hit) = stream(&mut service, question("How do I reset my password?"))?;
+    assert_eq!(output, "How do I reset my password?");
+    assert_eq!(cache_hit, None);
+
+    Ok(())
+}
+
+#[test]
+fn test_semantic_cache_scope() -> Result<(), Error> {
+    let mut service = cached_service(semantic_cache())?;
+
+    let support = |content: &str| {
+        prompt(vec![
+            message("system", "You are a support agent."),
+            message("user", content),
+        ])
+    };
+
+    stream(&mut service, support("What are your opening hours?"))?;
+
+    // the same question with another system prompt is generated
+    let (_, cache_hit) = stream(&mut service, question("What are your opening hours?"))?;
+    assert_eq!(cache_hit, None);
+
+    let (_, cache_hit) = stream(&mut service, support("what are your opening hours"))?;
+    assert!(matches!(cache_hit, Some(CacheHit::Semantic { .. })));
+
+    // the same question with other generation options is generated
+    let mut short = support("what are your opening hours");
+    if let Query::Prompt {
+        max_tokens, think, ..
+    } = &mut short
+    {
+        *max_tokens = Some(10);
+        *think = true;
+    }
+    let (_, cache_hit) = stream(&mut service, short)?;
+    assert_eq!(cache_hit, None);
+
+    // the chunk size does not affect the response
+    let mut chunked = support("what are your opening hours");
+    if let Query::Prompt { chunk_size, .. } = &mut chunked {
+        *chunk_size = Some(1);
+    }
+    let (_, cache_hit) = stream(&mut service, chunked)?;
+    assert!(matches!(cache_hit, Some(CacheHit::Semantic { .. })));
+
+    Ok(())
+}
+
+#[test]
+fn test_semantic_cache_skips_cancelled() -> Result<(), Error> {
+    let mut service = cached_service(semantic_cache())?;
+
+    // the Mock runtime echoes the message byte by byte, long enough to be cancelled
+    let mut long = question(&"What are your opening hours? ".repeat(20_000));
+    if let Query::Prompt { chunk_size, .. } = &mut long {
+        *chunk_size = Some(1);
+    }
+    assert_eq!(cancel(&mut service, long)?, Some(FinishReason::Cancelled));
+
+    // the truncated response is not served to paraphrases
+    let (output, cache_hit) = stream(&mut service, question("what are your opening hours"))?;
+    assert_eq!(output, "what are your opening hours");
+    assert_eq!(cache_hit, None);
+
+    let (output, cache_hit) = stream(&mut service, question("What are your opening hours?"))?;
+    assert_eq!(output, "what are your opening hours");
+    assert!(matches!(cache_hit, Some(CacheHit::Semantic { .. })));
+
+    Ok(())
+}
+
+#[test]
+fn test_semantic_cache_requires_embedding_model() -> Result<(), Error> {
+    // the embedding model must be configured with the embedding kind
+    let result = cached_service(SemanticCacheConfig {
+        model: "Mock".to_string(),
+        ..semantic_cache()
+    });
+    assert!(result.is_err());
+
+    let result = cached_service(SemanticCacheConfig {
+        model: "Unknown".to_string(),
+        ..semantic_cache()
+    });
+    assert!(result.is_err());
+
+    Ok(())
+}
@@ -0,0 +1,105 @@
+use tauri_plugin_llm::{
+    Error, LLMRuntimeConfig, LLMService, SpecialTokenPolicy, SpecialTokens, TokenizerConfig,
+};
+
+fn added_token(content: &str, special: bool) -> serde_json::Value {
+    serde_json::json!({
+        "content": content,
+        "single_word": false,
+        "lstrip": false,
+        "rstrip": false,
+        "normalized": false,
+        "special": special
+    })
+}
+
+#[test]
+fn test_special_tokens_from_tokenizer_config() {
+    let config: TokenizerConfig = serde_json::from_value(serde_json::json!({
+        "clean_up_tokenization_spaces": false,
+        "bos_token": null,
+        "eos_token": "<|im_end|>",
+        "pad_token": "<|endoftext|>",
+        "added_tokens_decoder": {
+            "151645": added_token("<|im_end|>", true),
+            "151643": added_token("<|endoftext|>", true),
+            "151657": added_token("<tool_call>", false)
+        }
+    }))
+    .expect("Failed to deserialize TokenizerConfig");
+
+    let tokens = SpecialTokens::new(&config, None);
+
+    assert!(tokens.bos_token.is_none());
+
+    let eos = tokens.eos_token.expect("Missing EOS token");
+    assert_eq!(eos.id, Some(151645));
+    assert_eq!(eos.content, "<|im_end|>");
+
+    let pad = tokens.pad_token.expect("Missing PAD token");
+    assert_eq!(pad.id, Some(151643));
+
+    let ids: Vec<_> = tokens.added_tokens.iter().map(|t| t.id).collect();
+    assert_eq!(ids, vec![Some(151643), Some(151645), Some(151657)]);
+    assert!(!tokens.added_tokens[2].special);
+}
+
+#[test]
+fn test_special_tokens_as_added_token_objects() {
+    let config: TokenizerConfig = serde_json::from_value(serde_json::json!({
+        "clean_up_tokenization_spaces": false,
+        "bos_token": added_token("<s>", true),
+        "eos_token": "</s>",
+        "pad_token": added_token("<unk>", true),
+        "added_tokens_decoder": {
+            "0": added_token("<unk>", true),
+            "1": added_token("<s>", true),
+            "2": added_token("</s>", true)
+        }
+    }))
+    .expect("Failed to deserialize TokenizerConfig");
+
+    assert_eq!(config.bos_token.as_deref(), Some("<s>"));
+    assert_eq!(config.eos_token.as_deref(), Some("</s>"));
+
+    let tokens = SpecialTokens::new(&config, None);
+    let pad = tokens.pad_token.expect("Missing PAD token");
+    assert_eq!(pad.id, Some(0));
+    assert_eq!(pad.content, "<unk>");
+}
+
+#[test]
+fn test_special_tokens_of_active_mock_runtime() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+
+    assert!(matches!(
+        service.special_tokens(None),
+        Err(Error::MissingActiveRuntime)
+    ));
+
+    service.activate("Mock".to_string())?;
+
+    let tokens = service.special_tokens(None)?;
+    assert!(tokens.eos_token.is_none());
+    assert!(tokens.added_tokens.is_empty());
+
+    assert!(service.special_tokens(Some("Unknown")).is_err());
+
+    Ok(())
+}
+
+#[test]
+fn test_deserialize_special_token_policy() {
+    let json = serde_json::json!({
+        "name": "meta-llama/Llama-3.2-3B-Instruct",
+        "special_tokens": { "add_special_tokens": false, "skip_special_tokens": false }
+    })
+    .to_string();
+
+    let config = LLMRuntimeConfig::from_raw(json).expect("Failed to deserialize config");
+    let policy: SpecialTokenPolicy = config.special_tokens.expect("Missing policy");
+
+    assert_eq!(policy.add_special_tokens, Some(false));
+    assert_eq!(policy.skip_special_tokens, Some(false));
+}
@@ -0,0 +1,128 @@
+use schemars::JsonSchema;
+use serde::Deserialize;
+use tauri_plugin_llm::{
+    json_schema, Error, LLMRuntimeConfig, LLMService, Query, QueryMessage,
+    DEFAULT_STRUCTURED_RETRIES,
+};
+
+#[derive(Deserialize, JsonSchema, Debug, PartialEq)]
+struct Person {
+    name: String,
+    age: u32,
+}
+
+fn prompt(content: &str) -> Query {
+    Query::Prompt {
+        messages: vec![QueryMessage {
+            role: "user".to_string(),
+            content: content.to_string(),
+        }],
+        tools: vec![],
+        chunk_size: Some(4),
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+fn mock_service() -> Result<LLMService, Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+
+    Ok(service)
+}
+
+/// Rating whose schema is stricter than its deserialization
+#[derive(Deserialize, JsonSchema, Debug, PartialEq)]
+struct Rating {
+    #[schemars(range(min = 1, max = 5))]
+    stars: u8,
+}
+
+#[test]
+fn test_json_schema_of_type() {
+    let schema = json_schema::<Person>();
+
+    assert!(schema.contains("\"name\""));
+    assert!(schema.contains("\"age\""));
+}
+
+#[test]
+fn test_complete_structured() -> Result<(), Error> {
+    let mut service = mock_service()?;
+
+    // The Mock runtime echoes the user message
+    let person: Person =
+        service.complete_structured(prompt(r#"```json {"name": "Ada", "age": 36} ```"#))?;
+
+    assert_eq!(
+        person,
+        Person {
+            name: "Ada".to_string(),
+            age: 36
+        }
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_complete_structured_invalid_output() -> Result<(), Error> {
+    let mut service = mock_service()?;
+
+    let result = service.complete_structured::<Person>(prompt(r#"{"name": "Ada"}"#));
+
+    match result {
+        Err(Error::StructuredOutput { raw, attempts, .. }) => {
+            assert_eq!(raw, r#"{"name": "Ada"}"#);
+            assert_eq!(attempts, DEFAULT_STRUCTURED_RETRIES + 1);
+        }
+        other => panic!("Expected structured output error, got {other:?}"),
+    }
+
+    Ok(())
+}
+
+#[test]
+fn test_complete_structured_validates_schema() -> Result<(), Error> {
+    let mut service = mock_service()?;
+
+    let rating: Rating = service.complete_structured(prompt(r#"{"stars": 4}"#))?;
+    assert_eq!(rating, Rating { stars: 4 });
+
+    match service.complete_structured::<Rating>(prompt(r#"{"stars": 9}"#)) {
+        Err(Error::StructuredOutput { message, .. }) => {
+            assert!(message.contains("does not match the schema"), "{message}");
+        }
+        other => panic!("Expected structured output error, got {other:?}"),
+    }
+
+    Ok(())
+}
+
+#[test]
+fn test_complete_structured_requires_prompt() -> Result<(), Error> {
+    let mut service = mock_service()?;
+
+    let query = serde_json::from_value(serde_json::json!({ "prompt": "{}" }))?;
+
+    assert!(matches!(
+        service.complete_structured::<Person>(query),
+        Err(Error::UnexpectedMessage)
+    ));
+
+    Ok(())
+}
@@ -0,0 +1,174 @@
+use serde_json::{json, Map, Value};
+use tauri_plugin_llm::{
+    DefaultSystemPrompt, Error, LLMRuntimeConfig, LLMService, Persona, Query, QueryMessage,
+    SystemPromptPolicy,
+};
+
+fn message(role: &str, content: &str) -> QueryMessage {
+    QueryMessage {
+        role: role.to_string(),
+        content: content.to_string(),
+    }
+}
+
+fn roles(messages: &[QueryMessage]) -> Vec<&str> {
+    messages.iter().map(|m| m.role.as_str()).collect()
+}
+
+fn system_prompt(policy: SystemPromptPolicy) -> DefaultSystemPrompt {
+    DefaultSystemPrompt::from_config(&LLMRuntimeConfig {
+        name: "Qwen".to_string(),
+        system_prompt: Some("Default".to_string()),
+        system_prompt_policy: Some(policy),
+        ..Default::default()
+    })
+    .unwrap()
+}
+
+#[test]
+fn test_no_system_prompt() {
+    assert!(DefaultSystemPrompt::from_config(&LLMRuntimeConfig::default()).is_none());
+}
+
+#[test]
+fn test_system_prompt_policies() -> Result<(), Error> {
+    let vars = Map::new();
+    let without_system = vec![message("user", "Hello")];
+    let with_system = vec![
+        message("system", "Custom"),
+        message("user", "Hello"),
+        message("system", "Other"),
+    ];
+
+    for policy in [
+        SystemPromptPolicy::IfMissing,
+        SystemPromptPolicy::Prepend,
+        SystemPromptPolicy::Append,
+        SystemPromptPolicy::Replace,
+    ] {
+        let result = system_prompt(policy).apply(without_system.clone(), &vars)?;
+        assert_eq!(roles(&result), vec!["system", "user"], "{policy:?}");
+        assert_eq!(result[0].content, "Default", "{policy:?}");
+    }
+
+    let result = system_prompt(SystemPromptPolicy::IfMissing).apply(with_system.clone(), &vars)?;
+    assert_eq!(roles(&result), vec!["system", "user", "system"]);
+    assert_eq!(result[0].content, "Custom");
+
+    let result = system_prompt(SystemPromptPolicy::Prepend).apply(with_system.clone(), &vars)?;
+    assert_eq!(roles(&result), vec!["system", "user", "system"]);
+    assert_eq!(result[0].content, "Default\n\nCustom");
+
+    let result = system_prompt(SystemPromptPolicy::Append).apply(with_system.clone(), &vars)?;
+    assert_eq!(result[0].content, "Custom\n\nDefault");
+    assert_eq!(result[2].content, "Other");
+
+    let result = system_prompt(SystemPromptPolicy::Replace).apply(with_system, &vars)?;
+    assert_eq!(roles(&result), vec!["system", "user"]);
+    assert_eq!(result[0].content, "Default");
+
+    Ok(())
+}
+
+#[test]
+fn test_system_prompt_policy_serde() -> Result<(), Error> {
+    let policy: SystemPromptPolicy = serde_json::from_value(json!("if_missing"))?;
+    assert_eq!(policy, SystemPromptPolicy::IfMissing);
+    assert_eq!(
+        serde_json::to_value(SystemPromptPolicy::Replace)?,
+        json!("replace")
+    );
+
+    Ok(())
+}
+
+#[test]
+fn test_system_prompt_variables() -> Result<(), Error> {
+    let config = LLMRuntimeConfig {
+        name: "Qwen".to_string(),
+        system_prompt: Some("{{ app_name }} uses {{ model }} on {{ date }}.".to_string()),
+        persona: Some(Persona {
+            name: "Ada".to_string(),
+            description: Some("{{ persona }} answers concisely.".to_string()),
+        }),
+        ..Default::default()
+    };
+
+    let mut vars = Map::new();
+    vars.insert("app_name".to_string(), Value::from("Notes"));
+
+    let prompt = DefaultSystemPrompt::from_config(&config)
+        .unwrap()
+        .render(&vars)?;
+    let parts: Vec<&str> = prompt.split("\n\n").collect();
+
+    assert_eq!(parts.len(), 3);
+    assert!(parts[0].starts_with("Notes uses Qwen on "));
+    assert_eq!(parts[0].len(), "Notes uses Qwen on 2025-01-01.".len());
+    assert_eq!(parts[1], "You are Ada.");
+    assert_eq!(parts[2], "Ada answers concisely.");
+
+    // variables of the application take precedence over built-in variables
+    vars.insert("date".to_string(), json!("tomorrow"));
+    let prompt = DefaultSystemPrompt::from_config(&config)
+        .unwrap()
+        .render(&vars)?;
+    assert!(prompt.starts_with("Notes uses Qwen on tomorrow."));
+
+    Ok(())
+}
+
+fn prompt(content: &str) -> Query {
+    Query::Prompt {
+        messages: vec![message("user", content)],
+        tools: vec![],
+        chunk_size: None,
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+#[test]
+fn test_system_prompt_mock() -> Result<(), Error> {
+    let mut config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    config.system_prompt = Some("Hello from {{ app_name }}".to_string());
+
+    let mut service = LLMService::from_runtime_configs(&[config.clone()]);
+    service.set_prompt_variable("app_name", "Notes");
+    service.activate("Mock".to_string())?;
+
+    // The Mock runtime echoes the user message
+    assert_eq!(
+        service.complete(prompt("Hello, Persona"))?,
+        "Hello, Persona"
+    );
+
+    // The system prompt is inserted into the query sent to the model
+    let request = service.active_runtime()?.last_request().unwrap();
+    let Query::Prompt { messages, .. } = request.query else {
+        panic!("Expected a prompt query");
+    };
+    assert_eq!(roles(&messages), vec!["system", "user"]);
+    assert_eq!(messages[0].content, "Hello from Notes");
+
+    // Invalid templates are reported before the query is sent
+    config.system_prompt = Some("{{ app_name".to_string());
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.activate("Mock".to_string())?;
+    assert!(service.complete(prompt("Hello, Persona")).is_err());
+
+    Ok(())
+}
@@ -1,5 +1,5 @@
 use std::fs::File;
-use tauri_plugin_llm::{TemplateProcessor, TokenizerConfig};
+use tauri_plugin_llm::{Query, QueryMessage, TemplateProcessor, TokenizerConfig};
 
 #[test]
 fn test_raw_jinja_template() {
@@ -19,3 +19,69 @@ fn test_raw_jinja_template() {
 
     assert!(result.is_ok(), "{:?}", result);
 }
+
+fn continue_query(messages: Vec<QueryMessage>) -> Query {
+    Query::Prompt {
+        messages,
+        tools: vec![],
+        chunk_size: None,
+        timestamp: None,
+        max_tokens: None,
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: true,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+#[test]
+fn test_continue_final_message() {
+    let template = std::fs::read_to_string("tests/fixtures/test_raw.jinja")
+        .expect("Failed to read template file");
+    let tmpl_proc = TemplateProcessor::with_jinja_template();
+
+    let query = continue_query(vec![
+        QueryMessage {
+            role: "user".to_string(),
+            content: "Return a JSON object with a greeting".to_string(),
+        },
+        QueryMessage {
+            role: "assistant".to_string(),
+            content: "{\"greeting\": ".to_string(),
+        },
+    ]);
+
+    let rendered = query
+        .apply_template_continue_final_message(&template, &tmpl_proc)
+        .expect("Failed to render template");
+
+    assert!(
+        rendered.ends_with("<|im_start|>assistant\n{\"greeting\":"),
+        "{rendered}"
+    );
+}
+
+#[test]
+fn test_continue_final_message_requires_assistant_message() {
+    let template = std::fs::read_to_string("tests/fixtures/test_raw.jinja")
+        .expect("Failed to read template file");
+    let tmpl_proc = TemplateProcessor::with_jinja_template();
+
+    let query = continue_query(vec![QueryMessage {
+        role: "user".to_string(),
+        content: "Hello".to_string(),
+    }]);
+
+    assert!(query
+        .apply_template_continue_final_message(&template, &tmpl_proc)
+        .is_err());
+}
@@ -0,0 +1,126 @@
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use tauri_plugin_llm::eval::{EvalDataset, Evaluator};
+use tauri_plugin_llm::usage::{UsageStore, BACKEND_WINDOW};
+use tauri_plugin_llm::{Error, LLMRuntimeConfig, LLMService, Query, QueryMessage, TokenUsage};
+
+fn usage(prompt_tokens: usize, completion_tokens: usize) -> TokenUsage {
+    TokenUsage {
+        prompt_tokens,
+        completion_tokens,
+        total_tokens: prompt_tokens + completion_tokens,
+    }
+}
+
+#[test]
+fn test_usage_report() -> Result<(), Error> {
+    let mut store = UsageStore::default();
+
+    store.record("Qwen", "main", &usage(10, 20), Duration::from_millis(500))?;
+    store.record("Qwen", "main", &usage(5, 5), Duration::from_millis(250))?;
+    store.record("Qwen", "settings", &usage(1, 2), Duration::from_millis(100))?;
+    store.record("Llama", "main", &usage(100, 200), Duration::from_secs(2))?;
+
+    let report = store.report();
+
+    // Generations of the same model, window and day are aggregated into one entry
+    assert_eq!(report.entries.len(), 3);
+    assert_eq!(report.total.requests, 4);
+    assert_eq!(report.total.prompt_tokens, 116);
+    assert_eq!(report.total.completion_tokens, 227);
+    assert_eq!(report.total.generation_ms, 2850);
+
+    assert_eq!(report.models["Qwen"].requests, 3);
+    assert_eq!(report.models["Qwen"].completion_tokens, 27);
+    assert_eq!(report.windows["main"].requests, 3);
+    assert_eq!(report.windows["settings"].prompt_tokens, 1);
+
+    assert_eq!(report.days.len(), 1);
+    let day = report.days.keys().next().unwrap();
+    assert_eq!(day.len(), "2025-01-01".len());
+
+    Ok(())
+}
+
+#[test]
+fn test_usage_persistence() -> Result<(), Error> {
+    let dir = std::env::temp_dir().join("test_usage_persistence");
+    let path = dir.join("usage.json");
+    let _ = std::fs::remove_dir_all(&dir);
+
+    let mut store = UsageStore::open(&path)?;
+    assert_eq!(store.report().total.requests, 0);
+
+    store.record("Mock", "main", &usage(3, 4), Duration::from_millis(10))?;
+
+    let mut store = UsageStore::open(&path)?;
+    let report = store.report();
+    assert_eq!(report.total.requests, 1);
+    assert_eq!(report.entries[0].model, "Mock");
+    assert_eq!(report.entries[0].totals.completion_tokens, 4);
+
+    store.reset()?;
+    assert_eq!(UsageStore::open(&path)?.report().total.requests, 0);
+
+    std::fs::write(&path, "not json")?;
+    assert!(UsageStore::open(&path).is_err());
+
+    let _ = std::fs::remove_dir_all(&dir);
+
+    Ok(())
+}
+
+fn prompt(content: &str) -> Query {
+    Query::Prompt {
+        messages: vec![QueryMessage {
+            role: "user".to_string(),
+            content: content.to_string(),
+        }],
+        tools: vec![],
+        chunk_size: Some(4),
+        timestamp: None,
+        max_tokens: Some(100),
+        temperature: None,
+        top_k: None,
+        top_p: None,
+        think: false,
+        continue_final_message: false,
+        stream: true,
+        model: None,
+        penalty: None,
+        seed: None,
+        sampling_config: None,
+        add_special_tokens: None,
+        skip_special_tokens: None,
+        flush: None,
+    }
+}
+
+#[test]
+fn test_usage_of_service_generations() -> Result<(), Error> {
+    let config = LLMRuntimeConfig::from_path("tests/fixtures/test_runtime_mock.json")?;
+    let store = Arc::new(Mutex::new(UsageStore::default()));
+
+    let mut service = LLMService::from_runtime_configs(&[config]);
+    service.set_usage_store(store.clone());
+    service.activate("Mock".to_string())?;
+
+    // The Mock runtime echoes the user message, one token per byte
+    service.complete(prompt("Hello"))?;
+    service.complete_structured::<Vec<u32>>(prompt("[42]"))?;
+
+    let dataset = EvalDataset::from_jsonl(
+        r#"{"id": "a", "messages": [{"role": "user", "content": "Paris"}], "expect": {"exact_match": "Paris"}}"#,
+    )?;
+    Evaluator::new().run(&mut service, &dataset, &["Mock".to_string()])?;
+
+    let report = store.lock().unwrap().report();
+
+    assert_eq!(report.total.requests, 3);
+    assert_eq!(report.total.completion_tokens, 14);
+    assert_eq!(report.windows[BACKEND_WINDOW].requests, 3);
+    assert_eq!(report.models["Mock"].requests, 3);
+
+    Ok(())
+}